@@ -2,7 +2,12 @@ package main
 
 import (
 	"encoding/json"
+	"math"
 	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
 
 	"github.com/SimonStiil/keyvaluedatabase/rest"
 )
@@ -19,6 +24,8 @@ const (
 	Error              APIv1Type = "Error"
 	FullListNamespaces APIv1Type = "FullListNamespaces"
 	Namespace          APIv1Type = "Namespace"
+	History            APIv1Type = "History"
+	Batch              APIv1Type = "Batch"
 )
 
 func (Api *APIv1) APIPrefix() string {
@@ -27,6 +34,23 @@ func (Api *APIv1) APIPrefix() string {
 
 func (api *APIv1) ApiController(w http.ResponseWriter, request *RequestParameters) {
 	debugLogger := request.Logger.Ext.With("function", "ApiController", "struct", "APIv1")
+	if api.GetRequestType(request) == Batch {
+		api.batch(w, request)
+		return
+	}
+	if request.Namespace == App.DB.GetSystemNS() && reservedSystemKey(request.Key) {
+		debugLogger.Debug("Reserved key in system namespace")
+		keys.WithLabelValues(request.Key, request.Namespace, request.Method, App.PrometheusStatusTest(http.StatusForbidden)).Inc()
+		App.WriteStatusMessage(http.StatusForbidden, w, request)
+		return
+	}
+	if request.Namespace == BatchNamespace && request.Method != "GET" {
+		// Only POST /v1/_batch is a batch, the name is not available as a namespace
+		debugLogger.Debug("Write to batch namespace")
+		keys.WithLabelValues(request.Key, request.Namespace, request.Method, App.PrometheusStatusTest(http.StatusBadRequest)).Inc()
+		App.WriteStatusMessage(http.StatusBadRequest, w, request)
+		return
+	}
 	if request.Method == "UPDATE" || request.Method == "PATCH" || request.Method == "POST" || request.Method == "PUT" {
 		data := rest.ObjectV1{}
 		err := App.decodeAny(request, &data)
@@ -35,6 +59,19 @@ func (api *APIv1) ApiController(w http.ResponseWriter, request *RequestParameter
 			App.WriteStatusMessage(http.StatusBadRequest, w, request)
 			return
 		}
+		if ttl := request.orgRequest.URL.Query().Get("ttl"); ttl != "" && data.TTL == 0 {
+			data.TTL, err = strconv.ParseInt(ttl, 10, 64)
+			if err != nil {
+				request.Logger.Log.Error("Unable to parse ttl", "error", err)
+				App.WriteStatusMessage(http.StatusBadRequest, w, request)
+				return
+			}
+		}
+		if data.TTL < 0 {
+			debugLogger.Debug("Negative ttl", "ttl", data.TTL)
+			App.WriteStatusMessage(http.StatusBadRequest, w, request)
+			return
+		}
 		request.Attachment = &data
 	}
 	requestType := api.GetRequestType(request)
@@ -50,15 +87,52 @@ func (api *APIv1) ApiController(w http.ResponseWriter, request *RequestParameter
 		api.key(w, request)
 	case Namespace:
 		api.namespace(w, request)
+	case History:
+		api.history(w, request)
 	default:
 		App.WriteStatusMessage(http.StatusNotFound, w, request)
 	}
 }
 
+// reservedSystemKey tests for the records the server keeps in the system namespace, like tokens and data keys.
+// They are not read, written or listed through the api. /v1/<system>/token/<id> addresses the key token, so the
+// first segment of a reserved prefix is reserved too.
+func reservedSystemKey(key string) bool {
+	for _, prefix := range []string{tokenKeyPrefix, dataKeysPrefix} {
+		if key+"/" == prefix || strings.HasPrefix(key, prefix) {
+			return true
+		}
+	}
+	return key == migrateCheckpointKey
+}
+
+// visibleKeys removes the reserved keys from a listing of the system namespace
+func visibleKeys(namespace string, content []string) []string {
+	if namespace != App.DB.GetSystemNS() {
+		return content
+	}
+	return slices.DeleteFunc(content, reservedSystemKey)
+}
+
+// countKeys counts the keys of namespace without the reserved keys of the system namespace
+func (api *APIv1) countKeys(request *RequestParameters, namespace string) (int, error) {
+	if namespace != App.DB.GetSystemNS() {
+		return App.DB.CountKeys(request.Context(), namespace)
+	}
+	content, err := App.DB.Keys(request.Context(), namespace)
+	return len(visibleKeys(namespace, content)), err
+}
+
 func (api *APIv1) GetRequestType(request *RequestParameters) APIv1Type {
+	if request.Namespace == BatchNamespace && request.Key == "" && request.Method == "POST" {
+		return Batch
+	}
+	if request.Resource == "history" && len(request.Namespace) > 0 && len(request.Key) > 0 {
+		return History
+	}
 	if request.Attachment != nil {
 		switch request.Attachment.Type {
-		case rest.TypeKey, rest.TypeRoll, rest.TypeGenerate:
+		case rest.TypeKey, rest.TypeRoll, rest.TypeGenerate, rest.TypeRestore:
 			return Key
 		case rest.TypeNamespace:
 			return Namespace
@@ -92,28 +166,31 @@ func (api *APIv1) fullListKeys(w http.ResponseWriter, request *RequestParameters
 	debugLogger := request.Logger.Ext.With("function", "fullListKeys")
 	status := http.StatusOK
 	debugLogger.Debug("Full List Keys Request")
-	content, err := App.DB.Keys(request.Namespace)
+	options, ok := api.listOptions(w, request)
+	if !ok {
+		return
+	}
+	content, next, err := App.DB.KeysPage(request.Context(), request.Namespace, options)
 	if err != nil {
-		status = http.StatusInternalServerError
 		debugLogger.Debug("Error listing keys from db", "Error", err)
-		keys.WithLabelValues(request.Key, request.Namespace, request.Method, App.PrometheusStatusTest(status)).Inc()
-		App.WriteStatusMessage(status, w, request)
+		keys.WithLabelValues(request.Key, request.Namespace, request.Method, App.PrometheusStatusTest(writeErrorStatus(err))).Inc()
+		App.WriteErrorMessage(err, w, request)
 		return
 	}
 	var fullList rest.KVPairListV1
-	for _, key := range content {
-		value, err := App.DB.Get(request.Namespace, key)
+	for _, key := range api.filterKeys(request, visibleKeys(request.Namespace, content), ConfigPermissions{Read: true, List: true}) {
+		value, err := App.DB.Get(request.Context(), request.Namespace, key)
 		if err == nil {
 			fullList = append(fullList, rest.KVPairV2{Key: key, Namespace: request.Namespace, Value: value})
 		} else {
-			status = http.StatusInternalServerError
 			debugLogger.Debug("Error reading key from db", "Error", err)
-			keys.WithLabelValues(request.Key, request.Namespace, request.Method, App.PrometheusStatusTest(status)).Inc()
-			App.WriteStatusMessage(status, w, request)
+			keys.WithLabelValues(request.Key, request.Namespace, request.Method, App.PrometheusStatusTest(writeErrorStatus(err))).Inc()
+			App.WriteErrorMessage(err, w, request)
 			return
 		}
 	}
 	request.Logger.Log.Info("Handeled Reqeust", "status", status, "status-text", http.StatusText(status))
+	setNextCursor(w, next)
 	w.Header().Set("Content-Type", "application/json")
 	json.NewEncoder(w).Encode(fullList)
 }
@@ -122,35 +199,37 @@ func (api *APIv1) fullListNamespaces(w http.ResponseWriter, request *RequestPara
 	debugLogger := request.Logger.Ext.With("function", "fullListNamespaces")
 	status := http.StatusOK
 	debugLogger.Debug("Full List Namespaces Request")
-	content, err := App.DB.Keys("")
+	options, ok := api.listOptions(w, request)
+	if !ok {
+		return
+	}
+	content, next, err := App.DB.KeysPage(request.Context(), "", options)
 	if err != nil {
-		status = http.StatusInternalServerError
 		debugLogger.Debug("Error listing namespaces from db", "Error", err)
-		keys.WithLabelValues(request.Key, request.Namespace, request.Method, App.PrometheusStatusTest(status)).Inc()
-		App.WriteStatusMessage(status, w, request)
+		keys.WithLabelValues(request.Key, request.Namespace, request.Method, App.PrometheusStatusTest(writeErrorStatus(err))).Inc()
+		App.WriteErrorMessage(err, w, request)
 		return
 	}
 	requestOrgNamespace := request.Namespace
 	testPermissons := ConfigPermissions{Read: true, List: true, Write: false}
 	user := request.Authentication.User
 	var fullList []rest.NamespaceV2
-	// TODO: Optimize for mysql
 	for _, namespace := range content {
-		keyslist, err := App.DB.Keys(namespace)
+		size, err := api.countKeys(request, namespace)
 		if err != nil {
-			status = http.StatusInternalServerError
 			debugLogger.Debug("Error listing keys from db", "Error", err)
-			keys.WithLabelValues(request.Key, request.Namespace, request.Method, App.PrometheusStatusTest(status)).Inc()
-			App.WriteStatusMessage(status, w, request)
+			keys.WithLabelValues(request.Key, request.Namespace, request.Method, App.PrometheusStatusTest(writeErrorStatus(err))).Inc()
+			App.WriteErrorMessage(err, w, request)
 			return
 		}
 		request.Namespace = namespace
 		access := user.Autorization(request, &testPermissons)
-		fullList = append(fullList, rest.NamespaceV2{Name: namespace, Size: len(keyslist), Access: access})
+		fullList = append(fullList, rest.NamespaceV2{Name: namespace, Size: size, Access: access})
 	}
 	request.Namespace = requestOrgNamespace
 	debugLogger.Debug("Full List Namespaces", "reply", fullList)
 	request.Logger.Log.Info("Handeled Reqeust", "status", status, "status-text", http.StatusText(status))
+	setNextCursor(w, next)
 	w.Header().Set("Content-Type", "application/json")
 	json.NewEncoder(w).Encode(fullList)
 }
@@ -158,45 +237,100 @@ func (api *APIv1) fullListNamespaces(w http.ResponseWriter, request *RequestPara
 func (api *APIv1) list(w http.ResponseWriter, request *RequestParameters) {
 	status := http.StatusOK
 	debugLogger := request.Logger.Ext.With("function", "list")
-	content, err := App.DB.Keys(request.Namespace)
+	options, ok := api.listOptions(w, request)
+	if !ok {
+		return
+	}
+	content, next, err := App.DB.KeysPage(request.Context(), request.Namespace, options)
 	if err != nil {
 		debugLogger.Debug("Error listing from db", "Error", err)
-		status := http.StatusInternalServerError
-		if _, ok := err.(*ErrNotFound); ok {
-			status = http.StatusNotFound
-		}
-		keys.WithLabelValues(request.Key, request.Namespace, "GET", App.PrometheusStatusTest(status)).Inc()
-		App.WriteStatusMessage(http.StatusInternalServerError, w, request)
+		keys.WithLabelValues(request.Key, request.Namespace, "GET", App.PrometheusStatusTest(writeErrorStatus(err))).Inc()
+		App.WriteErrorMessage(err, w, request)
 		return
 	}
-	debugLogger.Debug("List", "reply", content)
+	if request.Namespace != "" {
+		content = api.filterKeys(request, visibleKeys(request.Namespace, content), ConfigPermissions{List: true})
+	}
+	debugLogger.Debug("List", "reply", content, "next", next)
 	request.Logger.Log.Info("Handeled Reqeust", "status", status, "status-text", http.StatusText(status))
+	setNextCursor(w, next)
 	w.Header().Set("Content-Type", "application/json")
 	json.NewEncoder(w).Encode(content)
 }
 
+// listOptions reads the paging and filter parameters of a listing, replying 400 for invalid parameters
+func (api *APIv1) listOptions(w http.ResponseWriter, request *RequestParameters) (ListOptions, bool) {
+	options, err := ListOptionsFromQuery(request.orgRequest.URL.Query())
+	if err != nil {
+		request.Logger.Ext.Debug("Invalid list parameters", "function", "listOptions", "error", err)
+		App.WriteStatusMessage(http.StatusBadRequest, w, request)
+		return options, false
+	}
+	return options, true
+}
+
+func setNextCursor(w http.ResponseWriter, next string) {
+	if next != "" {
+		w.Header().Set(rest.HeaderNextCursor, next)
+	}
+}
+
+// filterKeys removes the keys of the request namespace the user does not have permissions for
+func (api *APIv1) filterKeys(request *RequestParameters, content []string, permissions ConfigPermissions) []string {
+	user := request.Authentication.User
+	if user == nil {
+		return content
+	}
+	filtered := []string{}
+	for _, key := range content {
+		if user.KeyAllowed(request.Namespace, key, permissions) {
+			filtered = append(filtered, key)
+		}
+	}
+	return filtered
+}
+
 func (api *APIv1) key(w http.ResponseWriter, request *RequestParameters) {
 	debugLogger := request.Logger.Ext.With("function", "key")
 	status := http.StatusOK
 	debugLogger.Debug("key Request - Start")
+	var precondition *Precondition
+	if request.Method != "GET" {
+		precondition, status = api.preconditions(request)
+		if status != http.StatusOK {
+			keys.WithLabelValues(request.Key, request.Namespace, request.Method, App.PrometheusStatusTest(status)).Inc()
+			App.WriteStatusMessage(status, w, request)
+			return
+		}
+	}
 	switch request.Method {
 	case "GET":
-		value, err := App.DB.Get(request.Namespace, request.Key)
+		if version := request.orgRequest.URL.Query().Get("version"); version != "" {
+			api.keyVersion(w, request, version)
+			return
+		}
+		value, err := App.DB.Get(request.Context(), request.Namespace, request.Key)
 		if err != nil {
-			status = http.StatusInternalServerError
 			debugLogger.Debug("Error getting key from db", "Error", err)
-
-			if _, ok := err.(*ErrNotFound); ok {
-				status = http.StatusNotFound
-			}
-			keys.WithLabelValues(request.Key, request.Namespace, request.Method, App.PrometheusStatusTest(status)).Inc()
-			App.WriteStatusMessage(status, w, request)
+			keys.WithLabelValues(request.Key, request.Namespace, request.Method, App.PrometheusStatusTest(writeErrorStatus(err))).Inc()
+			App.WriteErrorMessage(err, w, request)
 			return
 		}
 		debugLogger.Debug("key Request - DB.Get", "value", value)
+		ttl, err := App.DB.TTL(request.Context(), request.Namespace, request.Key)
+		if err != nil {
+			debugLogger.Debug("Error getting ttl from db", "Error", err)
+			keys.WithLabelValues(request.Key, request.Namespace, request.Method, App.PrometheusStatusTest(writeErrorStatus(err))).Inc()
+			App.WriteErrorMessage(err, w, request)
+			return
+		}
 		reply := rest.KVPairV2{Key: request.Key, Namespace: request.Namespace, Value: value}
 		keys.WithLabelValues(request.Key, request.Namespace, request.Method, http.StatusText(status)).Inc()
 		request.Logger.Log.Info("Handeled Reqeust", "status", status, "status-text", http.StatusText(status))
+		if ttl > 0 {
+			w.Header().Set(rest.HeaderTTL, strconv.FormatInt(int64(math.Ceil(ttl.Seconds())), 10))
+		}
+		w.Header().Set("ETag", ETag(value))
 		w.Header().Set("Content-Type", "application/json")
 		json.NewEncoder(w).Encode(reply)
 		return
@@ -204,19 +338,21 @@ func (api *APIv1) key(w http.ResponseWriter, request *RequestParameters) {
 		if request.Attachment == nil {
 			keys.WithLabelValues(request.Key, request.Namespace, "POST", "BadRequest").Inc()
 			App.WriteStatusMessage(http.StatusBadRequest, w, request)
+			return
 		}
-		debugLogger.Debug("POST Content", "value", request.Attachment.Value, "type", request.Attachment.Type)
-		err := App.DB.Set(request.Namespace, request.Key, request.Attachment.Value)
+		debugLogger.Debug("POST Content", "value", request.Attachment.Value, "type", request.Attachment.Type, "ttl", request.Attachment.TTL)
+		err := api.setKey(request, precondition, request.Key, request.Attachment.Value)
 		if err != nil {
 			debugLogger.Debug("Error setting key in db", "Error", err)
-			status := http.StatusInternalServerError
-			keys.WithLabelValues(request.Key, request.Namespace, request.Method, App.PrometheusStatusTest(status)).Inc()
-			App.WriteStatusMessage(status, w, request)
+			keys.WithLabelValues(request.Key, request.Namespace, request.Method, App.PrometheusStatusTest(writeErrorStatus(err))).Inc()
+			App.WriteErrorMessage(err, w, request)
 			return
 		}
+		api.recordVersion(request, request.Key, request.Attachment.Value)
+		w.Header().Set("ETag", ETag(request.Attachment.Value))
 		// Should not be nessesary to test that object is created....
 		/*
-			value, err := App.DB.Get(request.Namespace, request.Key)
+			value, err := App.DB.Get(request.Context(), request.Namespace, request.Key)
 			if err != nil {
 				debugLogger.Debug("Error getting key from db", "Error", err)
 				status := http.StatusInternalServerError
@@ -241,18 +377,19 @@ func (api *APIv1) key(w http.ResponseWriter, request *RequestParameters) {
 		return
 
 	case "PUT":
-		debugLogger.Debug("PUT Content", "value", request.Attachment.Value, "type", request.Attachment.Type)
-		err := App.DB.Set(request.Namespace, request.Key, request.Attachment.Value)
+		debugLogger.Debug("PUT Content", "value", request.Attachment.Value, "type", request.Attachment.Type, "ttl", request.Attachment.TTL)
+		err := api.setKey(request, precondition, request.Key, request.Attachment.Value)
 		if err != nil {
 			debugLogger.Debug("Error setting key in db", "Error", err)
-			status := http.StatusInternalServerError
-			keys.WithLabelValues(request.Key, request.Namespace, request.Method, App.PrometheusStatusTest(status)).Inc()
-			App.WriteStatusMessage(status, w, request)
+			keys.WithLabelValues(request.Key, request.Namespace, request.Method, App.PrometheusStatusTest(writeErrorStatus(err))).Inc()
+			App.WriteErrorMessage(err, w, request)
 			return
 		}
+		api.recordVersion(request, request.Key, request.Attachment.Value)
+		w.Header().Set("ETag", ETag(request.Attachment.Value))
 		// Should not be nessesary to test that object is created....
 		/*
-			value, err := App.DB.Get(request.Namespace, request.Key)
+			value, err := App.DB.Get(request.Context(), request.Namespace, request.Key)
 			if err != nil {
 				logger.Debug("Error getting key from db",
 					"function", "key", "struct", "APIv1",
@@ -289,16 +426,19 @@ func (api *APIv1) key(w http.ResponseWriter, request *RequestParameters) {
 		if request.Key == "" { // Should never happen anymore :-/
 			newKey = AuthGenerateRandomString(16)
 		}
+		if request.Attachment.Type == rest.TypeRestore {
+			api.restore(w, request, precondition)
+			return
+		}
 		newData := rest.KVPairV2{Key: newKey, Namespace: request.Namespace, Value: AuthGenerateRandomString(32)}
 
-		_, err := App.DB.Get(request.Namespace, request.Key)
+		_, err := App.DB.Get(request.Context(), request.Namespace, request.Key)
 		exists := err == nil
 		if !exists {
 			if _, ok := err.(*ErrNotFound); !ok {
-				status = http.StatusInternalServerError
 				debugLogger.Debug("Error getting key in db", "Error", err)
-				keys.WithLabelValues(request.Key, request.Namespace, request.Method, App.PrometheusStatusTest(status)).Inc()
-				App.WriteStatusMessage(status, w, request)
+				keys.WithLabelValues(request.Key, request.Namespace, request.Method, App.PrometheusStatusTest(writeErrorStatus(err))).Inc()
+				App.WriteErrorMessage(err, w, request)
 				return
 			}
 		}
@@ -306,16 +446,17 @@ func (api *APIv1) key(w http.ResponseWriter, request *RequestParameters) {
 			"newData.key", newData.Key, "newData.value", newData.Value, "exists", exists)
 		if exists {
 			if request.Attachment.Type == rest.TypeRoll {
-				err := App.DB.Set(newData.Namespace, newData.Key, newData.Value)
+				err := api.setKey(request, precondition, newData.Key, newData.Value)
 				if err != nil {
 					debugLogger.Debug("Error setting key in db", "Error", err)
-					status = http.StatusInternalServerError
-					keys.WithLabelValues(request.Key, request.Namespace, request.Method, App.PrometheusStatusTest(status)).Inc()
-					App.WriteStatusMessage(status, w, request)
+					keys.WithLabelValues(request.Key, request.Namespace, request.Method, App.PrometheusStatusTest(writeErrorStatus(err))).Inc()
+					App.WriteErrorMessage(err, w, request)
 					return
 				}
+				api.recordVersion(request, newData.Key, newData.Value)
 				keys.WithLabelValues(request.Key, request.Namespace, request.Method, http.StatusText(status)).Inc()
 				request.Logger.Log.Info("Handeled Reqeust", "status", status, "status-text", http.StatusText(status))
+				w.Header().Set("ETag", ETag(newData.Value))
 				w.Header().Set("Content-Type", "application/json")
 				w.WriteHeader(status)
 				json.NewEncoder(w).Encode(newData)
@@ -323,16 +464,17 @@ func (api *APIv1) key(w http.ResponseWriter, request *RequestParameters) {
 			}
 		} else {
 			if request.Attachment.Type == rest.TypeGenerate {
-				err := App.DB.Set(newData.Namespace, newData.Key, newData.Value)
+				err := api.setKey(request, precondition, newData.Key, newData.Value)
 				if err != nil {
 					debugLogger.Debug("Error setting key in db", "Error", err)
-					status := http.StatusInternalServerError
-					keys.WithLabelValues(request.Key, request.Namespace, request.Method, App.PrometheusStatusTest(status)).Inc()
-					App.WriteStatusMessage(status, w, request)
+					keys.WithLabelValues(request.Key, request.Namespace, request.Method, App.PrometheusStatusTest(writeErrorStatus(err))).Inc()
+					App.WriteErrorMessage(err, w, request)
 					return
 				}
+				api.recordVersion(request, newData.Key, newData.Value)
 				keys.WithLabelValues(request.Key, request.Namespace, request.Method, http.StatusText(status)).Inc()
 				request.Logger.Log.Info("Handeled Reqeust", "status", status, "status-text", http.StatusText(status))
+				w.Header().Set("ETag", ETag(newData.Value))
 				w.Header().Set("Content-Type", "application/json")
 				w.WriteHeader(status)
 				json.NewEncoder(w).Encode(newData)
@@ -343,15 +485,11 @@ func (api *APIv1) key(w http.ResponseWriter, request *RequestParameters) {
 		App.WriteStatusMessage(http.StatusBadRequest, w, request)
 		return
 	case "DELETE":
-		err := App.DB.DeleteKey(request.Namespace, request.Key)
+		err := api.deleteKey(request, precondition)
 		if err != nil {
-			status := http.StatusInternalServerError
-			if _, ok := err.(*ErrNotAllowed); ok {
-				status = http.StatusForbidden
-			}
 			debugLogger.Debug("Error deleting key in db", "Error", err)
-			keys.WithLabelValues(request.Key, request.Namespace, request.Method, App.PrometheusStatusTest(status)).Inc()
-			App.WriteStatusMessage(status, w, request)
+			keys.WithLabelValues(request.Key, request.Namespace, request.Method, App.PrometheusStatusTest(writeErrorStatus(err))).Inc()
+			App.WriteErrorMessage(err, w, request)
 			return
 		}
 		keys.WithLabelValues(request.Key, request.Namespace, request.Method, App.PrometheusStatusTest(status)).Inc()
@@ -365,6 +503,107 @@ func (api *APIv1) key(w http.ResponseWriter, request *RequestParameters) {
 	}
 }
 
+func (api *APIv1) recordVersion(request *RequestParameters, key string, value string) {
+	if App.Config.History.Versions <= 0 {
+		return
+	}
+	version := rest.KeyVersionV1{Value: value, Timestamp: time.Now(), User: request.GetUserName()}
+	err := App.DB.AddVersion(request.Context(), request.Namespace, key, version, App.Config.History.Versions)
+	if err != nil {
+		request.Logger.Log.Error("Unable to record key version", "error", err)
+	}
+}
+
+func (api *APIv1) findVersion(request *RequestParameters, versionString string) (rest.KeyVersionV1, error) {
+	debugLogger := request.Logger.Ext.With("function", "findVersion")
+	versionNumber, err := strconv.Atoi(versionString)
+	if err != nil {
+		debugLogger.Debug("Unable to parse version", "version", versionString, "Error", err)
+		return rest.KeyVersionV1{}, &ErrMalformRequest{Value: "invalid version " + versionString}
+	}
+	history, err := App.DB.Versions(request.Context(), request.Namespace, request.Key)
+	if err != nil {
+		debugLogger.Debug("Error getting history from db", "Error", err)
+		return rest.KeyVersionV1{}, err
+	}
+	for _, version := range history {
+		if version.Version == versionNumber {
+			return version, nil
+		}
+	}
+	return rest.KeyVersionV1{}, &ErrNotFound{Value: "version " + versionString}
+}
+
+func (api *APIv1) keyVersion(w http.ResponseWriter, request *RequestParameters, versionString string) {
+	debugLogger := request.Logger.Ext.With("function", "keyVersion")
+	status := http.StatusOK
+	version, err := api.findVersion(request, versionString)
+	if err != nil {
+		keys.WithLabelValues(request.Key, request.Namespace, request.Method, App.PrometheusStatusTest(writeErrorStatus(err))).Inc()
+		App.WriteErrorMessage(err, w, request)
+		return
+	}
+	debugLogger.Debug("key Version", "version", version.Version)
+	reply := rest.KVPairV2{Key: request.Key, Namespace: request.Namespace, Value: version.Value}
+	keys.WithLabelValues(request.Key, request.Namespace, request.Method, http.StatusText(status)).Inc()
+	request.Logger.Log.Info("Handeled Reqeust", "status", status, "status-text", http.StatusText(status))
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(reply)
+}
+
+func (api *APIv1) restore(w http.ResponseWriter, request *RequestParameters, precondition *Precondition) {
+	debugLogger := request.Logger.Ext.With("function", "restore")
+	version, err := api.findVersion(request, request.Attachment.Value)
+	if err != nil {
+		keys.WithLabelValues(request.Key, request.Namespace, request.Method, App.PrometheusStatusTest(writeErrorStatus(err))).Inc()
+		App.WriteErrorMessage(err, w, request)
+		return
+	}
+	err = api.setKey(request, precondition, request.Key, version.Value)
+	if err != nil {
+		debugLogger.Debug("Error setting key in db", "Error", err)
+		keys.WithLabelValues(request.Key, request.Namespace, request.Method, App.PrometheusStatusTest(writeErrorStatus(err))).Inc()
+		App.WriteErrorMessage(err, w, request)
+		return
+	}
+	api.recordVersion(request, request.Key, version.Value)
+	status := http.StatusCreated
+	debugLogger.Debug("Restored version", "version", version.Version)
+	keys.WithLabelValues(request.Key, request.Namespace, request.Method, http.StatusText(status)).Inc()
+	request.Logger.Log.Info("Handeled Reqeust", "status", status, "status-text", http.StatusText(status))
+	w.Header().Set("ETag", ETag(version.Value))
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(rest.KVPairV2{Key: request.Key, Namespace: request.Namespace, Value: version.Value})
+}
+
+func (api *APIv1) history(w http.ResponseWriter, request *RequestParameters) {
+	debugLogger := request.Logger.Ext.With("function", "history")
+	status := http.StatusOK
+	if request.Method != "GET" {
+		status = http.StatusNotFound
+		keys.WithLabelValues(request.Key, request.Namespace, request.Method, App.PrometheusStatusTest(status)).Inc()
+		App.WriteStatusMessage(status, w, request)
+		return
+	}
+	history, err := App.DB.Versions(request.Context(), request.Namespace, request.Key)
+	if err != nil {
+		debugLogger.Debug("Error getting history from db", "Error", err)
+		keys.WithLabelValues(request.Key, request.Namespace, request.Method, App.PrometheusStatusTest(writeErrorStatus(err))).Inc()
+		App.WriteErrorMessage(err, w, request)
+		return
+	}
+	debugLogger.Debug("History", "versions", len(history))
+	keys.WithLabelValues(request.Key, request.Namespace, request.Method, http.StatusText(status)).Inc()
+	request.Logger.Log.Info("Handeled Reqeust", "status", status, "status-text", http.StatusText(status))
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(history)
+}
+
+func attachmentTTL(attachment *rest.ObjectV1) time.Duration {
+	return time.Duration(attachment.TTL) * time.Second
+}
+
 func (api *APIv1) namespace(w http.ResponseWriter, request *RequestParameters) {
 	debugLogger := request.Logger.Ext.With("function", "namespace")
 	status := http.StatusOK
@@ -375,22 +614,29 @@ func (api *APIv1) namespace(w http.ResponseWriter, request *RequestParameters) {
 			status = http.StatusBadRequest
 			keys.WithLabelValues(request.Key, request.Namespace, request.Method, App.PrometheusStatusTest(status)).Inc()
 			App.WriteStatusMessage(status, w, request)
+			return
 		}
 		namespace := request.Namespace
 		if namespace == "" {
 			namespace = request.Attachment.Value
 		}
+		if namespace == BatchNamespace {
+			status = http.StatusBadRequest
+			keys.WithLabelValues(request.Key, namespace, request.Method, App.PrometheusStatusTest(status)).Inc()
+			App.WriteStatusMessage(status, w, request)
+			return
+		}
 		if namespace == "" {
 			status = http.StatusBadRequest
 			keys.WithLabelValues(request.Key, request.Namespace, request.Method, App.PrometheusStatusTest(status)).Inc()
 			App.WriteStatusMessage(status, w, request)
+			return
 		}
-		err := App.DB.CreateNamespace(namespace)
+		err := App.DB.CreateNamespace(request.Context(), namespace)
 		if err != nil {
-			status = http.StatusInternalServerError
 			debugLogger.Debug("Error creating namespace in db", "Error", err)
-			keys.WithLabelValues(request.Key, request.Namespace, request.Method, App.PrometheusStatusTest(status)).Inc()
-			App.WriteStatusMessage(status, w, request)
+			keys.WithLabelValues(request.Key, request.Namespace, request.Method, App.PrometheusStatusTest(writeErrorStatus(err))).Inc()
+			App.WriteErrorMessage(err, w, request)
 			return
 		}
 		status = http.StatusCreated
@@ -398,15 +644,11 @@ func (api *APIv1) namespace(w http.ResponseWriter, request *RequestParameters) {
 		App.WriteStatusMessage(status, w, request)
 		return
 	case "DELETE":
-		err := App.DB.DeleteNamespace(request.Namespace)
+		err := App.DB.DeleteNamespace(request.Context(), request.Namespace)
 		if err != nil {
-			status = http.StatusInternalServerError
-			if _, ok := err.(*ErrNotAllowed); ok {
-				status = http.StatusForbidden
-			}
 			debugLogger.Debug("Error deleting namespace in db", "Error", err)
-			keys.WithLabelValues(request.Key, request.Namespace, request.Method, App.PrometheusStatusTest(status)).Inc()
-			App.WriteStatusMessage(status, w, request)
+			keys.WithLabelValues(request.Key, request.Namespace, request.Method, App.PrometheusStatusTest(writeErrorStatus(err))).Inc()
+			App.WriteErrorMessage(err, w, request)
 			return
 		}
 		keys.WithLabelValues(request.Key, request.Namespace, request.Method, App.PrometheusStatusTest(status)).Inc()
@@ -422,10 +664,15 @@ func (api *APIv1) namespace(w http.ResponseWriter, request *RequestParameters) {
 
 func (api *APIv1) Permissions(request *RequestParameters) *ConfigPermissions {
 	switch api.GetRequestType(request) {
+	case Batch:
+		// Operations are authorized one by one, see batchAllowed
+		return &ConfigPermissions{Write: true, Read: true, List: true}
 	case FullListKeys:
 		return &ConfigPermissions{List: true, Read: true}
 	case List:
 		return &ConfigPermissions{List: true}
+	case History:
+		return &ConfigPermissions{Read: true}
 	case Key:
 		switch request.Method {
 		case "GET":
@@ -443,3 +690,34 @@ func (api *APIv1) Permissions(request *RequestParameters) *ConfigPermissions {
 	}
 	return &ConfigPermissions{Write: true, Read: true, List: true}
 }
+
+func (api *APIv1) AuditAction(request *RequestParameters) string {
+	switch api.GetRequestType(request) {
+	case List, FullListNamespaces:
+		return "list"
+	case FullListKeys:
+		return "list-values"
+	case History:
+		return "history"
+	case Batch:
+		return "batch"
+	case Namespace:
+		if request.Method == "DELETE" {
+			return "delete-namespace"
+		}
+		return "create-namespace"
+	case Key:
+		switch request.Method {
+		case "GET":
+			return "read"
+		case "DELETE":
+			return "delete"
+		case "UPDATE", "PATCH":
+			if request.Attachment != nil && request.Attachment.Type != rest.TypeKey {
+				return string(request.Attachment.Type)
+			}
+		}
+		return "write"
+	}
+	return "unknown"
+}
@@ -2,6 +2,7 @@ package main
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
 	"errors"
 	"fmt"
@@ -11,6 +12,7 @@ import (
 	"os"
 	"strings"
 	"testing"
+	"time"
 
 	"github.com/SimonStiil/keyvaluedatabase/rest"
 	"golang.org/x/exp/slices"
@@ -62,7 +64,7 @@ func TestApiV1(t *testing.T) {
 		if string(b) != createdBody {
 			t.Errorf(".Body got %q, want %q", string(b), createdBody)
 		}
-		dbValue, dbErr := App.DB.Get(testNamespace, testKey)
+		dbValue, dbErr := App.DB.Get(context.Background(), testNamespace, testKey)
 		if dbErr != nil {
 			t.Errorf("Error Reading from db %v", dbErr)
 		}
@@ -94,7 +96,7 @@ func TestApiV1(t *testing.T) {
 		if string(b) != createdBody {
 			t.Errorf(".Body got %q, want %q", string(b), createdBody)
 		}
-		dbValue, dbErr := App.DB.Get(testNamespace, testKey)
+		dbValue, dbErr := App.DB.Get(context.Background(), testNamespace, testKey)
 		if dbErr != nil {
 			t.Errorf("Error Reading from db %v", dbErr)
 		}
@@ -124,7 +126,7 @@ func TestApiV1(t *testing.T) {
 		if string(b) != createdBody {
 			t.Errorf(".Body got %q, want %q", string(b), createdBody)
 		}
-		dbValue, dbErr := App.DB.Get(testNamespace, testKey)
+		dbValue, dbErr := App.DB.Get(context.Background(), testNamespace, testKey)
 		if dbErr != nil {
 			t.Errorf("Error Reading from db %v", dbErr)
 		}
@@ -155,7 +157,7 @@ func TestApiV1(t *testing.T) {
 		if string(b) != createdBody {
 			t.Errorf(".Body got %q, want %q", string(b), createdBody)
 		}
-		dbValue, dbErr := App.DB.Get(testNamespace, testKey)
+		dbValue, dbErr := App.DB.Get(context.Background(), testNamespace, testKey)
 		if dbErr != nil {
 			t.Errorf("Error Reading from db %v", dbErr)
 		}
@@ -191,7 +193,7 @@ func TestApiV1(t *testing.T) {
 		if replyPair.Key != testGeneratedKey {
 			t.Errorf(".Key got %q, want %q", replyPair.Key, testGeneratedKey)
 		}
-		dbValue, dbErr := App.DB.Get(testNamespace, testGeneratedKey)
+		dbValue, dbErr := App.DB.Get(context.Background(), testNamespace, testGeneratedKey)
 		if dbErr != nil {
 			t.Errorf("Error Reading from db %v", dbErr)
 		}
@@ -247,7 +249,7 @@ func TestApiV1(t *testing.T) {
 		if replyPair.Key != testGeneratedKey {
 			t.Errorf(".Key got %q, want %q", replyPair.Key, testGeneratedKey)
 		}
-		dbValue, dbErr := App.DB.Get(testNamespace, testGeneratedKey)
+		dbValue, dbErr := App.DB.Get(context.Background(), testNamespace, testGeneratedKey)
 		if dbErr != nil {
 			t.Errorf("Error Reading from db %v", dbErr)
 		}
@@ -329,6 +331,195 @@ func TestApiV1(t *testing.T) {
 			t.Errorf(".Value got %q, want %q", replyPair.Value, testData.Value)
 		}
 	})
+	t.Run("Get (request timeout)", func(t *testing.T) {
+		db := App.DB
+		App.DB = &slowDatabase{Database: db}
+		defer func() { App.DB = db }()
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+		defer cancel()
+		request, _ := http.NewRequestWithContext(ctx, http.MethodGet,
+			fmt.Sprintf("%v/%v/%v", URLPrefix, testNamespace, testKey),
+			nil)
+		response := httptest.NewRecorder()
+		requestParameters := GetRequestParameters(request, requestsCount)
+		requestsCount += 1
+		api.ApiController(response, requestParameters)
+		if response.Code != http.StatusGatewayTimeout {
+			t.Errorf(".Code got %q, want %q", response.Code, http.StatusGatewayTimeout)
+		}
+	})
+	t.Run("Get (ttl)", func(t *testing.T) {
+		ttlKey := "ttlkey"
+		request, _ := http.NewRequest(http.MethodPut,
+			fmt.Sprintf("%v/%v/%v?ttl=60", URLPrefix, testNamespace, ttlKey),
+			strings.NewReader(testData.Value))
+		response := httptest.NewRecorder()
+		requestParameters := GetRequestParameters(request, requestsCount)
+		requestsCount += 1
+		api.ApiController(response, requestParameters)
+		if response.Code != http.StatusCreated {
+			t.Errorf(".Code got %v, want %v", response.Code, http.StatusCreated)
+		}
+		request, _ = http.NewRequest(http.MethodGet,
+			fmt.Sprintf("%v/%v/%v", URLPrefix, testNamespace, ttlKey),
+			nil)
+		response = httptest.NewRecorder()
+		requestParameters = GetRequestParameters(request, requestsCount)
+		requestsCount += 1
+		api.ApiController(response, requestParameters)
+		if response.Code != http.StatusOK {
+			t.Errorf(".Code got %v, want %v", response.Code, http.StatusOK)
+		}
+		if ttl := response.Header().Get(rest.HeaderTTL); ttl != "60" {
+			t.Errorf("%v header got %q, want %q", rest.HeaderTTL, ttl, "60")
+		}
+		App.DB.DeleteKey(context.Background(), testNamespace, ttlKey)
+	})
+	t.Run("History and restore", func(t *testing.T) {
+		App.Config.History.Versions = 2
+		defer func() { App.Config.History.Versions = 0 }()
+		historyKey := "historykey"
+		for _, value := range []string{"first", "second", "third"} {
+			request, _ := http.NewRequest(http.MethodPut,
+				fmt.Sprintf("%v/%v/%v", URLPrefix, testNamespace, historyKey),
+				strings.NewReader(value))
+			response := httptest.NewRecorder()
+			requestParameters := GetRequestParameters(request, requestsCount)
+			requestsCount += 1
+			api.ApiController(response, requestParameters)
+			if response.Code != http.StatusCreated {
+				t.Errorf(".Code got %v, want %v", response.Code, http.StatusCreated)
+			}
+		}
+		request, _ := http.NewRequest(http.MethodGet,
+			fmt.Sprintf("%v/%v/%v/history", URLPrefix, testNamespace, historyKey),
+			nil)
+		response := httptest.NewRecorder()
+		requestParameters := GetRequestParameters(request, requestsCount)
+		requestsCount += 1
+		api.ApiController(response, requestParameters)
+		if response.Code != http.StatusOK {
+			t.Errorf(".Code got %v, want %v", response.Code, http.StatusOK)
+		}
+		var history rest.KeyHistoryV1
+		err := json.Unmarshal(response.Body.Bytes(), &history)
+		if err != nil {
+			t.Error(err)
+		}
+		if len(history) != 2 {
+			t.Fatalf("history length got %v, want %v", len(history), 2)
+		}
+		if history[0].Version != 3 || history[0].Value != "third" || history[1].Value != "second" {
+			t.Errorf("history got %+v", history)
+		}
+		if history[0].User != "anonymous" {
+			t.Errorf(".User got %q, want %q", history[0].User, "anonymous")
+		}
+
+		request, _ = http.NewRequest(http.MethodGet,
+			fmt.Sprintf("%v/%v/%v?version=2", URLPrefix, testNamespace, historyKey),
+			nil)
+		response = httptest.NewRecorder()
+		requestParameters = GetRequestParameters(request, requestsCount)
+		requestsCount += 1
+		api.ApiController(response, requestParameters)
+		var replyPair rest.KVPairV2
+		err = json.Unmarshal(response.Body.Bytes(), &replyPair)
+		if err != nil {
+			t.Error(err)
+		}
+		if replyPair.Value != "second" {
+			t.Errorf(".Value got %q, want %q", replyPair.Value, "second")
+		}
+
+		request, _ = http.NewRequest(http.MethodGet,
+			fmt.Sprintf("%v/%v/%v?version=1", URLPrefix, testNamespace, historyKey),
+			nil)
+		response = httptest.NewRecorder()
+		requestParameters = GetRequestParameters(request, requestsCount)
+		requestsCount += 1
+		api.ApiController(response, requestParameters)
+		if response.Code != http.StatusNotFound {
+			t.Errorf(".Code got %v, want %v", response.Code, http.StatusNotFound)
+		}
+
+		marshalled, _ := json.Marshal(rest.ObjectV1{Type: rest.TypeRestore, Value: "2"})
+		request, _ = http.NewRequest(http.MethodPatch,
+			fmt.Sprintf("%v/%v/%v", URLPrefix, testNamespace, historyKey),
+			bytes.NewReader(marshalled))
+		request.Header.Set("Content-Type", "application/json")
+		response = httptest.NewRecorder()
+		requestParameters = GetRequestParameters(request, requestsCount)
+		requestsCount += 1
+		api.ApiController(response, requestParameters)
+		if response.Code != http.StatusCreated {
+			t.Errorf(".Code got %v, want %v", response.Code, http.StatusCreated)
+		}
+		dbValue, dbErr := App.DB.Get(context.Background(), testNamespace, historyKey)
+		if dbErr != nil {
+			t.Errorf("Error Reading from db %v", dbErr)
+		}
+		if dbValue != "second" {
+			t.Errorf("data in database %v does not match restored value %v", dbValue, "second")
+		}
+		App.DB.DeleteKey(context.Background(), testNamespace, historyKey)
+	})
+	t.Run("Conditional requests (etag)", func(t *testing.T) {
+		etagKey := "etagkey"
+		conditional := func(method string, value string, header string, etag string) *httptest.ResponseRecorder {
+			var body io.Reader
+			if value != "" {
+				body = strings.NewReader(value)
+			}
+			request, _ := http.NewRequest(method,
+				fmt.Sprintf("%v/%v/%v", URLPrefix, testNamespace, etagKey),
+				body)
+			if header != "" {
+				request.Header.Set(header, etag)
+			}
+			response := httptest.NewRecorder()
+			requestParameters := GetRequestParameters(request, requestsCount)
+			requestsCount += 1
+			api.ApiController(response, requestParameters)
+			return response
+		}
+		response := conditional(http.MethodPut, "first", "If-None-Match", "*")
+		if response.Code != http.StatusCreated {
+			t.Errorf("create-only .Code got %v, want %v", response.Code, http.StatusCreated)
+		}
+		response = conditional(http.MethodPut, "second", "If-None-Match", "*")
+		if response.Code != http.StatusPreconditionFailed {
+			t.Errorf("create-only existing .Code got %v, want %v", response.Code, http.StatusPreconditionFailed)
+		}
+		response = conditional(http.MethodGet, "", "", "")
+		etag := response.Header().Get("ETag")
+		if etag != ETag("first") {
+			t.Errorf("ETag got %q, want %q", etag, ETag("first"))
+		}
+		response = conditional(http.MethodPut, "second", "If-Match", ETag("other"))
+		if response.Code != http.StatusPreconditionFailed {
+			t.Errorf("stale If-Match .Code got %v, want %v", response.Code, http.StatusPreconditionFailed)
+		}
+		response = conditional(http.MethodPut, "second", "If-Match", etag)
+		if response.Code != http.StatusCreated {
+			t.Errorf("If-Match .Code got %v, want %v", response.Code, http.StatusCreated)
+		}
+		if response.Header().Get("ETag") != ETag("second") {
+			t.Errorf("ETag got %q, want %q", response.Header().Get("ETag"), ETag("second"))
+		}
+		response = conditional(http.MethodDelete, "", "If-Match", etag)
+		if response.Code != http.StatusPreconditionFailed {
+			t.Errorf("stale delete .Code got %v, want %v", response.Code, http.StatusPreconditionFailed)
+		}
+		response = conditional(http.MethodDelete, "", "If-Match", ETag("second"))
+		if response.Code != http.StatusOK {
+			t.Errorf("delete .Code got %v, want %v", response.Code, http.StatusOK)
+		}
+		_, err := App.DB.Get(context.Background(), testNamespace, etagKey)
+		if _, ok := err.(*ErrNotFound); !ok {
+			t.Errorf("Supposed to get ErrNotFound error got %v", err)
+		}
+	})
 	t.Run("ListAll keys", func(t *testing.T) {
 
 		request, _ := http.NewRequest(http.MethodGet,
@@ -399,6 +590,20 @@ func TestApiV1(t *testing.T) {
 			t.Errorf(".Body got %q, want %q", string(b), createdBody)
 		}
 	})
+	t.Run("Create Namespace without name", func(t *testing.T) {
+		request, _ := http.NewRequest(http.MethodPost, URLPrefix, strings.NewReader(`{"type": "namespace", "value": ""}`))
+		request.Header.Set("Content-Type", "application/json")
+		response := httptest.NewRecorder()
+		requestParameters := GetRequestParameters(request, requestsCount)
+		requestsCount += 1
+		api.ApiController(response, requestParameters)
+		if response.Code != http.StatusBadRequest {
+			t.Errorf(".Code got %v, want %v", response.Code, http.StatusBadRequest)
+		}
+		if namespaces, _ := App.DB.Keys(context.Background(), ""); slices.Contains(namespaces, "") {
+			t.Errorf("Namespace without name created")
+		}
+	})
 	t.Run("List namespaces", func(t *testing.T) {
 
 		request, _ := http.NewRequest(http.MethodGet, URLPrefix, nil)
@@ -526,6 +731,97 @@ func TestApiV1(t *testing.T) {
 		}
 	})
 
+	t.Run("List keys filtered by key permissions", func(t *testing.T) {
+		namespace := "keyacl"
+		App.DB.CreateNamespace(context.Background(), namespace)
+		for _, key := range []string{"db-user", "db-password", "other"} {
+			App.DB.Set(context.Background(), namespace, key, "value")
+		}
+		user := User{}
+		user.SetPermissions([]ConfigPermissionsset{
+			{Namespaces: []string{namespace}, Keys: []string{"db-*"}, Permissions: ConfigPermissions{Read: true, List: true}},
+			{Namespaces: []string{namespace}, Keys: []string{"db-password"}, Permissions: ConfigPermissions{Read: true}, Deny: true},
+		})
+		for path, want := range map[string][]string{namespace: {"db-user", "db-password"}, namespace + "/*": {"db-user"}} {
+			request, _ := http.NewRequest(http.MethodGet, URLPrefix+"/"+path, nil)
+			response := httptest.NewRecorder()
+			requestParameters := GetRequestParameters(request, requestsCount)
+			requestsCount += 1
+			requestParameters.Authentication.User = &user
+			if !user.Autorization(requestParameters, api.Permissions(requestParameters)) {
+				t.Fatalf("Expected %v to be allowed with key permissions", path)
+			}
+			api.ApiController(response, requestParameters)
+			got := []string{}
+			if strings.HasSuffix(path, "*") {
+				var listReply rest.KVPairListV1
+				json.Unmarshal(response.Body.Bytes(), &listReply)
+				for _, pair := range listReply {
+					got = append(got, pair.Key)
+				}
+			} else {
+				json.Unmarshal(response.Body.Bytes(), &got)
+			}
+			slices.Sort(got)
+			slices.Sort(want)
+			if !slices.Equal(got, want) {
+				t.Errorf("List %v got %v, want %v", path, got, want)
+			}
+		}
+		request, _ := http.NewRequest(http.MethodGet, URLPrefix+"/"+namespace+"/other", nil)
+		requestParameters := GetRequestParameters(request, requestsCount)
+		requestsCount += 1
+		if user.Autorization(requestParameters, api.Permissions(requestParameters)) {
+			t.Errorf("Unexpected read of key outside key permissions")
+		}
+		request, _ = http.NewRequest(http.MethodDelete, URLPrefix+"/"+namespace, nil)
+		requestParameters = GetRequestParameters(request, requestsCount)
+		requestsCount += 1
+		if user.Autorization(requestParameters, api.Permissions(requestParameters)) {
+			t.Errorf("Unexpected namespace delete with key permissions")
+		}
+	})
+	t.Run("List keys paged", func(t *testing.T) {
+		namespace := "paged"
+		App.DB.CreateNamespace(context.Background(), namespace)
+		for _, key := range []string{"a-1", "a-2", "a-3", "b-1", "b-2"} {
+			App.DB.Set(context.Background(), namespace, key, "value")
+		}
+		list := func(query string) ([]string, string, int) {
+			request, _ := http.NewRequest(http.MethodGet, URLPrefix+"/"+namespace+"?"+query, nil)
+			response := httptest.NewRecorder()
+			requestParameters := GetRequestParameters(request, requestsCount)
+			requestsCount += 1
+			api.ApiController(response, requestParameters)
+			got := []string{}
+			json.Unmarshal(response.Body.Bytes(), &got)
+			return got, response.Header().Get(rest.HeaderNextCursor), response.Code
+		}
+		got := []string{}
+		cursor := ""
+		for pages := 1; ; pages++ {
+			page, next, code := list("limit=2&prefix=a-&cursor=" + cursor)
+			if code != http.StatusOK || len(page) > 2 {
+				t.Fatalf("Page %v got %v, %v", pages, code, page)
+			}
+			got = append(got, page...)
+			cursor = next
+			if cursor == "" || pages > 3 {
+				break
+			}
+		}
+		if want := []string{"a-1", "a-2", "a-3"}; !slices.Equal(got, want) {
+			t.Errorf("Paged list got %v, want %v", got, want)
+		}
+		if got, next, _ := list("match=*-2"); !slices.Equal(got, []string{"a-2", "b-2"}) || next != "" {
+			t.Errorf("Filtered list got %v, next %q", got, next)
+		}
+		for _, query := range []string{"limit=0", "limit=x", "match=[", "cursor=!"} {
+			if _, _, code := list(query); code != http.StatusBadRequest {
+				t.Errorf("%v .Code got %v, want %v", query, code, http.StatusBadRequest)
+			}
+		}
+	})
 	t.Run("Delete key", func(t *testing.T) {
 		request, _ := http.NewRequest(http.MethodDelete,
 			fmt.Sprintf("%v/%v/%v", URLPrefix, testNamespace, testKey),
@@ -573,3 +869,13 @@ func TestApiV1(t *testing.T) {
 
 	})
 }
+
+// slowDatabase does not answer Get before the context of the request ends
+type slowDatabase struct {
+	Database
+}
+
+func (DB *slowDatabase) Get(ctx context.Context, namespace string, key string) (string, error) {
+	<-ctx.Done()
+	return "", ctx.Err()
+}
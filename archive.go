@@ -0,0 +1,606 @@
+package main
+
+import (
+	"archive/tar"
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/url"
+	"os"
+	"path"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/SimonStiil/keyvaluedatabase/rest"
+	"golang.org/x/crypto/argon2"
+	"gopkg.in/yaml.v3"
+)
+
+const (
+	archiveVersion = 1
+	// archiveChunkSize is the size of the plaintext sealed in each chunk of an encrypted archive
+	archiveChunkSize          = 64 * 1024
+	archiveHeaderFile         = "archive.yaml"
+	archiveNamespaceDirectory = "namespaces/"
+)
+
+// archiveMagic starts encrypted archives, it is followed by the salt and the chunks
+var archiveMagic = []byte("KVDBARC1")
+
+// ArchiveFilter selects the namespaces and keys of an export, an empty list selects all
+type ArchiveFilter struct {
+	Namespaces []string // Glob patterns like team-*, same syntax as path.Match
+	Keys       []string
+}
+
+type ArchiveOptions struct {
+	Format     rest.ArchiveFormat
+	Filter     ArchiveFilter
+	Passphrase string // Encrypt the archive, empty for no encryption
+}
+
+// ArchiveOptionsFromQuery reads the format, namespace and key query parameters, namespace and key can be repeated
+func ArchiveOptionsFromQuery(query url.Values) (ArchiveOptions, error) {
+	options := ArchiveOptions{
+		Format: rest.ArchiveFormat(query.Get("format")),
+		Filter: ArchiveFilter{Namespaces: query["namespace"], Keys: query["key"]},
+	}
+	if options.Format == "" {
+		options.Format = rest.ArchiveJSONLines
+	}
+	return options, options.Validate()
+}
+
+func (Options *ArchiveOptions) Validate() error {
+	if Options.Format != rest.ArchiveJSONLines && Options.Format != rest.ArchiveTar {
+		return &ErrMalformRequest{Value: "format must be jsonl or tar"}
+	}
+	for _, pattern := range append(slices.Clone(Options.Filter.Namespaces), Options.Filter.Keys...) {
+		_, err := path.Match(pattern, "")
+		if err != nil {
+			return &ErrMalformRequest{Value: "invalid pattern " + pattern}
+		}
+	}
+	return nil
+}
+
+func matchesAny(patterns []string, value string) bool {
+	if len(patterns) == 0 {
+		return true
+	}
+	for _, pattern := range patterns {
+		if matched, _ := path.Match(pattern, value); matched {
+			return true
+		}
+	}
+	return false
+}
+
+// Export writes the namespaces and keys selected by options.Filter to output with expiry and key history.
+// Namespaces are read one at a time so the archive is streamed. It returns the number of keys written.
+func Export(ctx context.Context, DB Database, output io.Writer, options ArchiveOptions) (int, error) {
+	err := options.Validate()
+	if err != nil {
+		return 0, err
+	}
+	var encrypter *archiveEncrypter
+	if options.Passphrase != "" {
+		encrypter, err = newArchiveEncrypter(output, options.Passphrase)
+		if err != nil {
+			return 0, err
+		}
+		output = encrypter
+	}
+	var writer archiveWriter
+	if options.Format == rest.ArchiveTar {
+		writer = &tarArchiveWriter{tar: tar.NewWriter(output)}
+	} else {
+		writer = &jsonLinesWriter{encoder: json.NewEncoder(output)}
+	}
+	namespaces, err := DB.Keys(ctx, "")
+	if err != nil {
+		return 0, err
+	}
+	if !slices.Contains(namespaces, DB.GetSystemNS()) {
+		namespaces = append(namespaces, DB.GetSystemNS())
+	}
+	slices.Sort(namespaces)
+	err = writer.WriteHeader(rest.ArchiveHeaderV1{Version: archiveVersion, SystemNamespace: DB.GetSystemNS(), Created: time.Now().UTC()})
+	if err != nil {
+		return 0, err
+	}
+	count := 0
+	for _, namespace := range namespaces {
+		if !matchesAny(options.Filter.Namespaces, namespace) {
+			continue
+		}
+		err = writer.Write(rest.ArchiveRecordV1{Namespace: namespace})
+		if err != nil {
+			return count, err
+		}
+		keys, err := migrationKeys(ctx, DB, namespace)
+		if err != nil {
+			return count, err
+		}
+		for _, key := range keys {
+			if !matchesAny(options.Filter.Keys, key) {
+				continue
+			}
+			record, err := exportRecord(ctx, DB, namespace, key)
+			if err != nil {
+				if _, ok := err.(*ErrNotFound); ok {
+					// Expired or deleted since the keys were listed
+					continue
+				}
+				return count, err
+			}
+			err = writer.Write(record)
+			if err != nil {
+				return count, err
+			}
+			count++
+		}
+	}
+	err = writer.Close()
+	if err == nil && encrypter != nil {
+		err = encrypter.Close()
+	}
+	return count, err
+}
+
+func exportRecord(ctx context.Context, DB Database, namespace string, key string) (rest.ArchiveRecordV1, error) {
+	record := rest.ArchiveRecordV1{Namespace: namespace, Key: key}
+	var err error
+	record.Value, err = DB.Get(ctx, namespace, key)
+	if err != nil {
+		return record, err
+	}
+	ttl, err := DB.TTL(ctx, namespace, key)
+	if err != nil {
+		return record, err
+	}
+	if ttl > 0 {
+		expires := time.Now().Add(ttl).UTC()
+		record.Expires = &expires
+	}
+	history, err := DB.Versions(ctx, namespace, key)
+	if err == nil {
+		record.History = history
+	} else if _, ok := err.(*ErrNotFound); !ok {
+		return record, err
+	}
+	return record, nil
+}
+
+// Import reads an archive written by Export into DB. The system namespace of the archive is imported to the
+// system namespace of DB. With mode fail the archive is read twice, first to check for conflicts and then to
+// write, input that can not seek is spooled to a temporary file so the archive is never held in memory.
+func Import(ctx context.Context, DB Database, input io.Reader, mode rest.ImportMode, passphrase string) (rest.ImportResultV1, error) {
+	result := rest.ImportResultV1{}
+	if mode != rest.ImportMerge && mode != rest.ImportOverwrite && mode != rest.ImportFail {
+		return result, &ErrMalformRequest{Value: "mode must be merge, overwrite or fail"}
+	}
+	if mode == rest.ImportFail {
+		source, ok := input.(io.ReadSeeker)
+		if !ok {
+			spool, err := os.CreateTemp("", "kvdb-import-*")
+			if err != nil {
+				return result, err
+			}
+			defer os.Remove(spool.Name())
+			defer spool.Close()
+			if _, err := io.Copy(spool, input); err != nil {
+				return result, err
+			}
+			if _, err := spool.Seek(0, io.SeekStart); err != nil {
+				return result, err
+			}
+			source = spool
+		}
+		start, err := source.Seek(0, io.SeekCurrent)
+		if err != nil {
+			return result, err
+		}
+		err = readArchive(DB, source, passphrase, func(record rest.ArchiveRecordV1) error {
+			if record.Key == "" {
+				return nil
+			}
+			current, err := DB.Get(ctx, record.Namespace, record.Key)
+			if err == nil && current != record.Value {
+				result.Conflicts = append(result.Conflicts, record.Namespace+"/"+record.Key)
+			}
+			return nil
+		})
+		if err != nil || len(result.Conflicts) > 0 {
+			return result, err
+		}
+		if _, err := source.Seek(start, io.SeekStart); err != nil {
+			return result, err
+		}
+		input = source
+	}
+	err := readArchive(DB, input, passphrase, func(record rest.ArchiveRecordV1) error {
+		return importRecord(ctx, DB, record, mode, &result)
+	})
+	return result, err
+}
+
+// readArchive calls fn for every record of the archive in input, records of the system namespace of the
+// archive are moved to the system namespace of DB
+func readArchive(DB Database, input io.Reader, passphrase string, fn func(record rest.ArchiveRecordV1) error) error {
+	reader, err := openArchive(input, passphrase)
+	if err != nil {
+		return err
+	}
+	systemNS := reader.Header().SystemNamespace
+	for {
+		record, err := reader.Next()
+		if errors.Is(err, io.EOF) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if record.Namespace == systemNS {
+			record.Namespace = DB.GetSystemNS()
+		}
+		err = fn(record)
+		if err != nil {
+			return err
+		}
+	}
+}
+
+func importRecord(ctx context.Context, DB Database, record rest.ArchiveRecordV1, mode rest.ImportMode, result *rest.ImportResultV1) error {
+	if record.Key == "" {
+		result.Namespaces++
+		return DB.CreateNamespace(ctx, record.Namespace)
+	}
+	if internalKey(DB, record.Namespace, record.Key) {
+		result.Skipped++
+		return nil
+	}
+	var ttl time.Duration
+	if record.Expires != nil {
+		ttl = time.Until(*record.Expires)
+		if ttl <= 0 {
+			result.Skipped++
+			return nil
+		}
+	}
+	current, err := DB.Get(ctx, record.Namespace, record.Key)
+	exists := err == nil
+	if exists && (mode == rest.ImportMerge || mode == rest.ImportFail && current == record.Value) {
+		result.Skipped++
+		return nil
+	}
+	err = DB.SetWithTTL(ctx, record.Namespace, record.Key, record.Value, ttl)
+	if err != nil {
+		return err
+	}
+	err = addHistory(ctx, DB, record.Namespace, record.Key, record.History)
+	if err != nil {
+		return err
+	}
+	result.Imported++
+	return nil
+}
+
+type archiveWriter interface {
+	WriteHeader(header rest.ArchiveHeaderV1) error
+	// Write adds a record, a record without key starts a namespace
+	Write(record rest.ArchiveRecordV1) error
+	Close() error
+}
+
+type archiveReader interface {
+	Header() rest.ArchiveHeaderV1
+	// Next returns the next record, a record without key starts a namespace. io.EOF after the last record.
+	Next() (rest.ArchiveRecordV1, error)
+}
+
+// openArchive detects encryption and the format of input
+func openArchive(input io.Reader, passphrase string) (archiveReader, error) {
+	buffered := bufio.NewReader(input)
+	start, _ := buffered.Peek(len(archiveMagic))
+	if bytes.Equal(start, archiveMagic) {
+		if passphrase == "" {
+			return nil, &ErrMalformRequest{Value: "archive is encrypted, a passphrase is required"}
+		}
+		decrypter, err := newArchiveDecrypter(buffered, passphrase)
+		if err != nil {
+			return nil, err
+		}
+		buffered = bufio.NewReader(decrypter)
+	}
+	// Tar headers have the ustar magic at offset 257
+	start, _ = buffered.Peek(262)
+	if len(start) == 262 && string(start[257:262]) == "ustar" {
+		return newTarArchiveReader(buffered)
+	}
+	return newJSONLinesReader(buffered)
+}
+
+type jsonLinesWriter struct {
+	encoder *json.Encoder
+}
+
+func (Writer *jsonLinesWriter) WriteHeader(header rest.ArchiveHeaderV1) error {
+	return Writer.encoder.Encode(header)
+}
+
+func (Writer *jsonLinesWriter) Write(record rest.ArchiveRecordV1) error {
+	return Writer.encoder.Encode(record)
+}
+
+func (Writer *jsonLinesWriter) Close() error {
+	return nil
+}
+
+type jsonLinesReader struct {
+	decoder *json.Decoder
+	header  rest.ArchiveHeaderV1
+}
+
+func newJSONLinesReader(input io.Reader) (*jsonLinesReader, error) {
+	reader := &jsonLinesReader{decoder: json.NewDecoder(input)}
+	err := reader.decoder.Decode(&reader.header)
+	if err != nil || reader.header.Version != archiveVersion {
+		return nil, &ErrMalformRequest{Value: "not a supported archive"}
+	}
+	return reader, nil
+}
+
+func (Reader *jsonLinesReader) Header() rest.ArchiveHeaderV1 {
+	return Reader.header
+}
+
+func (Reader *jsonLinesReader) Next() (rest.ArchiveRecordV1, error) {
+	record := rest.ArchiveRecordV1{}
+	err := Reader.decoder.Decode(&record)
+	if errors.Is(err, io.EOF) {
+		return record, err
+	}
+	if err != nil || record.Namespace == "" {
+		return record, &ErrMalformRequest{Value: "invalid archive record"}
+	}
+	return record, nil
+}
+
+// tarArchiveWriter collects the records of a namespace and writes them as one yaml file
+type tarArchiveWriter struct {
+	tar       *tar.Writer
+	namespace *string
+	records   []rest.ArchiveRecordV1
+}
+
+func (Writer *tarArchiveWriter) writeFile(name string, content any) error {
+	data, err := yaml.Marshal(content)
+	if err != nil {
+		return err
+	}
+	err = Writer.tar.WriteHeader(&tar.Header{Typeflag: tar.TypeReg, Name: name, Mode: 0600, Size: int64(len(data)), ModTime: time.Now()})
+	if err != nil {
+		return err
+	}
+	_, err = Writer.tar.Write(data)
+	return err
+}
+
+func (Writer *tarArchiveWriter) flush() error {
+	if Writer.namespace == nil {
+		return nil
+	}
+	err := Writer.writeFile(archiveNamespaceDirectory+*Writer.namespace+".yaml", Writer.records)
+	Writer.namespace = nil
+	Writer.records = nil
+	return err
+}
+
+func (Writer *tarArchiveWriter) WriteHeader(header rest.ArchiveHeaderV1) error {
+	return Writer.writeFile(archiveHeaderFile, header)
+}
+
+func (Writer *tarArchiveWriter) Write(record rest.ArchiveRecordV1) error {
+	if record.Key != "" {
+		Writer.records = append(Writer.records, record)
+		return nil
+	}
+	err := Writer.flush()
+	Writer.namespace = &record.Namespace
+	Writer.records = []rest.ArchiveRecordV1{}
+	return err
+}
+
+func (Writer *tarArchiveWriter) Close() error {
+	err := Writer.flush()
+	if err != nil {
+		return err
+	}
+	return Writer.tar.Close()
+}
+
+type tarArchiveReader struct {
+	tar     *tar.Reader
+	header  rest.ArchiveHeaderV1
+	pending []rest.ArchiveRecordV1
+}
+
+func newTarArchiveReader(input io.Reader) (*tarArchiveReader, error) {
+	reader := &tarArchiveReader{tar: tar.NewReader(input)}
+	file, err := reader.tar.Next()
+	if err != nil || file.Name != archiveHeaderFile {
+		return nil, &ErrMalformRequest{Value: "not a supported archive"}
+	}
+	err = yaml.NewDecoder(reader.tar).Decode(&reader.header)
+	if err != nil || reader.header.Version != archiveVersion {
+		return nil, &ErrMalformRequest{Value: "not a supported archive"}
+	}
+	return reader, nil
+}
+
+func (Reader *tarArchiveReader) Header() rest.ArchiveHeaderV1 {
+	return Reader.header
+}
+
+func (Reader *tarArchiveReader) Next() (rest.ArchiveRecordV1, error) {
+	for len(Reader.pending) == 0 {
+		file, err := Reader.tar.Next()
+		if errors.Is(err, io.EOF) {
+			return rest.ArchiveRecordV1{}, err
+		}
+		if err != nil {
+			return rest.ArchiveRecordV1{}, &ErrMalformRequest{Value: "invalid archive: " + err.Error()}
+		}
+		if !strings.HasPrefix(file.Name, archiveNamespaceDirectory) || !strings.HasSuffix(file.Name, ".yaml") {
+			continue
+		}
+		namespace := strings.TrimSuffix(strings.TrimPrefix(file.Name, archiveNamespaceDirectory), ".yaml")
+		records := []rest.ArchiveRecordV1{}
+		err = yaml.NewDecoder(Reader.tar).Decode(&records)
+		if err != nil && !errors.Is(err, io.EOF) {
+			return rest.ArchiveRecordV1{}, &ErrMalformRequest{Value: "invalid archive file " + file.Name}
+		}
+		Reader.pending = append(Reader.pending, rest.ArchiveRecordV1{Namespace: namespace})
+		for _, record := range records {
+			if record.Key == "" {
+				return rest.ArchiveRecordV1{}, &ErrMalformRequest{Value: "invalid archive file " + file.Name}
+			}
+			record.Namespace = namespace
+			Reader.pending = append(Reader.pending, record)
+		}
+	}
+	record := Reader.pending[0]
+	Reader.pending = Reader.pending[1:]
+	return record, nil
+}
+
+// archiveKey derives the key of an encrypted archive from the passphrase
+func archiveKey(passphrase string, salt []byte) []byte {
+	return argon2.IDKey([]byte(passphrase), salt, argon2Time, argon2Memory, argon2Threads, argon2KeyLength)
+}
+
+// chunkAdditionalData binds a chunk to its position, the final flag detects truncated archives
+func chunkAdditionalData(index uint64, final bool) []byte {
+	data := make([]byte, 9)
+	binary.BigEndian.PutUint64(data, index)
+	if final {
+		data[8] = 1
+	}
+	return data
+}
+
+// archiveEncrypter writes <magic><salt> followed by chunks of <final flag><4 byte length><AES-GCM sealed plaintext>
+type archiveEncrypter struct {
+	output io.Writer
+	key    []byte
+	buffer bytes.Buffer
+	index  uint64
+}
+
+func newArchiveEncrypter(output io.Writer, passphrase string) (*archiveEncrypter, error) {
+	salt := make([]byte, argon2SaltLength)
+	_, err := rand.Read(salt)
+	if err != nil {
+		return nil, err
+	}
+	_, err = output.Write(append(slices.Clone(archiveMagic), salt...))
+	if err != nil {
+		return nil, err
+	}
+	return &archiveEncrypter{output: output, key: archiveKey(passphrase, salt)}, nil
+}
+
+func (Encrypter *archiveEncrypter) writeChunk(plaintext []byte, final bool) error {
+	sealed, err := sealAESGCM(Encrypter.key, plaintext, chunkAdditionalData(Encrypter.index, final))
+	if err != nil {
+		return err
+	}
+	header := make([]byte, 5)
+	if final {
+		header[0] = 1
+	}
+	binary.BigEndian.PutUint32(header[1:], uint32(len(sealed)))
+	_, err = Encrypter.output.Write(append(header, sealed...))
+	Encrypter.index++
+	return err
+}
+
+func (Encrypter *archiveEncrypter) Write(data []byte) (int, error) {
+	Encrypter.buffer.Write(data)
+	for Encrypter.buffer.Len() >= archiveChunkSize {
+		err := Encrypter.writeChunk(Encrypter.buffer.Next(archiveChunkSize), false)
+		if err != nil {
+			return 0, err
+		}
+	}
+	return len(data), nil
+}
+
+// Close writes the final chunk, without it the archive is rejected as truncated
+func (Encrypter *archiveEncrypter) Close() error {
+	return Encrypter.writeChunk(Encrypter.buffer.Bytes(), true)
+}
+
+type archiveDecrypter struct {
+	input     io.Reader
+	key       []byte
+	index     uint64
+	plaintext []byte
+	final     bool
+}
+
+func newArchiveDecrypter(input io.Reader, passphrase string) (*archiveDecrypter, error) {
+	header := make([]byte, len(archiveMagic)+argon2SaltLength)
+	_, err := io.ReadFull(input, header)
+	if err != nil {
+		return nil, &ErrMalformRequest{Value: "archive is truncated"}
+	}
+	return &archiveDecrypter{input: input, key: archiveKey(passphrase, header[len(archiveMagic):])}, nil
+}
+
+func (Decrypter *archiveDecrypter) readChunk() error {
+	header := make([]byte, 5)
+	_, err := io.ReadFull(Decrypter.input, header)
+	if err != nil {
+		return &ErrMalformRequest{Value: "archive is truncated"}
+	}
+	final := header[0] == 1
+	length := binary.BigEndian.Uint32(header[1:])
+	if length > archiveChunkSize+64 {
+		return &ErrMalformRequest{Value: "invalid archive chunk"}
+	}
+	sealed := make([]byte, length)
+	_, err = io.ReadFull(Decrypter.input, sealed)
+	if err != nil {
+		return &ErrMalformRequest{Value: "archive is truncated"}
+	}
+	Decrypter.plaintext, err = openAESGCM(Decrypter.key, sealed, chunkAdditionalData(Decrypter.index, final))
+	if err != nil {
+		return &ErrMalformRequest{Value: "unable to decrypt archive, wrong passphrase or modified archive"}
+	}
+	Decrypter.index++
+	Decrypter.final = final
+	return nil
+}
+
+func (Decrypter *archiveDecrypter) Read(data []byte) (int, error) {
+	for len(Decrypter.plaintext) == 0 {
+		if Decrypter.final {
+			return 0, io.EOF
+		}
+		err := Decrypter.readChunk()
+		if err != nil {
+			return 0, err
+		}
+	}
+	n := copy(data, Decrypter.plaintext)
+	Decrypter.plaintext = Decrypter.plaintext[n:]
+	return n, nil
+}
@@ -0,0 +1,235 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/SimonStiil/keyvaluedatabase/rest"
+)
+
+func Test_Archive(t *testing.T) {
+	setupTestlogging()
+	directory := t.TempDir()
+	source := &YamlDatabase{DatabaseName: filepath.Join(directory, "source.yaml")}
+	source.Init()
+	source.Set(context.Background(), source.GetSystemNS(), "counter", "42")
+	source.CreateNamespace(context.Background(), "empty")
+	source.Set(context.Background(), "alpha", "one", "1")
+	source.SetWithTTL(context.Background(), "alpha", "two", "2", time.Hour)
+	source.Set(context.Background(), "beta", "three", "3")
+	source.AddVersion(context.Background(), "beta", "three", rest.KeyVersionV1{Value: "old", User: "test", Timestamp: time.Now()}, 0)
+	source.AddVersion(context.Background(), "beta", "three", rest.KeyVersionV1{Value: "3", User: "test", Timestamp: time.Now()}, 0)
+	newTarget := func(name string) Database {
+		target := &BoltDatabase{Config: &ConfigBolt{Path: filepath.Join(directory, name+".bolt"), SystemNS: "system", Timeout: time.Second}}
+		target.Init()
+		t.Cleanup(target.Close)
+		return target
+	}
+	export := func(t *testing.T, options ArchiveOptions) *bytes.Buffer {
+		archive := &bytes.Buffer{}
+		count, err := Export(context.Background(), source, archive, options)
+		if err != nil {
+			t.Fatalf("Export failed: %v", err)
+		}
+		if len(options.Filter.Namespaces) == 0 && count != 4 {
+			t.Errorf("Expected 4 keys exported, got %v", count)
+		}
+		return archive
+	}
+	for _, options := range []ArchiveOptions{
+		{Format: rest.ArchiveJSONLines},
+		{Format: rest.ArchiveTar},
+		{Format: rest.ArchiveJSONLines, Passphrase: "secret"},
+		{Format: rest.ArchiveTar, Passphrase: "secret"},
+	} {
+		name := string(options.Format)
+		if options.Passphrase != "" {
+			name += " encrypted"
+		}
+		t.Run("round trip "+name, func(t *testing.T) {
+			archive := export(t, options)
+			if options.Passphrase != "" && strings.Contains(archive.String(), "three") {
+				t.Errorf("Encrypted archive contains plain text")
+			}
+			target := newTarget(strings.ReplaceAll(name, " ", "-"))
+			result, err := Import(context.Background(), target, archive, rest.ImportMerge, options.Passphrase)
+			if err != nil {
+				t.Fatalf("Import failed: %v", err)
+			}
+			if result.Namespaces != 4 || result.Imported != 4 {
+				t.Errorf("Expected 4 namespaces and 4 keys imported, got %+v", result)
+			}
+			value, err := target.Get(context.Background(), "system", "counter")
+			if err != nil || value != "42" {
+				t.Errorf("Expected system namespace imported to system, got %v %v", value, err)
+			}
+			namespaces, _ := target.Keys(context.Background(), "")
+			if !strings.Contains(strings.Join(namespaces, ","), "empty") {
+				t.Errorf("Expected empty namespace imported, got %v", namespaces)
+			}
+			ttl, err := target.TTL(context.Background(), "alpha", "two")
+			if err != nil || ttl <= 0 || ttl > time.Hour {
+				t.Errorf("Expected ttl within an hour, got %v %v", ttl, err)
+			}
+			history, err := target.Versions(context.Background(), "beta", "three")
+			if err != nil || len(history) != 2 || history[0].Value != "3" || history[1].Value != "old" {
+				t.Errorf("Expected history imported, got %+v %v", history, err)
+			}
+		})
+	}
+	t.Run("filter", func(t *testing.T) {
+		archive := export(t, ArchiveOptions{Format: rest.ArchiveJSONLines, Filter: ArchiveFilter{Namespaces: []string{"a*", "b*"}, Keys: []string{"t*"}}})
+		target := newTarget("filter")
+		result, err := Import(context.Background(), target, archive, rest.ImportMerge, "")
+		if err != nil {
+			t.Fatalf("Import failed: %v", err)
+		}
+		if result.Namespaces != 2 || result.Imported != 2 {
+			t.Errorf("Expected 2 namespaces and 2 keys imported, got %+v", result)
+		}
+		_, err = target.Get(context.Background(), "alpha", "one")
+		if _, ok := err.(*ErrNotFound); !ok {
+			t.Errorf("Expected filtered key to be left out, got %v", err)
+		}
+		_, err = Export(context.Background(), source, &bytes.Buffer{}, ArchiveOptions{Format: rest.ArchiveJSONLines, Filter: ArchiveFilter{Keys: []string{"["}}})
+		if _, ok := err.(*ErrMalformRequest); !ok {
+			t.Errorf("Expected ErrMalformRequest for invalid pattern, got %v", err)
+		}
+	})
+	t.Run("modes", func(t *testing.T) {
+		archive := export(t, ArchiveOptions{Format: rest.ArchiveJSONLines})
+		target := newTarget("modes")
+		target.Set(context.Background(), "alpha", "one", "changed")
+		result, err := Import(context.Background(), target, bytes.NewReader(archive.Bytes()), rest.ImportFail, "")
+		if err != nil {
+			t.Fatalf("Import failed: %v", err)
+		}
+		if len(result.Conflicts) != 1 || result.Conflicts[0] != "alpha/one" || result.Imported != 0 {
+			t.Errorf("Expected conflict for alpha/one and nothing imported, got %+v", result)
+		}
+		if _, err := target.Get(context.Background(), "beta", "three"); err == nil {
+			t.Errorf("Expected nothing imported on conflict")
+		}
+		result, err = Import(context.Background(), target, bytes.NewReader(archive.Bytes()), rest.ImportMerge, "")
+		if err != nil || result.Imported != 3 || result.Skipped != 1 {
+			t.Errorf("Expected 3 imported and 1 skipped, got %+v %v", result, err)
+		}
+		if value, _ := target.Get(context.Background(), "alpha", "one"); value != "changed" {
+			t.Errorf("Expected merge to keep existing value, got %v", value)
+		}
+		result, err = Import(context.Background(), target, bytes.NewReader(archive.Bytes()), rest.ImportOverwrite, "")
+		if err != nil || result.Imported != 4 {
+			t.Errorf("Expected 4 imported, got %+v %v", result, err)
+		}
+		if value, _ := target.Get(context.Background(), "alpha", "one"); value != "1" {
+			t.Errorf("Expected overwrite to replace existing value, got %v", value)
+		}
+	})
+	t.Run("fail mode without seek", func(t *testing.T) {
+		archive := export(t, ArchiveOptions{Format: rest.ArchiveJSONLines, Passphrase: "secret"})
+		target := newTarget("spool")
+		target.Set(context.Background(), "alpha", "one", "changed")
+		result, err := Import(context.Background(), target, io.MultiReader(bytes.NewReader(archive.Bytes())), rest.ImportFail, "secret")
+		if err != nil || len(result.Conflicts) != 1 || result.Imported != 0 {
+			t.Errorf("Expected conflict for alpha/one and nothing imported, got %+v %v", result, err)
+		}
+		target.Set(context.Background(), "alpha", "one", "1")
+		result, err = Import(context.Background(), target, io.MultiReader(bytes.NewReader(archive.Bytes())), rest.ImportFail, "secret")
+		if err != nil || len(result.Conflicts) != 0 || result.Imported != 3 {
+			t.Errorf("Expected 3 imported, got %+v %v", result, err)
+		}
+		if value, _ := target.Get(context.Background(), "beta", "three"); value == "" {
+			t.Errorf("Expected beta/three imported")
+		}
+	})
+	t.Run("invalid archives", func(t *testing.T) {
+		target := newTarget("invalid")
+		encrypted := export(t, ArchiveOptions{Format: rest.ArchiveJSONLines, Passphrase: "secret"}).Bytes()
+		tests := []struct {
+			name       string
+			archive    []byte
+			passphrase string
+		}{
+			{"no passphrase", encrypted, ""},
+			{"wrong passphrase", encrypted, "wrong"},
+			{"truncated", encrypted[:len(encrypted)-10], "secret"},
+			{"not an archive", []byte("hello"), ""},
+		}
+		for _, test := range tests {
+			_, err := Import(context.Background(), target, bytes.NewReader(test.archive), rest.ImportMerge, test.passphrase)
+			if _, ok := err.(*ErrMalformRequest); !ok {
+				t.Errorf("%v: expected ErrMalformRequest, got %v", test.name, err)
+			}
+		}
+	})
+}
+
+func TestSystemV1Archive(t *testing.T) {
+	api := new(Systemv1)
+	App = new(Application)
+	setupTestlogging()
+	App.DB = &YamlDatabase{DatabaseName: filepath.Join(t.TempDir(), "archive.yaml")}
+	App.DB.Init()
+	App.DB.Set(context.Background(), "hello", "world", "value")
+	send := func(method string, url string, body []byte, admin bool) *httptest.ResponseRecorder {
+		request, _ := http.NewRequest(method, url, bytes.NewReader(body))
+		request.Header.Set(rest.HeaderArchivePassphrase, "secret")
+		requestParameters := GetRequestParameters(request, 0)
+		requestParameters.Authentication.User = &User{Admin: admin}
+		response := httptest.NewRecorder()
+		api.ApiController(response, requestParameters)
+		return response
+	}
+	var archive []byte
+	t.Run("Export requires admin", func(t *testing.T) {
+		if response := send(http.MethodGet, "/system/export", nil, false); response.Code != http.StatusForbidden {
+			t.Errorf(".Code got %v, want %v", response.Code, http.StatusForbidden)
+		}
+	})
+	t.Run("Export", func(t *testing.T) {
+		response := send(http.MethodGet, "/system/export?format=tar", nil, true)
+		if response.Code != http.StatusOK {
+			t.Fatalf(".Code got %v, want %v", response.Code, http.StatusOK)
+		}
+		if response.Header().Get("Content-Type") != "application/octet-stream" {
+			t.Errorf("Content-Type got %v", response.Header().Get("Content-Type"))
+		}
+		archive = response.Body.Bytes()
+		if response := send(http.MethodGet, "/system/export?format=zip", nil, true); response.Code != http.StatusBadRequest {
+			t.Errorf(".Code got %v, want %v", response.Code, http.StatusBadRequest)
+		}
+	})
+	t.Run("Import", func(t *testing.T) {
+		App.DB.Set(context.Background(), "hello", "world", "changed")
+		response := send(http.MethodPost, "/system/import?mode=fail", archive, true)
+		if response.Code != http.StatusConflict {
+			t.Errorf(".Code got %v, want %v", response.Code, http.StatusConflict)
+		}
+		response = send(http.MethodPost, "/system/import?mode=overwrite", archive, true)
+		if response.Code != http.StatusOK {
+			t.Fatalf(".Code got %v, want %v", response.Code, http.StatusOK)
+		}
+		var result rest.ImportResultV1
+		err := json.Unmarshal(response.Body.Bytes(), &result)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if result.Imported != 1 {
+			t.Errorf("Expected 1 imported, got %+v", result)
+		}
+		if value, _ := App.DB.Get(context.Background(), "hello", "world"); value != "value" {
+			t.Errorf("Expected value restored, got %v", value)
+		}
+		if response := send(http.MethodPost, "/system/import?mode=other", archive, true); response.Code != http.StatusBadRequest {
+			t.Errorf(".Code got %v, want %v", response.Code, http.StatusBadRequest)
+		}
+	})
+}
@@ -0,0 +1,524 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/syslog"
+	"net/http"
+	"os"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/SimonStiil/keyvaluedatabase/rest"
+	"github.com/spf13/viper"
+)
+
+type ConfigAudit struct {
+	Enabled      bool               `mapstructure:"enabled"`
+	MemoryEvents int                `mapstructure:"memoryEvents"`
+	File         ConfigAuditFile    `mapstructure:"file"`
+	Syslog       ConfigAuditSyslog  `mapstructure:"syslog"`
+	Webhook      ConfigAuditWebhook `mapstructure:"webhook"`
+}
+
+type ConfigAuditFile struct {
+	Enabled    bool   `mapstructure:"enabled"`
+	Path       string `mapstructure:"path"`
+	MaxSize    int64  `mapstructure:"maxSize"`
+	MaxBackups int    `mapstructure:"maxBackups"`
+}
+
+type ConfigAuditSyslog struct {
+	Enabled bool   `mapstructure:"enabled"`
+	Network string `mapstructure:"network"`
+	Address string `mapstructure:"address"`
+	Tag     string `mapstructure:"tag"`
+}
+
+type ConfigAuditWebhook struct {
+	Enabled         bool          `mapstructure:"enabled"`
+	URL             string        `mapstructure:"url"`
+	Timeout         time.Duration `mapstructure:"timeout"`
+	EnvVariableName string        `mapstructure:"envVariableName"`
+	QueueSize       int           `mapstructure:"queueSize"`
+}
+
+func AuditGetDefaults(configReader *viper.Viper) {
+	configReader.SetDefault("audit.enabled", false)
+	configReader.SetDefault("audit.memoryEvents", 1000)
+	configReader.SetDefault("audit.file.enabled", true)
+	configReader.SetDefault("audit.file.path", "audit.log")
+	configReader.SetDefault("audit.file.maxSize", 10*1024*1024)
+	configReader.SetDefault("audit.file.maxBackups", 5)
+	configReader.SetDefault("audit.syslog.enabled", false)
+	configReader.SetDefault("audit.syslog.tag", "kvdb")
+	configReader.SetDefault("audit.webhook.enabled", false)
+	configReader.SetDefault("audit.webhook.timeout", "5s")
+	configReader.SetDefault("audit.webhook.envVariableName", BaseENVname+"_AUDIT_WEBHOOK_TOKEN")
+	configReader.SetDefault("audit.webhook.queueSize", 1000)
+}
+
+// APIs implementing Auditable have their requests recorded in the audit log,
+// requests with an empty action are not recorded.
+type Auditable interface {
+	AuditAction(request *RequestParameters) string
+}
+
+type AuditSink interface {
+	Write(event rest.AuditEventV1) error
+	Close() error
+}
+
+// Sinks that can be read back implement AuditQuerier, returning matching events newest first
+type AuditQuerier interface {
+	Query(filter AuditFilter) ([]rest.AuditEventV1, error)
+}
+
+type AuditFilter struct {
+	User      string
+	Namespace string
+	Key       string
+	Action    string
+	Outcome   string
+	Since     time.Time
+	Until     time.Time
+	Limit     int
+}
+
+func (Filter *AuditFilter) Match(event rest.AuditEventV1) bool {
+	return (Filter.User == "" || Filter.User == event.User) &&
+		(Filter.Namespace == "" || Filter.Namespace == event.Namespace) &&
+		(Filter.Key == "" || Filter.Key == event.Key) &&
+		(Filter.Action == "" || Filter.Action == event.Action) &&
+		(Filter.Outcome == "" || Filter.Outcome == event.Outcome) &&
+		(Filter.Since.IsZero() || !event.Time.Before(Filter.Since)) &&
+		(Filter.Until.IsZero() || event.Time.Before(Filter.Until))
+}
+
+type Auditor struct {
+	Sinks   []AuditSink
+	Querier AuditQuerier
+}
+
+func NewAuditor(config ConfigAudit) (*Auditor, error) {
+	auditor := &Auditor{}
+	if config.File.Enabled {
+		sink, err := NewAuditFileSink(config.File)
+		if err != nil {
+			return nil, err
+		}
+		auditor.Sinks = append(auditor.Sinks, sink)
+		auditor.Querier = sink
+	} else if config.MemoryEvents > 0 {
+		sink := NewAuditMemorySink(config.MemoryEvents)
+		auditor.Sinks = append(auditor.Sinks, sink)
+		auditor.Querier = sink
+	}
+	if config.Syslog.Enabled {
+		writer, err := syslog.Dial(config.Syslog.Network, config.Syslog.Address, syslog.LOG_INFO|syslog.LOG_AUTH, config.Syslog.Tag)
+		if err != nil {
+			auditor.Close()
+			return nil, err
+		}
+		auditor.Sinks = append(auditor.Sinks, &AuditSyslogSink{Writer: writer})
+	}
+	if config.Webhook.Enabled {
+		auditor.Sinks = append(auditor.Sinks, NewAuditWebhookSink(config.Webhook))
+	}
+	return auditor, nil
+}
+
+func auditOutcome(status int) string {
+	switch {
+	case status == http.StatusUnauthorized || status == http.StatusForbidden:
+		return rest.AuditOutcomeDenied
+	case status >= 400:
+		return rest.AuditOutcomeFailure
+	}
+	return rest.AuditOutcomeSuccess
+}
+
+func auditAuthMethod(request *RequestParameters) string {
+	if request.Authentication.Verified.mTLS {
+		return "mtls"
+	}
+	if request.Bearer.Ok && isJWT(request.Bearer.Token) {
+		return "jwt"
+	}
+	if request.Bearer.Ok {
+		return "token"
+	}
+	if request.Basic.Ok {
+		return "basic"
+	}
+	return "none"
+}
+
+func (Auditor *Auditor) Record(request *RequestParameters, action string, status int) {
+	if action == "" {
+		return
+	}
+	event := rest.AuditEventV1{
+		Time:       time.Now().UTC(),
+		ID:         request.ID,
+		User:       request.GetUserName(),
+		IP:         request.RequestIP,
+		AuthMethod: auditAuthMethod(request),
+		Method:     request.Method,
+		Namespace:  request.Namespace,
+		Key:        request.Key,
+		Action:     action,
+		Outcome:    auditOutcome(status),
+		Status:     status,
+	}
+	for _, sink := range Auditor.Sinks {
+		err := sink.Write(event)
+		if err != nil {
+			logger.Error("Failed to write audit event", "function", "Record", "struct", "Auditor", "sink", fmt.Sprintf("%T", sink), "error", err)
+		}
+	}
+}
+
+func (Auditor *Auditor) Close() {
+	for _, sink := range Auditor.Sinks {
+		err := sink.Close()
+		if err != nil {
+			logger.Error("Failed to close audit sink", "function", "Close", "struct", "Auditor", "sink", fmt.Sprintf("%T", sink), "error", err)
+		}
+	}
+}
+
+// statusRecorder keeps the status written by an API for the audit log
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+}
+
+func (Recorder *statusRecorder) WriteHeader(status int) {
+	if Recorder.status == 0 {
+		Recorder.status = status
+	}
+	Recorder.ResponseWriter.WriteHeader(status)
+}
+
+func (Recorder *statusRecorder) Write(b []byte) (int, error) {
+	if Recorder.status == 0 {
+		Recorder.status = http.StatusOK
+	}
+	return Recorder.ResponseWriter.Write(b)
+}
+
+func (Recorder *statusRecorder) Status() int {
+	if Recorder.status == 0 {
+		return http.StatusOK
+	}
+	return Recorder.status
+}
+
+// AuditFileSink writes JSON lines, the file is rotated to <path>.1 .. <path>.<maxBackups> when it reaches maxSize bytes
+type AuditFileSink struct {
+	Config ConfigAuditFile
+	mutex  sync.Mutex
+	file   *os.File
+	size   int64
+}
+
+func NewAuditFileSink(config ConfigAuditFile) (*AuditFileSink, error) {
+	sink := &AuditFileSink{Config: config}
+	return sink, sink.open()
+}
+
+func (Sink *AuditFileSink) open() error {
+	file, err := os.OpenFile(Sink.Config.Path, os.O_APPEND|os.O_WRONLY|os.O_CREATE, 0600)
+	if err != nil {
+		return err
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return err
+	}
+	Sink.file = file
+	Sink.size = info.Size()
+	return nil
+}
+
+func (Sink *AuditFileSink) backupName(index int) string {
+	return fmt.Sprintf("%v.%d", Sink.Config.Path, index)
+}
+
+// rotate closes the file and moves it to the first backup, the file is opened again on every path so the
+// audit log continues when a rename fails. Sink.file is nil when the file could not be opened again.
+func (Sink *AuditFileSink) rotate() error {
+	err := Sink.file.Close()
+	Sink.file = nil
+	if err == nil && Sink.Config.MaxBackups > 0 {
+		os.Remove(Sink.backupName(Sink.Config.MaxBackups))
+		for i := Sink.Config.MaxBackups - 1; i > 0; i-- {
+			os.Rename(Sink.backupName(i), Sink.backupName(i+1))
+		}
+		err = os.Rename(Sink.Config.Path, Sink.backupName(1))
+	} else if err == nil {
+		err = os.Remove(Sink.Config.Path)
+	}
+	openErr := Sink.open()
+	if err != nil {
+		return errors.Join(err, openErr)
+	}
+	if openErr == nil {
+		logger.Debug("Rotated audit log", "function", "rotate", "struct", "AuditFileSink", "path", Sink.Config.Path)
+	}
+	return openErr
+}
+
+func (Sink *AuditFileSink) Write(event rest.AuditEventV1) error {
+	line, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+	line = append(line, '\n')
+	Sink.mutex.Lock()
+	defer Sink.mutex.Unlock()
+	if Sink.file != nil && Sink.Config.MaxSize > 0 && Sink.size > 0 && Sink.size+int64(len(line)) > Sink.Config.MaxSize {
+		err = Sink.rotate()
+		if err != nil {
+			logger.Error("Failed to rotate audit log", "function", "Write", "struct", "AuditFileSink", "path", Sink.Config.Path, "error", err)
+		}
+	}
+	if Sink.file == nil {
+		err = Sink.open()
+		if err != nil {
+			return err
+		}
+	}
+	n, err := Sink.file.Write(line)
+	Sink.size += int64(n)
+	return err
+}
+
+// auditSnapshot is an audit file opened by Query and the number of bytes written to it when it was opened
+type auditSnapshot struct {
+	file *os.File
+	size int64
+}
+
+// snapshot opens the audit files oldest first while Write is blocked, the open files are read after
+// the lock is released and stay readable when rotated
+func (Sink *AuditFileSink) snapshot() ([]auditSnapshot, error) {
+	Sink.mutex.Lock()
+	defer Sink.mutex.Unlock()
+	fileNames := []string{}
+	for i := Sink.Config.MaxBackups; i > 0; i-- {
+		fileNames = append(fileNames, Sink.backupName(i))
+	}
+	fileNames = append(fileNames, Sink.Config.Path)
+	snapshots := []auditSnapshot{}
+	for _, fileName := range fileNames {
+		file, err := os.Open(fileName)
+		if err != nil {
+			if os.IsNotExist(err) {
+				continue
+			}
+			closeSnapshots(snapshots)
+			return nil, err
+		}
+		info, err := file.Stat()
+		if err != nil {
+			file.Close()
+			closeSnapshots(snapshots)
+			return nil, err
+		}
+		snapshots = append(snapshots, auditSnapshot{file: file, size: info.Size()})
+	}
+	return snapshots, nil
+}
+
+func closeSnapshots(snapshots []auditSnapshot) {
+	for _, snapshot := range snapshots {
+		snapshot.file.Close()
+	}
+}
+
+func (Sink *AuditFileSink) Query(filter AuditFilter) ([]rest.AuditEventV1, error) {
+	snapshots, err := Sink.snapshot()
+	if err != nil {
+		return nil, err
+	}
+	defer closeSnapshots(snapshots)
+	events := []rest.AuditEventV1{}
+	for _, snapshot := range snapshots {
+		scanner := bufio.NewScanner(io.LimitReader(snapshot.file, snapshot.size))
+		for scanner.Scan() {
+			var event rest.AuditEventV1
+			if json.Unmarshal(scanner.Bytes(), &event) != nil {
+				continue
+			}
+			if filter.Match(event) {
+				events = append(events, event)
+				if filter.Limit > 0 && len(events) > filter.Limit {
+					// Only the newest events are returned
+					events = events[1:]
+				}
+			}
+		}
+		if err := scanner.Err(); err != nil {
+			return nil, err
+		}
+	}
+	slices.Reverse(events)
+	return events, nil
+}
+
+func (Sink *AuditFileSink) Close() error {
+	Sink.mutex.Lock()
+	defer Sink.mutex.Unlock()
+	if Sink.file == nil {
+		return nil
+	}
+	return Sink.file.Close()
+}
+
+// AuditMemorySink keeps the latest events in memory when no file is used
+type AuditMemorySink struct {
+	mutex  sync.RWMutex
+	events []rest.AuditEventV1
+	next   int
+	full   bool
+}
+
+func NewAuditMemorySink(size int) *AuditMemorySink {
+	return &AuditMemorySink{events: make([]rest.AuditEventV1, size)}
+}
+
+func (Sink *AuditMemorySink) Write(event rest.AuditEventV1) error {
+	Sink.mutex.Lock()
+	defer Sink.mutex.Unlock()
+	Sink.events[Sink.next] = event
+	Sink.next = (Sink.next + 1) % len(Sink.events)
+	if Sink.next == 0 {
+		Sink.full = true
+	}
+	return nil
+}
+
+func (Sink *AuditMemorySink) Query(filter AuditFilter) ([]rest.AuditEventV1, error) {
+	Sink.mutex.RLock()
+	defer Sink.mutex.RUnlock()
+	count := Sink.next
+	if Sink.full {
+		count = len(Sink.events)
+	}
+	events := []rest.AuditEventV1{}
+	for i := 1; i <= count; i++ {
+		event := Sink.events[(Sink.next-i+len(Sink.events))%len(Sink.events)]
+		if filter.Match(event) {
+			events = append(events, event)
+			if filter.Limit > 0 && len(events) == filter.Limit {
+				break
+			}
+		}
+	}
+	return events, nil
+}
+
+func (Sink *AuditMemorySink) Close() error {
+	return nil
+}
+
+type AuditSyslogSink struct {
+	Writer *syslog.Writer
+}
+
+func (Sink *AuditSyslogSink) Write(event rest.AuditEventV1) error {
+	line, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+	if event.Outcome == rest.AuditOutcomeSuccess {
+		return Sink.Writer.Info(string(line))
+	}
+	return Sink.Writer.Warning(string(line))
+}
+
+func (Sink *AuditSyslogSink) Close() error {
+	return Sink.Writer.Close()
+}
+
+// AuditWebhookSink posts every event as json, events are queued so requests are not
+// held up by the webhook and dropped when the queue is full.
+type AuditWebhookSink struct {
+	Config ConfigAuditWebhook
+	client *http.Client
+	token  string
+	queue  chan rest.AuditEventV1
+	done   sync.WaitGroup
+}
+
+func NewAuditWebhookSink(config ConfigAuditWebhook) *AuditWebhookSink {
+	if config.QueueSize <= 0 {
+		config.QueueSize = 1
+	}
+	sink := &AuditWebhookSink{
+		Config: config,
+		client: &http.Client{Timeout: config.Timeout},
+		token:  os.Getenv(config.EnvVariableName),
+		queue:  make(chan rest.AuditEventV1, config.QueueSize),
+	}
+	sink.done.Add(1)
+	go sink.run()
+	return sink
+}
+
+func (Sink *AuditWebhookSink) run() {
+	defer Sink.done.Done()
+	for event := range Sink.queue {
+		err := Sink.post(event)
+		if err != nil {
+			logger.Error("Failed to post audit event", "function", "run", "struct", "AuditWebhookSink", "url", Sink.Config.URL, "error", err)
+		}
+	}
+}
+
+func (Sink *AuditWebhookSink) post(event rest.AuditEventV1) error {
+	body, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+	request, err := http.NewRequest(http.MethodPost, Sink.Config.URL, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	request.Header.Set("Content-Type", "application/json")
+	if Sink.token != "" {
+		request.Header.Set("Authorization", "Bearer "+Sink.token)
+	}
+	response, err := Sink.client.Do(request)
+	if err != nil {
+		return err
+	}
+	response.Body.Close()
+	if response.StatusCode >= 300 {
+		return fmt.Errorf("webhook returned %v", response.Status)
+	}
+	return nil
+}
+
+func (Sink *AuditWebhookSink) Write(event rest.AuditEventV1) error {
+	select {
+	case Sink.queue <- event:
+		return nil
+	default:
+		return fmt.Errorf("audit webhook queue full, event %v dropped", event.ID)
+	}
+}
+
+func (Sink *AuditWebhookSink) Close() error {
+	close(Sink.queue)
+	Sink.done.Wait()
+	return nil
+}
@@ -0,0 +1,196 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/SimonStiil/keyvaluedatabase/rest"
+)
+
+func TestAudit(t *testing.T) {
+	setupTestlogging()
+	App = new(Application)
+	t.Run("Initialize DB for Tests", func(t *testing.T) {
+		fileName := "testdb.yaml"
+		err := os.Remove(fileName)
+		if err != nil && !errors.Is(err, os.ErrNotExist) {
+			t.Fatal(err)
+		}
+		config := ConfigType{}
+		ConfigRead("example-config", &config)
+		App.Auth = Auth{}
+		App.Auth.Init(config)
+		App.DB = &YamlDatabase{DatabaseName: fileName}
+		App.DB.Init()
+		App.Count = &Counter{}
+		App.Count.Init(App.DB)
+		App.APIEndpoints = []API{&Systemv1{}, &APIv1{}}
+		App.Audit, err = NewAuditor(ConfigAudit{MemoryEvents: 10})
+		if err != nil {
+			t.Fatal(err)
+		}
+	})
+	defer func() { App.Audit = nil }()
+	secret := "topsecret"
+	send := func(method string, path string, body string, password string) int {
+		request, _ := http.NewRequest(method, path, strings.NewReader(body))
+		request.SetBasicAuth("user", password)
+		request.RemoteAddr = "127.0.0.1:434"
+		response := httptest.NewRecorder()
+		App.RootControllerV1(response, request)
+		return response.Code
+	}
+	t.Run("Audited requests", func(t *testing.T) {
+		if code := send(http.MethodPost, "/v1/audited/secret", secret, "password"); code != http.StatusCreated {
+			t.Errorf(".Code got %v, want %v", code, http.StatusCreated)
+		}
+		if code := send(http.MethodGet, "/v1/audited/secret", "", "password"); code != http.StatusOK {
+			t.Errorf(".Code got %v, want %v", code, http.StatusOK)
+		}
+		if code := send(http.MethodGet, "/v1/audited/secret", "", "wrong"); code != http.StatusUnauthorized {
+			t.Errorf(".Code got %v, want %v", code, http.StatusUnauthorized)
+		}
+		if code := send(http.MethodGet, "/system/health", "", ""); code != http.StatusOK {
+			t.Errorf(".Code got %v, want %v", code, http.StatusOK)
+		}
+	})
+	t.Run("Query requires admin", func(t *testing.T) {
+		if code := send(http.MethodGet, "/system/audit", "", "password"); code != http.StatusForbidden {
+			t.Errorf(".Code got %v, want %v", code, http.StatusForbidden)
+		}
+	})
+	t.Run("Query", func(t *testing.T) {
+		user := App.Auth.Users["user"]
+		user.Admin = true
+		App.Auth.Users["user"] = user
+		request, _ := http.NewRequest(http.MethodGet, "/system/audit?namespace=audited", nil)
+		request.SetBasicAuth("user", "password")
+		request.RemoteAddr = "127.0.0.1:434"
+		response := httptest.NewRecorder()
+		App.RootControllerV1(response, request)
+		if response.Code != http.StatusOK {
+			t.Fatalf(".Code got %v, want %v", response.Code, http.StatusOK)
+		}
+		if strings.Contains(response.Body.String(), secret) {
+			t.Errorf("Audit log contains value: %v", response.Body.String())
+		}
+		var events []rest.AuditEventV1
+		err := json.Unmarshal(response.Body.Bytes(), &events)
+		if err != nil {
+			t.Fatal(err)
+		}
+		expected := []struct{ action, outcome string }{
+			{"read", rest.AuditOutcomeDenied},
+			{"read", rest.AuditOutcomeSuccess},
+			{"write", rest.AuditOutcomeSuccess},
+		}
+		if len(events) != len(expected) {
+			t.Fatalf("Expected %v events got %+v", len(expected), events)
+		}
+		for i, want := range expected {
+			if events[i].Action != want.action || events[i].Outcome != want.outcome {
+				t.Errorf("Event %v got %v/%v, want %v/%v", i, events[i].Action, events[i].Outcome, want.action, want.outcome)
+			}
+			if events[i].User != "user" || events[i].IP != "127.0.0.1" || events[i].AuthMethod != "basic" || events[i].Key != "secret" {
+				t.Errorf("Event %v missing request details %+v", i, events[i])
+			}
+		}
+	})
+}
+
+func TestAuditFileSink(t *testing.T) {
+	setupTestlogging()
+	config := ConfigAuditFile{Path: filepath.Join(t.TempDir(), "audit.log"), MaxSize: 400, MaxBackups: 2}
+	sink, err := NewAuditFileSink(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sink.Close()
+	for i := 0; i < 10; i++ {
+		err = sink.Write(rest.AuditEventV1{Time: time.Now(), ID: uint32(i), User: "user", Namespace: "ns", Key: fmt.Sprint(i), Action: "read", Outcome: rest.AuditOutcomeSuccess})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	t.Run("rotated", func(t *testing.T) {
+		for _, fileName := range []string{config.Path, config.Path + ".1", config.Path + ".2"} {
+			info, err := os.Stat(fileName)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if info.Size() > config.MaxSize {
+				t.Errorf("%v larger than max size: %v", fileName, info.Size())
+			}
+		}
+		if _, err := os.Stat(config.Path + ".3"); err == nil {
+			t.Errorf("Expected at most %v backups", config.MaxBackups)
+		}
+	})
+	t.Run("query newest first", func(t *testing.T) {
+		events, err := sink.Query(AuditFilter{Limit: 2})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(events) != 2 || events[0].ID != 9 || events[1].ID != 8 {
+			t.Errorf("Expected events 9 and 8 got %+v", events)
+		}
+		events, _ = sink.Query(AuditFilter{Key: "7"})
+		if len(events) != 1 || events[0].ID != 7 {
+			t.Errorf("Expected event 7 got %+v", events)
+		}
+	})
+	t.Run("query while writing", func(t *testing.T) {
+		done := make(chan struct{})
+		go func() {
+			defer close(done)
+			for i := 10; i < 50; i++ {
+				sink.Write(rest.AuditEventV1{Time: time.Now(), ID: uint32(i), User: "user", Action: "read", Outcome: rest.AuditOutcomeSuccess})
+			}
+		}()
+		for range 20 {
+			events, err := sink.Query(AuditFilter{})
+			if err != nil {
+				t.Fatal(err)
+			}
+			for i := 1; i < len(events); i++ {
+				if events[i].ID >= events[i-1].ID {
+					t.Fatalf("Expected events newest first got %v after %v", events[i].ID, events[i-1].ID)
+				}
+			}
+		}
+		<-done
+	})
+	t.Run("rotate failure", func(t *testing.T) {
+		config := ConfigAuditFile{Path: filepath.Join(t.TempDir(), "audit.log"), MaxSize: 200, MaxBackups: 1}
+		if err := os.MkdirAll(filepath.Join(config.Path+".1", "blocked"), 0700); err != nil {
+			t.Fatal(err)
+		}
+		sink, err := NewAuditFileSink(config)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer sink.Close()
+		for i := 0; i < 5; i++ {
+			err = sink.Write(rest.AuditEventV1{Time: time.Now(), ID: uint32(i), User: "user", Action: "read", Outcome: rest.AuditOutcomeSuccess})
+			if err != nil {
+				t.Fatalf("Expected write to continue when rotation fails got %v", err)
+			}
+		}
+		content, err := os.ReadFile(config.Path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if lines := bytes.Count(content, []byte("\n")); lines != 5 {
+			t.Errorf("Expected 5 events in the audit log got %v", lines)
+		}
+	})
+}
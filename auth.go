@@ -17,6 +17,14 @@ type Auth struct {
 	Users       map[string]User
 	Config      ConfigType
 	HostHeaders []string
+	// Successful password verifications, nil disables caching
+	PasswordCache *PasswordCache
+	// API tokens, nil disables bearer authentication
+	Tokens *TokenStore
+	// JWT verification, nil disables JWT bearer authentication
+	JWT         *JWTVerifier
+	Roles       ConfigRoles
+	Groups      GroupBindings
 	Permissions struct {
 		ListFull *ConfigPermissions
 		List     *ConfigPermissions
@@ -28,14 +36,24 @@ var AnonymounsUser User
 // https://www.alexedwards.net/blog/basic-authentication-in-go
 // https://medium.com/@matryer/the-http-handler-wrapper-technique-in-golang-updated-bc7fbcffa702
 func (Auth *Auth) Authentication(request *RequestParameters) bool {
+	if request.Bearer.Ok {
+		if isJWT(request.Bearer.Token) {
+			return Auth.JWTAuthentication(request)
+		}
+		return Auth.TokenAuthentication(request)
+	}
 	user, ok := Auth.Users[request.Basic.Username]
 	debugLogger := request.Logger.Ext.With("function", "Authentication")
 	debugLogger.Debug(fmt.Sprintf("User in database : %v", ok), "found", ok)
+	if roles, bound := Auth.Groups.MTLS[request.Basic.Username]; bound && request.Authentication.Verified.mTLS {
+		debugLogger.Debug("Certificate bound by groups", "roles", roles)
+		user = user.WithRoles(roles, Auth.Roles)
+		ok = true
+	}
 	if ok {
 		request.Authentication.User = &user
 		if request.Basic.Ok {
-			passwordHash := AuthHash(request.Basic.Password)
-			if AuthTest(passwordHash, user.PasswordEnc) {
+			if Auth.PasswordCache.Verify(request.Basic.Username, &user.Password, request.Basic.Password) {
 				request.Authentication.Verified.Password = true
 			}
 			if user.HostAllowed(request.RequestIP, request.Logger.Ext) {
@@ -49,6 +67,59 @@ func (Auth *Auth) Authentication(request *RequestParameters) bool {
 	}
 	return false
 }
+
+// TokenAuthentication authenticates as the user owning the bearer token, limited to the scopes of the token
+func (Auth *Auth) TokenAuthentication(request *RequestParameters) bool {
+	debugLogger := request.Logger.Ext.With("function", "TokenAuthentication")
+	if Auth.Tokens == nil {
+		debugLogger.Debug("Bearer token without token store")
+		return false
+	}
+	token, err := Auth.Tokens.Verify(request.Context(), request.Bearer.Token)
+	if err != nil {
+		debugLogger.Debug("Token not valid", "error", err)
+		return false
+	}
+	user, ok := Auth.Users[token.User]
+	debugLogger.Debug(fmt.Sprintf("Token user in database : %v", ok), "found", ok, "token", token.ID)
+	if !ok {
+		return false
+	}
+	user.Admin = false
+	user.Scope = token.ScopeUser()
+	request.Authentication.User = &user
+	request.Authentication.Username = token.User
+	request.Authentication.Token = token
+	request.Authentication.Verified.Token = true
+	if user.HostAllowed(request.RequestIP, request.Logger.Ext) {
+		request.Authentication.Verified.Host = true
+	}
+	return request.Authentication.Verified.Ok()
+}
+
+// JWTAuthentication authenticates workloads with a signed JWT, permissions are mapped from the claims
+func (Auth *Auth) JWTAuthentication(request *RequestParameters) bool {
+	debugLogger := request.Logger.Ext.With("function", "JWTAuthentication")
+	if Auth.JWT == nil {
+		debugLogger.Debug("JWT without jwt configuration")
+		return false
+	}
+	claims, err := Auth.JWT.Verify(request.Bearer.Token)
+	if err != nil {
+		debugLogger.Debug("JWT not valid", "error", err)
+		return false
+	}
+	user, username := Auth.JWT.User(claims)
+	if roles, bound := Auth.Groups.Subjects[username]; bound {
+		*user = user.WithRoles(roles, Auth.Roles)
+	}
+	debugLogger.Debug("JWT verified", "subject", username, "rules", user.Rules)
+	request.Authentication.User = user
+	request.Authentication.Username = username
+	request.Authentication.Verified.JWT = true
+	return request.Authentication.Verified.Ok()
+}
+
 func (Auth *Auth) NoAuth(permissions *ConfigPermissions) bool {
 	return !permissions.List && !permissions.Read && !permissions.Write
 }
@@ -59,15 +130,30 @@ func (User *User) Autorization(request *RequestParameters, permissions *ConfigPe
 		debugLogger.Debug("Skipping Auth for system api")
 		return true
 	}
-	userPermissions, ok := User.Permissions[request.Namespace]
+	if request.Namespace == BatchNamespace && request.Key == "" && request.Method == "POST" {
+		debugLogger.Debug("Skipping Auth for batch, operations are authorized one by one")
+		return true
+	}
+	var userPermissions ConfigPermissions
+	var pattern string
+	keyRequest := request.Key != "" && request.Key != "*"
+	if keyRequest {
+		userPermissions, pattern = User.KeyPermissions(request.Namespace, request.Key)
+	} else {
+		userPermissions, pattern = User.NamespacePermissions(request.Namespace)
+	}
 	debugLogger.Debug("Testing User Permissions",
 		"userPermissions", userPermissions, "expectedPermissions", permissions,
-		"gobal", !ok)
-	if ok {
-		return AuthTestPermission(userPermissions, *permissions)
-	} else {
-		return AuthTestPermission(User.GlobalPermissions, *permissions)
+		"pattern", pattern, "roles", User.Roles, "scoped", User.Scope != nil)
+	allowed := AuthTestPermission(userPermissions, *permissions)
+	if !allowed && !keyRequest && !permissions.Write {
+		// Listing is allowed with permissions for some keys, the keys are filtered by the handler
+		allowed = AuthTestPermission(mergePermissions(userPermissions, User.KeyRulePermissions(request.Namespace)), *permissions)
 	}
+	if allowed && User.Scope != nil {
+		return User.Scope.Autorization(request, permissions)
+	}
+	return allowed
 }
 
 func (Auth *Auth) GetIPHeaderFromRequest(request *RequestParameters) (string, string) {
@@ -113,29 +199,35 @@ func AuthTest(test [32]byte, fact [32]byte) bool {
 func AuthEncode(data [32]byte) string {
 	return b64.StdEncoding.EncodeToString(data[:])
 }
-func AuthDecode(data string) [32]byte {
+func AuthDecode(data string) ([32]byte, error) {
+	byteArray := [32]byte{}
 	bytes, err := b64.StdEncoding.DecodeString(data)
-
 	if err != nil {
-		panic(err)
+		return byteArray, &ErrInvalidConfig{Value: "password hash", Err: err}
 	}
 	if len(bytes) != 32 {
-		panic(fmt.Sprintf("E wrong datalength %d should be 32", len(bytes)))
+		return byteArray, &ErrInvalidConfig{Value: "password hash", Err: fmt.Errorf("wrong datalength %d should be 32", len(bytes))}
 	}
-	byteArray := [32]byte{}
 	copy(byteArray[:], bytes)
-	return byteArray
+	return byteArray, nil
 }
 func (Auth *Auth) AuthGenerate(generate string, test string) {
 	if generate != "" {
-		hash := AuthHash(generate)
-		encodedHash := AuthEncode(hash)
-		logger.Debug("encodedHash: "+encodedHash, "function", "AuthGenerate", "struct", "Auth")
 		if test == "" {
+			encodedHash, err := AuthHashPassword(generate)
+			if err != nil {
+				logger.Error("Unable to hash password", "function", "AuthGenerate", "struct", "Auth", "error", err)
+				os.Exit(1)
+			}
+			logger.Debug("encodedHash: "+encodedHash, "function", "AuthGenerate", "struct", "Auth")
 			fmt.Println(encodedHash)
 		} else {
-			testHash := AuthDecode(test)
-			success := AuthTest(testHash, hash)
+			testHash, err := ParsePasswordHash(test)
+			if err != nil {
+				logger.Error("Unable to parse password hash", "function", "AuthGenerate", "struct", "Auth", "error", err)
+				os.Exit(1)
+			}
+			success := testHash.Verify(generate)
 			fmt.Println("Test: ", success)
 		}
 		os.Exit(0)
@@ -143,6 +235,7 @@ func (Auth *Auth) AuthGenerate(generate string, test string) {
 }
 func (Auth *Auth) Init(config ConfigType) {
 	Auth.Config = config
+	Auth.PasswordCache = NewPasswordCache(config.PasswordCacheTTL)
 	Auth.LoadConfig(config)
 	logger.Debug(fmt.Sprintf("Auth.Users: %+v", Auth.Users), "function", "Init", "struct", "Auth")
 	logger.Debug(fmt.Sprintf("Loaded %v users", len(Auth.Users)), "function", "Init", "struct", "Auth")
@@ -161,21 +254,35 @@ func (Auth *Auth) Init(config ConfigType) {
 }
 
 func (Auth *Auth) LoadConfig(config ConfigType) {
+	Auth.Roles = config.Roles
+	Auth.Groups = NewGroupBindings(config.Groups)
 	users := make(map[string]User)
 	for _, v := range config.Users {
-		users[v.Username] = AuthUnpack(v)
+		user, err := AuthUnpack(v)
+		if err != nil {
+			// The other users can still login
+			logger.Error("Skipping user", "function", "LoadConfig", "struct", "Auth", "user", v.Username, "error", err)
+			continue
+		}
+		users[v.Username] = user.WithRoles(append(v.Roles, Auth.Groups.Users[v.Username]...), Auth.Roles)
 	}
 	Auth.Users = users
+	Auth.PasswordCache.Clear()
 	Auth.Permissions.ListFull = &ConfigPermissions{List: true, Read: true}
 	Auth.Permissions.List = &ConfigPermissions{List: true}
 	logger.Debug(fmt.Sprintf("Loaded %v users", len(Auth.Users)), "function", "Init", "struct", "Auth")
 }
 
 type User struct {
-	PasswordEnc       [32]byte
-	Permissions       map[string]ConfigPermissions
-	GlobalPermissions ConfigPermissions
-	Hosts             []string
+	Password PasswordHash
+	Rules    []PermissionRule
+	Hosts    []string
+	Admin    bool
+	Roles    []string
+	// Permissionsset holds the sets of the user and its roles, compiled into Rules
+	Permissionsset []ConfigPermissionsset
+	// Scope limits the permissions further when authenticated with an API token
+	Scope *User
 }
 
 func (User *User) HostAllowed(address string, dLogger *slog.Logger) bool {
@@ -216,27 +323,25 @@ func (User *User) HostAllowed(address string, dLogger *slog.Logger) bool {
 	return false
 }
 
-func AuthUnpack(Data ConfigUser) User {
+// AuthUnpack returns ErrInvalidConfig when the password of the user is not a valid hash
+func AuthUnpack(Data ConfigUser) (User, error) {
 
 	logger.Debug("ReadingUser", "user", Data.Username, "function", "AuthUnpack")
+	password, err := ParsePasswordHash(Data.Password)
+	if err != nil {
+		return User{}, &ErrInvalidConfig{Value: "password of " + Data.Username, Err: err}
+	}
+	if password.Legacy() {
+		logger.Warn("User has a legacy SHA-256 password hash, replace it with the output of -generate", "user", Data.Username, "function", "AuthUnpack")
+	}
 	user := User{
-		PasswordEnc: AuthDecode(Data.Password),
-		Permissions: make(map[string]ConfigPermissions),
-		Hosts:       Data.Hosts,
+		Password: password,
+		Hosts:    Data.Hosts,
+		Admin:    Data.Admin,
 	}
 	logger.Debug("Reading Permissionsset", "user", Data.Username, "function", "AuthUnpack", "size", len(Data.Permissionsset))
-	for _, permissionset := range Data.Permissionsset {
-
-		logger.Debug("Reading Permissionsset for Namespaces", "user", Data.Username, "function", "AuthUnpack", "size", len(permissionset.Namespaces), "namespaces", permissionset.Namespaces, "permissions", permissionset.Permissions)
-		for _, namespace := range permissionset.Namespaces {
-			if namespace == "*" {
-				user.GlobalPermissions = permissionset.Permissions
-			} else {
-				user.Permissions[namespace] = permissionset.Permissions
-			}
-		}
-	}
-	return user
+	user.SetPermissions(Data.Permissionsset)
+	return user, nil
 }
 
 func AuthTestPermission(permission ConfigPermissions, expected ConfigPermissions) bool {
@@ -4,6 +4,9 @@ import (
 	"fmt"
 	"net"
 	"testing"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
 )
 
 type HostCheckTest struct {
@@ -25,7 +28,10 @@ func Test_Auth(t *testing.T) {
 		expectedData := "hello"
 		base := "LPJNul+wow4m6DsqxbninhsWHlwfp0JecwQzYpOLmCQ="
 		expected := AuthHash(expectedData)
-		hash := AuthDecode(base)
+		hash, err := AuthDecode(base)
+		if err != nil {
+			t.Fatalf("Decoding failed %v", err)
+		}
 		result := AuthTest(hash, expected)
 		if !result {
 			t.Errorf("Decoding Test failed got %v, expected %v", expected, hash)
@@ -43,12 +49,172 @@ func Test_Auth(t *testing.T) {
 		if !ok {
 			t.Errorf("unable to read user %v - %v", ExampleUsername, user)
 		}
-		ok = AuthTest(user.PasswordEnc, AuthHash(ExamplePassword))
+		ok = user.Password.Verify(ExamplePassword)
 		if !ok {
 			t.Errorf("Password did not match for %v / %v", ExampleUsername, ExamplePassword)
 		}
 	})
 
+	t.Run("PHC Password Hashes", func(t *testing.T) {
+		encoded, err := AuthHashPassword("hello")
+		if err != nil {
+			t.Fatal(err)
+		}
+		bcryptHash, err := bcrypt.GenerateFromPassword([]byte("hello"), bcrypt.MinCost)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, test := range []string{encoded, string(bcryptHash), "LPJNul+wow4m6DsqxbninhsWHlwfp0JecwQzYpOLmCQ="} {
+			hash, err := ParsePasswordHash(test)
+			if err != nil {
+				t.Fatalf("Unable to parse %v: %v", test, err)
+			}
+			if !hash.Verify("hello") {
+				t.Errorf("Password did not match for %v", test)
+			}
+			if hash.Verify("world") {
+				t.Errorf("Wrong password matched for %v", test)
+			}
+		}
+		for _, test := range []string{"$argon2id$v=19$m=19456$salt", "$2b$broken", "aGVsbG8=",
+			"$argon2id$v=19$m=19456,t=2,p=0$c2FsdHNhbHQ$a2V5a2V5", "$argon2id$v=19$m=19456,t=0,p=1$c2FsdHNhbHQ$a2V5a2V5",
+			"$argon2id$v=19$m=4294967295,t=2,p=1$c2FsdHNhbHQ$a2V5a2V5", "$argon2id$v=19$m=19456,t=2,p=1$$a2V5a2V5",
+			"$argon2id$v=19$m=19456,t=2,p=1$c2FsdHNhbHQ$"} {
+			if _, err := ParsePasswordHash(test); err == nil {
+				t.Errorf("Expected error parsing %v", test)
+			}
+		}
+	})
+	t.Run("Password Cache", func(t *testing.T) {
+		cache := NewPasswordCache(time.Minute)
+		encoded, _ := AuthHashPassword("hello")
+		hash, _ := ParsePasswordHash(encoded)
+		if !cache.Verify("user", &hash, "hello") {
+			t.Errorf("Password did not match")
+		}
+		if _, ok := cache.entries["user"]; !ok {
+			t.Errorf("Expected verification to be cached")
+		}
+		if !cache.Verify("user", &hash, "hello") {
+			t.Errorf("Cached password did not match")
+		}
+		if cache.Verify("user", &hash, "world") {
+			t.Errorf("Wrong password matched with cache")
+		}
+		other, _ := AuthHashPassword("other")
+		otherHash, _ := ParsePasswordHash(other)
+		if cache.Verify("user", &otherHash, "hello") {
+			t.Errorf("Cached verification used for a changed password hash")
+		}
+	})
+
+	t.Run("Malformed Password", func(t *testing.T) {
+		_, err := AuthDecode("not base64")
+		if _, ok := err.(*ErrInvalidConfig); !ok {
+			t.Errorf("Expected ErrInvalidConfig got %v", err)
+		}
+		password, _ := AuthHashPassword("password")
+		config := ConfigType{Users: []ConfigUser{
+			{Username: "broken", Password: "$argon2id$broken"},
+			{Username: "working", Password: password},
+		}}
+		auth := &Auth{PasswordCache: NewPasswordCache(0)}
+		auth.LoadConfig(config)
+		if _, ok := auth.Users["broken"]; ok {
+			t.Errorf("User with a malformed password should be skipped")
+		}
+		if _, ok := auth.Users["working"]; !ok {
+			t.Errorf("Other users should still be loaded")
+		}
+	})
+	t.Run("Roles And Groups", func(t *testing.T) {
+		password, _ := AuthHashPassword("password")
+		config := ConfigType{
+			Roles: ConfigRoles{
+				"reader": {{Namespaces: []string{"*"}, Permissions: ConfigPermissions{Read: true, List: true}}},
+				"writer": {{Namespaces: []string{"shared"}, Permissions: ConfigPermissions{Write: true}}},
+			},
+			Groups: []ConfigGroup{
+				{Name: "team", Roles: []string{"Writer"}, Users: []string{"alice"}, MTLS: []string{"service.example.com"}},
+			},
+			Users: []ConfigUser{
+				{Username: "alice", Password: password, Roles: []string{"reader", "unknown"}},
+			},
+		}
+		auth := &Auth{}
+		auth.LoadConfig(config)
+		alice := auth.Users["alice"]
+		if len(alice.Roles) != 2 {
+			t.Errorf("Expected roles reader and writer got %v", alice.Roles)
+		}
+		request := &RequestParameters{Namespace: "other"}
+		request.Logger.Ext = debugLogger
+		if !alice.Autorization(request, &ConfigPermissions{Read: true, List: true}) {
+			t.Errorf("Expected read from role reader")
+		}
+		if alice.Autorization(request, &ConfigPermissions{Write: true}) {
+			t.Errorf("Unexpected write outside role writer")
+		}
+		request.Namespace = "shared"
+		if !alice.Autorization(request, &ConfigPermissions{Write: true}) {
+			t.Errorf("Expected write from group role writer")
+		}
+		if alice.Autorization(request, &ConfigPermissions{Read: true}) {
+			t.Errorf("Expected namespace permissions to replace global permissions")
+		}
+		certificate := &RequestParameters{Namespace: "shared"}
+		certificate.Logger.Ext = debugLogger
+		certificate.Basic.Username = "service.example.com"
+		certificate.Basic.Ok = true
+		certificate.Authentication.Verified.mTLS = true
+		if !auth.Authentication(certificate) {
+			t.Fatalf("Expected certificate bound by group to authenticate")
+		}
+		if !certificate.Authentication.User.Autorization(certificate, &ConfigPermissions{Write: true}) {
+			t.Errorf("Expected write for certificate bound by group")
+		}
+		certificate.Authentication.Verified.mTLS = false
+		if auth.Authentication(certificate) {
+			t.Errorf("Unexpected authentication without verified certificate")
+		}
+	})
+
+	t.Run("Namespace Patterns", func(t *testing.T) {
+		all := ConfigPermissions{Read: true, Write: true, List: true}
+		user := User{}
+		user.SetPermissions([]ConfigPermissionsset{
+			{Namespaces: []string{"*"}, Permissions: ConfigPermissions{List: true}},
+			{Namespaces: []string{"team-a-*"}, Permissions: all},
+			{Namespaces: []string{"team-a-prod"}, Permissions: ConfigPermissions{Write: true}, Deny: true},
+			{Namespaces: []string{"team-a-secret*"}, Deny: true},
+			{Namespaces: []string{"team-b"}, Permissions: ConfigPermissions{Read: true}},
+			{Namespaces: []string{"broken["}, Permissions: all},
+		})
+		expected := map[string]ConfigPermissions{
+			"other":          {List: true},
+			"team-a-dev":     all,
+			"team-a-prod":    {Read: true, List: true},
+			"team-a-secrets": {},
+			"team-b":         {Read: true},
+			"team-b-dev":     {List: true},
+			"broken[":        {List: true},
+		}
+		for namespace, want := range expected {
+			got, pattern := user.NamespacePermissions(namespace)
+			if got != want {
+				t.Errorf("Permissions for %v got %+v from %v, want %+v", namespace, got, pattern, want)
+			}
+		}
+		if patternSpecificity("team-a-*") <= patternSpecificity("team-*") || patternSpecificity("team-a") <= patternSpecificity("team-a*") {
+			t.Errorf("Unexpected pattern specificity")
+		}
+		jwtUser := User{}
+		jwtUser.SetPermissions([]ConfigPermissionsset{{Namespaces: []string{escapeNamespacePattern("*")}, Permissions: all}})
+		if got, _ := jwtUser.NamespacePermissions("team-a-dev"); got != (ConfigPermissions{}) {
+			t.Errorf("Escaped pattern matched other namespace %+v", got)
+		}
+	})
+
 	t.Run("Test Permissions", func(t *testing.T) {
 		none := ConfigPermissions{}
 		write := ConfigPermissions{Write: true}
@@ -0,0 +1,316 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/SimonStiil/keyvaluedatabase/rest"
+	"github.com/spf13/viper"
+)
+
+type ConfigBackup struct {
+	Enabled                   bool          `mapstructure:"enabled"`
+	Schedule                  string        `mapstructure:"schedule"`       // Cron expression or @every <duration>
+	Directory                 string        `mapstructure:"directory"`      // Directory of the filesystem snapshot store
+	Format                    string        `mapstructure:"format"`         // jsonl or tar, see Export
+	RetentionCount            int           `mapstructure:"retentionCount"` // Snapshots kept, 0 for no limit
+	RetentionAge              time.Duration `mapstructure:"retentionAge"`   // Snapshots older are deleted, 0 for no limit
+	PassphraseEnvVariableName string        `mapstructure:"passphraseEnvVariableName"`
+}
+
+func BackupGetDefaults(configReader *viper.Viper) {
+	configReader.SetDefault("backup.enabled", false)
+	configReader.SetDefault("backup.schedule", "0 2 * * *")
+	configReader.SetDefault("backup.directory", "backups")
+	configReader.SetDefault("backup.format", string(rest.ArchiveJSONLines))
+	configReader.SetDefault("backup.retentionCount", 7)
+	configReader.SetDefault("backup.retentionAge", "0s")
+	configReader.SetDefault("backup.passphraseEnvVariableName", BaseENVname+"_BACKUP_PASSPHRASE")
+}
+
+const snapshotPrefix = "kvdb-snapshot-"
+
+// lastSnapshot is the unix time of the newest successful snapshot, 0 before the first one
+var lastSnapshot atomic.Int64
+
+// SnapshotStore keeps snapshots, it can be implemented for object stores.
+// FileSnapshotStore keeps them in a local directory.
+type SnapshotStore interface {
+	Put(name string, content io.Reader) error
+	Get(name string) (io.ReadCloser, error)
+	List() (rest.SnapshotListV1, error)
+	Delete(name string) error
+}
+
+type FileSnapshotStore struct {
+	Directory string
+}
+
+func NewFileSnapshotStore(directory string) (*FileSnapshotStore, error) {
+	err := os.MkdirAll(directory, 0700)
+	if err != nil {
+		return nil, err
+	}
+	return &FileSnapshotStore{Directory: directory}, nil
+}
+
+// path returns the file of name, names with a path are rejected
+func (Store *FileSnapshotStore) path(name string) (string, error) {
+	if name == "" || name != filepath.Base(name) || strings.HasPrefix(name, ".") {
+		return "", &ErrMalformRequest{Value: "invalid snapshot name"}
+	}
+	return filepath.Join(Store.Directory, name), nil
+}
+
+// Put writes content to a temporary file that is renamed when complete, so List never sees a partial snapshot
+func (Store *FileSnapshotStore) Put(name string, content io.Reader) error {
+	path, err := Store.path(name)
+	if err != nil {
+		return err
+	}
+	file, err := os.CreateTemp(Store.Directory, "."+name+".*.tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(file.Name())
+	_, err = io.Copy(file, content)
+	if err == nil {
+		err = file.Sync()
+	}
+	closeErr := file.Close()
+	if err != nil {
+		return err
+	}
+	if closeErr != nil {
+		return closeErr
+	}
+	return os.Rename(file.Name(), path)
+}
+
+func (Store *FileSnapshotStore) Get(name string) (io.ReadCloser, error) {
+	path, err := Store.path(name)
+	if err != nil {
+		return nil, err
+	}
+	file, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return nil, &ErrNotFound{Value: name}
+	}
+	return file, err
+}
+
+// List returns the snapshots newest first
+func (Store *FileSnapshotStore) List() (rest.SnapshotListV1, error) {
+	entries, err := os.ReadDir(Store.Directory)
+	if err != nil {
+		return nil, err
+	}
+	snapshots := rest.SnapshotListV1{}
+	for _, entry := range entries {
+		if !entry.Type().IsRegular() || !strings.HasPrefix(entry.Name(), snapshotPrefix) {
+			continue
+		}
+		info, err := entry.Info()
+		if err != nil {
+			continue
+		}
+		snapshots = append(snapshots, rest.SnapshotV1{Name: entry.Name(), Size: info.Size(), Created: info.ModTime().UTC()})
+	}
+	sortSnapshots(snapshots)
+	return snapshots, nil
+}
+
+func (Store *FileSnapshotStore) Delete(name string) error {
+	path, err := Store.path(name)
+	if err != nil {
+		return err
+	}
+	err = os.Remove(path)
+	if os.IsNotExist(err) {
+		return &ErrNotFound{Value: name}
+	}
+	return err
+}
+
+// sortSnapshots sorts newest first
+func sortSnapshots(snapshots rest.SnapshotListV1) {
+	slices.SortFunc(snapshots, func(a rest.SnapshotV1, b rest.SnapshotV1) int {
+		if created := b.Created.Compare(a.Created); created != 0 {
+			return created
+		}
+		return strings.Compare(b.Name, a.Name)
+	})
+}
+
+type countingReader struct {
+	io.Reader
+	Count int64
+}
+
+func (Reader *countingReader) Read(data []byte) (int, error) {
+	n, err := Reader.Reader.Read(data)
+	Reader.Count += int64(n)
+	return n, err
+}
+
+// Backups takes snapshots of DB on Schedule and removes the ones outside the retention
+type Backups struct {
+	DB         Database
+	Store      SnapshotStore
+	Schedule   Schedule
+	Options    ArchiveOptions
+	Count      int
+	Age        time.Duration
+	mutex      sync.Mutex // One snapshot or restore at a time
+	stop       chan struct{}
+	stopped    sync.WaitGroup
+	lastNumber int64
+}
+
+func NewBackups(config ConfigBackup, DB Database) (*Backups, error) {
+	schedule, err := ParseSchedule(config.Schedule)
+	if err != nil {
+		return nil, err
+	}
+	store, err := NewFileSnapshotStore(config.Directory)
+	if err != nil {
+		return nil, err
+	}
+	options := ArchiveOptions{Format: rest.ArchiveFormat(config.Format), Passphrase: os.Getenv(config.PassphraseEnvVariableName)}
+	err = options.Validate()
+	if err != nil {
+		return nil, err
+	}
+	return &Backups{DB: DB, Store: store, Schedule: schedule, Options: options, Count: config.RetentionCount, Age: config.RetentionAge}, nil
+}
+
+func (Backups *Backups) Start() {
+	snapshots, err := Backups.Store.List()
+	if err == nil && len(snapshots) > 0 {
+		lastSnapshot.Store(snapshots[0].Created.Unix())
+	}
+	Backups.stop = make(chan struct{})
+	Backups.stopped.Add(1)
+	go Backups.run()
+}
+
+func (Backups *Backups) run() {
+	defer Backups.stopped.Done()
+	for {
+		next := Backups.Schedule.Next(time.Now())
+		if next.IsZero() {
+			logger.Error("Backup schedule never fires, no snapshots are taken", "function", "run", "struct", "Backups")
+			return
+		}
+		logger.Debug("Next snapshot", "function", "run", "struct", "Backups", "time", next)
+		timer := time.NewTimer(time.Until(next))
+		select {
+		case <-Backups.stop:
+			timer.Stop()
+			return
+		case <-timer.C:
+			Backups.Snapshot(context.Background())
+		}
+	}
+}
+
+// Stop waits for a running snapshot to finish
+func (Backups *Backups) Stop() {
+	if Backups.stop != nil {
+		close(Backups.stop)
+		Backups.stopped.Wait()
+		Backups.stop = nil
+	}
+}
+
+// Snapshot exports the database to the store and applies the retention
+func (Backups *Backups) Snapshot(ctx context.Context) (rest.SnapshotV1, error) {
+	Backups.mutex.Lock()
+	defer Backups.mutex.Unlock()
+	started := time.Now()
+	snapshot := rest.SnapshotV1{Name: Backups.snapshotName(started), Created: started.UTC()}
+	reader, writer := io.Pipe()
+	go func() {
+		_, err := Export(ctx, Backups.DB, writer, Backups.Options)
+		writer.CloseWithError(err)
+	}()
+	content := &countingReader{Reader: reader}
+	err := Backups.Store.Put(snapshot.Name, content)
+	reader.CloseWithError(err)
+	snapshot.Size = content.Count
+	backupDuration.Set(time.Since(started).Seconds())
+	if err != nil {
+		backupSnapshots.WithLabelValues("failure").Inc()
+		logger.Error("Snapshot failed", "function", "Snapshot", "struct", "Backups", "name", snapshot.Name, "error", err)
+		return snapshot, err
+	}
+	backupSnapshots.WithLabelValues("success").Inc()
+	lastSnapshot.Store(started.Unix())
+	logger.Info("Snapshot taken", "function", "Snapshot", "struct", "Backups", "name", snapshot.Name, "duration", time.Since(started))
+	err = Backups.prune()
+	if err != nil {
+		logger.Error("Unable to remove old snapshots", "function", "Snapshot", "struct", "Backups", "error", err)
+	}
+	return snapshot, nil
+}
+
+// snapshotName is unique also for snapshots taken within the same second
+func (Backups *Backups) snapshotName(started time.Time) string {
+	number := started.UnixMilli()
+	if number <= Backups.lastNumber {
+		number = Backups.lastNumber + 1
+	}
+	Backups.lastNumber = number
+	name := fmt.Sprintf("%v%v-%03d.%v", snapshotPrefix, time.UnixMilli(number).UTC().Format("20060102T150405"), number%1000, Backups.Options.Format)
+	if Backups.Options.Passphrase != "" {
+		name += ".enc"
+	}
+	return name
+}
+
+// prune deletes snapshots beyond Count and older than Age, the newest snapshot is always kept
+func (Backups *Backups) prune() error {
+	snapshots, err := Backups.Store.List()
+	if err != nil {
+		return err
+	}
+	for i, snapshot := range snapshots {
+		if i == 0 {
+			continue
+		}
+		if (Backups.Count > 0 && i >= Backups.Count) || (Backups.Age > 0 && time.Since(snapshot.Created) > Backups.Age) {
+			logger.Debug("Removing snapshot", "function", "prune", "struct", "Backups", "name", snapshot.Name)
+			err = Backups.Store.Delete(snapshot.Name)
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func (Backups *Backups) List() (rest.SnapshotListV1, error) {
+	return Backups.Store.List()
+}
+
+// Restore imports the snapshot name into the database
+func (Backups *Backups) Restore(ctx context.Context, name string, mode rest.ImportMode) (rest.ImportResultV1, error) {
+	Backups.mutex.Lock()
+	defer Backups.mutex.Unlock()
+	content, err := Backups.Store.Get(name)
+	if err != nil {
+		return rest.ImportResultV1{}, err
+	}
+	defer content.Close()
+	result, err := Import(ctx, Backups.DB, content, mode, Backups.Options.Passphrase)
+	logger.Info("Snapshot restored", "function", "Restore", "struct", "Backups", "name", name, "mode", mode, "imported", result.Imported, "error", err)
+	return result, err
+}
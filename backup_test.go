@@ -0,0 +1,178 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/SimonStiil/keyvaluedatabase/rest"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestSchedule(t *testing.T) {
+	start := time.Date(2024, time.January, 31, 10, 30, 15, 0, time.UTC)
+	tests := []struct {
+		expression string
+		next       time.Time
+	}{
+		{"* * * * *", time.Date(2024, time.January, 31, 10, 31, 0, 0, time.UTC)},
+		{"0 2 * * *", time.Date(2024, time.February, 1, 2, 0, 0, 0, time.UTC)},
+		{"*/20 * * * *", time.Date(2024, time.January, 31, 10, 40, 0, 0, time.UTC)},
+		{"15 9-17/4 * * 1-5", time.Date(2024, time.January, 31, 13, 15, 0, 0, time.UTC)},
+		{"0 0 29 2 *", time.Date(2024, time.February, 29, 0, 0, 0, 0, time.UTC)},
+		{"0 0 1 * 7", time.Date(2024, time.February, 1, 0, 0, 0, 0, time.UTC)},
+		{"@weekly", time.Date(2024, time.February, 4, 0, 0, 0, 0, time.UTC)},
+		{"@every 90m", start.Add(90 * time.Minute)},
+	}
+	for _, test := range tests {
+		schedule, err := ParseSchedule(test.expression)
+		if err != nil {
+			t.Errorf("%v: unexpected error %v", test.expression, err)
+			continue
+		}
+		if next := schedule.Next(start); !next.Equal(test.next) {
+			t.Errorf("%v: next got %v, want %v", test.expression, next, test.next)
+		}
+	}
+	for _, expression := range []string{"", "* * * *", "60 * * * *", "* * 0 * *", "5-1 * * * *", "*/0 * * * *", "@every 1ms", "@often"} {
+		if _, err := ParseSchedule(expression); err == nil {
+			t.Errorf("%q: expected error", expression)
+		}
+	}
+	schedule, _ := ParseSchedule("0 0 31 2 *")
+	if next := schedule.Next(start); !next.IsZero() {
+		t.Errorf("Expected a schedule that never fires, got %v", next)
+	}
+}
+
+func Test_Backups(t *testing.T) {
+	setupTestlogging()
+	directory := t.TempDir()
+	DB := &YamlDatabase{DatabaseName: filepath.Join(directory, "backup.yaml")}
+	DB.Init()
+	DB.Set(context.Background(), "hello", "world", "value")
+	config := ConfigBackup{Schedule: "@every 1h", Directory: filepath.Join(directory, "snapshots"), Format: "tar", RetentionCount: 2}
+	backups, err := NewBackups(config, DB)
+	if err != nil {
+		t.Fatalf("Unable to setup backups: %v", err)
+	}
+	var first rest.SnapshotV1
+	t.Run("snapshot", func(t *testing.T) {
+		successes := testutil.ToFloat64(backupSnapshots.WithLabelValues("success"))
+		first, err = backups.Snapshot(context.Background())
+		if err != nil {
+			t.Fatalf("Snapshot failed: %v", err)
+		}
+		if first.Size == 0 || filepath.Ext(first.Name) != ".tar" {
+			t.Errorf("Unexpected snapshot %+v", first)
+		}
+		if testutil.ToFloat64(backupSnapshots.WithLabelValues("success")) != successes+1 {
+			t.Errorf("Expected success metric to increase")
+		}
+		if lastSnapshot.Load() == 0 {
+			t.Errorf("Expected last snapshot time to be set")
+		}
+	})
+	t.Run("retention count", func(t *testing.T) {
+		for i := 0; i < 3; i++ {
+			_, err := backups.Snapshot(context.Background())
+			if err != nil {
+				t.Fatalf("Snapshot failed: %v", err)
+			}
+		}
+		snapshots, err := backups.List()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(snapshots) != 2 {
+			t.Errorf("Expected 2 snapshots kept, got %+v", snapshots)
+		}
+		for _, snapshot := range snapshots {
+			if snapshot.Name == first.Name {
+				t.Errorf("Expected oldest snapshot removed")
+			}
+		}
+	})
+	t.Run("retention age", func(t *testing.T) {
+		snapshots, _ := backups.List()
+		old := time.Now().Add(-48 * time.Hour)
+		os.Chtimes(filepath.Join(config.Directory, snapshots[1].Name), old, old)
+		backups.Age = 24 * time.Hour
+		backups.Count = 0
+		backups.Snapshot(context.Background())
+		snapshots, _ = backups.List()
+		if len(snapshots) != 2 {
+			t.Errorf("Expected snapshot older than a day removed, got %+v", snapshots)
+		}
+	})
+	t.Run("restore", func(t *testing.T) {
+		snapshots, _ := backups.List()
+		DB.Set(context.Background(), "hello", "world", "changed")
+		result, err := backups.Restore(context.Background(), snapshots[0].Name, rest.ImportOverwrite)
+		if err != nil {
+			t.Fatalf("Restore failed: %v", err)
+		}
+		if result.Imported != 1 {
+			t.Errorf("Expected 1 key restored, got %+v", result)
+		}
+		if value, _ := DB.Get(context.Background(), "hello", "world"); value != "value" {
+			t.Errorf("Expected value restored, got %v", value)
+		}
+		_, err = backups.Restore(context.Background(), "../backup.yaml", rest.ImportOverwrite)
+		if _, ok := err.(*ErrMalformRequest); !ok {
+			t.Errorf("Expected ErrMalformRequest for a path, got %v", err)
+		}
+		_, err = backups.Restore(context.Background(), snapshotPrefix+"missing", rest.ImportOverwrite)
+		if _, ok := err.(*ErrNotFound); !ok {
+			t.Errorf("Expected ErrNotFound, got %v", err)
+		}
+	})
+	t.Run("failure metric", func(t *testing.T) {
+		failures := testutil.ToFloat64(backupSnapshots.WithLabelValues("failure"))
+		failing := &Backups{DB: DB, Store: &FileSnapshotStore{Directory: filepath.Join(directory, "missing")}, Options: ArchiveOptions{Format: rest.ArchiveJSONLines}}
+		_, err := failing.Snapshot(context.Background())
+		if err == nil {
+			t.Errorf("Expected snapshot to a missing directory to fail")
+		}
+		if testutil.ToFloat64(backupSnapshots.WithLabelValues("failure")) != failures+1 {
+			t.Errorf("Expected failure metric to increase")
+		}
+	})
+	t.Run("endpoints", func(t *testing.T) {
+		api := new(Systemv1)
+		App = new(Application)
+		App.DB = DB
+		App.Backups = backups
+		send := func(method string, url string) *httptest.ResponseRecorder {
+			request, _ := http.NewRequest(method, url, nil)
+			requestParameters := GetRequestParameters(request, 0)
+			requestParameters.Authentication.User = &User{Admin: true}
+			response := httptest.NewRecorder()
+			api.ApiController(response, requestParameters)
+			return response
+		}
+		response := send(http.MethodPost, "/system/backups")
+		if response.Code != http.StatusCreated {
+			t.Fatalf(".Code got %v, want %v", response.Code, http.StatusCreated)
+		}
+		response = send(http.MethodGet, "/system/backups")
+		var snapshots rest.SnapshotListV1
+		err := json.Unmarshal(response.Body.Bytes(), &snapshots)
+		if err != nil || len(snapshots) == 0 {
+			t.Fatalf("Expected snapshots, got %v %v", response.Body.String(), err)
+		}
+		response = send(http.MethodPost, "/system/backups/"+snapshots[0].Name+"/restore")
+		if response.Code != http.StatusOK {
+			t.Errorf(".Code got %v, want %v", response.Code, http.StatusOK)
+		}
+		response = send(http.MethodPost, "/system/backups/"+snapshotPrefix+"missing/restore")
+		if response.Code != http.StatusNotFound {
+			t.Errorf(".Code got %v, want %v", response.Code, http.StatusNotFound)
+		}
+	})
+}
@@ -0,0 +1,249 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/SimonStiil/keyvaluedatabase/rest"
+)
+
+// BatchNamespace is the path of the batch endpoint, /v1/_batch
+const BatchNamespace = "_batch"
+
+// Transaction is the view of the database inside Transactor.Transaction.
+// Reads see the writes made earlier in the same transaction.
+type Transaction interface {
+	Get(namespace string, key string) (string, error)
+	SetWithTTL(namespace string, key string, value string, ttl time.Duration) error
+	DeleteKey(namespace string, key string) error
+}
+
+// Databases that can apply several writes atomically implement Transactor.
+// The writes made by fn are only applied if fn returns nil, fn can be run again when the transaction is retried.
+type Transactor interface {
+	Transaction(ctx context.Context, fn func(tx Transaction) error) error
+	// Atomic is false when writes are applied one by one
+	Atomic() bool
+}
+
+// directTransaction applies writes one by one for databases without transactions
+type directTransaction struct {
+	DB  Database
+	ctx context.Context
+}
+
+func (Tx *directTransaction) Transaction(ctx context.Context, fn func(tx Transaction) error) error {
+	return fn(&directTransaction{DB: Tx.DB, ctx: ctx})
+}
+
+func (Tx *directTransaction) Atomic() bool {
+	return false
+}
+
+func (Tx *directTransaction) Get(namespace string, key string) (string, error) {
+	return Tx.DB.Get(Tx.ctx, namespace, key)
+}
+
+func (Tx *directTransaction) SetWithTTL(namespace string, key string, value string, ttl time.Duration) error {
+	return Tx.DB.SetWithTTL(Tx.ctx, namespace, key, value, ttl)
+}
+
+func (Tx *directTransaction) DeleteKey(namespace string, key string) error {
+	return Tx.DB.DeleteKey(Tx.ctx, namespace, key)
+}
+
+// transactor returns the Transactor for db and if its transactions are atomic
+func transactor(db Database) (Transactor, bool) {
+	if db, ok := db.(Transactor); ok {
+		return db, db.Atomic()
+	}
+	return &directTransaction{DB: db}, false
+}
+
+// batchError is the operation that aborted a batch
+type batchError struct {
+	Index int
+	Err   error
+}
+
+func (err *batchError) Error() string {
+	return fmt.Sprintf("batch operation %v: %v", err.Index, err.Err)
+}
+
+func (err *batchError) Unwrap() error {
+	return err.Err
+}
+
+func batchMethod(op rest.BatchOp) string {
+	switch op {
+	case rest.BatchGet:
+		return "GET"
+	case rest.BatchSet:
+		return "PUT"
+	case rest.BatchDelete:
+		return "DELETE"
+	}
+	return ""
+}
+
+// batchPrecondition evaluates ifMatch and ifNoneMatch of operation like the If-Match and If-None-Match headers
+func batchPrecondition(operation rest.BatchOperationV1, current string, exists bool) bool {
+	currentETag := ETag(current)
+	if operation.IfMatch != "" && (!exists || !etagMatches(operation.IfMatch, currentETag)) {
+		return false
+	}
+	if operation.IfNoneMatch != "" && exists && etagMatches(operation.IfNoneMatch, currentETag) {
+		return false
+	}
+	return true
+}
+
+// batchRequest returns the request of a single operation, used for authorization, history, metrics and the audit log
+func (api *APIv1) batchRequest(request *RequestParameters, operation rest.BatchOperationV1) *RequestParameters {
+	operationRequest := *request
+	operationRequest.Method = batchMethod(operation.Op)
+	operationRequest.Namespace = operation.Namespace
+	operationRequest.Key = operation.Key
+	operationRequest.Attachment = &rest.ObjectV1{Type: rest.TypeKey, Value: operation.Value, TTL: operation.TTL}
+	operationRequest.Logger.Ext = request.Logger.Ext.With("batch.op", operation.Op, "batch.namespace", operation.Namespace, "batch.key", operation.Key)
+	return &operationRequest
+}
+
+// batchAllowed validates and authorizes a single operation
+func (api *APIv1) batchAllowed(request *RequestParameters, operation rest.BatchOperationV1) int {
+	if request.Method == "" || operation.Namespace == "" || operation.Namespace == "*" || operation.Namespace == BatchNamespace ||
+		operation.Key == "" || operation.Key == "*" || operation.TTL < 0 {
+		return http.StatusBadRequest
+	}
+	if operation.Namespace == App.DB.GetSystemNS() {
+		return http.StatusForbidden
+	}
+	user := request.Authentication.User
+	if user == nil {
+		return http.StatusUnauthorized
+	}
+	if !user.Autorization(request, api.Permissions(request)) {
+		return http.StatusForbidden
+	}
+	return http.StatusOK
+}
+
+func (api *APIv1) batch(w http.ResponseWriter, request *RequestParameters) {
+	debugLogger := request.Logger.Ext.With("function", "batch")
+	batchRequest := rest.BatchRequestV1{}
+	err := json.NewDecoder(request.orgRequest.Body).Decode(&batchRequest)
+	operations := batchRequest.Operations
+	if err != nil || len(operations) == 0 || len(operations) > rest.BatchMaxOperations {
+		debugLogger.Debug("Invalid batch request", "error", err, "operations", len(operations))
+		App.WriteStatusMessage(http.StatusBadRequest, w, request)
+		return
+	}
+	status := http.StatusOK
+	requests := make([]*RequestParameters, len(operations))
+	response := rest.BatchResponseV1{Results: make([]rest.BatchResultV1, len(operations))}
+	for i, operation := range operations {
+		requests[i] = api.batchRequest(request, operation)
+		response.Results[i] = rest.BatchResultV1{Op: operation.Op, Namespace: operation.Namespace, Key: operation.Key, Status: http.StatusFailedDependency}
+		operationStatus := api.batchAllowed(requests[i], operation)
+		if operationStatus != http.StatusOK {
+			debugLogger.Debug("Batch operation rejected", "index", i, "status", operationStatus)
+			response.Results[i].Status = operationStatus
+			if status == http.StatusOK {
+				status = operationStatus
+			}
+		}
+	}
+	if status == http.StatusOK {
+		status = api.applyBatch(request, operations, &response)
+	}
+	for i, result := range response.Results {
+		if result.Op == rest.BatchSet && result.Status == http.StatusCreated {
+			api.recordVersion(requests[i], result.Key, operations[i].Value)
+		}
+		keys.WithLabelValues(result.Key, result.Namespace, requests[i].Method, App.PrometheusStatusTest(result.Status)).Inc()
+		if App.Audit != nil {
+			App.Audit.Record(requests[i], api.AuditAction(requests[i]), result.Status)
+		}
+	}
+	request.Logger.Log.Info("Handeled Reqeust", "status", status, "status-text", http.StatusText(status), "operations", len(operations), "applied", response.Applied)
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(response)
+}
+
+// applyBatch runs the operations in a transaction and returns the status of the batch
+func (api *APIv1) applyBatch(request *RequestParameters, operations []rest.BatchOperationV1, response *rest.BatchResponseV1) int {
+	debugLogger := request.Logger.Ext.With("function", "applyBatch")
+	db, atomic := transactor(App.DB)
+	response.Atomic = atomic
+	err := db.Transaction(request.Context(), func(tx Transaction) error {
+		for i, operation := range operations {
+			result := &response.Results[i]
+			current := ""
+			exists := false
+			if operation.Op == rest.BatchGet || operation.IfMatch != "" || operation.IfNoneMatch != "" {
+				var err error
+				current, err = tx.Get(operation.Namespace, operation.Key)
+				exists = err == nil
+				if _, ok := err.(*ErrNotFound); err != nil && !ok {
+					return &batchError{Index: i, Err: err}
+				}
+				if !batchPrecondition(operation, current, exists) {
+					return &batchError{Index: i, Err: &ErrPreconditionFailed{Value: operation.Key}}
+				}
+			}
+			var err error
+			switch operation.Op {
+			case rest.BatchGet:
+				result.Status = http.StatusNotFound
+				result.Value = ""
+				result.ETag = ""
+				if exists {
+					result.Status = http.StatusOK
+					result.Value = current
+					result.ETag = ETag(current)
+				}
+			case rest.BatchSet:
+				err = tx.SetWithTTL(operation.Namespace, operation.Key, operation.Value, time.Duration(operation.TTL)*time.Second)
+				result.Status = http.StatusCreated
+				result.ETag = ETag(operation.Value)
+			case rest.BatchDelete:
+				err = tx.DeleteKey(operation.Namespace, operation.Key)
+				result.Status = http.StatusOK
+			}
+			if err != nil {
+				return &batchError{Index: i, Err: err}
+			}
+		}
+		return nil
+	})
+	if err == nil {
+		// The writes create their namespaces in the transaction, so a failed batch leaves none behind
+		response.Applied = true
+		return http.StatusOK
+	}
+	debugLogger.Debug("Batch not applied", "atomic", atomic, "Error", err)
+	status := writeErrorStatus(err)
+	var failed *batchError
+	if errors.As(err, &failed) {
+		status = writeErrorStatus(failed.Err)
+	}
+	for i := range response.Results {
+		result := &response.Results[i]
+		switch {
+		case failed != nil && i == failed.Index:
+			result.Status = status
+			result.ETag = ""
+		case atomic || failed == nil || i > failed.Index:
+			// Nothing of an atomic batch is applied
+			result.Status = http.StatusFailedDependency
+			result.Value = ""
+			result.ETag = ""
+		}
+	}
+	return status
+}
@@ -0,0 +1,228 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"slices"
+	"strings"
+	"testing"
+
+	"github.com/SimonStiil/keyvaluedatabase/rest"
+)
+
+// testTransaction verifies that a Transactor applies all writes of a transaction or none
+func testTransaction(t *testing.T, db Database, namespace string) {
+	transactor, ok := db.(Transactor)
+	if !ok {
+		t.Fatalf("%T does not implement Transactor", db)
+	}
+	db.CreateNamespace(context.Background(), namespace)
+	db.Set(context.Background(), namespace, "existing", "old")
+	db.DeleteKey(context.Background(), namespace, "new")
+	err := transactor.Transaction(context.Background(), func(tx Transaction) error {
+		tx.SetWithTTL(namespace, "new", "value", 0)
+		tx.DeleteKey(namespace, "existing")
+		value, err := tx.Get(namespace, "new")
+		if err != nil || value != "value" {
+			t.Errorf("Write not visible in transaction got %v, %v", value, err)
+		}
+		return errors.New("abort")
+	})
+	if err == nil {
+		t.Errorf("Expected error from aborted transaction")
+	}
+	if _, err := db.Get(context.Background(), namespace, "new"); err == nil {
+		t.Errorf("Write of aborted transaction applied")
+	}
+	if value, _ := db.Get(context.Background(), namespace, "existing"); value != "old" {
+		t.Errorf("Delete of aborted transaction applied, got %v", value)
+	}
+	err = transactor.Transaction(context.Background(), func(tx Transaction) error {
+		err := tx.SetWithTTL(namespace, "new", "value", 0)
+		if err != nil {
+			return err
+		}
+		return tx.DeleteKey(namespace, "existing")
+	})
+	if err != nil {
+		t.Errorf("Transaction failed: %v", err)
+	}
+	if value, _ := db.Get(context.Background(), namespace, "new"); value != "value" {
+		t.Errorf("Write of transaction not applied, got %v", value)
+	}
+	if _, err := db.Get(context.Background(), namespace, "existing"); err == nil {
+		t.Errorf("Delete of transaction not applied")
+	}
+	created := namespace + "-created"
+	db.DeleteNamespace(context.Background(), created)
+	transactor.Transaction(context.Background(), func(tx Transaction) error {
+		tx.SetWithTTL(created, "key", "value", 0)
+		return errors.New("abort")
+	})
+	if namespaces, _ := db.Keys(context.Background(), ""); slices.Contains(namespaces, created) {
+		t.Errorf("Namespace of aborted transaction created")
+	}
+	err = transactor.Transaction(context.Background(), func(tx Transaction) error {
+		return tx.SetWithTTL(created, "key", "value", 0)
+	})
+	if value, _ := db.Get(context.Background(), created, "key"); err != nil || value != "value" {
+		t.Errorf("Write to new namespace not applied, got %v, %v", value, err)
+	}
+	db.DeleteNamespace(context.Background(), created)
+}
+
+func TestBatch(t *testing.T) {
+	setupTestlogging()
+	App = new(Application)
+	t.Run("Initialize DB for Tests", func(t *testing.T) {
+		fileName := "testdb.yaml"
+		err := os.Remove(fileName)
+		if err != nil && !errors.Is(err, os.ErrNotExist) {
+			t.Fatal(err)
+		}
+		config := ConfigType{}
+		ConfigRead("example-config", &config)
+		App.Auth = Auth{}
+		App.Auth.Init(config)
+		App.DB = &YamlDatabase{DatabaseName: fileName}
+		App.DB.Init()
+		App.Count = &Counter{}
+		App.Count.Init(App.DB)
+		App.APIEndpoints = []API{&APIv1{}}
+		limited := App.Auth.Users["user"]
+		limited.SetPermissions([]ConfigPermissionsset{{Namespaces: []string{"batch"}, Permissions: ConfigPermissions{Read: true, Write: true}}})
+		App.Auth.Users["limited"] = limited
+	})
+	send := func(method string, username string, body string) (int, rest.BatchResponseV1) {
+		request, _ := http.NewRequest(method, "/v1/"+BatchNamespace, strings.NewReader(body))
+		request.SetBasicAuth(username, "password")
+		request.RemoteAddr = "127.0.0.1:434"
+		response := httptest.NewRecorder()
+		App.RootControllerV1(response, request)
+		reply := rest.BatchResponseV1{}
+		json.Unmarshal(response.Body.Bytes(), &reply)
+		return response.Code, reply
+	}
+	statuses := func(reply rest.BatchResponseV1) []int {
+		result := []int{}
+		for _, operation := range reply.Results {
+			result = append(result, operation.Status)
+		}
+		return result
+	}
+	t.Run("Transaction", func(t *testing.T) {
+		testTransaction(t, App.DB, "transaction")
+	})
+	t.Run("Apply", func(t *testing.T) {
+		code, reply := send(http.MethodPost, "user", `{"operations": [
+			{"op": "set", "namespace": "batch", "key": "a", "value": "1"},
+			{"op": "set", "namespace": "other", "key": "b", "value": "2", "ttl": 60},
+			{"op": "get", "namespace": "batch", "key": "a"},
+			{"op": "get", "namespace": "batch", "key": "missing"},
+			{"op": "delete", "namespace": "other", "key": "b"}]}`)
+		if code != http.StatusOK || !reply.Applied || !reply.Atomic {
+			t.Fatalf(".Code got %v, want %v, reply %+v", code, http.StatusOK, reply)
+		}
+		want := []int{http.StatusCreated, http.StatusCreated, http.StatusOK, http.StatusNotFound, http.StatusOK}
+		if got := statuses(reply); !slices.Equal(got, want) {
+			t.Errorf("Statuses got %v, want %v", got, want)
+		}
+		if reply.Results[2].Value != "1" || reply.Results[2].ETag != ETag("1") {
+			t.Errorf("Get in batch got %+v", reply.Results[2])
+		}
+		if value, _ := App.DB.Get(context.Background(), "batch", "a"); value != "1" {
+			t.Errorf("Value not written got %v", value)
+		}
+		if _, err := App.DB.Get(context.Background(), "other", "b"); err == nil {
+			t.Errorf("Key not deleted")
+		}
+		if namespaces, _ := App.DB.Keys(context.Background(), ""); !slices.Contains(namespaces, "other") {
+			t.Errorf("Namespace of applied batch not created, got %v", namespaces)
+		}
+	})
+	t.Run("Precondition failed", func(t *testing.T) {
+		code, reply := send(http.MethodPost, "user", `{"operations": [
+			{"op": "set", "namespace": "batch", "key": "c", "value": "3"},
+			{"op": "set", "namespace": "batch", "key": "a", "value": "new", "ifMatch": "\"wrong\""}]}`)
+		if code != http.StatusPreconditionFailed || reply.Applied {
+			t.Errorf(".Code got %v, want %v", code, http.StatusPreconditionFailed)
+		}
+		if got := statuses(reply); got[0] != http.StatusFailedDependency || got[1] != http.StatusPreconditionFailed {
+			t.Errorf("Statuses got %v", got)
+		}
+		if _, err := App.DB.Get(context.Background(), "batch", "c"); err == nil {
+			t.Errorf("Write of failed batch applied")
+		}
+		send(http.MethodPost, "user", `{"operations": [
+			{"op": "set", "namespace": "unused", "key": "a", "value": "1"},
+			{"op": "set", "namespace": "batch", "key": "a", "value": "new", "ifMatch": "\"wrong\""}]}`)
+		if namespaces, _ := App.DB.Keys(context.Background(), ""); slices.Contains(namespaces, "unused") {
+			t.Errorf("Namespace of failed batch created")
+		}
+		code, _ = send(http.MethodPost, "user", `{"operations": [
+			{"op": "set", "namespace": "batch", "key": "a", "value": "new", "ifMatch": `+jsonString(ETag("1"))+`}]}`)
+		if code != http.StatusOK {
+			t.Errorf("Matching ifMatch .Code got %v, want %v", code, http.StatusOK)
+		}
+	})
+	t.Run("Per operation authorization", func(t *testing.T) {
+		code, reply := send(http.MethodPost, "limited", `{"operations": [
+			{"op": "set", "namespace": "batch", "key": "d", "value": "4"},
+			{"op": "set", "namespace": "other", "key": "d", "value": "4"}]}`)
+		if code != http.StatusForbidden {
+			t.Errorf(".Code got %v, want %v", code, http.StatusForbidden)
+		}
+		if got := statuses(reply); got[0] != http.StatusFailedDependency || got[1] != http.StatusForbidden {
+			t.Errorf("Statuses got %v", got)
+		}
+		if _, err := App.DB.Get(context.Background(), "batch", "d"); err == nil {
+			t.Errorf("Write of unauthorized batch applied")
+		}
+		code, _ = send(http.MethodPost, "user", `{"operations": [{"op": "get", "namespace": "`+App.DB.GetSystemNS()+`", "key": "counter"}]}`)
+		if code != http.StatusForbidden {
+			t.Errorf("System namespace .Code got %v, want %v", code, http.StatusForbidden)
+		}
+		code, _ = send(http.MethodPost, "nobody", `{"operations": [{"op": "get", "namespace": "batch", "key": "a"}]}`)
+		if code != http.StatusUnauthorized {
+			t.Errorf("Unauthenticated .Code got %v, want %v", code, http.StatusUnauthorized)
+		}
+	})
+	t.Run("Invalid requests", func(t *testing.T) {
+		for body, want := range map[string]int{
+			`{"operations": []}`: http.StatusBadRequest,
+			`not json`:           http.StatusBadRequest,
+			`{"operations": [{"op": "rename", "namespace": "batch", "key": "a"}]}`: http.StatusBadRequest,
+			`{"operations": [{"op": "get", "namespace": "batch", "key": "*"}]}`:    http.StatusBadRequest,
+		} {
+			if code, _ := send(http.MethodPost, "user", body); code != want {
+				t.Errorf("%v .Code got %v, want %v", body, code, want)
+			}
+		}
+		if code, _ := send(http.MethodGet, "nobody", ""); code != http.StatusUnauthorized {
+			t.Errorf("Unauthenticated GET .Code got %v, want %v", code, http.StatusUnauthorized)
+		}
+		for _, method := range []string{http.MethodPut, http.MethodDelete} {
+			if code, _ := send(method, "user", `{"type": "key", "value": "1"}`); code != http.StatusBadRequest {
+				t.Errorf("%v .Code got %v, want %v", method, code, http.StatusBadRequest)
+			}
+		}
+		request, _ := http.NewRequest(http.MethodPost, "/v1/", strings.NewReader(`{"type": "namespace", "value": "`+BatchNamespace+`"}`))
+		request.Header.Set("Content-Type", "application/json")
+		request.SetBasicAuth("user", "password")
+		request.RemoteAddr = "127.0.0.1:434"
+		response := httptest.NewRecorder()
+		App.RootControllerV1(response, request)
+		if response.Code != http.StatusBadRequest {
+			t.Errorf("Create namespace %v .Code got %v, want %v", BatchNamespace, response.Code, http.StatusBadRequest)
+		}
+	})
+}
+
+func jsonString(value any) string {
+	encoded, _ := json.Marshal(value)
+	return string(encoded)
+}
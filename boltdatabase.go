@@ -0,0 +1,429 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"sync/atomic"
+	"time"
+
+	"github.com/SimonStiil/keyvaluedatabase/rest"
+	"github.com/spf13/viper"
+	bolt "go.etcd.io/bbolt"
+)
+
+// BoltDatabase stores everything in a single bbolt file. Writes are transactions flushed to disk
+// before they return and readers never wait for writers.
+type BoltDatabase struct {
+	Initialized atomic.Bool
+	Config      *ConfigBolt
+	Connection  *bolt.DB
+}
+
+type ConfigBolt struct {
+	Path     string        `mapstructure:"path"`
+	SystemNS string        `mapstructure:"systemnamespace"`
+	Timeout  time.Duration `mapstructure:"timeout"` // Time to wait for the file lock held by another process
+}
+
+var (
+	// Each namespace is a bucket in the data bucket, values are stored as <8 byte expiry in unix milliseconds><value>
+	boltDataBucket = []byte("data")
+	// Each namespace is a bucket in the history bucket, key histories are stored as json newest first
+	boltHistoryBucket = []byte("history")
+)
+
+func BoltDBGetDefaults(configReader *viper.Viper) {
+	configReader.SetDefault("bolt.path", "db.bolt")
+	configReader.SetDefault("bolt.systemnamespace", "kvdb")
+	configReader.SetDefault("bolt.timeout", "10s")
+}
+
+func (BDB *BoltDatabase) GetSystemNS() string {
+	return BDB.Config.SystemNS
+}
+
+func (BDB *BoltDatabase) Init() error {
+	logger.Debug("Opening database file", "function", "Init", "struct", "BoltDatabase", "path", BDB.Config.Path)
+	var err error
+	BDB.Connection, err = bolt.Open(BDB.Config.Path, 0600, &bolt.Options{Timeout: BDB.Config.Timeout})
+	if err != nil {
+		return &ErrUnavailable{Value: BDB.Config.Path, Err: err}
+	}
+	err = BDB.Connection.Update(func(tx *bolt.Tx) error {
+		data, err := tx.CreateBucketIfNotExists(boltDataBucket)
+		if err != nil {
+			return err
+		}
+		_, err = tx.CreateBucketIfNotExists(boltHistoryBucket)
+		if err != nil {
+			return err
+		}
+		_, err = data.CreateBucketIfNotExists([]byte(BDB.GetSystemNS()))
+		return err
+	})
+	if err != nil {
+		BDB.Connection.Close()
+		return &ErrUnavailable{Value: BDB.Config.Path, Err: err}
+	}
+	BDB.Initialized.Store(true)
+	logger.Debug("Initialization complete", "function", "Init", "struct", "BoltDatabase")
+	return nil
+}
+
+func encodeBoltValue(value string, expiry int64) []byte {
+	encoded := make([]byte, 8, 8+len(value))
+	binary.BigEndian.PutUint64(encoded, uint64(expiry))
+	return append(encoded, value...)
+}
+
+func decodeBoltValue(encoded []byte) (string, int64) {
+	if len(encoded) < 8 {
+		return "", 0
+	}
+	return string(encoded[8:]), int64(binary.BigEndian.Uint64(encoded[:8]))
+}
+
+// boltGet returns the value of a key that exists and has not expired
+func boltGet(tx *bolt.Tx, namespace string, key string) (string, int64, bool) {
+	bucket := tx.Bucket(boltDataBucket).Bucket([]byte(namespace))
+	if bucket == nil {
+		return "", 0, false
+	}
+	encoded := bucket.Get([]byte(key))
+	if encoded == nil {
+		return "", 0, false
+	}
+	value, expiry := decodeBoltValue(encoded)
+	if isExpired(expiry) {
+		return "", 0, false
+	}
+	return value, expiry, true
+}
+
+func boltSet(tx *bolt.Tx, namespace string, key string, value string, ttl time.Duration) error {
+	bucket, err := tx.Bucket(boltDataBucket).CreateBucketIfNotExists([]byte(namespace))
+	if err != nil {
+		return err
+	}
+	return bucket.Put([]byte(key), encodeBoltValue(value, expiryFromTTL(ttl)))
+}
+
+func boltDelete(tx *bolt.Tx, namespace string, key string) error {
+	bucket := tx.Bucket(boltDataBucket).Bucket([]byte(namespace))
+	if bucket == nil {
+		return nil
+	}
+	return bucket.Delete([]byte(key))
+}
+
+// update runs fn in a write transaction, unless ctx ended while waiting for the writer lock
+func (BDB *BoltDatabase) update(ctx context.Context, fn func(tx *bolt.Tx) error) error {
+	return BDB.Connection.Update(func(tx *bolt.Tx) error {
+		err := ctx.Err()
+		if err != nil {
+			return err
+		}
+		return fn(tx)
+	})
+}
+
+func (BDB *BoltDatabase) Set(ctx context.Context, namespace string, key string, value interface{}) error {
+	return BDB.SetWithTTL(ctx, namespace, key, value, 0)
+}
+
+func (BDB *BoltDatabase) SetWithTTL(ctx context.Context, namespace string, key string, value interface{}, ttl time.Duration) error {
+	if !BDB.Initialized.Load() {
+		return errNotInitialized
+	}
+	return BDB.update(ctx, func(tx *bolt.Tx) error {
+		return boltSet(tx, namespace, key, fmt.Sprint(value), ttl)
+	})
+}
+
+func (BDB *BoltDatabase) CompareAndSet(ctx context.Context, namespace string, key string, expected *string, value string, ttl time.Duration) error {
+	if !BDB.Initialized.Load() {
+		return errNotInitialized
+	}
+	return BDB.update(ctx, func(tx *bolt.Tx) error {
+		current, _, exists := boltGet(tx, namespace, key)
+		if expected == nil && exists || expected != nil && (!exists || current != *expected) {
+			return &ErrPreconditionFailed{Value: key}
+		}
+		return boltSet(tx, namespace, key, value, ttl)
+	})
+}
+
+func (BDB *BoltDatabase) Get(ctx context.Context, namespace string, key string) (string, error) {
+	if !BDB.Initialized.Load() {
+		return "", errNotInitialized
+	}
+	var value string
+	err := BDB.Connection.View(func(tx *bolt.Tx) error {
+		var exists bool
+		value, _, exists = boltGet(tx, namespace, key)
+		if !exists {
+			return &ErrNotFound{Value: key}
+		}
+		return nil
+	})
+	return value, err
+}
+
+func (BDB *BoltDatabase) TTL(ctx context.Context, namespace string, key string) (time.Duration, error) {
+	if !BDB.Initialized.Load() {
+		return 0, errNotInitialized
+	}
+	var expiry int64
+	err := BDB.Connection.View(func(tx *bolt.Tx) error {
+		var exists bool
+		_, expiry, exists = boltGet(tx, namespace, key)
+		if !exists {
+			return &ErrNotFound{Value: key}
+		}
+		return nil
+	})
+	return ttlFromExpiry(expiry), err
+}
+
+func (BDB *BoltDatabase) DeleteExpired(ctx context.Context) (int, error) {
+	if !BDB.Initialized.Load() {
+		return 0, errNotInitialized
+	}
+	count := 0
+	err := BDB.update(ctx, func(tx *bolt.Tx) error {
+		return tx.Bucket(boltDataBucket).ForEachBucket(func(namespace []byte) error {
+			if err := ctx.Err(); err != nil {
+				return err
+			}
+			bucket := tx.Bucket(boltDataBucket).Bucket(namespace)
+			expired := [][]byte{}
+			err := bucket.ForEach(func(key []byte, encoded []byte) error {
+				if _, expiry := decodeBoltValue(encoded); isExpired(expiry) {
+					expired = append(expired, key)
+				}
+				return nil
+			})
+			if err != nil {
+				return err
+			}
+			// Keys are deleted after the walk as deleting moves the cursor
+			for _, key := range expired {
+				err = bucket.Delete(key)
+				if err != nil {
+					return err
+				}
+			}
+			count += len(expired)
+			return nil
+		})
+	})
+	return count, err
+}
+
+func (BDB *BoltDatabase) DeleteKey(ctx context.Context, namespace string, key string) error {
+	if !BDB.Initialized.Load() {
+		return errNotInitialized
+	}
+	return BDB.update(ctx, func(tx *bolt.Tx) error {
+		return boltDelete(tx, namespace, key)
+	})
+}
+
+func (BDB *BoltDatabase) CompareAndDelete(ctx context.Context, namespace string, key string, expected string) error {
+	if !BDB.Initialized.Load() {
+		return errNotInitialized
+	}
+	return BDB.update(ctx, func(tx *bolt.Tx) error {
+		current, _, exists := boltGet(tx, namespace, key)
+		if !exists || current != expected {
+			return &ErrPreconditionFailed{Value: key}
+		}
+		return boltDelete(tx, namespace, key)
+	})
+}
+
+func (BDB *BoltDatabase) CreateNamespace(ctx context.Context, namespace string) error {
+	if !BDB.Initialized.Load() {
+		return errNotInitialized
+	}
+	return BDB.update(ctx, func(tx *bolt.Tx) error {
+		_, err := tx.Bucket(boltDataBucket).CreateBucketIfNotExists([]byte(namespace))
+		return err
+	})
+}
+
+func (BDB *BoltDatabase) DeleteNamespace(ctx context.Context, namespace string) error {
+	if !BDB.Initialized.Load() {
+		return errNotInitialized
+	}
+	if namespace == BDB.GetSystemNS() {
+		return &ErrNotAllowed{Value: fmt.Sprintf("delete System NS %v", namespace)}
+	}
+	return BDB.update(ctx, func(tx *bolt.Tx) error {
+		for _, name := range [][]byte{boltDataBucket, boltHistoryBucket} {
+			err := tx.Bucket(name).DeleteBucket([]byte(namespace))
+			if err != nil && err != bolt.ErrBucketNotFound {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+func (BDB *BoltDatabase) Keys(ctx context.Context, namespace string) ([]string, error) {
+	keys, _, err := BDB.KeysPage(ctx, namespace, ListOptions{})
+	return keys, err
+}
+
+// KeysPage walks the keys in order from the cursor, the cursor is the last key of the previous page
+func (BDB *BoltDatabase) KeysPage(ctx context.Context, namespace string, options ListOptions) ([]string, string, error) {
+	if !BDB.Initialized.Load() {
+		return nil, "", errNotInitialized
+	}
+	last, err := decodeCursor(options.Cursor)
+	if err != nil {
+		return nil, "", err
+	}
+	page := []string{}
+	next := ""
+	err = BDB.Connection.View(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(boltDataBucket)
+		if namespace != "" {
+			bucket = bucket.Bucket([]byte(namespace))
+			if bucket == nil {
+				return &ErrNotFound{Value: namespace}
+			}
+		}
+		start := []byte(options.Prefix)
+		if options.Cursor != "" && last > options.Prefix {
+			start = []byte(last)
+		}
+		cursor := bucket.Cursor()
+		for key, encoded := cursor.Seek(start); key != nil && bytes.HasPrefix(key, []byte(options.Prefix)); key, encoded = cursor.Next() {
+			// Namespaces are nested buckets and have no value, keys always have one
+			if (namespace == "") != (encoded == nil) {
+				continue
+			}
+			if options.Cursor != "" && string(key) <= last || !options.Matches(string(key)) {
+				continue
+			}
+			if namespace != "" {
+				if _, expiry := decodeBoltValue(encoded); isExpired(expiry) {
+					continue
+				}
+			}
+			if options.Limit > 0 && len(page) == options.Limit {
+				next = encodeCursor(page[len(page)-1])
+				return nil
+			}
+			page = append(page, string(key))
+		}
+		return nil
+	})
+	return page, next, err
+}
+
+func (BDB *BoltDatabase) CountKeys(ctx context.Context, namespace string) (int, error) {
+	keys, err := BDB.Keys(ctx, namespace)
+	return len(keys), err
+}
+
+func (BDB *BoltDatabase) AddVersion(ctx context.Context, namespace string, key string, version rest.KeyVersionV1, limit int) error {
+	if !BDB.Initialized.Load() {
+		return errNotInitialized
+	}
+	return BDB.update(ctx, func(tx *bolt.Tx) error {
+		bucket, err := tx.Bucket(boltHistoryBucket).CreateBucketIfNotExists([]byte(namespace))
+		if err != nil {
+			return err
+		}
+		history := rest.KeyHistoryV1{}
+		if encoded := bucket.Get([]byte(key)); encoded != nil {
+			err = json.Unmarshal(encoded, &history)
+			if err != nil {
+				return err
+			}
+		}
+		version.Version = 1
+		if len(history) > 0 {
+			version.Version = history[0].Version + 1
+		}
+		history = append(rest.KeyHistoryV1{version}, history...)
+		if limit > 0 && len(history) > limit {
+			history = history[:limit]
+		}
+		encoded, err := json.Marshal(history)
+		if err != nil {
+			return err
+		}
+		return bucket.Put([]byte(key), encoded)
+	})
+}
+
+func (BDB *BoltDatabase) Versions(ctx context.Context, namespace string, key string) (rest.KeyHistoryV1, error) {
+	if !BDB.Initialized.Load() {
+		return rest.KeyHistoryV1{}, errNotInitialized
+	}
+	var history rest.KeyHistoryV1
+	err := BDB.Connection.View(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(boltHistoryBucket).Bucket([]byte(namespace))
+		if bucket == nil || bucket.Get([]byte(key)) == nil {
+			return &ErrNotFound{Value: key}
+		}
+		return json.Unmarshal(bucket.Get([]byte(key)), &history)
+	})
+	return history, err
+}
+
+func (BDB *BoltDatabase) Atomic() bool {
+	return true
+}
+
+// Transaction runs fn in a single bbolt write transaction
+func (BDB *BoltDatabase) Transaction(ctx context.Context, fn func(tx Transaction) error) error {
+	if !BDB.Initialized.Load() {
+		return errNotInitialized
+	}
+	return BDB.update(ctx, func(tx *bolt.Tx) error {
+		return fn(&boltTransaction{Tx: tx})
+	})
+}
+
+type boltTransaction struct {
+	Tx *bolt.Tx
+}
+
+func (Tx *boltTransaction) Get(namespace string, key string) (string, error) {
+	value, _, exists := boltGet(Tx.Tx, namespace, key)
+	if !exists {
+		return "", &ErrNotFound{Value: key}
+	}
+	return value, nil
+}
+
+func (Tx *boltTransaction) SetWithTTL(namespace string, key string, value string, ttl time.Duration) error {
+	return boltSet(Tx.Tx, namespace, key, value, ttl)
+}
+
+func (Tx *boltTransaction) DeleteKey(namespace string, key string) error {
+	return boltDelete(Tx.Tx, namespace, key)
+}
+
+func (BDB *BoltDatabase) IsInitialized() bool {
+	return BDB.Initialized.Load()
+}
+
+func (BDB *BoltDatabase) Close() {
+	if !BDB.Initialized.Load() {
+		return
+	}
+	err := BDB.Connection.Close()
+	if err != nil {
+		logger.Error("Unable to close connection", "function", "Close", "struct", "BoltDatabase", "error", err)
+		return
+	}
+	logger.Debug("Closed Connection", "function", "Close", "struct", "BoltDatabase")
+}
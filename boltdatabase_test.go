@@ -0,0 +1,185 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"os"
+	"slices"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/SimonStiil/keyvaluedatabase/rest"
+)
+
+func Test_Bolt_DB(t *testing.T) {
+	dbt := new(DBTest)
+	setupTestlogging()
+	dbt.FileName = "testdb.bolt"
+	dbt.DB = &BoltDatabase{Config: &ConfigBolt{Path: dbt.FileName, SystemNS: "kvdb", Timeout: time.Second}}
+	t.Run("initialize fresh db", func(t *testing.T) {
+		err := os.Remove(dbt.FileName)
+		if err != nil && !errors.Is(err, os.ErrNotExist) {
+			t.Fatal(err)
+		}
+		dbt.DB.Init()
+	})
+	testKey := "test"
+	testValue := "value"
+
+	t.Run("get value (that don't exist yet)", func(t *testing.T) {
+		_, err := dbt.DB.Get(context.Background(), dbt.DB.GetSystemNS(), testKey)
+		if _, ok := err.(*ErrNotFound); !ok {
+			t.Errorf("Supposed to get ErrNotFound error got %v", err)
+		}
+		_, err = dbt.DB.Get(context.Background(), "missing", testKey)
+		if _, ok := err.(*ErrNotFound); !ok {
+			t.Errorf("Supposed to get ErrNotFound error for missing namespace got %v", err)
+		}
+	})
+	t.Run("set and get value", func(t *testing.T) {
+		err := dbt.DB.Set(context.Background(), dbt.DB.GetSystemNS(), testKey, testValue)
+		if err != nil {
+			t.Fatalf("Failed to set value: %v", err)
+		}
+		val, err := dbt.DB.Get(context.Background(), dbt.DB.GetSystemNS(), testKey)
+		if err != nil || val != testValue {
+			t.Errorf("Read from database failed expected %v, got %v, %v", testValue, val, err)
+		}
+	})
+	t.Run("compare and set", func(t *testing.T) {
+		wrong := "wrong"
+		err := dbt.DB.CompareAndSet(context.Background(), dbt.DB.GetSystemNS(), testKey, &wrong, "new", 0)
+		if _, ok := err.(*ErrPreconditionFailed); !ok {
+			t.Errorf("Expected ErrPreconditionFailed got %v", err)
+		}
+		err = dbt.DB.CompareAndSet(context.Background(), dbt.DB.GetSystemNS(), testKey, &testValue, "new", 0)
+		if err != nil {
+			t.Errorf("CompareAndSet failed: %v", err)
+		}
+		err = dbt.DB.CompareAndDelete(context.Background(), dbt.DB.GetSystemNS(), testKey, "new")
+		if err != nil {
+			t.Errorf("CompareAndDelete failed: %v", err)
+		}
+	})
+	t.Run("cancelled context", func(t *testing.T) {
+		ctx, cancel := context.WithCancel(context.Background())
+		cancel()
+		err := dbt.DB.Set(ctx, dbt.DB.GetSystemNS(), testKey, testValue)
+		if !errors.Is(err, context.Canceled) {
+			t.Errorf("Expected context.Canceled got %v", err)
+		}
+		_, err = dbt.DB.Get(context.Background(), dbt.DB.GetSystemNS(), testKey)
+		if _, ok := err.(*ErrNotFound); !ok {
+			t.Errorf("Cancelled Set should not write, got %v", err)
+		}
+	})
+	t.Run("expired value", func(t *testing.T) {
+		err := dbt.DB.SetWithTTL(context.Background(), dbt.DB.GetSystemNS(), testKey+"ttl", testValue, time.Hour)
+		if err != nil {
+			t.Fatalf("Failed to set value: %v", err)
+		}
+		ttl, err := dbt.DB.TTL(context.Background(), dbt.DB.GetSystemNS(), testKey+"ttl")
+		if err != nil || ttl <= 59*time.Minute {
+			t.Errorf("Expected ttl close to an hour got %v, %v", ttl, err)
+		}
+		dbt.DB.SetWithTTL(context.Background(), dbt.DB.GetSystemNS(), testKey+"expired", testValue, time.Millisecond)
+		time.Sleep(5 * time.Millisecond)
+		if _, err := dbt.DB.Get(context.Background(), dbt.DB.GetSystemNS(), testKey+"expired"); err == nil {
+			t.Errorf("Expired key returned")
+		}
+		keys, _ := dbt.DB.Keys(context.Background(), dbt.DB.GetSystemNS())
+		if slices.Contains(keys, testKey+"expired") {
+			t.Errorf("Expired key listed")
+		}
+		count, err := dbt.DB.(Expirer).DeleteExpired(context.Background())
+		if err != nil || count != 1 {
+			t.Errorf("Expected 1 expired key deleted, got %v, %v", count, err)
+		}
+	})
+	t.Run("key history", func(t *testing.T) {
+		for _, value := range []string{"one", "two", "three"} {
+			err := dbt.DB.AddVersion(context.Background(), dbt.DB.GetSystemNS(), testKey, rest.KeyVersionV1{Value: value, User: "test", Timestamp: time.Now()}, 2)
+			if err != nil {
+				t.Fatalf("Failed to add version: %v", err)
+			}
+		}
+		history, err := dbt.DB.Versions(context.Background(), dbt.DB.GetSystemNS(), testKey)
+		if err != nil || len(history) != 2 || history[0].Version != 3 || history[0].Value != "three" {
+			t.Errorf("Unexpected history %+v, %v", history, err)
+		}
+	})
+	t.Run("namespaces", func(t *testing.T) {
+		err := dbt.DB.CreateNamespace(context.Background(), "empty")
+		if err != nil {
+			t.Fatal(err)
+		}
+		dbt.DB.Set(context.Background(), "full", "key", "value")
+		dbt.DB.AddVersion(context.Background(), "full", "key", rest.KeyVersionV1{Value: "value"}, 0)
+		namespaces, _ := dbt.DB.Keys(context.Background(), "")
+		if !slices.Equal(namespaces, []string{"empty", "full", "kvdb"}) {
+			t.Errorf("Namespaces got %v", namespaces)
+		}
+		err = dbt.DB.DeleteNamespace(context.Background(), "full")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := dbt.DB.Versions(context.Background(), "full", "key"); err == nil {
+			t.Errorf("History not deleted with namespace")
+		}
+		if _, err := dbt.DB.Keys(context.Background(), "full"); err == nil {
+			t.Errorf("Deleted namespace listed")
+		}
+		if _, ok := dbt.DB.DeleteNamespace(context.Background(), dbt.DB.GetSystemNS()).(*ErrNotAllowed); !ok {
+			t.Errorf("Expected ErrNotAllowed deleting system namespace")
+		}
+	})
+	t.Run("transaction", func(t *testing.T) {
+		testTransaction(t, dbt.DB, "transaction")
+	})
+	t.Run("keys page", func(t *testing.T) {
+		testKeysPage(t, dbt.DB, "paged")
+	})
+	t.Run("concurrent writes", func(t *testing.T) {
+		var wait sync.WaitGroup
+		for i := range 20 {
+			wait.Add(1)
+			go func() {
+				defer wait.Done()
+				dbt.DB.Set(context.Background(), "concurrent", string(rune('a'+i)), "value")
+				dbt.DB.Keys(context.Background(), "concurrent")
+			}()
+		}
+		wait.Wait()
+		if count, _ := dbt.DB.CountKeys(context.Background(), "concurrent"); count != 20 {
+			t.Errorf("Expected 20 keys got %v", count)
+		}
+	})
+	t.Run("persisted after reopen", func(t *testing.T) {
+		dbt.DB.Close()
+		dbt.DB.Init()
+		value, err := dbt.DB.Get(context.Background(), "transaction", "new")
+		if err != nil || value != "value" {
+			t.Errorf("Value not persisted got %v, %v", value, err)
+		}
+	})
+	t.Run("Counter Integration Test (stored db)", func(t *testing.T) {
+		count := Counter{}
+		count.Init(dbt.DB)
+		val := count.GetCount()
+		if val != 0 {
+			t.Errorf("Fresh Counter expected value to be 0, got %v", val)
+		}
+		dbt.DB.Close()
+		dbt.DB.Init()
+		count.Init(dbt.DB)
+		val = count.GetCount()
+		if val != 1 {
+			t.Errorf("Stored Counter expected value to be 1, got %v", val)
+		}
+	})
+	t.Run("close database", func(t *testing.T) {
+		dbt.DB.Close()
+		os.Remove(dbt.FileName)
+	})
+}
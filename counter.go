@@ -1,11 +1,16 @@
 package main
 
 import (
+	"context"
 	"reflect"
 	"strconv"
 	"sync"
+	"time"
 )
 
+// counterTimeout limits how long GetCount waits for the database, every request waits for the counter
+const counterTimeout = 2 * time.Second
+
 type Counter struct {
 	Mutex     sync.Mutex
 	Value     uint32
@@ -21,15 +26,16 @@ func (Count *Counter) Init(DB Database) {
 	defer Count.Mutex.Unlock()
 	if Count.DB != nil && Count.DB.IsInitialized() {
 		Count.namespace = Count.DB.GetSystemNS()
-		val, err := Count.DB.Get(Count.namespace, "counter")
+		val, err := Count.DB.Get(context.Background(), Count.namespace, "counter")
 		Count.Value = 0
 		logger.Debug("Get count from db", "function", "Init", "struct", "Counter", "value", val, "type", reflect.TypeOf(val))
 		if err == nil {
-			fromString, err := strconv.ParseInt(val, 10, 32)
+			fromString, err := strconv.ParseUint(val, 10, 32)
 			if err != nil {
-				panic(err)
+				logger.Error("Stored counter is not a number, counting from 0", "function", "Init", "struct", "Counter", "value", val, "error", err)
+			} else {
+				Count.Value = uint32(fromString)
 			}
-			Count.Value = uint32(fromString)
 		}
 	} else {
 		Count.Value = 0
@@ -42,7 +48,9 @@ func (Count *Counter) GetCount() uint32 {
 	var currentCount = Count.Value
 	Count.Value = Count.Value + 1
 	if Count.DB != nil && Count.DB.IsInitialized() {
-		Count.DB.Set(Count.namespace, "counter", Count.Value)
+		ctx, cancel := context.WithTimeout(context.Background(), counterTimeout)
+		defer cancel()
+		Count.DB.Set(ctx, Count.namespace, "counter", Count.Value)
 	} else {
 		if !Count.testing {
 			logger.Error("Not initialized", "function", "GetCount", "struct", "Counter")
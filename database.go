@@ -1,22 +1,79 @@
 package main
 
-import "fmt"
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/SimonStiil/keyvaluedatabase/rest"
+)
 
 // https://gobyexample.com/interfaces
 
+// Database is implemented by the backends. ctx bounds the time an operation may wait for the backend,
+// when it is cancelled or its deadline passes the operation returns ctx.Err(), possibly wrapped.
 type Database interface {
-	Init()
-	Set(namespace string, key string, value interface{}) error
-	Get(namespace string, key string) (string, error)
+	// Init connects to the database, it returns ErrInvalidConfig or ErrUnavailable when the database can not be used
+	Init() error
+	Set(ctx context.Context, namespace string, key string, value interface{}) error
+	SetWithTTL(ctx context.Context, namespace string, key string, value interface{}, ttl time.Duration) error
+	// CompareAndSet writes value only if the current value equals expected, a nil expected requires the key to not exist
+	CompareAndSet(ctx context.Context, namespace string, key string, expected *string, value string, ttl time.Duration) error
+	Get(ctx context.Context, namespace string, key string) (string, error)
+	TTL(ctx context.Context, namespace string, key string) (time.Duration, error)
 	GetSystemNS() string
-	DeleteKey(namespace string, key string) error
-	CreateNamespace(namespace string) error
-	DeleteNamespace(namespace string) error
-	Keys(namespace string) ([]string, error)
+	DeleteKey(ctx context.Context, namespace string, key string) error
+	// CompareAndDelete deletes key only if the current value equals expected
+	CompareAndDelete(ctx context.Context, namespace string, key string, expected string) error
+	CreateNamespace(ctx context.Context, namespace string) error
+	DeleteNamespace(ctx context.Context, namespace string) error
+	Keys(ctx context.Context, namespace string) ([]string, error)
+	// KeysPage lists the keys of namespace, or the namespaces when namespace is empty, filtered and paged by options.
+	// The returned cursor continues the listing and is empty on the last page.
+	KeysPage(ctx context.Context, namespace string, options ListOptions) ([]string, string, error)
+	// CountKeys returns the number of keys in namespace
+	CountKeys(ctx context.Context, namespace string) (int, error)
+	// AddVersion records a written value in the key history, keeping at most limit versions (0 for unbounded)
+	AddVersion(ctx context.Context, namespace string, key string, version rest.KeyVersionV1, limit int) error
+	// Versions returns the key history newest first
+	Versions(ctx context.Context, namespace string, key string) (rest.KeyHistoryV1, error)
 	Close()
 	IsInitialized() bool
 }
 
+// healthTimeout limits how long /system/health waits for a database
+const healthTimeout = 2 * time.Second
+
+// reconnectMaxDelay is the longest wait between two attempts of Reconnect
+const reconnectMaxDelay = time.Minute
+
+// Reconnect retries Init of a database that was unavailable at startup, waiting twice as long after every failed
+// attempt, and calls ready once it succeeds. Until then the backends answer ErrUnavailable.
+func Reconnect(DB Database, delay time.Duration, ready func()) {
+	for {
+		time.Sleep(delay)
+		err := DB.Init()
+		if err == nil {
+			logger.Info("Database available", "function", "Reconnect")
+			ready()
+			return
+		}
+		var invalid *ErrInvalidConfig
+		if errors.As(err, &invalid) {
+			logger.Error("Database configuration invalid, not retrying", "function", "Reconnect", "error", err)
+			return
+		}
+		delay = min(delay*2, reconnectMaxDelay)
+		logger.Warn("Database unavailable, retrying", "function", "Reconnect", "retry", delay, "error", err)
+	}
+}
+
+// Databases with a connection that can fail implement HealthChecker, /system/health is DOWN when Health returns an error
+type HealthChecker interface {
+	Health(ctx context.Context) error
+}
+
 type ErrNotFound struct {
 	Value string
 }
@@ -40,3 +97,57 @@ type ErrMalformRequest struct {
 func (err *ErrMalformRequest) Error() string {
 	return err.Value
 }
+
+type ErrPreconditionFailed struct {
+	Value string
+}
+
+func (err *ErrPreconditionFailed) Error() string {
+	return fmt.Sprintf("precondition failed for %v", err.Value)
+}
+
+// ErrUnavailable is returned when the database can not be reached or was not initialized
+type ErrUnavailable struct {
+	Value string
+	Err   error
+}
+
+func (err *ErrUnavailable) Error() string {
+	if err.Err == nil {
+		return fmt.Sprintf("%v unavailable", err.Value)
+	}
+	return fmt.Sprintf("%v unavailable: %v", err.Value, err.Err)
+}
+
+func (err *ErrUnavailable) Unwrap() error {
+	return err.Err
+}
+
+// errNotInitialized is returned by the backends when Init did not complete
+var errNotInitialized = &ErrUnavailable{Value: "database"}
+
+// ErrConflict is returned when a concurrent change made a write fail, retrying the request may succeed
+type ErrConflict struct {
+	Value string
+}
+
+func (err *ErrConflict) Error() string {
+	return fmt.Sprintf("conflicting change to %v", err.Value)
+}
+
+// ErrInvalidConfig is returned for a configuration value that can not be used
+type ErrInvalidConfig struct {
+	Value string
+	Err   error
+}
+
+func (err *ErrInvalidConfig) Error() string {
+	if err.Err == nil {
+		return fmt.Sprintf("invalid configuration of %v", err.Value)
+	}
+	return fmt.Sprintf("invalid configuration of %v: %v", err.Value, err.Err)
+}
+
+func (err *ErrInvalidConfig) Unwrap() error {
+	return err.Err
+}
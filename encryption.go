@@ -0,0 +1,448 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	b64 "encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/SimonStiil/keyvaluedatabase/rest"
+)
+
+const (
+	encryptedPrefix = "enc:v1:"
+	dataKeysPrefix  = "datakeys/"
+)
+
+// EncryptedDatabase wraps any Database and stores values encrypted with AES-GCM.
+// Every namespace has its own data keys, which are stored in the system namespace
+// wrapped by the master key of the KeyProvider. Values stored before encryption was
+// enabled are returned as is until they are re-encrypted by Rotate.
+type EncryptedDatabase struct {
+	Database
+	Provider KeyProvider
+	mutex    sync.RWMutex
+	dataKeys map[string]*namespaceDataKeys
+}
+
+type namespaceDataKeys struct {
+	Current string
+	Keys    map[string][]byte
+}
+
+// dataKeyRecord is stored in the system namespace for each namespace
+type dataKeyRecord struct {
+	Current string            `json:"current"`
+	Keys    map[string]string `json:"keys"` // data key id -> <master key id>:<base64 wrapped data key>
+}
+
+func NewEncryptedDatabase(DB Database, Provider KeyProvider) *EncryptedDatabase {
+	return &EncryptedDatabase{Database: DB, Provider: Provider, dataKeys: map[string]*namespaceDataKeys{}}
+}
+
+func (DB *EncryptedDatabase) Init() error {
+	err := DB.Database.Init()
+	if err != nil {
+		return err
+	}
+	// Data keys are stored in the system namespace so it has to exist before the first write
+	err = DB.Database.CreateNamespace(context.Background(), DB.GetSystemNS())
+	if err != nil {
+		logger.Error("Unable to create system namespace", "function", "Init", "struct", "EncryptedDatabase", "error", err)
+	}
+	DB.mutex.Lock()
+	DB.dataKeys = map[string]*namespaceDataKeys{}
+	DB.mutex.Unlock()
+	return nil
+}
+
+func (DB *EncryptedDatabase) loadRecord(ctx context.Context, namespace string) (*dataKeyRecord, error) {
+	raw, err := DB.Database.Get(ctx, DB.GetSystemNS(), dataKeysPrefix+namespace)
+	if err != nil {
+		return nil, err
+	}
+	record := &dataKeyRecord{}
+	err = json.Unmarshal([]byte(raw), record)
+	if err != nil {
+		return nil, fmt.Errorf("data keys for %v: %w", namespace, err)
+	}
+	return record, nil
+}
+
+func (DB *EncryptedDatabase) unwrapRecord(record *dataKeyRecord) (*namespaceDataKeys, error) {
+	keys := &namespaceDataKeys{Current: record.Current, Keys: map[string][]byte{}}
+	for id, wrapped := range record.Keys {
+		masterKeyID, encoded, found := strings.Cut(wrapped, ":")
+		if !found {
+			return nil, fmt.Errorf("malformed data key %v", id)
+		}
+		sealed, err := b64.StdEncoding.DecodeString(encoded)
+		if err != nil {
+			return nil, err
+		}
+		keys.Keys[id], err = DB.Provider.Unwrap(masterKeyID, sealed)
+		if err != nil {
+			return nil, fmt.Errorf("unwrap data key %v: %w", id, err)
+		}
+	}
+	return keys, nil
+}
+
+func (DB *EncryptedDatabase) wrapRecord(keys *namespaceDataKeys) (*dataKeyRecord, error) {
+	record := &dataKeyRecord{Current: keys.Current, Keys: map[string]string{}}
+	for id, key := range keys.Keys {
+		masterKeyID, wrapped, err := DB.Provider.Wrap(key)
+		if err != nil {
+			return nil, err
+		}
+		record.Keys[id] = masterKeyID + ":" + b64.StdEncoding.EncodeToString(wrapped)
+	}
+	return record, nil
+}
+
+func newDataKey(keys *namespaceDataKeys) error {
+	id := make([]byte, 4)
+	key := make([]byte, 32)
+	_, err := rand.Read(id)
+	if err != nil {
+		return err
+	}
+	_, err = rand.Read(key)
+	if err != nil {
+		return err
+	}
+	keys.Current = hex.EncodeToString(id)
+	keys.Keys[keys.Current] = key
+	return nil
+}
+
+// namespaceKeys returns the cached data keys for a namespace. With reload the cache
+// is bypassed, with create a data key is created when the namespace has none.
+func (DB *EncryptedDatabase) namespaceKeys(ctx context.Context, namespace string, create bool, reload bool) (*namespaceDataKeys, error) {
+	if !reload {
+		DB.mutex.RLock()
+		keys, ok := DB.dataKeys[namespace]
+		DB.mutex.RUnlock()
+		if ok {
+			return keys, nil
+		}
+	}
+	DB.mutex.Lock()
+	defer DB.mutex.Unlock()
+	record, err := DB.loadRecord(ctx, namespace)
+	if err != nil {
+		if _, ok := err.(*ErrNotFound); !ok || !create {
+			return nil, err
+		}
+		keys := &namespaceDataKeys{Keys: map[string][]byte{}}
+		err = newDataKey(keys)
+		if err != nil {
+			return nil, err
+		}
+		record, err = DB.wrapRecord(keys)
+		if err != nil {
+			return nil, err
+		}
+		encoded, _ := json.Marshal(record)
+		// Create only, another instance may have created the data key first
+		err = DB.Database.CompareAndSet(ctx, DB.GetSystemNS(), dataKeysPrefix+namespace, nil, string(encoded), 0)
+		if err == nil {
+			logger.Debug("Created data key", "function", "namespaceKeys", "struct", "EncryptedDatabase", "namespace", namespace, "id", keys.Current)
+			DB.dataKeys[namespace] = keys
+			return keys, nil
+		}
+		if _, ok := err.(*ErrPreconditionFailed); !ok {
+			return nil, err
+		}
+		record, err = DB.loadRecord(ctx, namespace)
+		if err != nil {
+			return nil, err
+		}
+	}
+	keys, err := DB.unwrapRecord(record)
+	if err != nil {
+		return nil, err
+	}
+	DB.dataKeys[namespace] = keys
+	return keys, nil
+}
+
+func additionalData(namespace string, key string) []byte {
+	return []byte(namespace + "/" + key)
+}
+
+func (DB *EncryptedDatabase) encrypt(ctx context.Context, namespace string, key string, value string) (string, error) {
+	keys, err := DB.namespaceKeys(ctx, namespace, true, false)
+	if err != nil {
+		return "", err
+	}
+	sealed, err := sealAESGCM(keys.Keys[keys.Current], []byte(value), additionalData(namespace, key))
+	if err != nil {
+		return "", err
+	}
+	return encryptedPrefix + keys.Current + ":" + b64.StdEncoding.EncodeToString(sealed), nil
+}
+
+func (DB *EncryptedDatabase) decrypt(ctx context.Context, namespace string, key string, stored string) (string, error) {
+	if !strings.HasPrefix(stored, encryptedPrefix) {
+		return stored, nil
+	}
+	id, encoded, found := strings.Cut(strings.TrimPrefix(stored, encryptedPrefix), ":")
+	if !found {
+		return "", fmt.Errorf("malformed encrypted value for %v", key)
+	}
+	sealed, err := b64.StdEncoding.DecodeString(encoded)
+	if err != nil {
+		return "", err
+	}
+	keys, err := DB.namespaceKeys(ctx, namespace, false, false)
+	if err == nil && keys.Keys[id] == nil {
+		// Data key may have been added by a rotation since it was cached
+		keys, err = DB.namespaceKeys(ctx, namespace, false, true)
+	}
+	if err != nil {
+		return "", err
+	}
+	dataKey, ok := keys.Keys[id]
+	if !ok {
+		return "", fmt.Errorf("data key %v not found for namespace %v", id, namespace)
+	}
+	plaintext, err := openAESGCM(dataKey, sealed, additionalData(namespace, key))
+	if err != nil {
+		return "", err
+	}
+	return string(plaintext), nil
+}
+
+func (DB *EncryptedDatabase) Set(ctx context.Context, namespace string, key string, value interface{}) error {
+	return DB.SetWithTTL(ctx, namespace, key, value, 0)
+}
+
+func (DB *EncryptedDatabase) SetWithTTL(ctx context.Context, namespace string, key string, value interface{}, ttl time.Duration) error {
+	encrypted, err := DB.encrypt(ctx, namespace, key, fmt.Sprint(value))
+	if err != nil {
+		return err
+	}
+	return DB.Database.SetWithTTL(ctx, namespace, key, encrypted, ttl)
+}
+
+func (DB *EncryptedDatabase) Get(ctx context.Context, namespace string, key string) (string, error) {
+	stored, err := DB.Database.Get(ctx, namespace, key)
+	if err != nil {
+		return "", err
+	}
+	return DB.decrypt(ctx, namespace, key, stored)
+}
+
+func (DB *EncryptedDatabase) Atomic() bool {
+	transactor, ok := DB.Database.(Transactor)
+	return ok && transactor.Atomic()
+}
+
+func (DB *EncryptedDatabase) Health(ctx context.Context) error {
+	if checker, ok := DB.Database.(HealthChecker); ok {
+		return checker.Health(ctx)
+	}
+	return nil
+}
+
+// Transaction encrypts and decrypts the values of a transaction of the wrapped database,
+// writes are applied one by one if the wrapped database has no transactions.
+func (DB *EncryptedDatabase) Transaction(ctx context.Context, fn func(tx Transaction) error) error {
+	transactor, ok := DB.Database.(Transactor)
+	if !ok {
+		return fn(&directTransaction{DB: DB, ctx: ctx})
+	}
+	return transactor.Transaction(ctx, func(tx Transaction) error {
+		return fn(&encryptedTransaction{DB: DB, Tx: tx, ctx: ctx})
+	})
+}
+
+type encryptedTransaction struct {
+	DB  *EncryptedDatabase
+	Tx  Transaction
+	ctx context.Context
+}
+
+func (Tx *encryptedTransaction) Get(namespace string, key string) (string, error) {
+	stored, err := Tx.Tx.Get(namespace, key)
+	if err != nil {
+		return "", err
+	}
+	return Tx.DB.decrypt(Tx.ctx, namespace, key, stored)
+}
+
+func (Tx *encryptedTransaction) SetWithTTL(namespace string, key string, value string, ttl time.Duration) error {
+	encrypted, err := Tx.DB.encrypt(Tx.ctx, namespace, key, value)
+	if err != nil {
+		return err
+	}
+	return Tx.Tx.SetWithTTL(namespace, key, encrypted, ttl)
+}
+
+func (Tx *encryptedTransaction) DeleteKey(namespace string, key string) error {
+	return Tx.Tx.DeleteKey(namespace, key)
+}
+
+// currentStored returns the stored value if its plaintext equals expected, the comparison
+// of the conditional operation in the wrapped database is then done on the ciphertext.
+func (DB *EncryptedDatabase) currentStored(ctx context.Context, namespace string, key string, expected string) (string, error) {
+	stored, err := DB.Database.Get(ctx, namespace, key)
+	if err != nil {
+		if _, ok := err.(*ErrNotFound); ok {
+			return "", &ErrPreconditionFailed{Value: key}
+		}
+		return "", err
+	}
+	current, err := DB.decrypt(ctx, namespace, key, stored)
+	if err != nil {
+		return "", err
+	}
+	if current != expected {
+		return "", &ErrPreconditionFailed{Value: key}
+	}
+	return stored, nil
+}
+
+func (DB *EncryptedDatabase) CompareAndSet(ctx context.Context, namespace string, key string, expected *string, value string, ttl time.Duration) error {
+	encrypted, err := DB.encrypt(ctx, namespace, key, value)
+	if err != nil {
+		return err
+	}
+	if expected == nil {
+		return DB.Database.CompareAndSet(ctx, namespace, key, nil, encrypted, ttl)
+	}
+	stored, err := DB.currentStored(ctx, namespace, key, *expected)
+	if err != nil {
+		return err
+	}
+	return DB.Database.CompareAndSet(ctx, namespace, key, &stored, encrypted, ttl)
+}
+
+func (DB *EncryptedDatabase) CompareAndDelete(ctx context.Context, namespace string, key string, expected string) error {
+	stored, err := DB.currentStored(ctx, namespace, key, expected)
+	if err != nil {
+		return err
+	}
+	return DB.Database.CompareAndDelete(ctx, namespace, key, stored)
+}
+
+func (DB *EncryptedDatabase) AddVersion(ctx context.Context, namespace string, key string, version rest.KeyVersionV1, limit int) error {
+	var err error
+	version.Value, err = DB.encrypt(ctx, namespace, key, version.Value)
+	if err != nil {
+		return err
+	}
+	return DB.Database.AddVersion(ctx, namespace, key, version, limit)
+}
+
+func (DB *EncryptedDatabase) Versions(ctx context.Context, namespace string, key string) (rest.KeyHistoryV1, error) {
+	versions, err := DB.Database.Versions(ctx, namespace, key)
+	if err != nil {
+		return nil, err
+	}
+	for i := range versions {
+		versions[i].Value, err = DB.decrypt(ctx, namespace, key, versions[i].Value)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return versions, nil
+}
+
+// DeleteNamespace also deletes the data keys of the namespace
+func (DB *EncryptedDatabase) DeleteNamespace(ctx context.Context, namespace string) error {
+	err := DB.Database.DeleteNamespace(ctx, namespace)
+	if err != nil {
+		return err
+	}
+	DB.mutex.Lock()
+	delete(DB.dataKeys, namespace)
+	DB.mutex.Unlock()
+	err = DB.Database.DeleteKey(ctx, DB.GetSystemNS(), dataKeysPrefix+namespace)
+	if _, ok := err.(*ErrNotFound); ok {
+		return nil
+	}
+	return err
+}
+
+// Rotate re-wraps all data keys with the current master key, adds a new data key
+// to every namespace and re-encrypts all current values with it. Previous data keys
+// are kept so key history stays readable. Intended to run offline.
+func (DB *EncryptedDatabase) Rotate(ctx context.Context) (int, error) {
+	if rotator, ok := DB.Provider.(Rotator); ok {
+		err := rotator.Rotate()
+		if err != nil {
+			return 0, err
+		}
+	}
+	namespaces, err := DB.Database.Keys(ctx, "")
+	if err != nil {
+		return 0, err
+	}
+	systemIncluded := false
+	for _, namespace := range namespaces {
+		if namespace == DB.GetSystemNS() {
+			systemIncluded = true
+		}
+	}
+	if !systemIncluded {
+		namespaces = append(namespaces, DB.GetSystemNS())
+	}
+	count := 0
+	for _, namespace := range namespaces {
+		keys, err := DB.namespaceKeys(ctx, namespace, false, true)
+		if err != nil {
+			if _, ok := err.(*ErrNotFound); !ok {
+				return count, err
+			}
+			keys = &namespaceDataKeys{Keys: map[string][]byte{}}
+		}
+		err = newDataKey(keys)
+		if err != nil {
+			return count, err
+		}
+		record, err := DB.wrapRecord(keys)
+		if err != nil {
+			return count, err
+		}
+		encoded, _ := json.Marshal(record)
+		err = DB.Database.Set(ctx, DB.GetSystemNS(), dataKeysPrefix+namespace, string(encoded))
+		if err != nil {
+			return count, err
+		}
+		DB.mutex.Lock()
+		DB.dataKeys[namespace] = keys
+		DB.mutex.Unlock()
+		logger.Info("Rotated data keys", "function", "Rotate", "struct", "EncryptedDatabase", "namespace", namespace, "current", keys.Current, "master", DB.Provider.CurrentKeyID())
+
+		keyList, err := DB.Database.Keys(ctx, namespace)
+		if err != nil {
+			return count, err
+		}
+		for _, key := range keyList {
+			if namespace == DB.GetSystemNS() && strings.HasPrefix(key, dataKeysPrefix) {
+				continue
+			}
+			value, err := DB.Get(ctx, namespace, key)
+			if err != nil {
+				return count, fmt.Errorf("%v/%v: %w", namespace, key, err)
+			}
+			ttl, err := DB.Database.TTL(ctx, namespace, key)
+			if err != nil {
+				return count, fmt.Errorf("%v/%v: %w", namespace, key, err)
+			}
+			err = DB.SetWithTTL(ctx, namespace, key, value, ttl)
+			if err != nil {
+				return count, fmt.Errorf("%v/%v: %w", namespace, key, err)
+			}
+			count++
+		}
+	}
+	return count, nil
+}
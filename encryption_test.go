@@ -0,0 +1,202 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	b64 "encoding/base64"
+	"errors"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/SimonStiil/keyvaluedatabase/rest"
+)
+
+func Test_Encrypted_DB(t *testing.T) {
+	setupTestlogging()
+	fileName := "testencdb.yaml"
+	keyring := filepath.Join(t.TempDir(), "keyring")
+	defer os.Remove(fileName)
+	inner := &YamlDatabase{DatabaseName: fileName}
+	var DB *EncryptedDatabase
+	t.Run("initialize fresh db", func(t *testing.T) {
+		err := os.Remove(fileName)
+		if err != nil && !errors.Is(err, os.ErrNotExist) {
+			t.Fatal(err)
+		}
+		kms, err := NewLocalKMS(keyring)
+		if err != nil {
+			t.Fatal(err)
+		}
+		DB = NewEncryptedDatabase(inner, kms)
+		DB.Init()
+		err = DB.CreateNamespace(context.Background(), "secrets")
+		if err != nil {
+			t.Fatal(err)
+		}
+	})
+	testValue := "very secret"
+	t.Run("set and get value", func(t *testing.T) {
+		err := DB.SetWithTTL(context.Background(), "secrets", "key", testValue, time.Hour)
+		if err != nil {
+			t.Fatalf("Failed to set value: %v", err)
+		}
+		val, err := DB.Get(context.Background(), "secrets", "key")
+		if err != nil || val != testValue {
+			t.Errorf("Expected %v, got %v (%v)", testValue, val, err)
+		}
+		raw, err := inner.Get(context.Background(), "secrets", "key")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !strings.HasPrefix(raw, encryptedPrefix) || strings.Contains(raw, testValue) {
+			t.Errorf("Value stored unencrypted: %v", raw)
+		}
+	})
+	t.Run("plaintext values still readable", func(t *testing.T) {
+		inner.Set(context.Background(), "secrets", "legacy", "plain")
+		val, err := DB.Get(context.Background(), "secrets", "legacy")
+		if err != nil || val != "plain" {
+			t.Errorf("Expected plain, got %v (%v)", val, err)
+		}
+	})
+	t.Run("compare and set", func(t *testing.T) {
+		wrong := "wrong"
+		err := DB.CompareAndSet(context.Background(), "secrets", "key", &wrong, "new", 0)
+		if _, ok := err.(*ErrPreconditionFailed); !ok {
+			t.Errorf("Expected ErrPreconditionFailed got %v", err)
+		}
+		err = DB.CompareAndSet(context.Background(), "secrets", "key", &testValue, "new", 0)
+		if err != nil {
+			t.Errorf("Expected compare and set to succeed got %v", err)
+		}
+		err = DB.CompareAndDelete(context.Background(), "secrets", "key", "new")
+		if err != nil {
+			t.Errorf("Expected compare and delete to succeed got %v", err)
+		}
+		err = DB.CompareAndSet(context.Background(), "secrets", "key", nil, testValue, time.Hour)
+		if err != nil {
+			t.Errorf("Expected create to succeed got %v", err)
+		}
+	})
+	t.Run("history encrypted", func(t *testing.T) {
+		err := DB.AddVersion(context.Background(), "secrets", "key", rest.KeyVersionV1{Value: testValue, Timestamp: time.Now()}, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		raw, _ := inner.Versions(context.Background(), "secrets", "key")
+		if len(raw) != 1 || strings.Contains(raw[0].Value, testValue) {
+			t.Errorf("History stored unencrypted: %+v", raw)
+		}
+		versions, err := DB.Versions(context.Background(), "secrets", "key")
+		if err != nil || len(versions) != 1 || versions[0].Value != testValue {
+			t.Errorf("Expected decrypted history got %+v (%v)", versions, err)
+		}
+	})
+	t.Run("transaction encrypted", func(t *testing.T) {
+		testTransaction(t, DB, "secrets")
+		raw, _ := inner.Get(context.Background(), "secrets", "new")
+		if !strings.HasPrefix(raw, encryptedPrefix) {
+			t.Errorf("Transaction stored unencrypted value %v", raw)
+		}
+	})
+	t.Run("rotate", func(t *testing.T) {
+		before, _ := inner.Get(context.Background(), "secrets", "key")
+		previousMaster := DB.Provider.CurrentKeyID()
+		time.Sleep(time.Millisecond)
+		count, err := DB.Rotate(context.Background())
+		if err != nil {
+			t.Fatalf("Rotation failed: %v", err)
+		}
+		if count < 2 {
+			t.Errorf("Expected at least 2 re-encrypted values got %v", count)
+		}
+		if DB.Provider.CurrentKeyID() == previousMaster {
+			t.Errorf("Expected new master key")
+		}
+		after, _ := inner.Get(context.Background(), "secrets", "key")
+		if before == after {
+			t.Errorf("Expected value to be re-encrypted")
+		}
+		legacy, _ := inner.Get(context.Background(), "secrets", "legacy")
+		if !strings.HasPrefix(legacy, encryptedPrefix) {
+			t.Errorf("Expected plaintext value to be encrypted by rotation")
+		}
+		ttl, _ := DB.TTL(context.Background(), "secrets", "key")
+		if ttl <= 0 {
+			t.Errorf("Expected ttl to be preserved got %v", ttl)
+		}
+	})
+	t.Run("delete namespace deletes data keys", func(t *testing.T) {
+		err := DB.Set(context.Background(), "deleted", "key", testValue)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = DB.DeleteNamespace(context.Background(), "deleted")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := inner.Get(context.Background(), DB.GetSystemNS(), dataKeysPrefix+"deleted"); err == nil {
+			t.Errorf("Data keys of deleted namespace kept")
+		}
+	})
+	t.Run("reopen", func(t *testing.T) {
+		DB.Close()
+		kms, err := NewLocalKMS(keyring)
+		if err != nil {
+			t.Fatal(err)
+		}
+		DB = NewEncryptedDatabase(&YamlDatabase{DatabaseName: fileName}, kms)
+		DB.Init()
+		val, err := DB.Get(context.Background(), "secrets", "key")
+		if err != nil || val != testValue {
+			t.Errorf("Expected %v, got %v (%v)", testValue, val, err)
+		}
+		versions, err := DB.Versions(context.Background(), "secrets", "key")
+		if err != nil || len(versions) != 1 || versions[0].Value != testValue {
+			t.Errorf("Expected history readable with previous data key got %+v (%v)", versions, err)
+		}
+		DB.Close()
+	})
+}
+
+func Test_StaticKeyProvider(t *testing.T) {
+	newKey := func() string {
+		key := make([]byte, 32)
+		rand.Read(key)
+		return b64.StdEncoding.EncodeToString(key)
+	}
+	oldKey := newKey()
+	oldFile := filepath.Join(t.TempDir(), "old.key")
+	os.WriteFile(oldFile, []byte(oldKey+"\n"), 0600)
+	old, err := NewStaticKeyProvider(oldKey, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	id, wrapped, err := old.Wrap([]byte("datakey"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	current, err := NewStaticKeyProvider(newKey(), []string{oldFile})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if current.CurrentKeyID() == id {
+		t.Errorf("Expected different key ids")
+	}
+	dataKey, err := current.Unwrap(id, wrapped)
+	if err != nil || string(dataKey) != "datakey" {
+		t.Errorf("Expected to unwrap with previous key got %v (%v)", string(dataKey), err)
+	}
+	_, err = old.Unwrap(current.CurrentKeyID(), wrapped)
+	if status := writeErrorStatus(err); status != http.StatusInternalServerError {
+		t.Errorf("Expected missing master key to be a server error, got %v (%v)", status, err)
+	}
+	_, err = NewStaticKeyProvider("c2hvcnQ=", nil)
+	if err == nil {
+		t.Errorf("Expected error for short master key")
+	}
+}
@@ -0,0 +1,77 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+	"strings"
+)
+
+// Precondition is the state a key must be in for a conditional write to succeed
+type Precondition struct {
+	Expected *string // nil requires the key to not exist
+}
+
+func ETag(value string) string {
+	hash := sha256.Sum256([]byte(value))
+	return `"` + hex.EncodeToString(hash[:16]) + `"`
+}
+
+func etagMatches(header string, etag string) bool {
+	for _, candidate := range strings.Split(header, ",") {
+		candidate = strings.TrimPrefix(strings.TrimSpace(candidate), "W/")
+		if candidate == "*" || candidate == etag {
+			return true
+		}
+	}
+	return false
+}
+
+// preconditions evaluates If-Match and If-None-Match against the current value.
+// A nil Precondition means the request is unconditional.
+func (api *APIv1) preconditions(request *RequestParameters) (*Precondition, int) {
+	debugLogger := request.Logger.Ext.With("function", "preconditions")
+	ifMatch := request.orgRequest.Header.Get("If-Match")
+	ifNoneMatch := request.orgRequest.Header.Get("If-None-Match")
+	if ifMatch == "" && ifNoneMatch == "" {
+		return nil, http.StatusOK
+	}
+	current, err := App.DB.Get(request.Context(), request.Namespace, request.Key)
+	exists := err == nil
+	if !exists {
+		if _, ok := err.(*ErrNotFound); !ok {
+			debugLogger.Debug("Error getting key from db", "Error", err)
+			return nil, writeErrorStatus(err)
+		}
+	}
+	currentETag := ETag(current)
+	debugLogger.Debug("Evaluating preconditions", "if-match", ifMatch, "if-none-match", ifNoneMatch, "exists", exists, "etag", currentETag)
+	if ifMatch != "" && (!exists || !etagMatches(ifMatch, currentETag)) {
+		return nil, http.StatusPreconditionFailed
+	}
+	if ifNoneMatch != "" && exists && etagMatches(ifNoneMatch, currentETag) {
+		return nil, http.StatusPreconditionFailed
+	}
+	if exists {
+		return &Precondition{Expected: &current}, http.StatusOK
+	}
+	return &Precondition{}, http.StatusOK
+}
+
+func (api *APIv1) setKey(request *RequestParameters, precondition *Precondition, key string, value string) error {
+	if precondition == nil {
+		return App.DB.SetWithTTL(request.Context(), request.Namespace, key, value, attachmentTTL(request.Attachment))
+	}
+	return App.DB.CompareAndSet(request.Context(), request.Namespace, key, precondition.Expected, value, attachmentTTL(request.Attachment))
+}
+
+func (api *APIv1) deleteKey(request *RequestParameters, precondition *Precondition) error {
+	if precondition == nil {
+		return App.DB.DeleteKey(request.Context(), request.Namespace, request.Key)
+	}
+	if precondition.Expected == nil {
+		// Key does not exist, nothing to delete
+		return nil
+	}
+	return App.DB.CompareAndDelete(request.Context(), request.Namespace, request.Key, *precondition.Expected)
+}
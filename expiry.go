@@ -0,0 +1,84 @@
+package main
+
+import (
+	"context"
+	"time"
+)
+
+// Databases without native key expiry implement Expirer so expired keys can
+// be removed by the background reaper.
+type Expirer interface {
+	DeleteExpired(ctx context.Context) (int, error)
+}
+
+type ExpiryReaper struct {
+	DB       Expirer
+	Interval time.Duration
+	stop     chan struct{}
+}
+
+func (Reaper *ExpiryReaper) Start() {
+	if Reaper.Interval <= 0 {
+		Reaper.Interval = time.Minute
+	}
+	Reaper.stop = make(chan struct{})
+	logger.Debug("Starting expiry reaper", "function", "Start", "struct", "ExpiryReaper", "interval", Reaper.Interval)
+	go Reaper.run()
+}
+
+func (Reaper *ExpiryReaper) run() {
+	ticker := time.NewTicker(Reaper.Interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-Reaper.stop:
+			return
+		case <-ticker.C:
+			Reaper.Reap()
+		}
+	}
+}
+
+// Reap deletes the expired keys, a sweep taking longer than Interval is cancelled
+func (Reaper *ExpiryReaper) Reap() {
+	timeout := Reaper.Interval
+	if timeout <= 0 {
+		timeout = time.Minute
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	count, err := Reaper.DB.DeleteExpired(ctx)
+	if err != nil {
+		logger.Error("Failed to delete expired keys", "function", "Reap", "struct", "ExpiryReaper", "error", err)
+		return
+	}
+	if count > 0 {
+		logger.Debug("Deleted expired keys", "function", "Reap", "struct", "ExpiryReaper", "count", count)
+	}
+}
+
+func (Reaper *ExpiryReaper) Stop() {
+	if Reaper.stop != nil {
+		close(Reaper.stop)
+		Reaper.stop = nil
+	}
+}
+
+// Expiry is stored as unix milliseconds, 0 means the key never expires.
+func expiryFromTTL(ttl time.Duration) int64 {
+	if ttl <= 0 {
+		return 0
+	}
+	return time.Now().Add(ttl).UnixMilli()
+}
+
+func ttlFromExpiry(expiry int64) time.Duration {
+	if expiry == 0 {
+		return 0
+	}
+	return time.Until(time.UnixMilli(expiry))
+}
+
+func isExpired(expiry int64) bool {
+	return expiry != 0 && expiry <= time.Now().UnixMilli()
+}
@@ -0,0 +1,385 @@
+package main
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/sha512"
+	b64 "encoding/base64"
+	"encoding/json"
+	"fmt"
+	"hash"
+	"io"
+	"math/big"
+	"net/http"
+	"os"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/spf13/viper"
+)
+
+type ConfigJWT struct {
+	Enabled       bool               `mapstructure:"enabled"`
+	JWKSFile      string             `mapstructure:"jwksFile"`
+	JWKSURL       string             `mapstructure:"jwksURL"`
+	CacheTTL      time.Duration      `mapstructure:"cacheTTL"`
+	Issuer        string             `mapstructure:"issuer"`
+	Audiences     []string           `mapstructure:"audiences"`
+	UsernameClaim string             `mapstructure:"usernameClaim"`
+	Leeway        time.Duration      `mapstructure:"leeway"`
+	Mappings      []ConfigJWTMapping `mapstructure:"mappings"`
+}
+
+// ConfigJWTMapping grants Permissionsset when Claim contains one of Values, or any value if Values is empty.
+// Claim is a / separated path like kubernetes.io/namespace, {value} in namespaces is replaced by the matched value.
+type ConfigJWTMapping struct {
+	Claim          string                 `mapstructure:"claim"`
+	Values         []string               `mapstructure:"values"`
+	Permissionsset []ConfigPermissionsset `mapstructure:"permissionsset"`
+}
+
+func JWTGetDefaults(configReader *viper.Viper) {
+	configReader.SetDefault("jwt.enabled", false)
+	configReader.SetDefault("jwt.cacheTTL", "10m")
+	configReader.SetDefault("jwt.usernameClaim", "sub")
+	configReader.SetDefault("jwt.leeway", "30s")
+}
+
+// JWKS holds the verification keys from a JWKS file or URL, refreshed after CacheTTL
+// or when a token is signed by an unknown key.
+type JWKS struct {
+	File     string
+	URL      string
+	CacheTTL time.Duration
+	client   *http.Client
+	mutex    sync.RWMutex
+	keys     map[string]crypto.PublicKey
+	fetched  time.Time
+}
+
+type jsonWebKey struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Use string `json:"use"`
+	Alg string `json:"alg"`
+	N   string `json:"n"`
+	E   string `json:"e"`
+	Crv string `json:"crv"`
+	X   string `json:"x"`
+	Y   string `json:"y"`
+}
+
+// Minimum time between refreshes triggered by unknown key ids
+const jwksMinRefresh = 10 * time.Second
+
+func (JWKS *JWKS) Key(kid string) (crypto.PublicKey, error) {
+	JWKS.mutex.RLock()
+	key, ok := JWKS.keys[kid]
+	age := time.Since(JWKS.fetched)
+	JWKS.mutex.RUnlock()
+	if ok && age < JWKS.CacheTTL {
+		return key, nil
+	}
+	if ok || JWKS.keys == nil || age >= jwksMinRefresh {
+		err := JWKS.refresh()
+		if err != nil {
+			if ok {
+				logger.Warn("Unable to refresh JWKS, using cached keys", "function", "Key", "struct", "JWKS", "error", err)
+				return key, nil
+			}
+			return nil, err
+		}
+		JWKS.mutex.RLock()
+		key, ok = JWKS.keys[kid]
+		JWKS.mutex.RUnlock()
+	}
+	if !ok {
+		return nil, &ErrNotFound{Value: "jwks key " + kid}
+	}
+	return key, nil
+}
+
+func (JWKS *JWKS) read() ([]byte, error) {
+	if JWKS.File != "" {
+		return os.ReadFile(JWKS.File)
+	}
+	if JWKS.client == nil {
+		JWKS.client = &http.Client{Timeout: 10 * time.Second}
+	}
+	response, err := JWKS.client.Get(JWKS.URL)
+	if err != nil {
+		return nil, err
+	}
+	defer response.Body.Close()
+	if response.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("jwks %v returned %v", JWKS.URL, response.Status)
+	}
+	return io.ReadAll(response.Body)
+}
+
+func (JWKS *JWKS) refresh() error {
+	JWKS.mutex.Lock()
+	defer JWKS.mutex.Unlock()
+	JWKS.fetched = time.Now()
+	content, err := JWKS.read()
+	if err != nil {
+		return err
+	}
+	var set struct {
+		Keys []jsonWebKey `json:"keys"`
+	}
+	err = json.Unmarshal(content, &set)
+	if err != nil {
+		return err
+	}
+	keys := map[string]crypto.PublicKey{}
+	for _, jwk := range set.Keys {
+		if jwk.Use != "" && jwk.Use != "sig" {
+			continue
+		}
+		key, err := jwk.publicKey()
+		if err != nil {
+			logger.Warn("Skipping JWKS key", "function", "refresh", "struct", "JWKS", "kid", jwk.Kid, "error", err)
+			continue
+		}
+		keys[jwk.Kid] = key
+	}
+	JWKS.keys = keys
+	logger.Debug("Loaded JWKS", "function", "refresh", "struct", "JWKS", "keys", len(keys))
+	return nil
+}
+
+func decodeBigInt(encoded string) (*big.Int, error) {
+	bytes, err := b64.RawURLEncoding.DecodeString(encoded)
+	if err != nil {
+		return nil, err
+	}
+	return new(big.Int).SetBytes(bytes), nil
+}
+
+func (jwk *jsonWebKey) publicKey() (crypto.PublicKey, error) {
+	switch jwk.Kty {
+	case "RSA":
+		n, err := decodeBigInt(jwk.N)
+		if err != nil {
+			return nil, err
+		}
+		e, err := decodeBigInt(jwk.E)
+		if err != nil {
+			return nil, err
+		}
+		return &rsa.PublicKey{N: n, E: int(e.Int64())}, nil
+	case "EC":
+		var curve elliptic.Curve
+		switch jwk.Crv {
+		case "P-256":
+			curve = elliptic.P256()
+		case "P-384":
+			curve = elliptic.P384()
+		case "P-521":
+			curve = elliptic.P521()
+		default:
+			return nil, fmt.Errorf("unsupported curve %v", jwk.Crv)
+		}
+		x, err := decodeBigInt(jwk.X)
+		if err != nil {
+			return nil, err
+		}
+		y, err := decodeBigInt(jwk.Y)
+		if err != nil {
+			return nil, err
+		}
+		return &ecdsa.PublicKey{Curve: curve, X: x, Y: y}, nil
+	case "OKP":
+		if jwk.Crv != "Ed25519" {
+			return nil, fmt.Errorf("unsupported curve %v", jwk.Crv)
+		}
+		x, err := b64.RawURLEncoding.DecodeString(jwk.X)
+		if err != nil {
+			return nil, err
+		}
+		return ed25519.PublicKey(x), nil
+	}
+	return nil, fmt.Errorf("unsupported key type %v", jwk.Kty)
+}
+
+type JWTVerifier struct {
+	Config ConfigJWT
+	JWKS   *JWKS
+}
+
+func NewJWTVerifier(config ConfigJWT) (*JWTVerifier, error) {
+	if config.JWKSFile == "" && config.JWKSURL == "" {
+		return nil, fmt.Errorf("jwt requires jwksFile or jwksURL")
+	}
+	return &JWTVerifier{Config: config, JWKS: &JWKS{File: config.JWKSFile, URL: config.JWKSURL, CacheTTL: config.CacheTTL}}, nil
+}
+
+// isJWT tells JWTs apart from API tokens
+func isJWT(bearer string) bool {
+	return strings.Count(bearer, ".") == 2
+}
+
+func verifySignature(alg string, key crypto.PublicKey, signed []byte, signature []byte) error {
+	var hashFunc crypto.Hash
+	var hasher hash.Hash
+	switch alg {
+	case "RS256", "ES256":
+		hashFunc, hasher = crypto.SHA256, sha256.New()
+	case "RS384", "ES384":
+		hashFunc, hasher = crypto.SHA384, sha512.New384()
+	case "RS512", "ES512":
+		hashFunc, hasher = crypto.SHA512, sha512.New()
+	case "EdDSA":
+		edKey, ok := key.(ed25519.PublicKey)
+		if !ok || !ed25519.Verify(edKey, signed, signature) {
+			return fmt.Errorf("invalid signature")
+		}
+		return nil
+	default:
+		return fmt.Errorf("unsupported alg %v", alg)
+	}
+	hasher.Write(signed)
+	digest := hasher.Sum(nil)
+	switch key := key.(type) {
+	case *rsa.PublicKey:
+		if !strings.HasPrefix(alg, "RS") {
+			return fmt.Errorf("alg %v does not match rsa key", alg)
+		}
+		return rsa.VerifyPKCS1v15(key, hashFunc, digest, signature)
+	case *ecdsa.PublicKey:
+		size := (key.Curve.Params().BitSize + 7) / 8
+		if !strings.HasPrefix(alg, "ES") || len(signature) != 2*size {
+			return fmt.Errorf("alg %v does not match ecdsa key", alg)
+		}
+		r := new(big.Int).SetBytes(signature[:size])
+		s := new(big.Int).SetBytes(signature[size:])
+		if !ecdsa.Verify(key, digest, r, s) {
+			return fmt.Errorf("invalid signature")
+		}
+		return nil
+	}
+	return fmt.Errorf("alg %v does not match key", alg)
+}
+
+// Verify checks signature, issuer, audience and time claims and returns the claims of the token
+func (Verifier *JWTVerifier) Verify(token string) (map[string]any, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, &ErrMalformRequest{Value: "jwt"}
+	}
+	var header struct {
+		Alg string `json:"alg"`
+		Kid string `json:"kid"`
+	}
+	headerJSON, err := b64.RawURLEncoding.DecodeString(parts[0])
+	if err != nil {
+		return nil, err
+	}
+	err = json.Unmarshal(headerJSON, &header)
+	if err != nil {
+		return nil, err
+	}
+	signature, err := b64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, err
+	}
+	key, err := Verifier.JWKS.Key(header.Kid)
+	if err != nil {
+		return nil, err
+	}
+	err = verifySignature(header.Alg, key, []byte(parts[0]+"."+parts[1]), signature)
+	if err != nil {
+		return nil, err
+	}
+	claimsJSON, err := b64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil {
+		return nil, err
+	}
+	claims := map[string]any{}
+	err = json.Unmarshal(claimsJSON, &claims)
+	if err != nil {
+		return nil, err
+	}
+	now := time.Now()
+	exp, ok := claims["exp"].(float64)
+	if !ok || now.After(time.Unix(int64(exp), 0).Add(Verifier.Config.Leeway)) {
+		return nil, &ErrNotAllowed{Value: "expired jwt"}
+	}
+	if nbf, ok := claims["nbf"].(float64); ok && now.Add(Verifier.Config.Leeway).Before(time.Unix(int64(nbf), 0)) {
+		return nil, &ErrNotAllowed{Value: "jwt before nbf"}
+	}
+	if Verifier.Config.Issuer != "" && claims["iss"] != Verifier.Config.Issuer {
+		return nil, &ErrNotAllowed{Value: fmt.Sprintf("jwt issuer %v", claims["iss"])}
+	}
+	if len(Verifier.Config.Audiences) > 0 {
+		audienceOk := false
+		for _, audience := range claimValues(claims, "aud") {
+			if slices.Contains(Verifier.Config.Audiences, audience) {
+				audienceOk = true
+			}
+		}
+		if !audienceOk {
+			return nil, &ErrNotAllowed{Value: fmt.Sprintf("jwt audience %v", claims["aud"])}
+		}
+	}
+	return claims, nil
+}
+
+// claimValues returns the string values of a / separated claim path, a list claim returns all its strings
+func claimValues(claims map[string]any, path string) []string {
+	var current any = claims
+	for _, part := range strings.Split(path, "/") {
+		object, ok := current.(map[string]any)
+		if !ok {
+			return nil
+		}
+		current = object[part]
+	}
+	switch value := current.(type) {
+	case string:
+		return []string{value}
+	case []any:
+		values := []string{}
+		for _, item := range value {
+			if text, ok := item.(string); ok {
+				values = append(values, text)
+			}
+		}
+		return values
+	}
+	return nil
+}
+
+// User maps the claims onto a User with the permissions of all matching mappings and returns it with its username
+func (Verifier *JWTVerifier) User(claims map[string]any) (*User, string) {
+	sets := []ConfigPermissionsset{}
+	for _, mapping := range Verifier.Config.Mappings {
+		for _, value := range claimValues(claims, mapping.Claim) {
+			if len(mapping.Values) > 0 && !slices.Contains(mapping.Values, value) {
+				continue
+			}
+			for _, set := range mapping.Permissionsset {
+				namespaces := []string{}
+				for _, namespace := range set.Namespaces {
+					// Claim values are escaped so a value can not widen the pattern
+					namespaces = append(namespaces, strings.ReplaceAll(namespace, "{value}", escapeNamespacePattern(value)))
+				}
+				sets = append(sets, ConfigPermissionsset{Namespaces: namespaces, Keys: set.Keys, Permissions: set.Permissions, Deny: set.Deny})
+			}
+		}
+	}
+	user := &User{}
+	user.SetPermissions(sets)
+	username := ""
+	if values := claimValues(claims, Verifier.Config.UsernameClaim); len(values) > 0 {
+		username = values[0]
+	}
+	return user, username
+}
@@ -0,0 +1,174 @@
+package main
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	b64 "encoding/base64"
+	"encoding/json"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func signTestJWT(t *testing.T, alg string, kid string, key crypto.Signer, claims map[string]any) string {
+	header, _ := json.Marshal(map[string]string{"alg": alg, "kid": kid, "typ": "JWT"})
+	payload, _ := json.Marshal(claims)
+	signed := b64.RawURLEncoding.EncodeToString(header) + "." + b64.RawURLEncoding.EncodeToString(payload)
+	digest := sha256.Sum256([]byte(signed))
+	var signature []byte
+	var err error
+	switch key := key.(type) {
+	case *rsa.PrivateKey:
+		signature, err = rsa.SignPKCS1v15(rand.Reader, key, crypto.SHA256, digest[:])
+	case *ecdsa.PrivateKey:
+		var r, s *big.Int
+		r, s, err = ecdsa.Sign(rand.Reader, key, digest[:])
+		signature = append(r.FillBytes(make([]byte, 32)), s.FillBytes(make([]byte, 32))...)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	return signed + "." + b64.RawURLEncoding.EncodeToString(signature)
+}
+
+func writeTestJWKS(t *testing.T, fileName string, rsaKey *rsa.PrivateKey, ecKey *ecdsa.PrivateKey) {
+	encode := func(i *big.Int) string { return b64.RawURLEncoding.EncodeToString(i.Bytes()) }
+	jwks := map[string]any{"keys": []map[string]string{
+		{"kty": "RSA", "kid": "rsa", "use": "sig", "n": encode(rsaKey.N), "e": encode(big.NewInt(int64(rsaKey.E)))},
+		{"kty": "EC", "kid": "ec", "crv": "P-256", "x": encode(ecKey.X), "y": encode(ecKey.Y)},
+	}}
+	content, _ := json.Marshal(jwks)
+	err := os.WriteFile(fileName, content, 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestJWT(t *testing.T) {
+	setupTestlogging()
+	rsaKey, _ := rsa.GenerateKey(rand.Reader, 2048)
+	ecKey, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	otherKey, _ := rsa.GenerateKey(rand.Reader, 2048)
+	jwksFile := filepath.Join(t.TempDir(), "jwks.json")
+	writeTestJWKS(t, jwksFile, rsaKey, ecKey)
+	issuer := "https://kubernetes.default.svc"
+	config := ConfigJWT{
+		JWKSFile:      jwksFile,
+		CacheTTL:      time.Minute,
+		Issuer:        issuer,
+		Audiences:     []string{"kvdb"},
+		UsernameClaim: "sub",
+		Mappings: []ConfigJWTMapping{
+			{Claim: "kubernetes.io/namespace", Permissionsset: []ConfigPermissionsset{
+				{Namespaces: []string{"{value}"}, Permissions: ConfigPermissions{Read: true, List: true}}}},
+			{Claim: "groups", Values: []string{"writers"}, Permissionsset: []ConfigPermissionsset{
+				{Namespaces: []string{"shared"}, Permissions: ConfigPermissions{Write: true}}}},
+		},
+	}
+	verifier, err := NewJWTVerifier(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	claims := func(modify func(map[string]any)) map[string]any {
+		result := map[string]any{
+			"iss":           issuer,
+			"aud":           []string{"kvdb"},
+			"sub":           "system:serviceaccount:ci:builder",
+			"exp":           time.Now().Add(time.Hour).Unix(),
+			"groups":        []string{"writers"},
+			"kubernetes.io": map[string]any{"namespace": "ci"},
+		}
+		if modify != nil {
+			modify(result)
+		}
+		return result
+	}
+	t.Run("valid tokens", func(t *testing.T) {
+		for _, token := range []string{
+			signTestJWT(t, "RS256", "rsa", rsaKey, claims(nil)),
+			signTestJWT(t, "ES256", "ec", ecKey, claims(nil)),
+		} {
+			_, err := verifier.Verify(token)
+			if err != nil {
+				t.Errorf("Expected valid token got %v", err)
+			}
+		}
+	})
+	invalid := map[string]string{
+		"wrong audience": signTestJWT(t, "RS256", "rsa", rsaKey, claims(func(c map[string]any) { c["aud"] = "other" })),
+		"wrong issuer":   signTestJWT(t, "RS256", "rsa", rsaKey, claims(func(c map[string]any) { c["iss"] = "other" })),
+		"expired":        signTestJWT(t, "RS256", "rsa", rsaKey, claims(func(c map[string]any) { c["exp"] = time.Now().Add(-time.Hour).Unix() })),
+		"no expiry":      signTestJWT(t, "RS256", "rsa", rsaKey, claims(func(c map[string]any) { delete(c, "exp") })),
+		"wrong key":      signTestJWT(t, "RS256", "rsa", otherKey, claims(nil)),
+		"unknown kid":    signTestJWT(t, "RS256", "missing", rsaKey, claims(nil)),
+		"alg mismatch":   signTestJWT(t, "ES256", "rsa", rsaKey, claims(nil)),
+		"alg none":       b64.RawURLEncoding.EncodeToString([]byte(`{"alg":"none","kid":"rsa"}`)) + "." + b64.RawURLEncoding.EncodeToString([]byte(`{"sub":"x"}`)) + ".",
+	}
+	for name, token := range invalid {
+		t.Run(name, func(t *testing.T) {
+			_, err := verifier.Verify(token)
+			if err == nil {
+				t.Errorf("Expected %v to be rejected", name)
+			}
+		})
+	}
+	t.Run("claims mapping", func(t *testing.T) {
+		request, _ := http.NewRequest(http.MethodGet, "/v1/ci/key", nil)
+		request.Header.Set("Authorization", "Bearer "+signTestJWT(t, "RS256", "rsa", rsaKey, claims(nil)))
+		requestParameters := GetRequestParameters(request, 0)
+		auth := &Auth{JWT: verifier}
+		if !auth.Authentication(requestParameters) {
+			t.Fatalf("Expected jwt authentication to succeed")
+		}
+		if requestParameters.GetUserName() != "system:serviceaccount:ci:builder" {
+			t.Errorf("Username got %v", requestParameters.GetUserName())
+		}
+		user := requestParameters.Authentication.User
+		if !user.Autorization(requestParameters, &ConfigPermissions{Read: true}) {
+			t.Errorf("Expected read on namespace from claim")
+		}
+		if user.Autorization(requestParameters, &ConfigPermissions{Write: true}) {
+			t.Errorf("Unexpected write on namespace from claim")
+		}
+		requestParameters.Namespace = "shared"
+		if !user.Autorization(requestParameters, &ConfigPermissions{Write: true}) {
+			t.Errorf("Expected write from group mapping")
+		}
+		requestParameters.Namespace = "other"
+		if user.Autorization(requestParameters, &ConfigPermissions{Read: true}) {
+			t.Errorf("Unexpected read on unmapped namespace")
+		}
+	})
+	t.Run("jwks url cached", func(t *testing.T) {
+		fetches := 0
+		content, _ := os.ReadFile(jwksFile)
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			fetches++
+			w.Write(content)
+		}))
+		defer server.Close()
+		urlConfig := config
+		urlConfig.JWKSFile = ""
+		urlConfig.JWKSURL = server.URL
+		urlVerifier, _ := NewJWTVerifier(urlConfig)
+		token := signTestJWT(t, "RS256", "rsa", rsaKey, claims(nil))
+		for i := 0; i < 3; i++ {
+			_, err := urlVerifier.Verify(token)
+			if err != nil {
+				t.Fatalf("Expected valid token got %v", err)
+			}
+		}
+		urlVerifier.Verify(signTestJWT(t, "RS256", "missing", rsaKey, claims(nil)))
+		if fetches != 1 {
+			t.Errorf("Expected jwks to be fetched once got %v", fetches)
+		}
+	})
+}
@@ -0,0 +1,255 @@
+package main
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	b64 "encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/spf13/viper"
+)
+
+type ConfigEncryption struct {
+	Enabled          bool     `mapstructure:"enabled"`
+	Provider         string   `mapstructure:"provider"`
+	KeyFile          string   `mapstructure:"keyFile"`
+	EnvVariableName  string   `mapstructure:"envVariableName"`
+	PreviousKeyFiles []string `mapstructure:"previousKeyFiles"`
+	KMSDirectory     string   `mapstructure:"kmsDirectory"`
+}
+
+func EncryptionGetDefaults(configReader *viper.Viper) {
+	configReader.SetDefault("encryption.enabled", false)
+	configReader.SetDefault("encryption.provider", "file")
+	configReader.SetDefault("encryption.keyFile", "master.key")
+	configReader.SetDefault("encryption.envVariableName", BaseENVname+"_MASTER_KEY")
+	configReader.SetDefault("encryption.kmsDirectory", "keyring")
+}
+
+// KeyProvider wraps and unwraps data keys with a master key that never leaves the provider
+type KeyProvider interface {
+	// Wrap encrypts a data key with the current master key and returns the id of the master key used
+	Wrap(dataKey []byte) (keyID string, wrapped []byte, err error)
+	Unwrap(keyID string, wrapped []byte) ([]byte, error)
+	CurrentKeyID() string
+}
+
+// Providers that can create a new master key implement Rotator
+type Rotator interface {
+	Rotate() error
+}
+
+func NewKeyProvider(config ConfigEncryption) (KeyProvider, error) {
+	switch config.Provider {
+	case "file":
+		key, err := os.ReadFile(config.KeyFile)
+		if err != nil {
+			return nil, err
+		}
+		return NewStaticKeyProvider(string(key), config.PreviousKeyFiles)
+	case "env":
+		key := os.Getenv(config.EnvVariableName)
+		if key == "" {
+			return nil, fmt.Errorf("master key environment variable %v is empty", config.EnvVariableName)
+		}
+		return NewStaticKeyProvider(key, config.PreviousKeyFiles)
+	case "kms":
+		return NewLocalKMS(config.KMSDirectory)
+	}
+	return nil, fmt.Errorf("unknown encryption provider: %v", config.Provider)
+}
+
+func decodeMasterKey(encoded string) ([]byte, error) {
+	key, err := b64.StdEncoding.DecodeString(strings.TrimSpace(encoded))
+	if err != nil {
+		return nil, err
+	}
+	if len(key) != 32 {
+		return nil, fmt.Errorf("master key has wrong length %d should be 32", len(key))
+	}
+	return key, nil
+}
+
+func masterKeyID(key []byte) string {
+	hash := sha256.Sum256(key)
+	return hex.EncodeToString(hash[:4])
+}
+
+func sealAESGCM(key []byte, plaintext []byte, additionalData []byte) ([]byte, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	gcm, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	nonce := make([]byte, gcm.NonceSize())
+	_, err = rand.Read(nonce)
+	if err != nil {
+		return nil, err
+	}
+	return gcm.Seal(nonce, nonce, plaintext, additionalData), nil
+}
+
+func openAESGCM(key []byte, sealed []byte, additionalData []byte) ([]byte, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	gcm, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	if len(sealed) < gcm.NonceSize() {
+		return nil, fmt.Errorf("ciphertext too short")
+	}
+	nonce, ciphertext := sealed[:gcm.NonceSize()], sealed[gcm.NonceSize():]
+	return gcm.Open(nil, nonce, ciphertext, additionalData)
+}
+
+// StaticKeyProvider holds the master key from a file or environment variable,
+// previous keys are kept so data keys wrapped before a rotation can be unwrapped.
+type StaticKeyProvider struct {
+	current string
+	keys    map[string][]byte
+}
+
+func NewStaticKeyProvider(encodedKey string, previousKeyFiles []string) (*StaticKeyProvider, error) {
+	key, err := decodeMasterKey(encodedKey)
+	if err != nil {
+		return nil, err
+	}
+	provider := &StaticKeyProvider{current: masterKeyID(key), keys: map[string][]byte{}}
+	provider.keys[provider.current] = key
+	for _, fileName := range previousKeyFiles {
+		encoded, err := os.ReadFile(fileName)
+		if err != nil {
+			return nil, err
+		}
+		previous, err := decodeMasterKey(string(encoded))
+		if err != nil {
+			return nil, fmt.Errorf("%v: %w", fileName, err)
+		}
+		provider.keys[masterKeyID(previous)] = previous
+	}
+	return provider, nil
+}
+
+func (Provider *StaticKeyProvider) CurrentKeyID() string {
+	return Provider.current
+}
+
+func (Provider *StaticKeyProvider) Wrap(dataKey []byte) (string, []byte, error) {
+	wrapped, err := sealAESGCM(Provider.keys[Provider.current], dataKey, []byte(Provider.current))
+	return Provider.current, wrapped, err
+}
+
+func (Provider *StaticKeyProvider) Unwrap(keyID string, wrapped []byte) ([]byte, error) {
+	key, ok := Provider.keys[keyID]
+	if !ok {
+		return nil, &ErrInvalidConfig{Value: "master key " + keyID, Err: errors.New("not found")}
+	}
+	return openAESGCM(key, wrapped, []byte(keyID))
+}
+
+// LocalKMS is a stand-in for an external KMS keeping a keyring of master keys
+// in a directory. Each key is a file named <id>.key, the newest id is current.
+type LocalKMS struct {
+	Directory string
+	mutex     sync.RWMutex
+	current   string
+	keys      map[string][]byte
+}
+
+func NewLocalKMS(directory string) (*LocalKMS, error) {
+	kms := &LocalKMS{Directory: directory}
+	err := kms.load()
+	if err != nil {
+		return nil, err
+	}
+	if kms.current == "" {
+		logger.Info("No master keys in keyring, creating one", "function", "NewLocalKMS", "struct", "LocalKMS", "directory", directory)
+		err = kms.Rotate()
+	}
+	return kms, err
+}
+
+func (KMS *LocalKMS) load() error {
+	err := os.MkdirAll(KMS.Directory, 0700)
+	if err != nil {
+		return err
+	}
+	files, err := filepath.Glob(filepath.Join(KMS.Directory, "*.key"))
+	if err != nil {
+		return err
+	}
+	sort.Strings(files)
+	KMS.keys = map[string][]byte{}
+	for _, fileName := range files {
+		encoded, err := os.ReadFile(fileName)
+		if err != nil {
+			return err
+		}
+		key, err := decodeMasterKey(string(encoded))
+		if err != nil {
+			return fmt.Errorf("%v: %w", fileName, err)
+		}
+		id := strings.TrimSuffix(filepath.Base(fileName), ".key")
+		KMS.keys[id] = key
+		KMS.current = id
+	}
+	return nil
+}
+
+func (KMS *LocalKMS) Rotate() error {
+	KMS.mutex.Lock()
+	defer KMS.mutex.Unlock()
+	key := make([]byte, 32)
+	_, err := rand.Read(key)
+	if err != nil {
+		return err
+	}
+	id := time.Now().UTC().Format("20060102T150405.000000000Z")
+	err = os.WriteFile(filepath.Join(KMS.Directory, id+".key"), []byte(b64.StdEncoding.EncodeToString(key)), 0600)
+	if err != nil {
+		return err
+	}
+	KMS.keys[id] = key
+	KMS.current = id
+	logger.Info("Created new master key", "function", "Rotate", "struct", "LocalKMS", "id", id)
+	return nil
+}
+
+func (KMS *LocalKMS) CurrentKeyID() string {
+	KMS.mutex.RLock()
+	defer KMS.mutex.RUnlock()
+	return KMS.current
+}
+
+func (KMS *LocalKMS) Wrap(dataKey []byte) (string, []byte, error) {
+	KMS.mutex.RLock()
+	defer KMS.mutex.RUnlock()
+	wrapped, err := sealAESGCM(KMS.keys[KMS.current], dataKey, []byte(KMS.current))
+	return KMS.current, wrapped, err
+}
+
+func (KMS *LocalKMS) Unwrap(keyID string, wrapped []byte) ([]byte, error) {
+	KMS.mutex.RLock()
+	defer KMS.mutex.RUnlock()
+	key, ok := KMS.keys[keyID]
+	if !ok {
+		return nil, &ErrInvalidConfig{Value: "master key " + keyID, Err: errors.New("not found")}
+	}
+	return openAESGCM(key, wrapped, []byte(keyID))
+}
@@ -1,33 +1,53 @@
 package main
 
 import (
+	"context"
 	"fmt"
 	"os"
+	"slices"
 	"strings"
+	"sync/atomic"
+	"time"
 
 	"database/sql"
 
 	"github.com/SimonStiil/keyvaluedatabase/rest"
-	_ "github.com/go-sql-driver/mysql"
+	"github.com/go-sql-driver/mysql"
 	"github.com/spf13/viper"
 )
 
 type MariaDatabase struct {
-	Initialized  bool
+	Initialized  atomic.Bool
 	Connection   *sql.DB
 	Config       *ConfigMysql
 	Password     string
 	DatabaseName string
+	statements   statementCache
 }
 
 type ConfigMysql struct {
-	Address         string `mapstructure:"address"`
-	Username        string `mapstructure:"username"`
-	DatabaseName    string `mapstructure:"databaseName"`
-	SystemTableName string `mapstructure:"systemTableName"`
-	EnvVariableName string `mapstructure:"envVariableName"`
-	KeyName         string `mapstructure:"keyName"`
-	ValueName       string `mapstructure:"valueName"`
+	Address            string        `mapstructure:"address"`
+	Username           string        `mapstructure:"username"`
+	DatabaseName       string        `mapstructure:"databaseName"`
+	SystemTableName    string        `mapstructure:"systemTableName"`
+	EnvVariableName    string        `mapstructure:"envVariableName"`
+	KeyName            string        `mapstructure:"keyName"`
+	ValueName          string        `mapstructure:"valueName"`
+	ExpiryName         string        `mapstructure:"expiryName"`
+	HistoryTableName   string        `mapstructure:"historyTableName"`
+	Layout             string        `mapstructure:"layout"` // table or single, see MariaSingleTableDatabase
+	DataTableName      string        `mapstructure:"dataTableName"`
+	NamespaceTableName string        `mapstructure:"namespaceTableName"`
+	SchemaTableName    string        `mapstructure:"schemaTableName"`
+	TLS                ConfigTLS     `mapstructure:"tls"`
+	Pool               ConfigSQLPool `mapstructure:"pool"`
+	Charset            string        `mapstructure:"charset"`
+	Collation          string        `mapstructure:"collation"` // Default collation of charset if empty
+	ConnectTimeout     time.Duration `mapstructure:"connectTimeout"`
+	ReadTimeout        time.Duration `mapstructure:"readTimeout"` // 0 for no limit
+	WriteTimeout       time.Duration `mapstructure:"writeTimeout"`
+	StartupTimeout     time.Duration `mapstructure:"startupTimeout"`     // Time Init retries connecting to an unavailable database
+	StatementCacheSize int           `mapstructure:"statementCacheSize"` // Prepared statements kept, 0 prepares on every use
 }
 
 func MariaDBGetDefaults(configReader *viper.Viper) {
@@ -38,69 +58,457 @@ func MariaDBGetDefaults(configReader *viper.Viper) {
 	configReader.SetDefault("mysql.envVariableName", BaseENVname+"_MYSQL_PASSWORD")
 	configReader.SetDefault("mysql.keyName", "key")
 	configReader.SetDefault("mysql.valueName", "value")
+	configReader.SetDefault("mysql.expiryName", "expiry")
+	configReader.SetDefault("mysql.historyTableName", "kvdb_history")
+	configReader.SetDefault("mysql.layout", LayoutTable)
+	configReader.SetDefault("mysql.tls.enabled", false)
+	configReader.SetDefault("mysql.tls.insecureSkipVerify", false)
+	SQLPoolGetDefaults(configReader, "mysql")
+	configReader.SetDefault("mysql.charset", "utf8mb4")
+	configReader.SetDefault("mysql.collation", "")
+	configReader.SetDefault("mysql.connectTimeout", "10s")
+	configReader.SetDefault("mysql.readTimeout", "0s")
+	configReader.SetDefault("mysql.writeTimeout", "0s")
+	configReader.SetDefault("mysql.startupTimeout", "1m")
+	configReader.SetDefault("mysql.statementCacheSize", 256)
+	configReader.SetDefault("mysql.dataTableName", "kvdb_data")
+	configReader.SetDefault("mysql.namespaceTableName", "kvdb_namespaces")
+	configReader.SetDefault("mysql.schemaTableName", "kvdb_schema")
 }
 
-func (MDB *MariaDatabase) Init() {
+func (MDB *MariaDatabase) Init() error {
 
 	logger.Debug("Initializing MariaDB", "function", "Init", "struct", "MariaDatabase")
+	connection, err := MDB.connect()
+	if err != nil {
+		return err
+	}
+	err = MDB.createTables(connection)
+	if err != nil {
+		// Init is retried by Reconnect, which opens a new pool
+		connection.Close()
+		return &ErrUnavailable{Value: "mysql", Err: err}
+	}
+	MDB.publish(connection)
+	logger.Debug("Initialization complete", "function", "Init", "struct", "MariaDatabase")
+	return nil
+}
+
+// publish makes connection the pool of the database once Init succeeded,
+// Health and the requests only use the pool when the database is initialized.
+func (MDB *MariaDatabase) publish(connection *sql.DB) {
+	MDB.Connection = connection
+	MDB.statements.Size = MDB.Config.StatementCacheSize
+	MDB.Initialized.Store(true)
+}
+
+func (MDB *MariaDatabase) createTables(connection *sql.DB) error {
+	_, err := connection.Exec(MDB.createTableStatement(MDB.Config.SystemTableName))
+	if err != nil {
+		return err
+	}
+	err = MDB.createHistoryTable(connection)
+	if err != nil {
+		return err
+	}
+	return MDB.upgradeExpiryColumns(connection)
+}
+
+// connectionConfig returns the driver configuration, it holds the password and is never logged
+func (MDB *MariaDatabase) connectionConfig() (*mysql.Config, error) {
+	config := mysql.NewConfig()
+	config.User = MDB.Config.Username
+	config.Passwd = MDB.Password
+	config.Net = "tcp"
+	config.Addr = MDB.Config.Address
+	config.DBName = MDB.DatabaseName
+	config.Timeout = MDB.Config.ConnectTimeout
+	config.ReadTimeout = MDB.Config.ReadTimeout
+	config.WriteTimeout = MDB.Config.WriteTimeout
+	tlsConfig, err := MDB.Config.TLS.ClientConfig()
+	if err != nil {
+		return nil, err
+	}
+	if tlsConfig != nil && tlsConfig.ServerName == "" {
+		tlsConfig.ServerName, _, _ = strings.Cut(MDB.Config.Address, ":")
+	}
+	config.TLS = tlsConfig
+	if MDB.Config.Charset != "" {
+		err = config.Apply(mysql.Charset(MDB.Config.Charset, MDB.Config.Collation))
+	}
+	return config, err
+}
+
+// connect opens a pool and waits for the database, the pool is closed by the caller when Init fails
+func (MDB *MariaDatabase) connect() (*sql.DB, error) {
 	if MDB.Config.DatabaseName == "" {
 		MDB.DatabaseName = MDB.Config.Username
 	} else {
 		MDB.DatabaseName = MDB.Config.DatabaseName
 	}
 	MDB.Password = os.Getenv(MDB.Config.EnvVariableName)
-	var err error
-	connectionString := fmt.Sprintf("%v:%v@tcp(%v)/%v", MDB.Config.Username, MDB.Password, MDB.Config.Address, MDB.DatabaseName)
-
-	logger.Debug("Connection string: "+connectionString, "function", "Init", "struct", "MariaDatabase")
-	MDB.Connection, err = sql.Open("mysql", connectionString)
+	config, err := MDB.connectionConfig()
 	if err != nil {
-		panic(err.Error())
+		return nil, &ErrInvalidConfig{Value: "mysql", Err: err}
 	}
-	_, err = MDB.Connection.Exec(fmt.Sprintf("CREATE TABLE IF NOT EXISTS `%v` ( `%v` CHAR(%v) PRIMARY KEY, `%v` VARCHAR(%v) NOT NULL) ENGINE = InnoDB; ", MDB.Config.SystemTableName, MDB.Config.KeyName, rest.KeyMaxLength, MDB.Config.ValueName, rest.ValueMaxLength))
+	logger.Debug("Connecting", "function", "connect", "struct", "MariaDatabase", "address", config.Addr, "database", config.DBName, "user", config.User, "tls", MDB.Config.TLS.Enabled)
+	connector, err := mysql.NewConnector(config)
 	if err != nil {
-		panic(err.Error())
+		return nil, &ErrInvalidConfig{Value: "mysql", Err: err}
 	}
-	MDB.Initialized = true
-	err = MDB.CreateNamespace(MDB.GetSystemNS())
+	connection := sql.OpenDB(connector)
+	MDB.Config.Pool.Apply(connection)
+	err = waitForDatabase(connection, MDB.Config.StartupTimeout)
 	if err != nil {
-		panic(err.Error())
+		connection.Close()
+		return nil, &ErrUnavailable{Value: "mysql", Err: err}
 	}
-	logger.Debug("Initialization complete", "function", "Init", "struct", "MariaDatabase")
+	return connection, nil
+}
+
+// Health pings the database, it is reported by /system/health
+func (MDB *MariaDatabase) Health(ctx context.Context) error {
+	if !MDB.Initialized.Load() {
+		return errNotInitialized
+	}
+	ctx, cancel := context.WithTimeout(ctx, healthTimeout)
+	defer cancel()
+	return MDB.Connection.PingContext(ctx)
+}
+
+func (MDB *MariaDatabase) createHistoryTable(connection *sql.DB) error {
+	_, err := connection.Exec(fmt.Sprintf("CREATE TABLE IF NOT EXISTS `%v` ( `namespace` CHAR(%v) NOT NULL, `key` CHAR(%v) NOT NULL, `version` INT NOT NULL, `value` VARCHAR(%v) NOT NULL, `user` VARCHAR(%v) NOT NULL, `timestamp` BIGINT NOT NULL, PRIMARY KEY (`namespace`, `key`, `version`)) ENGINE = InnoDB; ",
+		MDB.Config.HistoryTableName, rest.KeyMaxLength, rest.KeyMaxLength, rest.ValueMaxLength, rest.KeyMaxLength))
+	return err
+}
+
+func (MDB *MariaDatabase) createTableStatement(namespace string) string {
+	return fmt.Sprintf("CREATE TABLE IF NOT EXISTS `%v` ( `%v` CHAR(%v) PRIMARY KEY, `%v` VARCHAR(%v) NOT NULL, `%v` BIGINT NOT NULL DEFAULT 0) ENGINE = InnoDB; ",
+		namespace, MDB.Config.KeyName, rest.KeyMaxLength, MDB.Config.ValueName, rest.ValueMaxLength, MDB.Config.ExpiryName)
+}
+
+// Tables created before expiry support are missing the expiry column
+func (MDB *MariaDatabase) upgradeExpiryColumns(connection *sql.DB) error {
+	tables, err := queryStrings(connection, "show TABLES")
+	if err != nil {
+		return err
+	}
+	for _, namespace := range tables {
+		if namespace == MDB.Config.HistoryTableName {
+			continue
+		}
+		_, err = connection.Exec(fmt.Sprintf("ALTER TABLE `%v` ADD COLUMN IF NOT EXISTS `%v` BIGINT NOT NULL DEFAULT 0", namespace, MDB.Config.ExpiryName))
+		if err != nil {
+			logger.Error("Error adding expiry column", "function", "upgradeExpiryColumns", "struct", "MariaDatabase", "namespace", namespace, "error", err)
+			return err
+		}
+	}
+	return nil
 }
 func (MDB *MariaDatabase) GetSystemNS() string {
 	return MDB.Config.SystemTableName
 }
 
-func (MDB *MariaDatabase) Set(namespace string, key string, value interface{}) error {
-	if !MDB.Initialized {
-		panic("F Unable to set. db not initialized()")
+func (MDB *MariaDatabase) Set(ctx context.Context, namespace string, key string, value interface{}) error {
+	return MDB.SetWithTTL(ctx, namespace, key, value, 0)
+}
+
+func (MDB *MariaDatabase) SetWithTTL(ctx context.Context, namespace string, key string, value interface{}, ttl time.Duration) error {
+	if !MDB.Initialized.Load() {
+		return errNotInitialized
+	}
+	if err := validateNamespace(namespace); err != nil {
+		return err
+	}
+	query := fmt.Sprintf("INSERT INTO `%v` (`%v`, `%v`, `%v`) VALUES (?, ?, ?) ON DUPLICATE KEY UPDATE `%v`=?, `%v`=?", namespace, MDB.Config.KeyName, MDB.Config.ValueName, MDB.Config.ExpiryName, MDB.Config.ValueName, MDB.Config.ExpiryName)
+	expiry := expiryFromTTL(ttl)
+	_, err := MDB.exec(ctx, namespace, "set", query, key, value, expiry, value, expiry)
+	if isMariaTableMissing(err) {
+		// The table is created by the first key of a namespace
+		err = MDB.CreateNamespace(ctx, namespace)
+		if err == nil {
+			_, err = MDB.exec(ctx, namespace, "set", query, key, value, expiry, value, expiry)
+		}
 	}
-	MDB.CreateNamespace(namespace)
-	statement, err := MDB.Connection.Prepare(fmt.Sprintf("INSERT INTO `%v` (`%v`, `%v`) VALUES (?, ?) ON DUPLICATE KEY UPDATE `%v`=?", namespace, MDB.Config.KeyName, MDB.Config.ValueName, MDB.Config.ValueName))
+	if err != nil {
+		logger.Error("Exec failed with error", "function", "SetWithTTL", "struct", "MariaDatabase", "namespace", namespace, "key", key, "error", err)
+	}
+	return err
+}
+
+// exec runs query as the cached statement name of namespace
+func (MDB *MariaDatabase) exec(ctx context.Context, namespace string, name string, query string, args ...any) (sql.Result, error) {
+	statement, release, err := MDB.statements.Prepare(ctx, MDB.Connection, namespace, name, query)
+	if err != nil {
+		return nil, err
+	}
+	defer release()
+	return statement.ExecContext(ctx, args...)
+}
+
+// queryRow runs query as the cached statement name of namespace and scans the row into dest
+func (MDB *MariaDatabase) queryRow(ctx context.Context, namespace string, name string, query string, args []any, dest ...any) error {
+	statement, release, err := MDB.statements.Prepare(ctx, MDB.Connection, namespace, name, query)
 	if err != nil {
 		return err
 	}
-	_, err = statement.Exec(key, value, value)
+	defer release()
+	return statement.QueryRowContext(ctx, args...).Scan(dest...)
+}
+
+// query runs query as the cached statement name of namespace, release must be called when done with the rows
+func (MDB *MariaDatabase) query(ctx context.Context, namespace string, name string, query string, args ...any) (*sql.Rows, func(), error) {
+	statement, release, err := MDB.statements.Prepare(ctx, MDB.Connection, namespace, name, query)
+	if err != nil {
+		return nil, nil, err
+	}
+	rows, err := statement.QueryContext(ctx, args...)
 	if err != nil {
+		release()
+		return nil, nil, err
+	}
+	return rows, release, nil
+}
+
+// isMariaTableMissing is true for errors of statements on a namespace without a table
+func isMariaTableMissing(err error) bool {
+	return err != nil && strings.Contains(err.Error(), "Error 1146 (42S02)")
+}
+
+func (MDB *MariaDatabase) CompareAndSet(ctx context.Context, namespace string, key string, expected *string, value string, ttl time.Duration) error {
+	if !MDB.Initialized.Load() {
+		return errNotInitialized
+	}
+	if err := validateNamespace(namespace); err != nil {
 		return err
 	}
-	return nil
+	err := MDB.compareAndSet(ctx, namespace, key, expected, value, ttl)
+	if isMariaTableMissing(err) {
+		// The table is created by the first key of a namespace
+		err = MDB.CreateNamespace(ctx, namespace)
+		if err == nil {
+			err = MDB.compareAndSet(ctx, namespace, key, expected, value, ttl)
+		}
+	}
+	return err
+}
+
+// compareAndSet is CompareAndSet on an existing table, a missing table is returned as the error of mysql
+// when expected is nil and as ErrPreconditionFailed otherwise.
+func (MDB *MariaDatabase) compareAndSet(ctx context.Context, namespace string, key string, expected *string, value string, ttl time.Duration) error {
+	tx, err := MDB.Connection.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	now := time.Now().UnixMilli()
+	if expected == nil {
+		// Expired rows not yet reaped would otherwise block the insert
+		_, err = tx.ExecContext(ctx, fmt.Sprintf("delete from `%v` where `%v` = ? and `%v` <> 0 and `%v` <= ?", namespace, MDB.Config.KeyName, MDB.Config.ExpiryName, MDB.Config.ExpiryName), key, now)
+		if isMariaTableMissing(err) {
+			return err
+		} else if err != nil {
+			logger.Error("Exec failed with error", "function", "CompareAndSet", "struct", "MariaDatabase", "namespace", namespace, "key", key, "error", err)
+			return err
+		}
+		_, err = tx.ExecContext(ctx, fmt.Sprintf("INSERT INTO `%v` (`%v`, `%v`, `%v`) VALUES (?, ?, ?)", namespace, MDB.Config.KeyName, MDB.Config.ValueName, MDB.Config.ExpiryName), key, value, expiryFromTTL(ttl))
+		if err != nil {
+			if strings.Contains(err.Error(), "Error 1062") {
+				return &ErrPreconditionFailed{Value: key}
+			}
+			logger.Error("Exec failed with error", "function", "CompareAndSet", "struct", "MariaDatabase", "namespace", namespace, "key", key, "error", err)
+			return err
+		}
+		return tx.Commit()
+	}
+	var current string
+	err = tx.QueryRowContext(ctx, fmt.Sprintf("select `%v` from `%v` where `%v` = ? and (`%v` = 0 or `%v` > ?) FOR UPDATE", MDB.Config.ValueName, namespace, MDB.Config.KeyName, MDB.Config.ExpiryName, MDB.Config.ExpiryName), key, now).Scan(&current)
+	if err == sql.ErrNoRows || isMariaTableMissing(err) || err == nil && current != *expected {
+		return &ErrPreconditionFailed{Value: key}
+	} else if err != nil {
+		logger.Error("Query failed with error", "function", "CompareAndSet", "struct", "MariaDatabase", "namespace", namespace, "key", key, "error", err)
+		return err
+	}
+	_, err = tx.ExecContext(ctx, fmt.Sprintf("update `%v` set `%v` = ?, `%v` = ? where `%v` = ?", namespace, MDB.Config.ValueName, MDB.Config.ExpiryName, MDB.Config.KeyName), value, expiryFromTTL(ttl), key)
+	if err != nil {
+		logger.Error("Exec failed with error", "function", "CompareAndSet", "struct", "MariaDatabase", "namespace", namespace, "key", key, "error", err)
+		return err
+	}
+	return tx.Commit()
+}
+
+func (MDB *MariaDatabase) Atomic() bool {
+	return true
+}
+
+// Transaction runs fn in a SQL transaction. Creating a table ends a transaction in mysql, so when fn writes
+// to a namespace without a table the transaction is rolled back, the tables are created and fn is run again.
+// Tables created for a transaction that is not applied are dropped again while they are empty.
+func (MDB *MariaDatabase) Transaction(ctx context.Context, fn func(tx Transaction) error) error {
+	if !MDB.Initialized.Load() {
+		return errNotInitialized
+	}
+	missing, err := MDB.transaction(ctx, fn)
+	if len(missing) == 0 {
+		return err
+	}
+	for _, namespace := range missing {
+		err = MDB.CreateNamespace(ctx, namespace)
+		if err != nil {
+			MDB.dropEmptyNamespaces(ctx, missing)
+			return err
+		}
+	}
+	_, err = MDB.transaction(ctx, fn)
+	if err != nil {
+		MDB.dropEmptyNamespaces(ctx, missing)
+	}
+	return err
+}
+
+// transaction runs fn in a SQL transaction which is only committed if fn wrote to no missing table
+func (MDB *MariaDatabase) transaction(ctx context.Context, fn func(tx Transaction) error) ([]string, error) {
+	tx, err := MDB.Connection.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+	transaction := &mariaTransaction{MDB: MDB, Tx: tx, ctx: ctx}
+	err = fn(transaction)
+	if err != nil || len(transaction.missing) > 0 {
+		return transaction.missing, err
+	}
+	return nil, tx.Commit()
+}
+
+// dropEmptyNamespaces drops the tables created for a transaction that was not applied
+func (MDB *MariaDatabase) dropEmptyNamespaces(ctx context.Context, namespaces []string) {
+	ctx = context.WithoutCancel(ctx)
+	for _, namespace := range namespaces {
+		count, err := MDB.CountKeys(ctx, namespace)
+		if err == nil && count == 0 {
+			err = MDB.DeleteNamespace(ctx, namespace)
+		}
+		if err != nil {
+			logger.Error("Unable to drop table of namespace", "function", "dropEmptyNamespaces", "struct", "MariaDatabase", "namespace", namespace, "error", err)
+		}
+	}
+}
+
+type mariaTransaction struct {
+	MDB     *MariaDatabase
+	Tx      *sql.Tx
+	ctx     context.Context
+	missing []string // namespaces written without a table
+}
+
+func (Tx *mariaTransaction) Get(namespace string, key string) (string, error) {
+	if err := validateNamespace(namespace); err != nil {
+		return "", err
+	}
+	var value string
+	err := Tx.Tx.QueryRowContext(Tx.ctx, fmt.Sprintf("select `%v` from `%v` where `%v` = ? and (`%v` = 0 or `%v` > ?) FOR UPDATE", Tx.MDB.Config.ValueName, namespace, Tx.MDB.Config.KeyName, Tx.MDB.Config.ExpiryName, Tx.MDB.Config.ExpiryName), key, time.Now().UnixMilli()).Scan(&value)
+	if err == sql.ErrNoRows {
+		return "", &ErrNotFound{Value: key}
+	} else if err != nil {
+		if isMariaTableMissing(err) {
+			return "", &ErrNotFound{Value: namespace}
+		}
+		logger.Error("Query failed with error", "function", "Get", "struct", "mariaTransaction", "namespace", namespace, "key", key, "error", err)
+		return "", err
+	}
+	return value, nil
+}
+
+func (Tx *mariaTransaction) SetWithTTL(namespace string, key string, value string, ttl time.Duration) error {
+	if err := validateNamespace(namespace); err != nil {
+		return err
+	}
+	expiry := expiryFromTTL(ttl)
+	_, err := Tx.Tx.ExecContext(Tx.ctx, fmt.Sprintf("INSERT INTO `%v` (`%v`, `%v`, `%v`) VALUES (?, ?, ?) ON DUPLICATE KEY UPDATE `%v`=?, `%v`=?", namespace, Tx.MDB.Config.KeyName, Tx.MDB.Config.ValueName, Tx.MDB.Config.ExpiryName, Tx.MDB.Config.ValueName, Tx.MDB.Config.ExpiryName), key, value, expiry, value, expiry)
+	if isMariaTableMissing(err) {
+		if !slices.Contains(Tx.missing, namespace) {
+			Tx.missing = append(Tx.missing, namespace)
+		}
+	} else if err != nil {
+		logger.Error("Exec failed with error", "function", "SetWithTTL", "struct", "mariaTransaction", "namespace", namespace, "key", key, "error", err)
+	}
+	return err
+}
+
+func (Tx *mariaTransaction) DeleteKey(namespace string, key string) error {
+	if err := validateNamespace(namespace); err != nil {
+		return err
+	}
+	_, err := Tx.Tx.ExecContext(Tx.ctx, fmt.Sprintf("delete from `%v` where `%v` = ?", namespace, Tx.MDB.Config.KeyName), key)
+	if err != nil {
+		if isMariaTableMissing(err) {
+			return nil
+		}
+		logger.Error("Exec failed with error", "function", "DeleteKey", "struct", "mariaTransaction", "namespace", namespace, "key", key, "error", err)
+	}
+	return err
+}
+
+func (MDB *MariaDatabase) TTL(ctx context.Context, namespace string, key string) (time.Duration, error) {
+	if !MDB.Initialized.Load() {
+		return 0, errNotInitialized
+	}
+	if err := validateNamespace(namespace); err != nil {
+		return 0, err
+	}
+	var expiry int64
+	err := MDB.queryRow(ctx, namespace, "ttl", fmt.Sprintf("select `%v` from `%v` where `%v` = ? and (`%v` = 0 or `%v` > ?)", MDB.Config.ExpiryName, namespace, MDB.Config.KeyName, MDB.Config.ExpiryName, MDB.Config.ExpiryName),
+		[]any{key, time.Now().UnixMilli()}, &expiry)
+	if err != nil {
+		if err == sql.ErrNoRows || isMariaTableMissing(err) {
+			return 0, &ErrNotFound{Value: key}
+		}
+		logger.Error("Query failed with error", "function", "TTL", "struct", "MariaDatabase", "namespace", namespace, "error", err)
+		return 0, err
+	}
+	return ttlFromExpiry(expiry), nil
+}
+
+func (MDB *MariaDatabase) DeleteExpired(ctx context.Context) (int, error) {
+	if !MDB.Initialized.Load() {
+		return 0, errNotInitialized
+	}
+	namespaces, err := MDB.Keys(ctx, "")
+	if err != nil {
+		return 0, err
+	}
+	count := 0
+	now := time.Now().UnixMilli()
+	for _, namespace := range namespaces {
+		result, err := MDB.Connection.ExecContext(ctx, fmt.Sprintf("delete from `%v` where `%v` <> 0 and `%v` <= ?", namespace, MDB.Config.ExpiryName, MDB.Config.ExpiryName), now)
+		if err != nil {
+			logger.Error("Exec failed with error", "function", "DeleteExpired", "struct", "MariaDatabase", "namespace", namespace, "error", err)
+			return count, err
+		}
+		affected, _ := result.RowsAffected()
+		count += int(affected)
+	}
+	return count, nil
 }
 
-func (MDB *MariaDatabase) Get(namespace string, key string) (string, error) {
-	if !MDB.Initialized {
-		panic("F Unable to get. db not initialized()")
+func (MDB *MariaDatabase) Get(ctx context.Context, namespace string, key string) (string, error) {
+	if !MDB.Initialized.Load() {
+		return "", errNotInitialized
+	}
+	if err := validateNamespace(namespace); err != nil {
+		return "", err
 	}
-	rows, err := MDB.Connection.Query(fmt.Sprintf("select * from `%v` where `%v` = ? ", namespace, MDB.Config.KeyName), key)
+	rows, release, err := MDB.query(ctx, namespace, "get", fmt.Sprintf("select `%v`, `%v` from `%v` where `%v` = ? and (`%v` = 0 or `%v` > ?)", MDB.Config.KeyName, MDB.Config.ValueName, namespace, MDB.Config.KeyName, MDB.Config.ExpiryName, MDB.Config.ExpiryName), key, time.Now().UnixMilli())
 
 	if err != nil {
-		if strings.Contains(err.Error(), "Error 1146 (42S02)") {
+		if isMariaTableMissing(err) {
 			return "", &ErrNotFound{Value: namespace}
 		}
 		logger.Error("Query failed with error", "function", "Get", "struct", "MariaDatabase", "namespace", namespace, "error", err)
 		return "", err
 	}
+	defer release()
 	defer rows.Close()
 	kvpair := rest.KVPairV2{}
 	found := false
@@ -119,16 +527,19 @@ func (MDB *MariaDatabase) Get(namespace string, key string) (string, error) {
 	}
 }
 
-func (MDB *MariaDatabase) Keys(namespace string) ([]string, error) {
-	if !MDB.Initialized {
-		panic("F Unable to get. db not initialized()")
+func (MDB *MariaDatabase) Keys(ctx context.Context, namespace string) ([]string, error) {
+	if !MDB.Initialized.Load() {
+		return nil, errNotInitialized
+	}
+	if err := validateNamespace(namespace); err != nil {
+		return nil, err
 	}
 	var rows *sql.Rows
 	var err error
 	if namespace == "" {
-		rows, err = MDB.Connection.Query("show TABLES")
+		rows, err = MDB.Connection.QueryContext(ctx, "show TABLES")
 	} else {
-		rows, err = MDB.Connection.Query(fmt.Sprintf("select `%v` from `%v`", MDB.Config.KeyName, namespace))
+		rows, err = MDB.Connection.QueryContext(ctx, fmt.Sprintf("select `%v` from `%v` where `%v` = 0 or `%v` > ?", MDB.Config.KeyName, namespace, MDB.Config.ExpiryName, MDB.Config.ExpiryName), time.Now().UnixMilli())
 	}
 	if err != nil {
 		logger.Error("Query failed with error", "function", "Keys", "struct", "MariaDatabase", "namespace", namespace, "error", err)
@@ -143,21 +554,110 @@ func (MDB *MariaDatabase) Keys(namespace string) ([]string, error) {
 			logger.Error("Scan row failed with error", "function", "Keys", "struct", "MariaDatabase", "namespace", namespace, "error", err)
 			return keys, err
 		}
+		if namespace == "" && key == MDB.Config.HistoryTableName {
+			continue
+		}
 		keys = append(keys, key)
 	}
 	return keys, nil
 }
 
-func (MDB *MariaDatabase) DeleteKey(namespace string, key string) error {
-	if !MDB.Initialized {
-		panic("F Unable to get. db not initialized()")
+// keysPageQuery returns the query listing a page of the keys of namespace, or of the namespaces when it is empty
+func (MDB *MariaDatabase) keysPageQuery(namespace string, options ListOptions, last string, now int64) (string, []any) {
+	args := []any{}
+	arg := func(value any) string {
+		args = append(args, value)
+		return "?"
+	}
+	column := fmt.Sprintf("`%v`", MDB.Config.KeyName)
+	var query string
+	if namespace == "" {
+		column = "TABLE_NAME"
+		query = fmt.Sprintf("select %v from information_schema.TABLES where TABLE_SCHEMA = DATABASE() and %v <> %v", column, column, arg(MDB.Config.HistoryTableName))
+	} else {
+		query = fmt.Sprintf("select %v from `%v` where (`%v` = 0 or `%v` > %v)", column, namespace, MDB.Config.ExpiryName, MDB.Config.ExpiryName, arg(now))
+	}
+	if options.Cursor != "" {
+		query += fmt.Sprintf(" and %v > %v", column, arg(last))
+	}
+	if options.Prefix != "" {
+		query += fmt.Sprintf(" and %v like %v", column, arg(likePrefix(options.Prefix)))
+	}
+	if options.Match != "" {
+		query += fmt.Sprintf(" and %v regexp %v", column, arg(globToRegexp(options.Match)))
+	}
+	query += " order by " + column
+	if options.Limit > 0 {
+		query += " limit " + arg(options.Limit+1)
+	}
+	return query, args
+}
+
+// KeysPage filters and pages in the query, the cursor is the last key of the previous page.
+// Keys are filtered again as the table collation can make LIKE and REGEXP case insensitive.
+func (MDB *MariaDatabase) KeysPage(ctx context.Context, namespace string, options ListOptions) ([]string, string, error) {
+	if !MDB.Initialized.Load() {
+		return nil, "", errNotInitialized
+	}
+	if err := validateNamespace(namespace); err != nil {
+		return nil, "", err
+	}
+	last, err := decodeCursor(options.Cursor)
+	if err != nil {
+		return nil, "", err
 	}
-	stmt, err := MDB.Connection.Prepare(fmt.Sprintf("delete from `%v` where `%v` = ?", namespace, MDB.Config.KeyName))
+	query, args := MDB.keysPageQuery(namespace, options, last, time.Now().UnixMilli())
+	rows, err := MDB.Connection.QueryContext(ctx, query, args...)
 	if err != nil {
-		logger.Error("Prepare failed with error", "function", "DeleteKey", "struct", "MariaDatabase", "namespace", namespace, "key", key, "error", err)
+		logger.Error("Query failed with error", "function", "KeysPage", "struct", "MariaDatabase", "namespace", namespace, "error", err)
+		return nil, "", err
+	}
+	defer rows.Close()
+	keys := []string{}
+	scanned := 0
+	for rows.Next() {
+		var key string
+		err = rows.Scan(&key)
+		if err != nil {
+			logger.Error("Scan row failed with error", "function", "KeysPage", "struct", "MariaDatabase", "namespace", namespace, "error", err)
+			return nil, "", err
+		}
+		if options.Limit > 0 && scanned == options.Limit {
+			return keys, encodeCursor(last), nil
+		}
+		scanned++
+		last = key
+		if options.Matches(key) {
+			keys = append(keys, key)
+		}
+	}
+	return keys, "", rows.Err()
+}
+
+func (MDB *MariaDatabase) CountKeys(ctx context.Context, namespace string) (int, error) {
+	if !MDB.Initialized.Load() {
+		return 0, errNotInitialized
+	}
+	if err := validateNamespace(namespace); err != nil {
+		return 0, err
+	}
+	var count int
+	err := MDB.queryRow(ctx, namespace, "count", fmt.Sprintf("select count(*) from `%v` where `%v` = 0 or `%v` > ?", namespace, MDB.Config.ExpiryName, MDB.Config.ExpiryName),
+		[]any{time.Now().UnixMilli()}, &count)
+	if err != nil {
+		logger.Error("Query failed with error", "function", "CountKeys", "struct", "MariaDatabase", "namespace", namespace, "error", err)
+	}
+	return count, err
+}
+
+func (MDB *MariaDatabase) DeleteKey(ctx context.Context, namespace string, key string) error {
+	if !MDB.Initialized.Load() {
+		return errNotInitialized
+	}
+	if err := validateNamespace(namespace); err != nil {
 		return err
 	}
-	_, err = stmt.Exec(key)
+	_, err := MDB.exec(ctx, namespace, "delete", fmt.Sprintf("delete from `%v` where `%v` = ?", namespace, MDB.Config.KeyName), key)
 	if err != nil {
 		logger.Error("Exec failed with error", "function", "DeleteKey", "struct", "MariaDatabase", "namespace", namespace, "key", key, "error", err)
 		return err
@@ -165,11 +665,106 @@ func (MDB *MariaDatabase) DeleteKey(namespace string, key string) error {
 	return nil
 }
 
-func (MDB *MariaDatabase) CreateNamespace(namespace string) error {
-	if !MDB.Initialized {
-		panic("F Unable to get. db not initialized()")
+func (MDB *MariaDatabase) CompareAndDelete(ctx context.Context, namespace string, key string, expected string) error {
+	if !MDB.Initialized.Load() {
+		return errNotInitialized
+	}
+	if err := validateNamespace(namespace); err != nil {
+		return err
+	}
+	tx, err := MDB.Connection.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	var current string
+	err = tx.QueryRowContext(ctx, fmt.Sprintf("select `%v` from `%v` where `%v` = ? and (`%v` = 0 or `%v` > ?) FOR UPDATE", MDB.Config.ValueName, namespace, MDB.Config.KeyName, MDB.Config.ExpiryName, MDB.Config.ExpiryName), key, time.Now().UnixMilli()).Scan(&current)
+	if err == sql.ErrNoRows || err == nil && current != expected {
+		return &ErrPreconditionFailed{Value: key}
+	} else if err != nil {
+		logger.Error("Query failed with error", "function", "CompareAndDelete", "struct", "MariaDatabase", "namespace", namespace, "key", key, "error", err)
+		return err
+	}
+	_, err = tx.ExecContext(ctx, fmt.Sprintf("delete from `%v` where `%v` = ?", namespace, MDB.Config.KeyName), key)
+	if err != nil {
+		logger.Error("Exec failed with error", "function", "CompareAndDelete", "struct", "MariaDatabase", "namespace", namespace, "key", key, "error", err)
+		return err
+	}
+	return tx.Commit()
+}
+
+func (MDB *MariaDatabase) AddVersion(ctx context.Context, namespace string, key string, version rest.KeyVersionV1, limit int) error {
+	if !MDB.Initialized.Load() {
+		return errNotInitialized
 	}
-	result, err := MDB.Connection.Exec(fmt.Sprintf("CREATE TABLE IF NOT EXISTS `%v` ( `%v` CHAR(%v) PRIMARY KEY, `%v` VARCHAR(%v) NOT NULL) ENGINE = InnoDB; ", namespace, MDB.Config.KeyName, rest.KeyMaxLength, MDB.Config.ValueName, rest.ValueMaxLength))
+	tx, err := MDB.Connection.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	var latest int
+	err = tx.QueryRowContext(ctx, fmt.Sprintf("select COALESCE(MAX(`version`), 0) from `%v` where `namespace` = ? and `key` = ? FOR UPDATE", MDB.Config.HistoryTableName), namespace, key).Scan(&latest)
+	if err != nil {
+		logger.Error("Query failed with error", "function", "AddVersion", "struct", "MariaDatabase", "namespace", namespace, "key", key, "error", err)
+		return err
+	}
+	version.Version = latest + 1
+	_, err = tx.ExecContext(ctx, fmt.Sprintf("INSERT INTO `%v` (`namespace`, `key`, `version`, `value`, `user`, `timestamp`) VALUES (?, ?, ?, ?, ?, ?)", MDB.Config.HistoryTableName),
+		namespace, key, version.Version, version.Value, version.User, version.Timestamp.UnixMilli())
+	if err != nil {
+		logger.Error("Exec failed with error", "function", "AddVersion", "struct", "MariaDatabase", "namespace", namespace, "key", key, "error", err)
+		return err
+	}
+	if limit > 0 {
+		_, err = tx.ExecContext(ctx, fmt.Sprintf("delete from `%v` where `namespace` = ? and `key` = ? and `version` <= ?", MDB.Config.HistoryTableName),
+			namespace, key, version.Version-limit)
+		if err != nil {
+			logger.Error("Exec failed with error", "function", "AddVersion", "struct", "MariaDatabase", "namespace", namespace, "key", key, "error", err)
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+func (MDB *MariaDatabase) Versions(ctx context.Context, namespace string, key string) (rest.KeyHistoryV1, error) {
+	if !MDB.Initialized.Load() {
+		return rest.KeyHistoryV1{}, errNotInitialized
+	}
+	rows, err := MDB.Connection.QueryContext(ctx, fmt.Sprintf("select `version`, `value`, `user`, `timestamp` from `%v` where `namespace` = ? and `key` = ? order by `version` desc", MDB.Config.HistoryTableName), namespace, key)
+	if err != nil {
+		logger.Error("Query failed with error", "function", "Versions", "struct", "MariaDatabase", "namespace", namespace, "key", key, "error", err)
+		return nil, err
+	}
+	defer rows.Close()
+	versions := rest.KeyHistoryV1{}
+	for rows.Next() {
+		var version rest.KeyVersionV1
+		var timestamp int64
+		err = rows.Scan(&version.Version, &version.Value, &version.User, &timestamp)
+		if err != nil {
+			logger.Error("Scan row failed with error", "function", "Versions", "struct", "MariaDatabase", "namespace", namespace, "key", key, "error", err)
+			return nil, err
+		}
+		version.Timestamp = time.UnixMilli(timestamp)
+		versions = append(versions, version)
+	}
+	if len(versions) == 0 {
+		return nil, &ErrNotFound{Value: key}
+	}
+	return versions, nil
+}
+
+func (MDB *MariaDatabase) CreateNamespace(ctx context.Context, namespace string) error {
+	if !MDB.Initialized.Load() {
+		return errNotInitialized
+	}
+	if err := validateNamespace(namespace); err != nil {
+		return err
+	}
+	if namespace == MDB.Config.HistoryTableName {
+		return &ErrNotAllowed{Value: fmt.Sprintf("create namespace %v", namespace)}
+	}
+	result, err := MDB.Connection.ExecContext(ctx, MDB.createTableStatement(namespace))
 	logger.Debug("Create table if not exists", "function", "createTable", "struct", "MariaDatabase", "namespace", namespace, "result", result)
 	if err != nil {
 		logger.Error("Error creating table", "function", "createTable", "struct", "MariaDatabase", "namespace", namespace, "error", err)
@@ -178,14 +773,23 @@ func (MDB *MariaDatabase) CreateNamespace(namespace string) error {
 	return nil
 }
 
-func (MDB *MariaDatabase) DeleteNamespace(namespace string) error {
-	if !MDB.Initialized {
-		panic("F Unable to get. db not initialized()")
+func (MDB *MariaDatabase) DeleteNamespace(ctx context.Context, namespace string) error {
+	if !MDB.Initialized.Load() {
+		return errNotInitialized
+	}
+	if err := validateNamespace(namespace); err != nil {
+		return err
 	}
 	if namespace == MDB.GetSystemNS() {
 		return &ErrNotAllowed{Value: fmt.Sprintf("delete System NS %v", namespace)}
 	}
-	_, err := MDB.Connection.Exec(fmt.Sprintf("DROP TABLE IF EXISTS `%v`", namespace))
+	MDB.statements.Invalidate(namespace)
+	_, err := MDB.Connection.ExecContext(ctx, fmt.Sprintf("DROP TABLE IF EXISTS `%v`", namespace))
+	if err != nil {
+		logger.Error("Exec failed with error", "function", "Delete", "struct", "MariaDatabase", "namespace", namespace, "error", err)
+		return err
+	}
+	_, err = MDB.Connection.ExecContext(ctx, fmt.Sprintf("delete from `%v` where `namespace` = ?", MDB.Config.HistoryTableName), namespace)
 	if err != nil {
 		logger.Error("Exec failed with error", "function", "Delete", "struct", "MariaDatabase", "namespace", namespace, "error", err)
 		return err
@@ -194,16 +798,18 @@ func (MDB *MariaDatabase) DeleteNamespace(namespace string) error {
 }
 
 func (MDB *MariaDatabase) IsInitialized() bool {
-	return MDB.Initialized
+	return MDB.Initialized.Load()
 }
 
 func (MDB *MariaDatabase) Close() {
-	if !MDB.Initialized {
-		panic("F Unable to close. db not initialized()")
+	if !MDB.Initialized.Load() {
+		return
 	}
+	MDB.statements.Close()
 	err := MDB.Connection.Close()
 	if err != nil {
-		panic(err)
+		logger.Error("Unable to close connection", "function", "Close", "struct", "MariaDatabase", "error", err)
+		return
 	}
 	logger.Debug("Closed database connection", "function", "Close", "struct", "MariaDatabase")
 }
@@ -1,7 +1,12 @@
 package main
 
 import (
+	"context"
+	"database/sql"
+	"fmt"
+	"strings"
 	"testing"
+	"time"
 )
 
 type MariaDBTest struct {
@@ -17,18 +22,23 @@ func Test_Maria_DB(t *testing.T) {
 	dbt.DB = &MariaDatabase{
 		Config: &dbt.Config.Mysql,
 	}
-	t.Run("initialize db", func(t *testing.T) {
-		dbt.DB.Init()
-	})
+	if !t.Run("initialize db", func(t *testing.T) {
+		err := dbt.DB.Init()
+		if err != nil {
+			t.Fatalf("Unable to initialize database %v", err)
+		}
+	}) {
+		t.FailNow()
+	}
 	testKey := "test"
 	testValue := "value"
 
 	t.Run("Delete Key (if it exists)", func(t *testing.T) {
-		dbt.DB.DeleteKey(dbt.DB.GetSystemNS(), testKey)
+		dbt.DB.DeleteKey(context.Background(), dbt.DB.GetSystemNS(), testKey)
 	})
 
 	t.Run("get value (that don't exist)", func(t *testing.T) {
-		_, err := dbt.DB.Get(dbt.DB.GetSystemNS(), testKey)
+		_, err := dbt.DB.Get(context.Background(), dbt.DB.GetSystemNS(), testKey)
 		if err == nil {
 			t.Errorf("Supposed to get error")
 		}
@@ -37,11 +47,11 @@ func Test_Maria_DB(t *testing.T) {
 		}
 	})
 	t.Run("set value", func(t *testing.T) {
-		dbt.DB.Set(dbt.DB.GetSystemNS(), testKey, testValue)
+		dbt.DB.Set(context.Background(), dbt.DB.GetSystemNS(), testKey, testValue)
 	})
 
 	t.Run("get value", func(t *testing.T) {
-		val, err := dbt.DB.Get(dbt.DB.GetSystemNS(), testKey)
+		val, err := dbt.DB.Get(context.Background(), dbt.DB.GetSystemNS(), testKey)
 		if err != nil {
 			t.Errorf("Supposed to get key %v got error %+v", testKey, err)
 		}
@@ -49,9 +59,33 @@ func Test_Maria_DB(t *testing.T) {
 			t.Errorf("Read from database failed expected %v, got %v", testValue, val)
 		}
 	})
+	t.Run("transaction", func(t *testing.T) {
+		testTransaction(t, dbt.DB, "transaction")
+	})
+	t.Run("keys page", func(t *testing.T) {
+		testKeysPage(t, dbt.DB, "paged")
+	})
+	t.Run("namespace created by first write", func(t *testing.T) {
+		dbt.DB.DeleteNamespace(context.Background(), "created")
+		expected := "value"
+		if _, ok := dbt.DB.CompareAndSet(context.Background(), "created", "key", &expected, "new", 0).(*ErrPreconditionFailed); !ok {
+			t.Errorf("Expected ErrPreconditionFailed for missing namespace")
+		}
+		err := dbt.DB.CompareAndSet(context.Background(), "created", "key", nil, "value", 0)
+		if err != nil {
+			t.Fatalf("CompareAndSet failed: %v", err)
+		}
+		if value, err := dbt.DB.Get(context.Background(), "created", "key"); err != nil || value != "value" {
+			t.Errorf("Expected value got %v, %v", value, err)
+		}
+		if _, ok := dbt.DB.Set(context.Background(), `invalid"namespace`, "key", "value").(*ErrMalformRequest); !ok {
+			t.Errorf("Expected ErrMalformRequest for invalid namespace")
+		}
+		dbt.DB.DeleteNamespace(context.Background(), "created")
+	})
 	t.Run("Counter Integration Test (stored db)", func(t *testing.T) {
 		count := Counter{}
-		dbt.DB.DeleteKey(dbt.DB.GetSystemNS(), "counter")
+		dbt.DB.DeleteKey(context.Background(), dbt.DB.GetSystemNS(), "counter")
 		count.Init(dbt.DB)
 		val := count.GetCount()
 		if val != 0 {
@@ -73,3 +107,82 @@ func Test_Maria_DB(t *testing.T) {
 		}
 	})
 }
+
+func Test_Maria_SingleTable_DB(t *testing.T) {
+	setupTestlogging()
+	config := ConfigType{}
+	ConfigRead("example-config", &config)
+	config.Mysql.DatabaseName = "kvdb-test"
+	config.Mysql.DataTableName = "kvdb_test_data"
+	config.Mysql.NamespaceTableName = "kvdb_test_namespaces"
+	config.Mysql.SchemaTableName = "kvdb_test_schema"
+	legacy := &MariaDatabase{Config: &config.Mysql}
+	single := &MariaSingleTableDatabase{MariaDatabase: &MariaDatabase{Config: &config.Mysql}}
+	// Start from the per namespace layout
+	connection, err := legacy.connect()
+	if err != nil {
+		t.Fatalf("Unable to connect to database %v", err)
+	}
+	for _, table := range []string{config.Mysql.DataTableName, config.Mysql.NamespaceTableName, config.Mysql.SchemaTableName} {
+		connection.Exec(fmt.Sprintf("DROP TABLE IF EXISTS `%v`", table))
+	}
+	connection.Close()
+	testSingleTableUpgrade(t, legacy, single, func() *sql.DB { return single.Connection }, "`kvdb_test_schema`",
+		func(namespace string, key string) int {
+			var version int
+			single.Connection.QueryRow("select `version` from `kvdb_test_data` where `namespace` = ? and `key` = ?", namespace, key).Scan(&version)
+			return version
+		})
+}
+
+func TestMariaConnectionConfig(t *testing.T) {
+	setupTestlogging()
+	config := ConfigType{}
+	ConfigRead("example-config", &config)
+	config.Mysql.Address = "db.example:3307"
+	config.Mysql.TLS.Enabled = true
+	config.Mysql.Collation = "utf8mb4_bin"
+	config.Mysql.ReadTimeout = 5 * time.Second
+	MDB := &MariaDatabase{Config: &config.Mysql, DatabaseName: "kvdb", Password: "secret"}
+	mysqlConfig, err := MDB.connectionConfig()
+	if err != nil {
+		t.Fatalf("connectionConfig failed: %v", err)
+	}
+	if mysqlConfig.Addr != "db.example:3307" || mysqlConfig.User != "kvdb" || mysqlConfig.Passwd != "secret" || mysqlConfig.DBName != "kvdb" {
+		t.Errorf("Unexpected connection %v %v %v", mysqlConfig.Addr, mysqlConfig.User, mysqlConfig.DBName)
+	}
+	if mysqlConfig.TLS == nil || mysqlConfig.TLS.ServerName != "db.example" {
+		t.Errorf("Expected TLS verifying db.example, got %+v", mysqlConfig.TLS)
+	}
+	if mysqlConfig.Timeout != 10*time.Second || mysqlConfig.ReadTimeout != 5*time.Second {
+		t.Errorf("Unexpected timeouts %v %v", mysqlConfig.Timeout, mysqlConfig.ReadTimeout)
+	}
+	dsn := mysqlConfig.FormatDSN()
+	if !strings.Contains(dsn, "charset=utf8mb4") || !strings.Contains(dsn, "collation=utf8mb4_bin") {
+		t.Errorf("Expected charset and collation in %v", strings.ReplaceAll(dsn, "secret", "*"))
+	}
+	config.Mysql.TLS.CACertificate = "missing-ca.crt"
+	_, err = MDB.connectionConfig()
+	if err == nil {
+		t.Errorf("Expected error for a missing CA certificate")
+	}
+}
+
+func TestMariaInitUnavailable(t *testing.T) {
+	setupTestlogging()
+	config := ConfigType{}
+	ConfigRead("example-config", &config)
+	config.Mysql.Address = "127.0.0.1:1"
+	config.Mysql.StartupTimeout = 0
+	MDB := &MariaDatabase{Config: &config.Mysql}
+	err := MDB.Init()
+	if _, ok := err.(*ErrUnavailable); !ok {
+		t.Fatalf("Expected ErrUnavailable, got %v", err)
+	}
+	if MDB.Connection != nil || MDB.IsInitialized() {
+		t.Errorf("Connection published after failed Init")
+	}
+	if MDB.Health(context.Background()) != errNotInitialized {
+		t.Errorf("Expected Health to report not initialized")
+	}
+}
@@ -0,0 +1,426 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/SimonStiil/keyvaluedatabase/rest"
+)
+
+// MariaSingleTableDatabase keeps all namespaces in the table dataTableName, selected with mysql.layout single.
+// Namespaces are values instead of table names and namespaces without keys are kept in namespaceTableName.
+// The schema is versioned in schemaTableName, Init applies new migrations and the first Init copies the tables of the per namespace layout.
+// Namespaces, keys and values use a binary collation so they are compared case sensitive.
+type MariaSingleTableDatabase struct {
+	*MariaDatabase
+}
+
+func (MDB *MariaSingleTableDatabase) migrations() []schemaMigration {
+	return []schemaMigration{
+		{Version: 1, Description: "create data and namespace tables", Apply: func(tx *sql.Tx) error {
+			_, err := tx.Exec(fmt.Sprintf("CREATE TABLE IF NOT EXISTS `%v` ( `namespace` VARCHAR(%v) CHARACTER SET utf8mb4 COLLATE utf8mb4_bin PRIMARY KEY, `created_at` BIGINT NOT NULL) ENGINE = InnoDB",
+				MDB.Config.NamespaceTableName, rest.KeyMaxLength))
+			if err != nil {
+				return err
+			}
+			_, err = tx.Exec(fmt.Sprintf("CREATE TABLE IF NOT EXISTS `%v` ( `namespace` VARCHAR(%v) CHARACTER SET utf8mb4 COLLATE utf8mb4_bin NOT NULL, `key` VARCHAR(%v) CHARACTER SET utf8mb4 COLLATE utf8mb4_bin NOT NULL, `value` VARCHAR(%v) CHARACTER SET utf8mb4 COLLATE utf8mb4_bin NOT NULL, `expiry` BIGINT NOT NULL DEFAULT 0, `created_at` BIGINT NOT NULL, `updated_at` BIGINT NOT NULL, `version` INT NOT NULL DEFAULT 1, PRIMARY KEY (`namespace`, `key`), INDEX `%v_expiry` (`expiry`)) ENGINE = InnoDB",
+				MDB.Config.DataTableName, rest.KeyMaxLength, rest.KeyMaxLength, rest.ValueMaxLength, MDB.Config.DataTableName))
+			return err
+		}},
+		{Version: 2, Description: "copy tables of the per namespace layout", Apply: MDB.copyLegacyTables},
+	}
+}
+
+// copyLegacyTables copies the namespace tables of the per namespace layout. The tables are left in place
+// so a failed upgrade can go back to the per namespace layout, they can be dropped once the upgrade is verified.
+func (MDB *MariaSingleTableDatabase) copyLegacyTables(tx *sql.Tx) error {
+	// Only tables with the key and value columns of createTableStatement are namespaces
+	rows, err := tx.Query("select c.TABLE_NAME from information_schema.COLUMNS c where c.TABLE_SCHEMA = DATABASE() and c.COLUMN_NAME in (?, ?) group by c.TABLE_NAME having count(*) = 2",
+		MDB.Config.KeyName, MDB.Config.ValueName)
+	if err != nil {
+		return err
+	}
+	internal := []string{MDB.Config.HistoryTableName, MDB.Config.DataTableName, MDB.Config.NamespaceTableName, MDB.Config.SchemaTableName}
+	tables := []string{}
+	for rows.Next() {
+		var table string
+		err = rows.Scan(&table)
+		if err != nil {
+			rows.Close()
+			return err
+		}
+		if !slices.Contains(internal, table) {
+			tables = append(tables, table)
+		}
+	}
+	rows.Close()
+	now := time.Now().UnixMilli()
+	for _, table := range tables {
+		_, err = tx.Exec(fmt.Sprintf("ALTER TABLE `%v` ADD COLUMN IF NOT EXISTS `%v` BIGINT NOT NULL DEFAULT 0", table, MDB.Config.ExpiryName))
+		if err != nil {
+			return err
+		}
+		result, err := tx.Exec(fmt.Sprintf("INSERT IGNORE INTO `%v` (`namespace`, `key`, `value`, `expiry`, `created_at`, `updated_at`, `version`) select ?, `%v`, `%v`, `%v`, ?, ?, 1 from `%v`",
+			MDB.Config.DataTableName, MDB.Config.KeyName, MDB.Config.ValueName, MDB.Config.ExpiryName, table), table, now, now)
+		if err != nil {
+			return err
+		}
+		_, err = tx.Exec(fmt.Sprintf("INSERT IGNORE INTO `%v` (`namespace`, `created_at`) VALUES (?, ?)", MDB.Config.NamespaceTableName), table, now)
+		if err != nil {
+			return err
+		}
+		copied, _ := result.RowsAffected()
+		logger.Info("Copied namespace table, it can be dropped once the upgrade is verified", "function", "copyLegacyTables", "struct", "MariaSingleTableDatabase", "namespace", table, "keys", copied)
+	}
+	return nil
+}
+
+func (MDB *MariaSingleTableDatabase) Init() error {
+	logger.Debug("Initializing MariaDB single table layout", "function", "Init", "struct", "MariaSingleTableDatabase")
+	connection, err := MDB.connect()
+	if err != nil {
+		return err
+	}
+	version, err := MDB.createTables(connection)
+	if err != nil {
+		// Init is retried by Reconnect, which opens a new pool
+		connection.Close()
+		return &ErrUnavailable{Value: "mysql", Err: err}
+	}
+	MDB.publish(connection)
+	logger.Debug("Initialization complete", "function", "Init", "struct", "MariaSingleTableDatabase", "schemaVersion", version)
+	return nil
+}
+
+// createTables migrates the schema and creates the system namespace, it returns the schema version
+func (MDB *MariaSingleTableDatabase) createTables(connection *sql.DB) (int, error) {
+	err := MDB.createHistoryTable(connection)
+	if err != nil {
+		return 0, err
+	}
+	schema := &sqlSchema{
+		Table:       fmt.Sprintf("`%v`", MDB.Config.SchemaTableName),
+		Lock:        fmt.Sprintf("SELECT GET_LOCK('%v', -1)", MDB.Config.SchemaTableName),
+		Unlock:      fmt.Sprintf("SELECT RELEASE_LOCK('%v')", MDB.Config.SchemaTableName),
+		Placeholder: func(n int) string { return "?" },
+	}
+	version, err := schema.Migrate(connection, MDB.migrations())
+	if err != nil {
+		return 0, err
+	}
+	_, err = connection.Exec(MDB.createNamespaceStatement(), MDB.GetSystemNS(), time.Now().UnixMilli())
+	return version, err
+}
+
+func (MDB *MariaSingleTableDatabase) createNamespaceStatement() string {
+	return fmt.Sprintf("INSERT IGNORE INTO `%v` (`namespace`, `created_at`) VALUES (?, ?)", MDB.Config.NamespaceTableName)
+}
+
+// upsertStatement writes namespace, key, value, expiry and the time, an expired row is replaced as a new key.
+// MariaDB assigns from left to right, so created_at and version are set before expiry changes.
+func (MDB *MariaSingleTableDatabase) upsertStatement() string {
+	expired := "`expiry` <> 0 and `expiry` <= VALUES(`updated_at`)"
+	return fmt.Sprintf("INSERT INTO `%v` (`namespace`, `key`, `value`, `expiry`, `created_at`, `updated_at`, `version`) VALUES (?, ?, ?, ?, ?, ?, 1) ON DUPLICATE KEY UPDATE `created_at` = IF(%v, VALUES(`created_at`), `created_at`), `version` = IF(%v, 1, `version` + 1), `value` = VALUES(`value`), `expiry` = VALUES(`expiry`), `updated_at` = VALUES(`updated_at`)",
+		MDB.Config.DataTableName, expired, expired)
+}
+
+func (MDB *MariaSingleTableDatabase) Set(ctx context.Context, namespace string, key string, value interface{}) error {
+	return MDB.SetWithTTL(ctx, namespace, key, value, 0)
+}
+
+func (MDB *MariaSingleTableDatabase) SetWithTTL(ctx context.Context, namespace string, key string, value interface{}, ttl time.Duration) error {
+	if !MDB.Initialized.Load() {
+		return errNotInitialized
+	}
+	now := time.Now().UnixMilli()
+	_, err := MDB.Connection.ExecContext(ctx, MDB.upsertStatement(), namespace, key, value, expiryFromTTL(ttl), now, now)
+	if err != nil {
+		logger.Error("Exec failed with error", "function", "SetWithTTL", "struct", "MariaSingleTableDatabase", "namespace", namespace, "key", key, "error", err)
+	}
+	return err
+}
+
+func (MDB *MariaSingleTableDatabase) CompareAndSet(ctx context.Context, namespace string, key string, expected *string, value string, ttl time.Duration) error {
+	if !MDB.Initialized.Load() {
+		return errNotInitialized
+	}
+	tx, err := MDB.Connection.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	now := time.Now().UnixMilli()
+	if expected == nil {
+		// Expired rows not yet reaped would otherwise block the insert
+		_, err = tx.ExecContext(ctx, fmt.Sprintf("delete from `%v` where `namespace` = ? and `key` = ? and `expiry` <> 0 and `expiry` <= ?", MDB.Config.DataTableName), namespace, key, now)
+		if err != nil {
+			logger.Error("Exec failed with error", "function", "CompareAndSet", "struct", "MariaSingleTableDatabase", "namespace", namespace, "key", key, "error", err)
+			return err
+		}
+		_, err = tx.ExecContext(ctx, fmt.Sprintf("INSERT INTO `%v` (`namespace`, `key`, `value`, `expiry`, `created_at`, `updated_at`, `version`) VALUES (?, ?, ?, ?, ?, ?, 1)", MDB.Config.DataTableName),
+			namespace, key, value, expiryFromTTL(ttl), now, now)
+		if err != nil {
+			if strings.Contains(err.Error(), "Error 1062") {
+				return &ErrPreconditionFailed{Value: key}
+			}
+			logger.Error("Exec failed with error", "function", "CompareAndSet", "struct", "MariaSingleTableDatabase", "namespace", namespace, "key", key, "error", err)
+			return err
+		}
+		return tx.Commit()
+	}
+	result, err := tx.ExecContext(ctx, fmt.Sprintf("update `%v` set `value` = ?, `expiry` = ?, `updated_at` = ?, `version` = `version` + 1 where `namespace` = ? and `key` = ? and `value` = ? and (`expiry` = 0 or `expiry` > ?)", MDB.Config.DataTableName),
+		value, expiryFromTTL(ttl), now, namespace, key, *expected, now)
+	if err != nil {
+		logger.Error("Exec failed with error", "function", "CompareAndSet", "struct", "MariaSingleTableDatabase", "namespace", namespace, "key", key, "error", err)
+		return err
+	}
+	affected, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if affected == 0 {
+		return &ErrPreconditionFailed{Value: key}
+	}
+	return tx.Commit()
+}
+
+func (MDB *MariaSingleTableDatabase) Get(ctx context.Context, namespace string, key string) (string, error) {
+	if !MDB.Initialized.Load() {
+		return "", errNotInitialized
+	}
+	var value string
+	err := MDB.Connection.QueryRowContext(ctx, fmt.Sprintf("select `value` from `%v` where `namespace` = ? and `key` = ? and (`expiry` = 0 or `expiry` > ?)", MDB.Config.DataTableName),
+		namespace, key, time.Now().UnixMilli()).Scan(&value)
+	if err == sql.ErrNoRows {
+		return "", &ErrNotFound{Value: key}
+	} else if err != nil {
+		logger.Error("Query failed with error", "function", "Get", "struct", "MariaSingleTableDatabase", "namespace", namespace, "key", key, "error", err)
+		return "", err
+	}
+	return value, nil
+}
+
+func (MDB *MariaSingleTableDatabase) TTL(ctx context.Context, namespace string, key string) (time.Duration, error) {
+	if !MDB.Initialized.Load() {
+		return 0, errNotInitialized
+	}
+	var expiry int64
+	err := MDB.Connection.QueryRowContext(ctx, fmt.Sprintf("select `expiry` from `%v` where `namespace` = ? and `key` = ? and (`expiry` = 0 or `expiry` > ?)", MDB.Config.DataTableName),
+		namespace, key, time.Now().UnixMilli()).Scan(&expiry)
+	if err == sql.ErrNoRows {
+		return 0, &ErrNotFound{Value: key}
+	} else if err != nil {
+		logger.Error("Query failed with error", "function", "TTL", "struct", "MariaSingleTableDatabase", "namespace", namespace, "key", key, "error", err)
+		return 0, err
+	}
+	return ttlFromExpiry(expiry), nil
+}
+
+func (MDB *MariaSingleTableDatabase) DeleteExpired(ctx context.Context) (int, error) {
+	if !MDB.Initialized.Load() {
+		return 0, errNotInitialized
+	}
+	result, err := MDB.Connection.ExecContext(ctx, fmt.Sprintf("delete from `%v` where `expiry` <> 0 and `expiry` <= ?", MDB.Config.DataTableName), time.Now().UnixMilli())
+	if err != nil {
+		logger.Error("Exec failed with error", "function", "DeleteExpired", "struct", "MariaSingleTableDatabase", "error", err)
+		return 0, err
+	}
+	affected, _ := result.RowsAffected()
+	return int(affected), nil
+}
+
+// Transaction runs fn in a SQL transaction, unlike the per namespace layout namespaces do not need to exist
+func (MDB *MariaSingleTableDatabase) Transaction(ctx context.Context, fn func(tx Transaction) error) error {
+	if !MDB.Initialized.Load() {
+		return errNotInitialized
+	}
+	tx, err := MDB.Connection.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	err = fn(&mariaSingleTableTransaction{MDB: MDB, Tx: tx, ctx: ctx})
+	if err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+type mariaSingleTableTransaction struct {
+	MDB *MariaSingleTableDatabase
+	Tx  *sql.Tx
+	ctx context.Context
+}
+
+func (Tx *mariaSingleTableTransaction) Get(namespace string, key string) (string, error) {
+	var value string
+	err := Tx.Tx.QueryRowContext(Tx.ctx, fmt.Sprintf("select `value` from `%v` where `namespace` = ? and `key` = ? and (`expiry` = 0 or `expiry` > ?) FOR UPDATE", Tx.MDB.Config.DataTableName),
+		namespace, key, time.Now().UnixMilli()).Scan(&value)
+	if err == sql.ErrNoRows {
+		return "", &ErrNotFound{Value: key}
+	} else if err != nil {
+		logger.Error("Query failed with error", "function", "Get", "struct", "mariaSingleTableTransaction", "namespace", namespace, "key", key, "error", err)
+		return "", err
+	}
+	return value, nil
+}
+
+func (Tx *mariaSingleTableTransaction) SetWithTTL(namespace string, key string, value string, ttl time.Duration) error {
+	now := time.Now().UnixMilli()
+	_, err := Tx.Tx.ExecContext(Tx.ctx, Tx.MDB.upsertStatement(), namespace, key, value, expiryFromTTL(ttl), now, now)
+	if err != nil {
+		logger.Error("Exec failed with error", "function", "SetWithTTL", "struct", "mariaSingleTableTransaction", "namespace", namespace, "key", key, "error", err)
+	}
+	return err
+}
+
+func (Tx *mariaSingleTableTransaction) DeleteKey(namespace string, key string) error {
+	_, err := Tx.Tx.ExecContext(Tx.ctx, fmt.Sprintf("delete from `%v` where `namespace` = ? and `key` = ?", Tx.MDB.Config.DataTableName), namespace, key)
+	if err != nil {
+		logger.Error("Exec failed with error", "function", "DeleteKey", "struct", "mariaSingleTableTransaction", "namespace", namespace, "key", key, "error", err)
+	}
+	return err
+}
+
+func (MDB *MariaSingleTableDatabase) Keys(ctx context.Context, namespace string) ([]string, error) {
+	keys, _, err := MDB.KeysPage(ctx, namespace, ListOptions{})
+	return keys, err
+}
+
+// KeysPage filters and pages in the query, the cursor is the last key of the previous page
+func (MDB *MariaSingleTableDatabase) KeysPage(ctx context.Context, namespace string, options ListOptions) ([]string, string, error) {
+	if !MDB.Initialized.Load() {
+		return nil, "", errNotInitialized
+	}
+	last, err := decodeCursor(options.Cursor)
+	if err != nil {
+		return nil, "", err
+	}
+	args := []any{}
+	arg := func(value any) string {
+		args = append(args, value)
+		return "?"
+	}
+	column := "`namespace`"
+	query := fmt.Sprintf("select %v from (select `namespace` from `%v` union select `namespace` from `%v`) as namespaces where true",
+		column, MDB.Config.NamespaceTableName, MDB.Config.DataTableName)
+	if namespace != "" {
+		column = "`key`"
+		query = fmt.Sprintf("select %v from `%v` where `namespace` = %v and (`expiry` = 0 or `expiry` > %v)",
+			column, MDB.Config.DataTableName, arg(namespace), arg(time.Now().UnixMilli()))
+	}
+	if options.Cursor != "" {
+		query += fmt.Sprintf(" and %v > %v", column, arg(last))
+	}
+	if options.Prefix != "" {
+		query += fmt.Sprintf(" and %v like %v", column, arg(likePrefix(options.Prefix)))
+	}
+	if options.Match != "" {
+		query += fmt.Sprintf(" and %v regexp %v", column, arg(globToRegexp(options.Match)))
+	}
+	query += " order by " + column
+	if options.Limit > 0 {
+		query += " limit " + arg(options.Limit+1)
+	}
+	rows, err := MDB.Connection.QueryContext(ctx, query, args...)
+	if err != nil {
+		logger.Error("Query failed with error", "function", "KeysPage", "struct", "MariaSingleTableDatabase", "namespace", namespace, "error", err)
+		return nil, "", err
+	}
+	defer rows.Close()
+	keys := []string{}
+	for rows.Next() {
+		var key string
+		err = rows.Scan(&key)
+		if err != nil {
+			logger.Error("Scan row failed with error", "function", "KeysPage", "struct", "MariaSingleTableDatabase", "namespace", namespace, "error", err)
+			return nil, "", err
+		}
+		if options.Limit > 0 && len(keys) == options.Limit {
+			return keys, encodeCursor(keys[len(keys)-1]), nil
+		}
+		keys = append(keys, key)
+	}
+	return keys, "", rows.Err()
+}
+
+func (MDB *MariaSingleTableDatabase) CountKeys(ctx context.Context, namespace string) (int, error) {
+	if !MDB.Initialized.Load() {
+		return 0, errNotInitialized
+	}
+	var count int
+	err := MDB.Connection.QueryRowContext(ctx, fmt.Sprintf("select count(*) from `%v` where `namespace` = ? and (`expiry` = 0 or `expiry` > ?)", MDB.Config.DataTableName),
+		namespace, time.Now().UnixMilli()).Scan(&count)
+	if err != nil {
+		logger.Error("Query failed with error", "function", "CountKeys", "struct", "MariaSingleTableDatabase", "namespace", namespace, "error", err)
+	}
+	return count, err
+}
+
+func (MDB *MariaSingleTableDatabase) DeleteKey(ctx context.Context, namespace string, key string) error {
+	if !MDB.Initialized.Load() {
+		return errNotInitialized
+	}
+	_, err := MDB.Connection.ExecContext(ctx, fmt.Sprintf("delete from `%v` where `namespace` = ? and `key` = ?", MDB.Config.DataTableName), namespace, key)
+	if err != nil {
+		logger.Error("Exec failed with error", "function", "DeleteKey", "struct", "MariaSingleTableDatabase", "namespace", namespace, "key", key, "error", err)
+	}
+	return err
+}
+
+func (MDB *MariaSingleTableDatabase) CompareAndDelete(ctx context.Context, namespace string, key string, expected string) error {
+	if !MDB.Initialized.Load() {
+		return errNotInitialized
+	}
+	result, err := MDB.Connection.ExecContext(ctx, fmt.Sprintf("delete from `%v` where `namespace` = ? and `key` = ? and `value` = ? and (`expiry` = 0 or `expiry` > ?)", MDB.Config.DataTableName),
+		namespace, key, expected, time.Now().UnixMilli())
+	if err != nil {
+		logger.Error("Exec failed with error", "function", "CompareAndDelete", "struct", "MariaSingleTableDatabase", "namespace", namespace, "key", key, "error", err)
+		return err
+	}
+	affected, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if affected == 0 {
+		return &ErrPreconditionFailed{Value: key}
+	}
+	return nil
+}
+
+func (MDB *MariaSingleTableDatabase) CreateNamespace(ctx context.Context, namespace string) error {
+	if !MDB.Initialized.Load() {
+		return errNotInitialized
+	}
+	_, err := MDB.Connection.ExecContext(ctx, MDB.createNamespaceStatement(), namespace, time.Now().UnixMilli())
+	if err != nil {
+		logger.Error("Error creating namespace", "function", "CreateNamespace", "struct", "MariaSingleTableDatabase", "namespace", namespace, "error", err)
+	}
+	return err
+}
+
+func (MDB *MariaSingleTableDatabase) DeleteNamespace(ctx context.Context, namespace string) error {
+	if !MDB.Initialized.Load() {
+		return errNotInitialized
+	}
+	if namespace == MDB.GetSystemNS() {
+		return &ErrNotAllowed{Value: fmt.Sprintf("delete System NS %v", namespace)}
+	}
+	tx, err := MDB.Connection.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	for _, table := range []string{MDB.Config.DataTableName, MDB.Config.NamespaceTableName, MDB.Config.HistoryTableName} {
+		_, err = tx.ExecContext(ctx, fmt.Sprintf("delete from `%v` where `namespace` = ?", table), namespace)
+		if err != nil {
+			logger.Error("Exec failed with error", "function", "DeleteNamespace", "struct", "MariaSingleTableDatabase", "namespace", namespace, "table", table, "error", err)
+			return err
+		}
+	}
+	return tx.Commit()
+}
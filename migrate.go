@@ -0,0 +1,256 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"slices"
+	"strings"
+
+	"github.com/SimonStiil/keyvaluedatabase/rest"
+)
+
+// migrateCheckpointKey is stored in the system namespace of the target while a migration runs.
+// It holds the last source namespace copied completely, a new run continues after it.
+const migrateCheckpointKey = "migrate-checkpoint"
+
+// Migration copies all namespaces, keys, expiry and key history from Source to Target.
+// The system namespace of Source is copied to the system namespace of Target, their names may differ.
+// When both databases are encrypted, values are decrypted from Source and encrypted again for Target.
+type Migration struct {
+	Source Database
+	Target Database
+	DryRun bool // Only report what would be copied
+}
+
+type MigrationResult struct {
+	Namespaces int
+	Keys       int
+	Skipped    int // Namespaces copied by a previous run
+}
+
+// targetNamespace returns the namespace in Target for namespace in Source
+func (Migration *Migration) targetNamespace(namespace string) string {
+	if namespace == Migration.Source.GetSystemNS() {
+		return Migration.Target.GetSystemNS()
+	}
+	return namespace
+}
+
+// internalKey tests for keys that belong to the database itself and are not migrated
+func internalKey(DB Database, namespace string, key string) bool {
+	if namespace != DB.GetSystemNS() {
+		return false
+	}
+	return key == migrateCheckpointKey || strings.HasPrefix(key, dataKeysPrefix)
+}
+
+// namespaces returns the namespaces of Source sorted, including the system namespace
+func (Migration *Migration) namespaces(ctx context.Context) ([]string, error) {
+	namespaces, err := Migration.Source.Keys(ctx, "")
+	if err != nil {
+		return nil, err
+	}
+	if !slices.Contains(namespaces, Migration.Source.GetSystemNS()) {
+		namespaces = append(namespaces, Migration.Source.GetSystemNS())
+	}
+	slices.Sort(namespaces)
+	return namespaces, nil
+}
+
+// migrationKeys returns the keys of namespace in DB sorted, without internal keys
+func migrationKeys(ctx context.Context, DB Database, namespace string) ([]string, error) {
+	keys, err := DB.Keys(ctx, namespace)
+	if err != nil {
+		return nil, err
+	}
+	keys = slices.DeleteFunc(keys, func(key string) bool {
+		return internalKey(DB, namespace, key)
+	})
+	slices.Sort(keys)
+	return keys, nil
+}
+
+// checkpoint returns the last namespace copied by a previous run, empty to start from the beginning
+func (Migration *Migration) checkpoint(ctx context.Context) string {
+	checkpoint, err := Migration.Target.Get(ctx, Migration.Target.GetSystemNS(), migrateCheckpointKey)
+	if err != nil {
+		return ""
+	}
+	return checkpoint
+}
+
+// Run copies every namespace after the checkpoint of a previous run and verifies the result.
+// The checkpoint is removed once all namespaces have been copied.
+func (Migration *Migration) Run(ctx context.Context) (MigrationResult, error) {
+	result := MigrationResult{}
+	namespaces, err := Migration.namespaces(ctx)
+	if err != nil {
+		return result, err
+	}
+	checkpoint := Migration.checkpoint(ctx)
+	if checkpoint != "" {
+		logger.Info("Resuming migration", "function", "Run", "struct", "Migration", "after", checkpoint)
+	}
+	for _, namespace := range namespaces {
+		if checkpoint != "" && namespace <= checkpoint {
+			result.Skipped++
+			continue
+		}
+		count, err := Migration.copyNamespace(ctx, namespace)
+		result.Keys += count
+		if err != nil {
+			return result, fmt.Errorf("namespace %v: %w", namespace, err)
+		}
+		result.Namespaces++
+		if Migration.DryRun {
+			continue
+		}
+		err = Migration.Target.CreateNamespace(ctx, Migration.Target.GetSystemNS())
+		if err == nil {
+			err = Migration.Target.Set(ctx, Migration.Target.GetSystemNS(), migrateCheckpointKey, namespace)
+		}
+		if err != nil {
+			return result, fmt.Errorf("storing checkpoint: %w", err)
+		}
+	}
+	if Migration.DryRun {
+		return result, nil
+	}
+	// All namespaces have been copied, the next run starts from the beginning also when verification fails
+	checkpointErr := Migration.Target.DeleteKey(ctx, Migration.Target.GetSystemNS(), migrateCheckpointKey)
+	err = Migration.Verify(ctx)
+	if err != nil {
+		return result, err
+	}
+	return result, checkpointErr
+}
+
+// copyNamespace copies the keys of namespace with their expiry and history, it returns the number of keys copied
+func (Migration *Migration) copyNamespace(ctx context.Context, namespace string) (int, error) {
+	target := Migration.targetNamespace(namespace)
+	keys, err := migrationKeys(ctx, Migration.Source, namespace)
+	if err != nil {
+		return 0, err
+	}
+	logger.Info("Copying namespace", "function", "copyNamespace", "struct", "Migration", "namespace", namespace, "target", target, "keys", len(keys), "dryRun", Migration.DryRun)
+	if Migration.DryRun {
+		return len(keys), nil
+	}
+	err = Migration.Target.CreateNamespace(ctx, target)
+	if err != nil {
+		return 0, err
+	}
+	count := 0
+	for _, key := range keys {
+		value, err := Migration.Source.Get(ctx, namespace, key)
+		if err != nil {
+			if _, ok := err.(*ErrNotFound); ok {
+				// Expired or deleted since the keys were listed
+				continue
+			}
+			return count, fmt.Errorf("%v: %w", key, err)
+		}
+		ttl, err := Migration.Source.TTL(ctx, namespace, key)
+		if err != nil {
+			if _, ok := err.(*ErrNotFound); ok {
+				continue
+			}
+			return count, fmt.Errorf("%v: %w", key, err)
+		}
+		err = Migration.Target.SetWithTTL(ctx, target, key, value, ttl)
+		if err != nil {
+			return count, fmt.Errorf("%v: %w", key, err)
+		}
+		err = Migration.copyHistory(ctx, namespace, target, key)
+		if err != nil {
+			return count, fmt.Errorf("%v history: %w", key, err)
+		}
+		count++
+	}
+	return count, nil
+}
+
+// copyHistory adds the versions of key oldest first, unless the key already has history in Target from an interrupted run
+func (Migration *Migration) copyHistory(ctx context.Context, namespace string, target string, key string) error {
+	versions, err := Migration.Source.Versions(ctx, namespace, key)
+	if err != nil {
+		if _, ok := err.(*ErrNotFound); ok {
+			return nil
+		}
+		return err
+	}
+	return addHistory(ctx, Migration.Target, target, key, versions)
+}
+
+// addHistory adds versions, newest first, to a key without history. Keys with history are left as they are.
+func addHistory(ctx context.Context, DB Database, namespace string, key string, versions rest.KeyHistoryV1) error {
+	if len(versions) == 0 {
+		return nil
+	}
+	existing, err := DB.Versions(ctx, namespace, key)
+	if err == nil && len(existing) > 0 {
+		return nil
+	}
+	for i := len(versions) - 1; i >= 0; i-- {
+		err = DB.AddVersion(ctx, namespace, key, versions[i], len(versions))
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// digest returns the number of keys in namespace and a hash over their names and values
+func digest(ctx context.Context, DB Database, namespace string) (int, string, error) {
+	keys, err := migrationKeys(ctx, DB, namespace)
+	if err != nil {
+		return 0, "", err
+	}
+	hash := sha256.New()
+	count := 0
+	for _, key := range keys {
+		value, err := DB.Get(ctx, namespace, key)
+		if err != nil {
+			if _, ok := err.(*ErrNotFound); ok {
+				continue
+			}
+			return count, "", fmt.Errorf("%v: %w", key, err)
+		}
+		fmt.Fprintf(hash, "%v\x00%v\x00", key, value)
+		count++
+	}
+	return count, hex.EncodeToString(hash.Sum(nil)), nil
+}
+
+// Verify compares the number of keys and a hash of the values of every namespace in Source and Target
+func (Migration *Migration) Verify(ctx context.Context) error {
+	namespaces, err := Migration.namespaces(ctx)
+	if err != nil {
+		return err
+	}
+	mismatches := []string{}
+	for _, namespace := range namespaces {
+		target := Migration.targetNamespace(namespace)
+		sourceCount, sourceHash, err := digest(ctx, Migration.Source, namespace)
+		if err != nil {
+			return fmt.Errorf("namespace %v: %w", namespace, err)
+		}
+		targetCount, targetHash, err := digest(ctx, Migration.Target, target)
+		if err != nil {
+			return fmt.Errorf("namespace %v: %w", target, err)
+		}
+		if sourceCount != targetCount || sourceHash != targetHash {
+			logger.Error("Namespace differs after migration", "function", "Verify", "struct", "Migration", "namespace", namespace, "target", target, "sourceKeys", sourceCount, "targetKeys", targetCount)
+			mismatches = append(mismatches, namespace)
+			continue
+		}
+		logger.Debug("Namespace verified", "function", "Verify", "struct", "Migration", "namespace", namespace, "target", target, "keys", sourceCount, "hash", sourceHash)
+	}
+	if len(mismatches) > 0 {
+		return errors.New("verification failed for namespaces " + strings.Join(mismatches, ", "))
+	}
+	return nil
+}
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"context"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/SimonStiil/keyvaluedatabase/rest"
+)
+
+func Test_Migration(t *testing.T) {
+	setupTestlogging()
+	directory := t.TempDir()
+	source := &YamlDatabase{DatabaseName: filepath.Join(directory, "source.yaml")}
+	source.Init()
+	target := &BoltDatabase{Config: &ConfigBolt{Path: filepath.Join(directory, "target.bolt"), SystemNS: "system", Timeout: time.Second}}
+	target.Init()
+	defer target.Close()
+	source.Set(context.Background(), source.GetSystemNS(), "counter", "42")
+	source.Set(context.Background(), "alpha", "one", "1")
+	source.SetWithTTL(context.Background(), "alpha", "two", "2", time.Hour)
+	source.Set(context.Background(), "beta", "three", "3")
+	source.AddVersion(context.Background(), "beta", "three", rest.KeyVersionV1{Value: "old", User: "test", Timestamp: time.Now()}, 0)
+	source.AddVersion(context.Background(), "beta", "three", rest.KeyVersionV1{Value: "3", User: "test", Timestamp: time.Now()}, 0)
+
+	t.Run("dry run", func(t *testing.T) {
+		migration := &Migration{Source: source, Target: target, DryRun: true}
+		result, err := migration.Run(context.Background())
+		if err != nil {
+			t.Fatalf("Dry run failed: %v", err)
+		}
+		if result.Namespaces != 3 || result.Keys != 4 {
+			t.Errorf("Expected 3 namespaces and 4 keys, got %+v", result)
+		}
+		namespaces, _ := target.Keys(context.Background(), "")
+		if len(namespaces) != 1 {
+			t.Errorf("Expected only the system namespace in target after dry run, got %v", namespaces)
+		}
+	})
+	t.Run("resume after checkpoint", func(t *testing.T) {
+		target.Set(context.Background(), target.GetSystemNS(), migrateCheckpointKey, "alpha")
+		migration := &Migration{Source: source, Target: target}
+		result, err := migration.Run(context.Background())
+		if err == nil {
+			t.Fatalf("Expected verification to fail for the skipped namespace")
+		}
+		if result.Skipped != 1 || result.Namespaces != 2 {
+			t.Errorf("Expected 1 skipped and 2 copied namespaces, got %+v", result)
+		}
+		_, err = target.Get(context.Background(), "alpha", "one")
+		if _, ok := err.(*ErrNotFound); !ok {
+			t.Errorf("Expected alpha to be skipped, got %v", err)
+		}
+	})
+	t.Run("migrate", func(t *testing.T) {
+		migration := &Migration{Source: source, Target: target}
+		result, err := migration.Run(context.Background())
+		if err != nil {
+			t.Fatalf("Migration failed: %v", err)
+		}
+		if result.Namespaces != 3 || result.Keys != 4 || result.Skipped != 0 {
+			t.Errorf("Expected 3 namespaces and 4 keys, got %+v", result)
+		}
+		value, err := target.Get(context.Background(), "system", "counter")
+		if err != nil || value != "42" {
+			t.Errorf("Expected system namespace mapped to system, got %v %v", value, err)
+		}
+		ttl, err := target.TTL(context.Background(), "alpha", "two")
+		if err != nil || ttl <= 0 || ttl > time.Hour {
+			t.Errorf("Expected ttl within an hour, got %v %v", ttl, err)
+		}
+		history, err := target.Versions(context.Background(), "beta", "three")
+		if err != nil || len(history) != 2 || history[0].Value != "3" || history[1].Value != "old" {
+			t.Errorf("Expected history copied, got %+v %v", history, err)
+		}
+		_, err = target.Get(context.Background(), target.GetSystemNS(), migrateCheckpointKey)
+		if _, ok := err.(*ErrNotFound); !ok {
+			t.Errorf("Expected checkpoint removed, got %v", err)
+		}
+	})
+	t.Run("verify detects changes", func(t *testing.T) {
+		migration := &Migration{Source: source, Target: target}
+		err := migration.Verify(context.Background())
+		if err != nil {
+			t.Errorf("Expected verification to pass: %v", err)
+		}
+		target.Set(context.Background(), "beta", "three", "changed")
+		err = migration.Verify(context.Background())
+		if err == nil {
+			t.Errorf("Expected verification to fail after a value changed")
+		}
+	})
+}
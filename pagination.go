@@ -0,0 +1,131 @@
+package main
+
+import (
+	b64 "encoding/base64"
+	"net/url"
+	"path"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/SimonStiil/keyvaluedatabase/rest"
+)
+
+// ListOptions filters and pages the result of Database.KeysPage
+type ListOptions struct {
+	Limit  int    // Maximum number of keys returned, 0 for all keys
+	Cursor string // Cursor returned with the previous page, empty for the first page
+	Prefix string // Only keys starting with Prefix
+	Match  string // Only keys matching the glob pattern, same syntax as path.Match
+}
+
+// ListOptionsFromQuery reads the limit, cursor, prefix and match query parameters
+func ListOptionsFromQuery(query url.Values) (ListOptions, error) {
+	options := ListOptions{
+		Cursor: query.Get("cursor"),
+		Prefix: query.Get("prefix"),
+		Match:  query.Get("match"),
+	}
+	if limit := query.Get("limit"); limit != "" {
+		var err error
+		options.Limit, err = strconv.Atoi(limit)
+		if err != nil || options.Limit < 1 || options.Limit > rest.ListMaxLimit {
+			return options, &ErrMalformRequest{Value: "limit must be between 1 and " + strconv.Itoa(rest.ListMaxLimit)}
+		}
+	}
+	if options.Match != "" {
+		_, err := path.Match(options.Match, "")
+		if err != nil {
+			return options, &ErrMalformRequest{Value: "invalid match pattern"}
+		}
+	}
+	return options, nil
+}
+
+// Matches tests key against Prefix and Match
+func (Options *ListOptions) Matches(key string) bool {
+	if !strings.HasPrefix(key, Options.Prefix) {
+		return false
+	}
+	if Options.Match == "" {
+		return true
+	}
+	matched, _ := path.Match(Options.Match, key)
+	return matched
+}
+
+// encodeCursor returns a cursor continuing after the key last
+func encodeCursor(last string) string {
+	return b64.RawURLEncoding.EncodeToString([]byte(last))
+}
+
+// decodeCursor returns the last key of the previous page, an empty cursor starts from the beginning
+func decodeCursor(cursor string) (string, error) {
+	last, err := b64.RawURLEncoding.DecodeString(cursor)
+	if err != nil {
+		return "", &ErrMalformRequest{Value: "invalid cursor"}
+	}
+	return string(last), nil
+}
+
+// pageSorted pages keys held in memory. Keys are sorted and the cursor is the last key of the previous page.
+func pageSorted(keys []string, options ListOptions) ([]string, string, error) {
+	last, err := decodeCursor(options.Cursor)
+	if err != nil {
+		return nil, "", err
+	}
+	slices.Sort(keys)
+	page := []string{}
+	for _, key := range keys {
+		if (options.Cursor != "" && key <= last) || !options.Matches(key) {
+			continue
+		}
+		if options.Limit > 0 && len(page) == options.Limit {
+			return page, encodeCursor(page[len(page)-1]), nil
+		}
+		page = append(page, key)
+	}
+	return page, "", nil
+}
+
+// likePrefix escapes prefix for a SQL LIKE pattern matching all strings starting with it
+func likePrefix(prefix string) string {
+	escaped := strings.NewReplacer(`\`, `\\`, `%`, `\%`, `_`, `\_`).Replace(prefix)
+	return escaped + "%"
+}
+
+// globToRegexp translates a path.Match pattern to an anchored regular expression for SQL REGEXP and ~ filters
+func globToRegexp(pattern string) string {
+	var expression strings.Builder
+	expression.WriteString("^")
+	inClass := false
+	escaped := false
+	for _, c := range pattern {
+		switch {
+		case escaped:
+			escaped = false
+			expression.WriteString(regexp.QuoteMeta(string(c)))
+		case c == '\\':
+			escaped = true
+		case inClass:
+			inClass = c != ']'
+			if c == '-' || c == ']' || c == '^' {
+				expression.WriteRune(c)
+			} else {
+				expression.WriteString(regexp.QuoteMeta(string(c)))
+			}
+		case c == '[':
+			inClass = true
+			expression.WriteRune(c)
+		case c == '*':
+			expression.WriteString(".*")
+		case c == '?':
+			expression.WriteString(".")
+		default:
+			expression.WriteString(regexp.QuoteMeta(string(c)))
+		}
+	}
+	expression.WriteString("$")
+	return expression.String()
+}
@@ -0,0 +1,144 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/url"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func TestPagination(t *testing.T) {
+	t.Run("List options", func(t *testing.T) {
+		options, err := ListOptionsFromQuery(url.Values{"limit": {"10"}, "prefix": {"a"}, "match": {"a*b"}, "cursor": {"YQ"}})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if options != (ListOptions{Limit: 10, Prefix: "a", Match: "a*b", Cursor: "YQ"}) {
+			t.Errorf("Options got %+v", options)
+		}
+		for _, query := range []url.Values{{"limit": {"0"}}, {"limit": {"1001"}}, {"limit": {"ten"}}, {"match": {"[a"}}} {
+			if _, err := ListOptionsFromQuery(query); err == nil {
+				t.Errorf("Expected error for %v", query)
+			}
+		}
+	})
+	t.Run("Sorted pages", func(t *testing.T) {
+		keys := []string{"c", "a", "e", "b", "d", "ab"}
+		options := ListOptions{Limit: 2, Prefix: ""}
+		got := []string{}
+		for pages := 0; pages < 10; pages++ {
+			page, next, err := pageSorted(slices.Clone(keys), options)
+			if err != nil {
+				t.Fatal(err)
+			}
+			got = append(got, page...)
+			if next == "" {
+				break
+			}
+			options.Cursor = next
+		}
+		if want := []string{"a", "ab", "b", "c", "d", "e"}; !slices.Equal(got, want) {
+			t.Errorf("Pages got %v, want %v", got, want)
+		}
+		page, next, _ := pageSorted(slices.Clone(keys), ListOptions{Prefix: "a"})
+		if !slices.Equal(page, []string{"a", "ab"}) || next != "" {
+			t.Errorf("Prefix page got %v, next %q", page, next)
+		}
+		if _, _, err := pageSorted(keys, ListOptions{Cursor: "%%"}); err == nil {
+			t.Errorf("Expected error for invalid cursor")
+		}
+	})
+	t.Run("Glob to regexp", func(t *testing.T) {
+		for pattern, cases := range map[string]map[string]bool{
+			"a*":     {"a": true, "abc": true, "ba": false},
+			"a?c":    {"abc": true, "ac": false},
+			"[a-c]x": {"bx": true, "dx": false},
+			"[^a]x":  {"bx": true, "ax": false},
+			"a.b\\*": {"a.b*": true, "axb*": false, "a.bc": false},
+			"(x)+":   {"(x)+": true, "x": false},
+		} {
+			expression := regexp.MustCompile(globToRegexp(pattern))
+			for key, want := range cases {
+				if got := expression.MatchString(key); got != want {
+					t.Errorf("%v (%v) matching %v got %v, want %v", pattern, expression, key, got, want)
+				}
+			}
+		}
+		if got := likePrefix(`a_b%\\`); got != `a\_b\%\\\\%` {
+			t.Errorf("likePrefix got %v", got)
+		}
+	})
+}
+
+func TestKeysPageQuery(t *testing.T) {
+	maria := &MariaDatabase{Config: &ConfigMysql{KeyName: "kvkey", ExpiryName: "expiry", HistoryTableName: "kvdb_history"}}
+	postgres := &PostgresDatabase{Config: &ConfigPostgres{KeyName: "kvkey", ExpiryName: "expiry", HistoryTableName: "kvdb_history"}}
+	placeholder := regexp.MustCompile(`\$(\d+)`)
+	for _, namespace := range []string{"", "namespace"} {
+		for _, options := range []ListOptions{{}, {Limit: 2, Prefix: "a", Match: "a*", Cursor: "YQ"}} {
+			t.Run(fmt.Sprintf("mysql %q %+v", namespace, options), func(t *testing.T) {
+				query, args := maria.keysPageQuery(namespace, options, "a", 1)
+				if count := strings.Count(query, "?"); count != len(args) {
+					t.Errorf("Query %v has %v placeholders for %v arguments", query, count, len(args))
+				}
+			})
+			t.Run(fmt.Sprintf("postgres %q %+v", namespace, options), func(t *testing.T) {
+				query, args := postgres.keysPageQuery(namespace, options, "a", 1)
+				matches := placeholder.FindAllStringSubmatch(query, -1)
+				for i, match := range matches {
+					if match[1] != strconv.Itoa(i+1) {
+						t.Errorf("Query %v placeholder %v out of order", query, match[0])
+					}
+				}
+				if len(matches) != len(args) {
+					t.Errorf("Query %v has %v placeholders for %v arguments", query, len(matches), len(args))
+				}
+			})
+		}
+	}
+}
+
+// testKeysPage verifies that paging through namespace returns every matching key once
+func testKeysPage(t *testing.T, db Database, namespace string) {
+	db.CreateNamespace(context.Background(), namespace)
+	for _, key := range []string{"page-1", "page-2", "page-3", "page-4", "other"} {
+		db.Set(context.Background(), namespace, key, "value")
+	}
+	options := ListOptions{Limit: 2, Prefix: "page-"}
+	got := []string{}
+	for pages := 0; pages < 10; pages++ {
+		page, next, err := db.KeysPage(context.Background(), namespace, options)
+		if err != nil {
+			t.Fatalf("Failed to list keys: %v", err)
+		}
+		if len(page) > options.Limit {
+			t.Errorf("Page of %v keys, limit %v", len(page), options.Limit)
+		}
+		got = append(got, page...)
+		if next == "" {
+			break
+		}
+		options.Cursor = next
+	}
+	slices.Sort(got)
+	if want := []string{"page-1", "page-2", "page-3", "page-4"}; !slices.Equal(got, want) {
+		t.Errorf("Paged keys got %v, want %v", got, want)
+	}
+	page, _, err := db.KeysPage(context.Background(), namespace, ListOptions{Match: "*-[13]"})
+	slices.Sort(page)
+	if err != nil || !slices.Equal(page, []string{"page-1", "page-3"}) {
+		t.Errorf("Matched keys got %v, %v", page, err)
+	}
+	count, err := db.CountKeys(context.Background(), namespace)
+	if err != nil || count != 5 {
+		t.Errorf("Count got %v, %v want 5", count, err)
+	}
+	namespaces, _, err := db.KeysPage(context.Background(), "", ListOptions{Prefix: namespace})
+	if err != nil || !slices.Contains(namespaces, namespace) {
+		t.Errorf("Namespaces got %v, %v", namespaces, err)
+	}
+}
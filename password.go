@@ -0,0 +1,193 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	b64 "encoding/base64"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// argon2id parameters for new hashes, see the OWASP password storage cheat sheet
+const (
+	argon2Memory     uint32 = 19 * 1024
+	argon2Time       uint32 = 2
+	argon2Threads    uint8  = 1
+	argon2KeyLength  uint32 = 32
+	argon2SaltLength        = 16
+	// Hashes asking for more memory (KiB) are rejected, verifying them could exhaust the server
+	argon2MaxMemory uint32 = 1024 * 1024
+)
+
+// PasswordHash is a ConfigUser.Password in PHC format ($argon2id$..., $2b$...)
+// or the legacy base64 encoded unsalted SHA-256.
+type PasswordHash struct {
+	Encoded string
+	legacy  bool
+}
+
+func ParsePasswordHash(encoded string) (PasswordHash, error) {
+	hash := PasswordHash{Encoded: encoded}
+	switch {
+	case strings.HasPrefix(encoded, "$argon2id$"):
+		_, _, _, err := decodeArgon2id(encoded)
+		return hash, err
+	case strings.HasPrefix(encoded, "$2a$"), strings.HasPrefix(encoded, "$2b$"), strings.HasPrefix(encoded, "$2y$"):
+		_, err := bcrypt.Cost([]byte(encoded))
+		return hash, err
+	}
+	bytes, err := b64.StdEncoding.DecodeString(encoded)
+	if err != nil {
+		return hash, err
+	}
+	if len(bytes) != 32 {
+		return hash, fmt.Errorf("wrong datalength %d should be 32", len(bytes))
+	}
+	hash.legacy = true
+	return hash, nil
+}
+
+func (Hash *PasswordHash) Legacy() bool {
+	return Hash.legacy
+}
+
+func (Hash *PasswordHash) Verify(password string) bool {
+	if Hash.legacy {
+		decoded, err := AuthDecode(Hash.Encoded)
+		if err != nil {
+			return false
+		}
+		return AuthTest(AuthHash(password), decoded)
+	}
+	if strings.HasPrefix(Hash.Encoded, "$argon2id$") {
+		params, salt, key, err := decodeArgon2id(Hash.Encoded)
+		if err != nil {
+			return false
+		}
+		test := argon2.IDKey([]byte(password), salt, params.time, params.memory, params.threads, uint32(len(key)))
+		return subtle.ConstantTimeCompare(test, key) == 1
+	}
+	return bcrypt.CompareHashAndPassword([]byte(Hash.Encoded), []byte(password)) == nil
+}
+
+type argon2Params struct {
+	memory  uint32
+	time    uint32
+	threads uint8
+}
+
+// $argon2id$v=19$m=19456,t=2,p=1$<salt>$<key> with unpadded base64
+func decodeArgon2id(encoded string) (argon2Params, []byte, []byte, error) {
+	params := argon2Params{}
+	parts := strings.Split(encoded, "$")
+	if len(parts) != 6 {
+		return params, nil, nil, fmt.Errorf("malformed argon2id hash")
+	}
+	var version int
+	_, err := fmt.Sscanf(parts[2], "v=%d", &version)
+	if err != nil {
+		return params, nil, nil, err
+	}
+	if version != argon2.Version {
+		return params, nil, nil, fmt.Errorf("unsupported argon2 version %v", version)
+	}
+	_, err = fmt.Sscanf(parts[3], "m=%d,t=%d,p=%d", &params.memory, &params.time, &params.threads)
+	if err != nil {
+		return params, nil, nil, err
+	}
+	if params.time == 0 || params.threads == 0 || params.memory > argon2MaxMemory {
+		return params, nil, nil, fmt.Errorf("invalid argon2id parameters %v", parts[3])
+	}
+	salt, err := b64.RawStdEncoding.DecodeString(parts[4])
+	if err != nil {
+		return params, nil, nil, err
+	}
+	key, err := b64.RawStdEncoding.DecodeString(parts[5])
+	if err != nil {
+		return params, nil, nil, err
+	}
+	if len(salt) == 0 || len(key) == 0 {
+		return params, nil, nil, fmt.Errorf("argon2id hash without salt or key")
+	}
+	return params, salt, key, nil
+}
+
+// AuthHashPassword returns a PHC formatted argon2id hash for use in ConfigUser.Password
+func AuthHashPassword(password string) (string, error) {
+	salt := make([]byte, argon2SaltLength)
+	_, err := rand.Read(salt)
+	if err != nil {
+		return "", err
+	}
+	key := argon2.IDKey([]byte(password), salt, argon2Time, argon2Memory, argon2Threads, argon2KeyLength)
+	return fmt.Sprintf("$argon2id$v=%d$m=%d,t=%d,p=%d$%s$%s", argon2.Version, argon2Memory, argon2Time, argon2Threads,
+		b64.RawStdEncoding.EncodeToString(salt), b64.RawStdEncoding.EncodeToString(key)), nil
+}
+
+// PasswordCache remembers the last successful verification per user, so the slow
+// hash is not computed on every request. Passwords are kept as a HMAC with a key
+// only known to this process.
+type PasswordCache struct {
+	TTL     time.Duration
+	mutex   sync.Mutex
+	key     []byte
+	entries map[string]verifiedPassword
+}
+
+type verifiedPassword struct {
+	encoded string
+	mac     []byte
+	expires time.Time
+}
+
+func NewPasswordCache(ttl time.Duration) *PasswordCache {
+	key := make([]byte, 32)
+	_, err := rand.Read(key)
+	if err != nil {
+		panic(err)
+	}
+	return &PasswordCache{TTL: ttl, key: key, entries: map[string]verifiedPassword{}}
+}
+
+func (Cache *PasswordCache) mac(password string) []byte {
+	mac := hmac.New(sha256.New, Cache.key)
+	mac.Write([]byte(password))
+	return mac.Sum(nil)
+}
+
+// Verify checks password against hash, using and updating the cached verification for username
+func (Cache *PasswordCache) Verify(username string, hash *PasswordHash, password string) bool {
+	if Cache == nil || Cache.TTL <= 0 {
+		return hash.Verify(password)
+	}
+	mac := Cache.mac(password)
+	Cache.mutex.Lock()
+	entry, ok := Cache.entries[username]
+	Cache.mutex.Unlock()
+	if ok && entry.encoded == hash.Encoded && time.Now().Before(entry.expires) && hmac.Equal(entry.mac, mac) {
+		return true
+	}
+	if !hash.Verify(password) {
+		return false
+	}
+	Cache.mutex.Lock()
+	Cache.entries[username] = verifiedPassword{encoded: hash.Encoded, mac: mac, expires: time.Now().Add(Cache.TTL)}
+	Cache.mutex.Unlock()
+	return true
+}
+
+func (Cache *PasswordCache) Clear() {
+	if Cache == nil {
+		return
+	}
+	Cache.mutex.Lock()
+	Cache.entries = map[string]verifiedPassword{}
+	Cache.mutex.Unlock()
+}
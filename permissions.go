@@ -0,0 +1,211 @@
+package main
+
+import (
+	"cmp"
+	"path"
+	"slices"
+	"strings"
+)
+
+// PermissionRule is a permissionsset entry for a single namespace name or glob pattern like team-a-*.
+// Rules with a Key pattern only cover the matching keys of the namespace.
+type PermissionRule struct {
+	Pattern     string
+	Key         string
+	Permissions ConfigPermissions
+	Deny        bool
+}
+
+func (Rule *PermissionRule) String() string {
+	if Rule.Key == "" {
+		return Rule.Pattern
+	}
+	return Rule.Pattern + "/" + Rule.Key
+}
+
+func isNamespacePattern(namespace string) bool {
+	return strings.ContainsAny(namespace, `*?[\`)
+}
+
+// escapeNamespacePattern escapes glob characters so value only matches itself
+func escapeNamespacePattern(value string) string {
+	var escaped strings.Builder
+	for _, c := range value {
+		if strings.ContainsRune(`*?[\`, c) {
+			escaped.WriteRune('\\')
+		}
+		escaped.WriteRune(c)
+	}
+	return escaped.String()
+}
+
+// patternSpecificity ranks patterns so the most specific match wins.
+// Exact names rank above all patterns, patterns with more literal characters rank above those with fewer and * ranks lowest.
+func patternSpecificity(pattern string) int {
+	if !isNamespacePattern(pattern) {
+		return len(pattern)*2 + 1
+	}
+	literal := 0
+	inClass := false
+	escaped := false
+	for _, c := range pattern {
+		switch {
+		case escaped:
+			escaped = false
+			if !inClass {
+				literal++
+			}
+		case c == '\\':
+			escaped = true
+		case inClass:
+			inClass = c != ']'
+		case c == '[':
+			inClass = true
+		case c != '*' && c != '?':
+			literal++
+		}
+	}
+	return literal * 2
+}
+
+func compilePermissionRules(sets []ConfigPermissionsset) []PermissionRule {
+	rules := []PermissionRule{}
+	for _, permissionset := range sets {
+		logger.Debug("Reading Permissionsset for Namespaces", "function", "compilePermissionRules", "size", len(permissionset.Namespaces), "namespaces", permissionset.Namespaces, "permissions", permissionset.Permissions, "deny", permissionset.Deny)
+		permissions := permissionset.Permissions
+		if permissionset.Deny && permissions == (ConfigPermissions{}) {
+			// A deny entry without permissions denies everything
+			permissions = ConfigPermissions{Read: true, Write: true, List: true}
+		}
+		keys := permissionset.Keys
+		if len(keys) == 0 {
+			keys = []string{""}
+		}
+		for _, namespace := range permissionset.Namespaces {
+			_, err := path.Match(namespace, "")
+			if err != nil {
+				logger.Warn("Invalid namespace pattern", "function", "compilePermissionRules", "pattern", namespace, "error", err)
+				continue
+			}
+			for _, key := range keys {
+				_, err := path.Match(key, "")
+				if err != nil {
+					logger.Warn("Invalid key pattern", "function", "compilePermissionRules", "pattern", key, "error", err)
+					continue
+				}
+				rules = append(rules, PermissionRule{Pattern: namespace, Key: key, Permissions: permissions, Deny: permissionset.Deny})
+			}
+		}
+	}
+	return rules
+}
+
+// NamespacePermissions returns the permissions for the whole namespace and the most specific pattern that matched it,
+// rules limited to keys are not included.
+func (User *User) NamespacePermissions(namespace string) (ConfigPermissions, string) {
+	return User.permissions(namespace, "")
+}
+
+// KeyPermissions returns the permissions for key in namespace and the most specific pattern that matched it.
+// Key patterns are more specific than the namespace they are in.
+func (User *User) KeyPermissions(namespace string, key string) (ConfigPermissions, string) {
+	return User.permissions(namespace, key)
+}
+
+// KeyRulePermissions returns the combined permissions granted to some keys of namespace.
+// It is used for listing, where the keys are filtered with KeyPermissions afterwards.
+func (User *User) KeyRulePermissions(namespace string) ConfigPermissions {
+	permissions := ConfigPermissions{}
+	for _, rule := range User.Rules {
+		if rule.Key == "" || rule.Deny {
+			continue
+		}
+		if matched, _ := path.Match(rule.Pattern, namespace); matched {
+			permissions = mergePermissions(permissions, rule.Permissions)
+		}
+	}
+	return permissions
+}
+
+// KeyAllowed tests permissions for key in namespace, including the scope of an API token
+func (User *User) KeyAllowed(namespace string, key string, permissions ConfigPermissions) bool {
+	userPermissions, _ := User.KeyPermissions(namespace, key)
+	if !AuthTestPermission(userPermissions, permissions) {
+		return false
+	}
+	if User.Scope != nil {
+		return User.Scope.KeyAllowed(namespace, key, permissions)
+	}
+	return true
+}
+
+// permissions applies the matching rules from the least to the most specific pattern.
+// Allow entries replace the permissions and deny entries remove permissions, entries with the same specificity are combined.
+// With an empty key only the rules for the whole namespace are used.
+func (User *User) permissions(namespace string, key string) (ConfigPermissions, string) {
+	type level struct {
+		pattern string
+		allow   *ConfigPermissions
+		deny    ConfigPermissions
+	}
+	levels := map[[2]int]*level{}
+	for _, rule := range User.Rules {
+		matched, _ := path.Match(rule.Pattern, namespace)
+		if !matched {
+			continue
+		}
+		specificity := [2]int{patternSpecificity(rule.Pattern), -1}
+		if rule.Key != "" {
+			if key == "" {
+				continue
+			}
+			matched, _ = path.Match(rule.Key, key)
+			if !matched {
+				continue
+			}
+			specificity[1] = patternSpecificity(rule.Key)
+		}
+		current, ok := levels[specificity]
+		if !ok {
+			current = &level{pattern: rule.String()}
+			levels[specificity] = current
+		}
+		if rule.Deny {
+			current.deny = mergePermissions(current.deny, rule.Permissions)
+		} else if current.allow == nil {
+			permissions := rule.Permissions
+			current.allow = &permissions
+		} else {
+			*current.allow = mergePermissions(*current.allow, rule.Permissions)
+		}
+	}
+	specificities := make([][2]int, 0, len(levels))
+	for specificity := range levels {
+		specificities = append(specificities, specificity)
+	}
+	slices.SortFunc(specificities, func(a [2]int, b [2]int) int {
+		if a[0] != b[0] {
+			return cmp.Compare(a[0], b[0])
+		}
+		return cmp.Compare(a[1], b[1])
+	})
+	permissions := ConfigPermissions{}
+	pattern := ""
+	for _, specificity := range specificities {
+		current := levels[specificity]
+		if current.allow != nil {
+			permissions = *current.allow
+		}
+		permissions = removePermissions(permissions, current.deny)
+		pattern = current.pattern
+	}
+	return permissions, pattern
+}
+
+func mergePermissions(a ConfigPermissions, b ConfigPermissions) ConfigPermissions {
+	return ConfigPermissions{Read: a.Read || b.Read, Write: a.Write || b.Write, List: a.List || b.List}
+}
+
+func removePermissions(a ConfigPermissions, b ConfigPermissions) ConfigPermissions {
+	return ConfigPermissions{Read: a.Read && !b.Read, Write: a.Write && !b.Write, List: a.List && !b.List}
+}
@@ -1,19 +1,25 @@
 package main
 
 import (
+	"context"
+	"errors"
 	"fmt"
+	"net"
 	"os"
+	"strconv"
 	"strings"
+	"sync/atomic"
+	"time"
 
 	"database/sql"
 
 	"github.com/SimonStiil/keyvaluedatabase/rest"
-	_ "github.com/lib/pq"
+	"github.com/lib/pq"
 	"github.com/spf13/viper"
 )
 
 type PostgresDatabase struct {
-	Initialized  bool
+	Initialized  atomic.Bool
 	Connection   *sql.DB
 	Config       *ConfigPostgres
 	Password     string
@@ -21,14 +27,29 @@ type PostgresDatabase struct {
 }
 
 type ConfigPostgres struct {
-	Address         string `mapstructure:"address"`
-	Username        string `mapstructure:"username"`
-	DatabaseName    string `mapstructure:"databaseName"`
-	SystemTableName string `mapstructure:"systemTableName"`
-	EnvVariableName string `mapstructure:"envVariableName"`
-	KeyName         string `mapstructure:"keyName"`
-	ValueName       string `mapstructure:"valueName"`
-	SSLMode         string `mapstructure:"sslMode"`
+	DSN                string        `mapstructure:"dsn"` // Connection string or postgres:// URL, replaces address, username, databaseName and sslMode
+	Address            string        `mapstructure:"address"`
+	Username           string        `mapstructure:"username"`
+	DatabaseName       string        `mapstructure:"databaseName"`
+	SystemTableName    string        `mapstructure:"systemTableName"`
+	EnvVariableName    string        `mapstructure:"envVariableName"`
+	KeyName            string        `mapstructure:"keyName"`
+	ValueName          string        `mapstructure:"valueName"`
+	SSLMode            string        `mapstructure:"sslMode"`
+	ExpiryName         string        `mapstructure:"expiryName"`
+	HistoryTableName   string        `mapstructure:"historyTableName"`
+	Layout             string        `mapstructure:"layout"` // table or single, see PostgresSingleTableDatabase
+	DataTableName      string        `mapstructure:"dataTableName"`
+	NamespaceTableName string        `mapstructure:"namespaceTableName"`
+	SchemaTableName    string        `mapstructure:"schemaTableName"`
+	SSLRootCert        string        `mapstructure:"sslRootCert"` // CA certificate to verify the server with
+	SSLCert            string        `mapstructure:"sslCert"`     // Client certificate
+	SSLKey             string        `mapstructure:"sslKey"`      // Key of the client certificate
+	Schema             string        `mapstructure:"schema"`
+	Pool               ConfigSQLPool `mapstructure:"pool"`
+	ConnectTimeout     time.Duration `mapstructure:"connectTimeout"`
+	StatementTimeout   time.Duration `mapstructure:"statementTimeout"` // Statements running longer are cancelled by the server, 0 for no limit
+	StartupTimeout     time.Duration `mapstructure:"startupTimeout"`   // Time Init retries connecting to an unavailable database
 }
 
 func PostgresGetDefaults(configReader *viper.Viper) {
@@ -40,81 +61,431 @@ func PostgresGetDefaults(configReader *viper.Viper) {
 	configReader.SetDefault("postgres.keyName", "key")
 	configReader.SetDefault("postgres.valueName", "value")
 	configReader.SetDefault("postgres.sslMode", "disable")
+	configReader.SetDefault("postgres.expiryName", "expiry")
+	configReader.SetDefault("postgres.historyTableName", "kvdb_history")
+	configReader.SetDefault("postgres.layout", LayoutTable)
+	configReader.SetDefault("postgres.dataTableName", "kvdb_data")
+	configReader.SetDefault("postgres.namespaceTableName", "kvdb_namespaces")
+	configReader.SetDefault("postgres.schemaTableName", "kvdb_schema")
+	configReader.SetDefault("postgres.dsn", "")
+	configReader.SetDefault("postgres.sslRootCert", "")
+	configReader.SetDefault("postgres.sslCert", "")
+	configReader.SetDefault("postgres.sslKey", "")
+	configReader.SetDefault("postgres.schema", "public")
+	SQLPoolGetDefaults(configReader, "postgres")
+	configReader.SetDefault("postgres.connectTimeout", "10s")
+	configReader.SetDefault("postgres.statementTimeout", "0s")
+	configReader.SetDefault("postgres.startupTimeout", "1m")
 }
 
-func (PDB *PostgresDatabase) Init() {
+func (PDB *PostgresDatabase) Init() error {
 	logger.Debug("Initializing PostgreSQL", "function", "Init", "struct", "PostgresDatabase")
+	connection, err := PDB.connect()
+	if err != nil {
+		return err
+	}
+	err = PDB.createTables(connection)
+	if err != nil {
+		// Init is retried by Reconnect, which opens a new pool
+		connection.Close()
+		return &ErrUnavailable{Value: "postgres", Err: err}
+	}
+	PDB.publish(connection)
+	logger.Debug("Initialization complete", "function", "Init", "struct", "PostgresDatabase")
+	return nil
+}
+
+// publish makes connection the pool of the database once Init succeeded,
+// Health and the requests only use the pool when the database is initialized.
+func (PDB *PostgresDatabase) publish(connection *sql.DB) {
+	PDB.Connection = connection
+	PDB.Initialized.Store(true)
+}
+
+func (PDB *PostgresDatabase) createTables(connection *sql.DB) error {
+	// Create system table
+	_, err := connection.Exec(PDB.createTableStatement(PDB.Config.SystemTableName))
+	if err != nil {
+		return err
+	}
+	err = PDB.createHistoryTable(connection)
+	if err != nil {
+		return err
+	}
+	return PDB.upgradeExpiryColumns(connection)
+}
+
+// connectionConfig parses dsn, or builds it from address when not set, and applies the settings that are not part of it
+func (PDB *PostgresDatabase) connectionConfig() (pq.Config, error) {
+	dsn := PDB.Config.DSN
+	if dsn == "" {
+		host, port, err := net.SplitHostPort(PDB.Config.Address)
+		if err != nil {
+			// Address without a port, IPv6 addresses may be given with brackets
+			host, port = strings.Trim(PDB.Config.Address, "[]"), "5432"
+		}
+		dsn = fmt.Sprintf("host=%v port=%v user=%v dbname=%v sslmode=%v", pqValue(host), pqValue(port),
+			pqValue(PDB.Config.Username), pqValue(PDB.DatabaseName), pqValue(PDB.Config.SSLMode))
+	}
+	config, err := pq.NewConfig(dsn)
+	if err != nil {
+		return config, err
+	}
+	if config.Password == "" {
+		config.Password = PDB.Password
+	}
+	if PDB.Config.SSLRootCert != "" {
+		config.SSLRootCert = PDB.Config.SSLRootCert
+	}
+	if PDB.Config.SSLCert != "" {
+		config.SSLCert = PDB.Config.SSLCert
+	}
+	if PDB.Config.SSLKey != "" {
+		config.SSLKey = PDB.Config.SSLKey
+	}
+	if config.ConnectTimeout == 0 {
+		config.ConnectTimeout = PDB.Config.ConnectTimeout
+	}
+	if config.Runtime == nil {
+		config.Runtime = map[string]string{}
+	}
+	if PDB.Config.Schema != "" {
+		config.Runtime["search_path"] = PDB.Config.Schema
+	}
+	if PDB.Config.StatementTimeout > 0 {
+		config.Runtime["statement_timeout"] = strconv.FormatInt(PDB.Config.StatementTimeout.Milliseconds(), 10)
+	}
+	return config, nil
+}
+
+// pqValue quotes a value of a key=value connection string
+func pqValue(value string) string {
+	return "'" + strings.NewReplacer(`\`, `\\`, "'", `\'`).Replace(value) + "'"
+}
+
+// connect opens a pool and waits for the database, the pool is closed by the caller when Init fails
+func (PDB *PostgresDatabase) connect() (*sql.DB, error) {
 	if PDB.Config.DatabaseName == "" {
 		PDB.DatabaseName = PDB.Config.Username
 	} else {
 		PDB.DatabaseName = PDB.Config.DatabaseName
 	}
 	PDB.Password = os.Getenv(PDB.Config.EnvVariableName)
-	var err error
-	connectionString := fmt.Sprintf("host=%v port=%v user=%v password=%v dbname=%v sslmode=%v",
-		strings.Split(PDB.Config.Address, ":")[0],
-		strings.Split(PDB.Config.Address, ":")[1],
-		PDB.Config.Username, PDB.Password, PDB.DatabaseName, PDB.Config.SSLMode)
-
-	logger.Debug("Connection string (password hidden)", "function", "Init", "struct", "PostgresDatabase")
-	PDB.Connection, err = sql.Open("postgres", connectionString)
+	config, err := PDB.connectionConfig()
 	if err != nil {
-		panic(err.Error())
+		return nil, &ErrInvalidConfig{Value: "postgres", Err: err}
 	}
-
-	// Test connection
-	err = PDB.Connection.Ping()
+	logger.Debug("Connecting", "function", "connect", "struct", "PostgresDatabase", "host", config.Host, "port", config.Port, "database", config.Database, "user", config.User, "sslmode", config.SSLMode, "schema", PDB.Config.Schema)
+	connector, err := pq.NewConnectorConfig(config)
+	if err != nil {
+		return nil, &ErrInvalidConfig{Value: "postgres", Err: err}
+	}
+	connection := sql.OpenDB(connector)
+	PDB.Config.Pool.Apply(connection)
+	err = waitForDatabase(connection, PDB.Config.StartupTimeout)
 	if err != nil {
-		panic(err.Error())
+		connection.Close()
+		return nil, &ErrUnavailable{Value: "postgres", Err: err}
 	}
+	return connection, nil
+}
 
-	// Create system table
-	_, err = PDB.Connection.Exec(fmt.Sprintf(`CREATE TABLE IF NOT EXISTS "%v" ( 
+// Health pings the database, it is reported by /system/health
+func (PDB *PostgresDatabase) Health(ctx context.Context) error {
+	if !PDB.Initialized.Load() {
+		return errNotInitialized
+	}
+	ctx, cancel := context.WithTimeout(ctx, healthTimeout)
+	defer cancel()
+	return PDB.Connection.PingContext(ctx)
+}
+
+func (PDB *PostgresDatabase) createHistoryTable(connection *sql.DB) error {
+	_, err := connection.Exec(fmt.Sprintf(`CREATE TABLE IF NOT EXISTS "%v" ( 
+		"namespace" CHAR(%v) NOT NULL, 
+		"key" CHAR(%v) NOT NULL, 
+		"version" INTEGER NOT NULL, 
+		"value" VARCHAR(%v) NOT NULL, 
+		"user" VARCHAR(%v) NOT NULL, 
+		"timestamp" BIGINT NOT NULL, 
+		PRIMARY KEY ("namespace", "key", "version"))`,
+		PDB.Config.HistoryTableName, rest.KeyMaxLength, rest.KeyMaxLength,
+		rest.ValueMaxLength, rest.KeyMaxLength))
+	return err
+}
+
+func (PDB *PostgresDatabase) createTableStatement(namespace string) string {
+	return fmt.Sprintf(`CREATE TABLE IF NOT EXISTS "%v" ( 
 		"%v" CHAR(%v) PRIMARY KEY, 
-		"%v" VARCHAR(%v) NOT NULL)`,
-		PDB.Config.SystemTableName, PDB.Config.KeyName, rest.KeyMaxLength,
-		PDB.Config.ValueName, rest.ValueMaxLength))
+		"%v" VARCHAR(%v) NOT NULL,
+		"%v" BIGINT NOT NULL DEFAULT 0)`,
+		namespace, PDB.Config.KeyName, rest.KeyMaxLength,
+		PDB.Config.ValueName, rest.ValueMaxLength, PDB.Config.ExpiryName)
+}
+
+// Tables created before expiry support are missing the expiry column
+func (PDB *PostgresDatabase) upgradeExpiryColumns(connection *sql.DB) error {
+	namespaces, err := queryStrings(connection, `SELECT tablename FROM pg_catalog.pg_tables 
+		WHERE schemaname = current_schema() AND tablename <> $1`, PDB.Config.HistoryTableName)
 	if err != nil {
-		panic(err.Error())
+		return err
 	}
-	PDB.Initialized = true
-	err = PDB.CreateNamespace(PDB.GetSystemNS())
-	if err != nil {
-		panic(err.Error())
+	for _, namespace := range namespaces {
+		_, err = connection.Exec(fmt.Sprintf(`ALTER TABLE "%v" ADD COLUMN IF NOT EXISTS "%v" BIGINT NOT NULL DEFAULT 0`,
+			namespace, PDB.Config.ExpiryName))
+		if err != nil {
+			logger.Error("Error adding expiry column", "function", "upgradeExpiryColumns", "struct", "PostgresDatabase", "namespace", namespace, "error", err)
+			return err
+		}
 	}
-	logger.Debug("Initialization complete", "function", "Init", "struct", "PostgresDatabase")
+	return nil
 }
 
 func (PDB *PostgresDatabase) GetSystemNS() string {
 	return PDB.Config.SystemTableName
 }
 
-func (PDB *PostgresDatabase) Set(namespace string, key string, value interface{}) error {
-	if !PDB.Initialized {
-		panic("F Unable to set. db not initialized()")
+func (PDB *PostgresDatabase) Set(ctx context.Context, namespace string, key string, value interface{}) error {
+	return PDB.SetWithTTL(ctx, namespace, key, value, 0)
+}
+
+func (PDB *PostgresDatabase) SetWithTTL(ctx context.Context, namespace string, key string, value interface{}, ttl time.Duration) error {
+	if !PDB.Initialized.Load() {
+		return errNotInitialized
+	}
+	if err := validateNamespace(namespace); err != nil {
+		return err
+	}
+	query := fmt.Sprintf(`INSERT INTO "%v" ("%v", "%v", "%v") VALUES ($1, $2, $3) 
+		ON CONFLICT ("%v") DO UPDATE SET "%v"=$2, "%v"=$3`,
+		namespace, PDB.Config.KeyName, PDB.Config.ValueName, PDB.Config.ExpiryName,
+		PDB.Config.KeyName, PDB.Config.ValueName, PDB.Config.ExpiryName)
+	expiry := expiryFromTTL(ttl)
+	_, err := PDB.Connection.ExecContext(ctx, query, key, value, expiry)
+	if isPostgresTableMissing(err) {
+		// The table is created by the first key of a namespace
+		err = PDB.CreateNamespace(ctx, namespace)
+		if err == nil {
+			_, err = PDB.Connection.ExecContext(ctx, query, key, value, expiry)
+		}
+	}
+	if err != nil {
+		logger.Error("Exec failed with error", "function", "SetWithTTL", "struct", "PostgresDatabase", "namespace", namespace, "key", key, "error", err)
+	}
+	return err
+}
+
+// isPostgresTableMissing is true for errors of statements on a namespace without a table
+func isPostgresTableMissing(err error) bool {
+	var pqErr *pq.Error
+	return errors.As(err, &pqErr) && pqErr.Code == "42P01"
+}
+
+func (PDB *PostgresDatabase) CompareAndSet(ctx context.Context, namespace string, key string, expected *string, value string, ttl time.Duration) error {
+	if !PDB.Initialized.Load() {
+		return errNotInitialized
+	}
+	if err := validateNamespace(namespace); err != nil {
+		return err
+	}
+	now := time.Now().UnixMilli()
+	var result sql.Result
+	var err error
+	if expected == nil {
+		// Insert, or replace a row that has expired but is not yet reaped
+		query := fmt.Sprintf(`INSERT INTO "%v" ("%v", "%v", "%v") VALUES ($1, $2, $3) 
+			ON CONFLICT ("%v") DO UPDATE SET "%v"=$2, "%v"=$3 WHERE "%v"."%v" <> 0 AND "%v"."%v" <= $4`,
+			namespace, PDB.Config.KeyName, PDB.Config.ValueName, PDB.Config.ExpiryName,
+			PDB.Config.KeyName, PDB.Config.ValueName, PDB.Config.ExpiryName,
+			namespace, PDB.Config.ExpiryName, namespace, PDB.Config.ExpiryName)
+		result, err = PDB.Connection.ExecContext(ctx, query, key, value, expiryFromTTL(ttl), now)
+		if isPostgresTableMissing(err) {
+			// The table is created by the first key of a namespace
+			err = PDB.CreateNamespace(ctx, namespace)
+			if err == nil {
+				result, err = PDB.Connection.ExecContext(ctx, query, key, value, expiryFromTTL(ttl), now)
+			}
+		}
+	} else {
+		result, err = PDB.Connection.ExecContext(ctx, fmt.Sprintf(`UPDATE "%v" SET "%v"=$1, "%v"=$2 
+			WHERE "%v" = $3 AND "%v" = $4 AND ("%v" = 0 OR "%v" > $5)`,
+			namespace, PDB.Config.ValueName, PDB.Config.ExpiryName,
+			PDB.Config.KeyName, PDB.Config.ValueName, PDB.Config.ExpiryName, PDB.Config.ExpiryName),
+			value, expiryFromTTL(ttl), key, *expected, now)
+		if isPostgresTableMissing(err) {
+			return &ErrPreconditionFailed{Value: key}
+		}
 	}
-	PDB.CreateNamespace(namespace)
-	statement, err := PDB.Connection.Prepare(fmt.Sprintf(`INSERT INTO "%v" ("%v", "%v") VALUES ($1, $2) 
-		ON CONFLICT ("%v") DO UPDATE SET "%v"=$2`,
-		namespace, PDB.Config.KeyName, PDB.Config.ValueName,
-		PDB.Config.KeyName, PDB.Config.ValueName))
 	if err != nil {
+		logger.Error("Exec failed with error", "function", "CompareAndSet", "struct", "PostgresDatabase", "namespace", namespace, "key", key, "error", err)
 		return err
 	}
-	defer statement.Close()
-	_, err = statement.Exec(key, value)
+	affected, err := result.RowsAffected()
 	if err != nil {
 		return err
 	}
+	if affected == 0 {
+		return &ErrPreconditionFailed{Value: key}
+	}
 	return nil
 }
 
-func (PDB *PostgresDatabase) Get(namespace string, key string) (string, error) {
-	if !PDB.Initialized {
-		panic("F Unable to get. db not initialized()")
+func (PDB *PostgresDatabase) TTL(ctx context.Context, namespace string, key string) (time.Duration, error) {
+	if !PDB.Initialized.Load() {
+		return 0, errNotInitialized
+	}
+	if err := validateNamespace(namespace); err != nil {
+		return 0, err
+	}
+	var expiry int64
+	err := PDB.Connection.QueryRowContext(ctx, fmt.Sprintf(`SELECT "%v" FROM "%v" WHERE "%v" = $1 AND ("%v" = 0 OR "%v" > $2)`,
+		PDB.Config.ExpiryName, namespace, PDB.Config.KeyName, PDB.Config.ExpiryName, PDB.Config.ExpiryName),
+		key, time.Now().UnixMilli()).Scan(&expiry)
+	if err != nil {
+		if err == sql.ErrNoRows || strings.Contains(err.Error(), "does not exist") {
+			return 0, &ErrNotFound{Value: key}
+		}
+		logger.Error("Query failed with error", "function", "TTL", "struct", "PostgresDatabase", "namespace", namespace, "error", err)
+		return 0, err
+	}
+	return ttlFromExpiry(expiry), nil
+}
+
+func (PDB *PostgresDatabase) DeleteExpired(ctx context.Context) (int, error) {
+	if !PDB.Initialized.Load() {
+		return 0, errNotInitialized
+	}
+	namespaces, err := PDB.Keys(ctx, "")
+	if err != nil {
+		return 0, err
+	}
+	count := 0
+	now := time.Now().UnixMilli()
+	for _, namespace := range namespaces {
+		result, err := PDB.Connection.ExecContext(ctx, fmt.Sprintf(`DELETE FROM "%v" WHERE "%v" <> 0 AND "%v" <= $1`,
+			namespace, PDB.Config.ExpiryName, PDB.Config.ExpiryName), now)
+		if err != nil {
+			logger.Error("Exec failed with error", "function", "DeleteExpired", "struct", "PostgresDatabase", "namespace", namespace, "error", err)
+			return count, err
+		}
+		affected, _ := result.RowsAffected()
+		count += int(affected)
+	}
+	return count, nil
+}
+
+func (PDB *PostgresDatabase) Atomic() bool {
+	return true
+}
+
+// Transaction runs fn in a SQL transaction, tables of namespaces written by fn are created in it
+// and removed again by a rollback.
+func (PDB *PostgresDatabase) Transaction(ctx context.Context, fn func(tx Transaction) error) error {
+	if !PDB.Initialized.Load() {
+		return errNotInitialized
+	}
+	tx, err := PDB.Connection.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	err = fn(&postgresTransaction{PDB: PDB, Tx: tx, ctx: ctx})
+	if err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+type postgresTransaction struct {
+	PDB *PostgresDatabase
+	Tx  *sql.Tx
+	ctx context.Context
+}
+
+// namespaceExists is checked before using a table, a failed statement aborts the whole transaction in PostgreSQL
+func (Tx *postgresTransaction) namespaceExists(namespace string) (bool, error) {
+	var exists bool
+	err := Tx.Tx.QueryRowContext(Tx.ctx, `SELECT EXISTS (SELECT 1 FROM pg_catalog.pg_tables WHERE schemaname = current_schema() AND tablename = $1)`, namespace).Scan(&exists)
+	if err != nil {
+		logger.Error("Query failed with error", "function", "namespaceExists", "struct", "postgresTransaction", "namespace", namespace, "error", err)
+	}
+	return exists, err
+}
+
+func (Tx *postgresTransaction) Get(namespace string, key string) (string, error) {
+	if err := validateNamespace(namespace); err != nil {
+		return "", err
+	}
+	exists, err := Tx.namespaceExists(namespace)
+	if err != nil {
+		return "", err
+	}
+	if !exists {
+		return "", &ErrNotFound{Value: namespace}
+	}
+	var value string
+	err = Tx.Tx.QueryRowContext(Tx.ctx, fmt.Sprintf(`SELECT "%v" FROM "%v" WHERE "%v" = $1 AND ("%v" = 0 OR "%v" > $2) FOR UPDATE`,
+		Tx.PDB.Config.ValueName, namespace, Tx.PDB.Config.KeyName,
+		Tx.PDB.Config.ExpiryName, Tx.PDB.Config.ExpiryName), key, time.Now().UnixMilli()).Scan(&value)
+	if err == sql.ErrNoRows {
+		return "", &ErrNotFound{Value: key}
+	} else if err != nil {
+		logger.Error("Query failed with error", "function", "Get", "struct", "postgresTransaction", "namespace", namespace, "key", key, "error", err)
+		return "", err
+	}
+	return value, nil
+}
+
+func (Tx *postgresTransaction) SetWithTTL(namespace string, key string, value string, ttl time.Duration) error {
+	if err := validateNamespace(namespace); err != nil {
+		return err
+	}
+	exists, err := Tx.namespaceExists(namespace)
+	if err != nil {
+		return err
+	}
+	if !exists {
+		_, err = Tx.Tx.ExecContext(Tx.ctx, Tx.PDB.createTableStatement(namespace))
+		if err != nil {
+			logger.Error("Error creating table", "function", "SetWithTTL", "struct", "postgresTransaction", "namespace", namespace, "error", err)
+			return err
+		}
+	}
+	_, err = Tx.Tx.ExecContext(Tx.ctx, fmt.Sprintf(`INSERT INTO "%v" ("%v", "%v", "%v") VALUES ($1, $2, $3) 
+		ON CONFLICT ("%v") DO UPDATE SET "%v"=$2, "%v"=$3`,
+		namespace, Tx.PDB.Config.KeyName, Tx.PDB.Config.ValueName, Tx.PDB.Config.ExpiryName,
+		Tx.PDB.Config.KeyName, Tx.PDB.Config.ValueName, Tx.PDB.Config.ExpiryName), key, value, expiryFromTTL(ttl))
+	if err != nil {
+		logger.Error("Exec failed with error", "function", "SetWithTTL", "struct", "postgresTransaction", "namespace", namespace, "key", key, "error", err)
+	}
+	return err
+}
+
+func (Tx *postgresTransaction) DeleteKey(namespace string, key string) error {
+	if err := validateNamespace(namespace); err != nil {
+		return err
+	}
+	exists, err := Tx.namespaceExists(namespace)
+	if err != nil || !exists {
+		return err
 	}
-	rows, err := PDB.Connection.Query(fmt.Sprintf(`SELECT * FROM "%v" WHERE "%v" = $1`,
-		namespace, PDB.Config.KeyName), key)
+	_, err = Tx.Tx.ExecContext(Tx.ctx, fmt.Sprintf(`DELETE FROM "%v" WHERE "%v" = $1`, namespace, Tx.PDB.Config.KeyName), key)
+	if err != nil {
+		logger.Error("Exec failed with error", "function", "DeleteKey", "struct", "postgresTransaction", "namespace", namespace, "key", key, "error", err)
+	}
+	return err
+}
+
+func (PDB *PostgresDatabase) Get(ctx context.Context, namespace string, key string) (string, error) {
+	if !PDB.Initialized.Load() {
+		return "", errNotInitialized
+	}
+	if err := validateNamespace(namespace); err != nil {
+		return "", err
+	}
+	rows, err := PDB.Connection.QueryContext(ctx, fmt.Sprintf(`SELECT "%v", "%v" FROM "%v" WHERE "%v" = $1 AND ("%v" = 0 OR "%v" > $2)`,
+		PDB.Config.KeyName, PDB.Config.ValueName, namespace, PDB.Config.KeyName,
+		PDB.Config.ExpiryName, PDB.Config.ExpiryName), key, time.Now().UnixMilli())
 
 	if err != nil {
 		if strings.Contains(err.Error(), "does not exist") {
@@ -141,18 +512,21 @@ func (PDB *PostgresDatabase) Get(namespace string, key string) (string, error) {
 	}
 }
 
-func (PDB *PostgresDatabase) Keys(namespace string) ([]string, error) {
-	if !PDB.Initialized {
-		panic("F Unable to get. db not initialized()")
+func (PDB *PostgresDatabase) Keys(ctx context.Context, namespace string) ([]string, error) {
+	if !PDB.Initialized.Load() {
+		return nil, errNotInitialized
+	}
+	if err := validateNamespace(namespace); err != nil {
+		return nil, err
 	}
 	var rows *sql.Rows
 	var err error
 	if namespace == "" {
-		rows, err = PDB.Connection.Query(`SELECT tablename FROM pg_catalog.pg_tables 
-			WHERE schemaname = 'public'`)
+		rows, err = PDB.Connection.QueryContext(ctx, `SELECT tablename FROM pg_catalog.pg_tables 
+			WHERE schemaname = current_schema() AND tablename <> $1`, PDB.Config.HistoryTableName)
 	} else {
-		rows, err = PDB.Connection.Query(fmt.Sprintf(`SELECT "%v" FROM "%v"`,
-			PDB.Config.KeyName, namespace))
+		rows, err = PDB.Connection.QueryContext(ctx, fmt.Sprintf(`SELECT "%v" FROM "%v" WHERE "%v" = 0 OR "%v" > $1`,
+			PDB.Config.KeyName, namespace, PDB.Config.ExpiryName, PDB.Config.ExpiryName), time.Now().UnixMilli())
 	}
 	if err != nil {
 		logger.Error("Query failed with error", "function", "Keys", "struct", "PostgresDatabase", "namespace", namespace, "error", err)
@@ -172,18 +546,104 @@ func (PDB *PostgresDatabase) Keys(namespace string) ([]string, error) {
 	return keys, nil
 }
 
-func (PDB *PostgresDatabase) DeleteKey(namespace string, key string) error {
-	if !PDB.Initialized {
-		panic("F Unable to get. db not initialized()")
+// keysPageQuery returns the query listing a page of the keys of namespace, or of the namespaces when it is empty
+func (PDB *PostgresDatabase) keysPageQuery(namespace string, options ListOptions, last string, now int64) (string, []any) {
+	args := []any{}
+	arg := func(value any) string {
+		args = append(args, value)
+		return fmt.Sprintf("$%v", len(args))
+	}
+	column := fmt.Sprintf(`"%v"`, PDB.Config.KeyName)
+	var query string
+	if namespace == "" {
+		column = "tablename"
+		query = fmt.Sprintf(`SELECT %v FROM pg_catalog.pg_tables WHERE schemaname = current_schema() AND %v <> %v`, column, column, arg(PDB.Config.HistoryTableName))
+	} else {
+		query = fmt.Sprintf(`SELECT %v FROM "%v" WHERE ("%v" = 0 OR "%v" > %v)`, column, namespace, PDB.Config.ExpiryName, PDB.Config.ExpiryName, arg(now))
+	}
+	if options.Cursor != "" {
+		query += fmt.Sprintf(" AND %v > %v", column, arg(last))
+	}
+	// Keys are CHAR columns, padding is removed before matching
+	if options.Prefix != "" {
+		query += fmt.Sprintf(" AND RTRIM(%v) LIKE %v", column, arg(likePrefix(options.Prefix)))
+	}
+	if options.Match != "" {
+		query += fmt.Sprintf(" AND RTRIM(%v) ~ %v", column, arg(globToRegexp(options.Match)))
+	}
+	query += " ORDER BY " + column
+	if options.Limit > 0 {
+		query += " LIMIT " + arg(options.Limit+1)
+	}
+	return query, args
+}
+
+// KeysPage filters and pages in the query, the cursor is the last key of the previous page
+func (PDB *PostgresDatabase) KeysPage(ctx context.Context, namespace string, options ListOptions) ([]string, string, error) {
+	if !PDB.Initialized.Load() {
+		return nil, "", errNotInitialized
+	}
+	if err := validateNamespace(namespace); err != nil {
+		return nil, "", err
+	}
+	last, err := decodeCursor(options.Cursor)
+	if err != nil {
+		return nil, "", err
+	}
+	query, args := PDB.keysPageQuery(namespace, options, last, time.Now().UnixMilli())
+	rows, err := PDB.Connection.QueryContext(ctx, query, args...)
+	if err != nil {
+		logger.Error("Query failed with error", "function", "KeysPage", "struct", "PostgresDatabase", "namespace", namespace, "error", err)
+		return nil, "", err
+	}
+	defer rows.Close()
+	keys := []string{}
+	for rows.Next() {
+		var key string
+		err = rows.Scan(&key)
+		if err != nil {
+			logger.Error("Scan row failed with error", "function", "KeysPage", "struct", "PostgresDatabase", "namespace", namespace, "error", err)
+			return nil, "", err
+		}
+		if options.Limit > 0 && len(keys) == options.Limit {
+			return keys, encodeCursor(keys[len(keys)-1]), nil
+		}
+		keys = append(keys, strings.TrimSpace(key))
+	}
+	return keys, "", rows.Err()
+}
+
+func (PDB *PostgresDatabase) CountKeys(ctx context.Context, namespace string) (int, error) {
+	if !PDB.Initialized.Load() {
+		return 0, errNotInitialized
+	}
+	if err := validateNamespace(namespace); err != nil {
+		return 0, err
+	}
+	var count int
+	err := PDB.Connection.QueryRowContext(ctx, fmt.Sprintf(`SELECT COUNT(*) FROM "%v" WHERE "%v" = 0 OR "%v" > $1`,
+		namespace, PDB.Config.ExpiryName, PDB.Config.ExpiryName), time.Now().UnixMilli()).Scan(&count)
+	if err != nil {
+		logger.Error("Query failed with error", "function", "CountKeys", "struct", "PostgresDatabase", "namespace", namespace, "error", err)
+	}
+	return count, err
+}
+
+func (PDB *PostgresDatabase) DeleteKey(ctx context.Context, namespace string, key string) error {
+	if !PDB.Initialized.Load() {
+		return errNotInitialized
+	}
+	if err := validateNamespace(namespace); err != nil {
+		return err
 	}
-	stmt, err := PDB.Connection.Prepare(fmt.Sprintf(`DELETE FROM "%v" WHERE "%v" = $1`,
+	stmt, err := PDB.Connection.PrepareContext(ctx, fmt.Sprintf(`DELETE FROM "%v" WHERE "%v" = $1`,
 		namespace, PDB.Config.KeyName))
 	if err != nil {
 		logger.Error("Prepare failed with error", "function", "DeleteKey", "struct", "PostgresDatabase", "namespace", namespace, "key", key, "error", err)
 		return err
 	}
 	defer stmt.Close()
-	_, err = stmt.Exec(key)
+	_, err = stmt.ExecContext(ctx, key)
 	if err != nil {
 		logger.Error("Exec failed with error", "function", "DeleteKey", "struct", "PostgresDatabase", "namespace", namespace, "key", key, "error", err)
 		return err
@@ -191,15 +651,111 @@ func (PDB *PostgresDatabase) DeleteKey(namespace string, key string) error {
 	return nil
 }
 
-func (PDB *PostgresDatabase) CreateNamespace(namespace string) error {
-	if !PDB.Initialized {
-		panic("F Unable to get. db not initialized()")
+func (PDB *PostgresDatabase) CompareAndDelete(ctx context.Context, namespace string, key string, expected string) error {
+	if !PDB.Initialized.Load() {
+		return errNotInitialized
 	}
-	result, err := PDB.Connection.Exec(fmt.Sprintf(`CREATE TABLE IF NOT EXISTS "%v" ( 
-		"%v" CHAR(%v) PRIMARY KEY, 
-		"%v" VARCHAR(%v) NOT NULL)`,
-		namespace, PDB.Config.KeyName, rest.KeyMaxLength,
-		PDB.Config.ValueName, rest.ValueMaxLength))
+	if err := validateNamespace(namespace); err != nil {
+		return err
+	}
+	result, err := PDB.Connection.ExecContext(ctx, fmt.Sprintf(`DELETE FROM "%v" WHERE "%v" = $1 AND "%v" = $2 AND ("%v" = 0 OR "%v" > $3)`,
+		namespace, PDB.Config.KeyName, PDB.Config.ValueName, PDB.Config.ExpiryName, PDB.Config.ExpiryName),
+		key, expected, time.Now().UnixMilli())
+	if err != nil {
+		logger.Error("Exec failed with error", "function", "CompareAndDelete", "struct", "PostgresDatabase", "namespace", namespace, "key", key, "error", err)
+		return err
+	}
+	affected, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if affected == 0 {
+		return &ErrPreconditionFailed{Value: key}
+	}
+	return nil
+}
+
+func (PDB *PostgresDatabase) AddVersion(ctx context.Context, namespace string, key string, version rest.KeyVersionV1, limit int) error {
+	if !PDB.Initialized.Load() {
+		return errNotInitialized
+	}
+	tx, err := PDB.Connection.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	// Serialize concurrent writers of the same key history
+	_, err = tx.ExecContext(ctx, `SELECT pg_advisory_xact_lock(hashtext($1))`, namespace+"/"+key)
+	if err != nil {
+		logger.Error("Exec failed with error", "function", "AddVersion", "struct", "PostgresDatabase", "namespace", namespace, "key", key, "error", err)
+		return err
+	}
+	var latest int
+	err = tx.QueryRowContext(ctx, fmt.Sprintf(`SELECT COALESCE(MAX("version"), 0) FROM "%v" WHERE "namespace" = $1 AND "key" = $2`,
+		PDB.Config.HistoryTableName), namespace, key).Scan(&latest)
+	if err != nil {
+		logger.Error("Query failed with error", "function", "AddVersion", "struct", "PostgresDatabase", "namespace", namespace, "key", key, "error", err)
+		return err
+	}
+	version.Version = latest + 1
+	_, err = tx.ExecContext(ctx, fmt.Sprintf(`INSERT INTO "%v" ("namespace", "key", "version", "value", "user", "timestamp") 
+		VALUES ($1, $2, $3, $4, $5, $6)`, PDB.Config.HistoryTableName),
+		namespace, key, version.Version, version.Value, version.User, version.Timestamp.UnixMilli())
+	if err != nil {
+		logger.Error("Exec failed with error", "function", "AddVersion", "struct", "PostgresDatabase", "namespace", namespace, "key", key, "error", err)
+		return err
+	}
+	if limit > 0 {
+		_, err = tx.ExecContext(ctx, fmt.Sprintf(`DELETE FROM "%v" WHERE "namespace" = $1 AND "key" = $2 AND "version" <= $3`,
+			PDB.Config.HistoryTableName), namespace, key, version.Version-limit)
+		if err != nil {
+			logger.Error("Exec failed with error", "function", "AddVersion", "struct", "PostgresDatabase", "namespace", namespace, "key", key, "error", err)
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+func (PDB *PostgresDatabase) Versions(ctx context.Context, namespace string, key string) (rest.KeyHistoryV1, error) {
+	if !PDB.Initialized.Load() {
+		return rest.KeyHistoryV1{}, errNotInitialized
+	}
+	rows, err := PDB.Connection.QueryContext(ctx, fmt.Sprintf(`SELECT "version", "value", "user", "timestamp" FROM "%v" 
+		WHERE "namespace" = $1 AND "key" = $2 ORDER BY "version" DESC`, PDB.Config.HistoryTableName), namespace, key)
+	if err != nil {
+		logger.Error("Query failed with error", "function", "Versions", "struct", "PostgresDatabase", "namespace", namespace, "key", key, "error", err)
+		return nil, err
+	}
+	defer rows.Close()
+	versions := rest.KeyHistoryV1{}
+	for rows.Next() {
+		var version rest.KeyVersionV1
+		var timestamp int64
+		err = rows.Scan(&version.Version, &version.Value, &version.User, &timestamp)
+		if err != nil {
+			logger.Error("Scan row failed with error", "function", "Versions", "struct", "PostgresDatabase", "namespace", namespace, "key", key, "error", err)
+			return nil, err
+		}
+		version.Timestamp = time.UnixMilli(timestamp)
+		versions = append(versions, version)
+	}
+	if len(versions) == 0 {
+		return nil, &ErrNotFound{Value: key}
+	}
+	return versions, nil
+}
+
+func (PDB *PostgresDatabase) CreateNamespace(ctx context.Context, namespace string) error {
+	if !PDB.Initialized.Load() {
+		return errNotInitialized
+	}
+	if err := validateNamespace(namespace); err != nil {
+		return err
+	}
+	if namespace == PDB.Config.HistoryTableName {
+		return &ErrNotAllowed{Value: fmt.Sprintf("create namespace %v", namespace)}
+	}
+	result, err := PDB.Connection.ExecContext(ctx, PDB.createTableStatement(namespace))
 	logger.Debug("Create table if not exists", "function", "createTable", "struct", "PostgresDatabase", "namespace", namespace, "result", result)
 	if err != nil {
 		logger.Error("Error creating table", "function", "createTable", "struct", "PostgresDatabase", "namespace", namespace, "error", err)
@@ -208,14 +764,22 @@ func (PDB *PostgresDatabase) CreateNamespace(namespace string) error {
 	return nil
 }
 
-func (PDB *PostgresDatabase) DeleteNamespace(namespace string) error {
-	if !PDB.Initialized {
-		panic("F Unable to get. db not initialized()")
+func (PDB *PostgresDatabase) DeleteNamespace(ctx context.Context, namespace string) error {
+	if !PDB.Initialized.Load() {
+		return errNotInitialized
+	}
+	if err := validateNamespace(namespace); err != nil {
+		return err
 	}
 	if namespace == PDB.GetSystemNS() {
 		return &ErrNotAllowed{Value: fmt.Sprintf("delete System NS %v", namespace)}
 	}
-	_, err := PDB.Connection.Exec(fmt.Sprintf(`DROP TABLE IF EXISTS "%v"`, namespace))
+	_, err := PDB.Connection.ExecContext(ctx, fmt.Sprintf(`DROP TABLE IF EXISTS "%v"`, namespace))
+	if err != nil {
+		logger.Error("Exec failed with error", "function", "Delete", "struct", "PostgresDatabase", "namespace", namespace, "error", err)
+		return err
+	}
+	_, err = PDB.Connection.ExecContext(ctx, fmt.Sprintf(`DELETE FROM "%v" WHERE "namespace" = $1`, PDB.Config.HistoryTableName), namespace)
 	if err != nil {
 		logger.Error("Exec failed with error", "function", "Delete", "struct", "PostgresDatabase", "namespace", namespace, "error", err)
 		return err
@@ -224,16 +788,17 @@ func (PDB *PostgresDatabase) DeleteNamespace(namespace string) error {
 }
 
 func (PDB *PostgresDatabase) IsInitialized() bool {
-	return PDB.Initialized
+	return PDB.Initialized.Load()
 }
 
 func (PDB *PostgresDatabase) Close() {
-	if !PDB.Initialized {
-		panic("F Unable to close. db not initialized()")
+	if !PDB.Initialized.Load() {
+		return
 	}
 	err := PDB.Connection.Close()
 	if err != nil {
-		panic(err)
+		logger.Error("Unable to close connection", "function", "Close", "struct", "PostgresDatabase", "error", err)
+		return
 	}
 	logger.Debug("Closed database connection", "function", "Close", "struct", "PostgresDatabase")
 }
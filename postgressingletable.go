@@ -0,0 +1,448 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"slices"
+	"time"
+
+	"github.com/SimonStiil/keyvaluedatabase/rest"
+)
+
+// PostgresSingleTableDatabase keeps all namespaces in the table dataTableName, selected with postgres.layout single.
+// Namespaces are values instead of table names and namespaces without keys are kept in namespaceTableName.
+// The schema is versioned in schemaTableName, Init applies new migrations and the first Init copies the tables of the per namespace layout.
+type PostgresSingleTableDatabase struct {
+	*PostgresDatabase
+}
+
+func (PDB *PostgresSingleTableDatabase) migrations() []schemaMigration {
+	return []schemaMigration{
+		{Version: 1, Description: "create data and namespace tables", Apply: func(tx *sql.Tx) error {
+			_, err := tx.Exec(fmt.Sprintf(`CREATE TABLE IF NOT EXISTS "%v" (
+				"namespace" VARCHAR(%v) PRIMARY KEY,
+				"created_at" BIGINT NOT NULL)`,
+				PDB.Config.NamespaceTableName, rest.KeyMaxLength))
+			if err != nil {
+				return err
+			}
+			_, err = tx.Exec(fmt.Sprintf(`CREATE TABLE IF NOT EXISTS "%v" (
+				"namespace" VARCHAR(%v) NOT NULL,
+				"key" VARCHAR(%v) NOT NULL,
+				"value" VARCHAR(%v) NOT NULL,
+				"expiry" BIGINT NOT NULL DEFAULT 0,
+				"created_at" BIGINT NOT NULL,
+				"updated_at" BIGINT NOT NULL,
+				"version" INTEGER NOT NULL DEFAULT 1,
+				PRIMARY KEY ("namespace", "key"))`,
+				PDB.Config.DataTableName, rest.KeyMaxLength, rest.KeyMaxLength, rest.ValueMaxLength))
+			if err != nil {
+				return err
+			}
+			_, err = tx.Exec(fmt.Sprintf(`CREATE INDEX IF NOT EXISTS "%v_expiry" ON "%v" ("expiry") WHERE "expiry" <> 0`,
+				PDB.Config.DataTableName, PDB.Config.DataTableName))
+			return err
+		}},
+		{Version: 2, Description: "copy tables of the per namespace layout", Apply: PDB.copyLegacyTables},
+	}
+}
+
+// copyLegacyTables copies the namespace tables of the per namespace layout. The tables are left in place
+// so a failed upgrade can go back to the per namespace layout, they can be dropped once the upgrade is verified.
+func (PDB *PostgresSingleTableDatabase) copyLegacyTables(tx *sql.Tx) error {
+	// Only tables with the key and value columns of createTableStatement are namespaces
+	rows, err := tx.Query(`SELECT t.tablename FROM pg_catalog.pg_tables t WHERE t.schemaname = current_schema()
+		AND (SELECT COUNT(*) FROM information_schema.columns c WHERE c.table_schema = current_schema()
+		AND c.table_name = t.tablename AND c.column_name IN ($1, $2)) = 2`,
+		PDB.Config.KeyName, PDB.Config.ValueName)
+	if err != nil {
+		return err
+	}
+	internal := []string{PDB.Config.HistoryTableName, PDB.Config.DataTableName, PDB.Config.NamespaceTableName, PDB.Config.SchemaTableName}
+	tables := []string{}
+	for rows.Next() {
+		var table string
+		err = rows.Scan(&table)
+		if err != nil {
+			rows.Close()
+			return err
+		}
+		if !slices.Contains(internal, table) {
+			tables = append(tables, table)
+		}
+	}
+	rows.Close()
+	now := time.Now().UnixMilli()
+	for _, table := range tables {
+		_, err = tx.Exec(fmt.Sprintf(`ALTER TABLE "%v" ADD COLUMN IF NOT EXISTS "%v" BIGINT NOT NULL DEFAULT 0`, table, PDB.Config.ExpiryName))
+		if err != nil {
+			return err
+		}
+		result, err := tx.Exec(fmt.Sprintf(`INSERT INTO "%v" ("namespace", "key", "value", "expiry", "created_at", "updated_at", "version")
+			SELECT $1, RTRIM("%v"), "%v", "%v", $2, $2, 1 FROM "%v" ON CONFLICT ("namespace", "key") DO NOTHING`,
+			PDB.Config.DataTableName, PDB.Config.KeyName, PDB.Config.ValueName, PDB.Config.ExpiryName, table), table, now)
+		if err != nil {
+			return err
+		}
+		_, err = tx.Exec(fmt.Sprintf(`INSERT INTO "%v" ("namespace", "created_at") VALUES ($1, $2) ON CONFLICT DO NOTHING`,
+			PDB.Config.NamespaceTableName), table, now)
+		if err != nil {
+			return err
+		}
+		copied, _ := result.RowsAffected()
+		logger.Info("Copied namespace table, it can be dropped once the upgrade is verified", "function", "copyLegacyTables", "struct", "PostgresSingleTableDatabase", "namespace", table, "keys", copied)
+	}
+	return nil
+}
+
+func (PDB *PostgresSingleTableDatabase) Init() error {
+	logger.Debug("Initializing PostgreSQL single table layout", "function", "Init", "struct", "PostgresSingleTableDatabase")
+	connection, err := PDB.connect()
+	if err != nil {
+		return err
+	}
+	version, err := PDB.createTables(connection)
+	if err != nil {
+		// Init is retried by Reconnect, which opens a new pool
+		connection.Close()
+		return &ErrUnavailable{Value: "postgres", Err: err}
+	}
+	PDB.publish(connection)
+	logger.Debug("Initialization complete", "function", "Init", "struct", "PostgresSingleTableDatabase", "schemaVersion", version)
+	return nil
+}
+
+// createTables migrates the schema and creates the system namespace, it returns the schema version
+func (PDB *PostgresSingleTableDatabase) createTables(connection *sql.DB) (int, error) {
+	err := PDB.createHistoryTable(connection)
+	if err != nil {
+		return 0, err
+	}
+	schema := &sqlSchema{
+		Table:       fmt.Sprintf(`"%v"`, PDB.Config.SchemaTableName),
+		Lock:        fmt.Sprintf(`SELECT pg_advisory_lock(hashtext('%v'))`, PDB.Config.SchemaTableName),
+		Unlock:      fmt.Sprintf(`SELECT pg_advisory_unlock(hashtext('%v'))`, PDB.Config.SchemaTableName),
+		Placeholder: func(n int) string { return fmt.Sprintf("$%v", n) },
+	}
+	version, err := schema.Migrate(connection, PDB.migrations())
+	if err != nil {
+		return 0, err
+	}
+	_, err = connection.Exec(PDB.createNamespaceStatement(), PDB.GetSystemNS(), time.Now().UnixMilli())
+	return version, err
+}
+
+func (PDB *PostgresSingleTableDatabase) createNamespaceStatement() string {
+	return fmt.Sprintf(`INSERT INTO "%v" ("namespace", "created_at") VALUES ($1, $2) ON CONFLICT DO NOTHING`, PDB.Config.NamespaceTableName)
+}
+
+// live is the condition of keys that have not expired, compared to the time in parameter n
+func (PDB *PostgresSingleTableDatabase) live(n int) string {
+	return fmt.Sprintf(`("expiry" = 0 OR "expiry" > $%v)`, n)
+}
+
+// upsertStatement writes $3 with expiry $4 to namespace $1 key $2 at time $5, an expired row is replaced as a new key.
+// condition limits which existing rows are updated.
+func (PDB *PostgresSingleTableDatabase) upsertStatement(condition string) string {
+	table := PDB.Config.DataTableName
+	expired := fmt.Sprintf(`"%v"."expiry" <> 0 AND "%v"."expiry" <= EXCLUDED."updated_at"`, table, table)
+	statement := fmt.Sprintf(`INSERT INTO "%v" ("namespace", "key", "value", "expiry", "created_at", "updated_at", "version")
+		VALUES ($1, $2, $3, $4, $5, $5, 1) ON CONFLICT ("namespace", "key") DO UPDATE SET
+		"value" = EXCLUDED."value", "expiry" = EXCLUDED."expiry", "updated_at" = EXCLUDED."updated_at",
+		"created_at" = CASE WHEN %v THEN EXCLUDED."created_at" ELSE "%v"."created_at" END,
+		"version" = CASE WHEN %v THEN 1 ELSE "%v"."version" + 1 END`,
+		table, expired, table, expired, table)
+	if condition != "" {
+		statement += " WHERE " + condition
+	}
+	return statement
+}
+
+func (PDB *PostgresSingleTableDatabase) Set(ctx context.Context, namespace string, key string, value interface{}) error {
+	return PDB.SetWithTTL(ctx, namespace, key, value, 0)
+}
+
+func (PDB *PostgresSingleTableDatabase) SetWithTTL(ctx context.Context, namespace string, key string, value interface{}, ttl time.Duration) error {
+	if !PDB.Initialized.Load() {
+		return errNotInitialized
+	}
+	_, err := PDB.Connection.ExecContext(ctx, PDB.upsertStatement(""), namespace, key, value, expiryFromTTL(ttl), time.Now().UnixMilli())
+	if err != nil {
+		logger.Error("Exec failed with error", "function", "SetWithTTL", "struct", "PostgresSingleTableDatabase", "namespace", namespace, "key", key, "error", err)
+	}
+	return err
+}
+
+func (PDB *PostgresSingleTableDatabase) CompareAndSet(ctx context.Context, namespace string, key string, expected *string, value string, ttl time.Duration) error {
+	if !PDB.Initialized.Load() {
+		return errNotInitialized
+	}
+	now := time.Now().UnixMilli()
+	var result sql.Result
+	var err error
+	if expected == nil {
+		// Insert, or replace a row that has expired but is not yet reaped
+		table := PDB.Config.DataTableName
+		result, err = PDB.Connection.ExecContext(ctx, PDB.upsertStatement(fmt.Sprintf(`"%v"."expiry" <> 0 AND "%v"."expiry" <= $5`, table, table)),
+			namespace, key, value, expiryFromTTL(ttl), now)
+	} else {
+		result, err = PDB.Connection.ExecContext(ctx, fmt.Sprintf(`UPDATE "%v" SET "value" = $1, "expiry" = $2, "updated_at" = $3, "version" = "version" + 1
+			WHERE "namespace" = $4 AND "key" = $5 AND "value" = $6 AND %v`, PDB.Config.DataTableName, PDB.live(3)),
+			value, expiryFromTTL(ttl), now, namespace, key, *expected)
+	}
+	if err != nil {
+		logger.Error("Exec failed with error", "function", "CompareAndSet", "struct", "PostgresSingleTableDatabase", "namespace", namespace, "key", key, "error", err)
+		return err
+	}
+	affected, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if affected == 0 {
+		return &ErrPreconditionFailed{Value: key}
+	}
+	return nil
+}
+
+func (PDB *PostgresSingleTableDatabase) Get(ctx context.Context, namespace string, key string) (string, error) {
+	if !PDB.Initialized.Load() {
+		return "", errNotInitialized
+	}
+	var value string
+	err := PDB.Connection.QueryRowContext(ctx, fmt.Sprintf(`SELECT "value" FROM "%v" WHERE "namespace" = $1 AND "key" = $2 AND %v`,
+		PDB.Config.DataTableName, PDB.live(3)), namespace, key, time.Now().UnixMilli()).Scan(&value)
+	if err == sql.ErrNoRows {
+		return "", &ErrNotFound{Value: key}
+	} else if err != nil {
+		logger.Error("Query failed with error", "function", "Get", "struct", "PostgresSingleTableDatabase", "namespace", namespace, "key", key, "error", err)
+		return "", err
+	}
+	return value, nil
+}
+
+func (PDB *PostgresSingleTableDatabase) TTL(ctx context.Context, namespace string, key string) (time.Duration, error) {
+	if !PDB.Initialized.Load() {
+		return 0, errNotInitialized
+	}
+	var expiry int64
+	err := PDB.Connection.QueryRowContext(ctx, fmt.Sprintf(`SELECT "expiry" FROM "%v" WHERE "namespace" = $1 AND "key" = $2 AND %v`,
+		PDB.Config.DataTableName, PDB.live(3)), namespace, key, time.Now().UnixMilli()).Scan(&expiry)
+	if err == sql.ErrNoRows {
+		return 0, &ErrNotFound{Value: key}
+	} else if err != nil {
+		logger.Error("Query failed with error", "function", "TTL", "struct", "PostgresSingleTableDatabase", "namespace", namespace, "key", key, "error", err)
+		return 0, err
+	}
+	return ttlFromExpiry(expiry), nil
+}
+
+func (PDB *PostgresSingleTableDatabase) DeleteExpired(ctx context.Context) (int, error) {
+	if !PDB.Initialized.Load() {
+		return 0, errNotInitialized
+	}
+	result, err := PDB.Connection.ExecContext(ctx, fmt.Sprintf(`DELETE FROM "%v" WHERE "expiry" <> 0 AND "expiry" <= $1`,
+		PDB.Config.DataTableName), time.Now().UnixMilli())
+	if err != nil {
+		logger.Error("Exec failed with error", "function", "DeleteExpired", "struct", "PostgresSingleTableDatabase", "error", err)
+		return 0, err
+	}
+	affected, _ := result.RowsAffected()
+	return int(affected), nil
+}
+
+// Transaction runs fn in a SQL transaction, unlike the per namespace layout namespaces do not need to exist
+func (PDB *PostgresSingleTableDatabase) Transaction(ctx context.Context, fn func(tx Transaction) error) error {
+	if !PDB.Initialized.Load() {
+		return errNotInitialized
+	}
+	tx, err := PDB.Connection.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	err = fn(&postgresSingleTableTransaction{PDB: PDB, Tx: tx, ctx: ctx})
+	if err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+type postgresSingleTableTransaction struct {
+	PDB *PostgresSingleTableDatabase
+	Tx  *sql.Tx
+	ctx context.Context
+}
+
+func (Tx *postgresSingleTableTransaction) Get(namespace string, key string) (string, error) {
+	var value string
+	err := Tx.Tx.QueryRowContext(Tx.ctx, fmt.Sprintf(`SELECT "value" FROM "%v" WHERE "namespace" = $1 AND "key" = $2 AND %v FOR UPDATE`,
+		Tx.PDB.Config.DataTableName, Tx.PDB.live(3)), namespace, key, time.Now().UnixMilli()).Scan(&value)
+	if err == sql.ErrNoRows {
+		return "", &ErrNotFound{Value: key}
+	} else if err != nil {
+		logger.Error("Query failed with error", "function", "Get", "struct", "postgresSingleTableTransaction", "namespace", namespace, "key", key, "error", err)
+		return "", err
+	}
+	return value, nil
+}
+
+func (Tx *postgresSingleTableTransaction) SetWithTTL(namespace string, key string, value string, ttl time.Duration) error {
+	_, err := Tx.Tx.ExecContext(Tx.ctx, Tx.PDB.upsertStatement(""), namespace, key, value, expiryFromTTL(ttl), time.Now().UnixMilli())
+	if err != nil {
+		logger.Error("Exec failed with error", "function", "SetWithTTL", "struct", "postgresSingleTableTransaction", "namespace", namespace, "key", key, "error", err)
+	}
+	return err
+}
+
+func (Tx *postgresSingleTableTransaction) DeleteKey(namespace string, key string) error {
+	_, err := Tx.Tx.ExecContext(Tx.ctx, fmt.Sprintf(`DELETE FROM "%v" WHERE "namespace" = $1 AND "key" = $2`, Tx.PDB.Config.DataTableName), namespace, key)
+	if err != nil {
+		logger.Error("Exec failed with error", "function", "DeleteKey", "struct", "postgresSingleTableTransaction", "namespace", namespace, "key", key, "error", err)
+	}
+	return err
+}
+
+// namespacesQuery selects the created namespaces and the namespaces with keys as "namespace"
+func (PDB *PostgresSingleTableDatabase) namespacesQuery() string {
+	return fmt.Sprintf(`(SELECT "namespace" FROM "%v" UNION SELECT "namespace" FROM "%v") AS namespaces`,
+		PDB.Config.NamespaceTableName, PDB.Config.DataTableName)
+}
+
+func (PDB *PostgresSingleTableDatabase) Keys(ctx context.Context, namespace string) ([]string, error) {
+	keys, _, err := PDB.KeysPage(ctx, namespace, ListOptions{})
+	return keys, err
+}
+
+// KeysPage filters and pages in the query, the cursor is the last key of the previous page
+func (PDB *PostgresSingleTableDatabase) KeysPage(ctx context.Context, namespace string, options ListOptions) ([]string, string, error) {
+	if !PDB.Initialized.Load() {
+		return nil, "", errNotInitialized
+	}
+	last, err := decodeCursor(options.Cursor)
+	if err != nil {
+		return nil, "", err
+	}
+	args := []any{}
+	arg := func(value any) string {
+		args = append(args, value)
+		return fmt.Sprintf("$%v", len(args))
+	}
+	column := `"namespace"`
+	query := fmt.Sprintf(`SELECT %v FROM %v WHERE TRUE`, column, PDB.namespacesQuery())
+	if namespace != "" {
+		column = `"key"`
+		query = fmt.Sprintf(`SELECT %v FROM "%v" WHERE "namespace" = %v AND ("expiry" = 0 OR "expiry" > %v)`,
+			column, PDB.Config.DataTableName, arg(namespace), arg(time.Now().UnixMilli()))
+	}
+	if options.Cursor != "" {
+		query += fmt.Sprintf(" AND %v > %v", column, arg(last))
+	}
+	if options.Prefix != "" {
+		query += fmt.Sprintf(" AND %v LIKE %v", column, arg(likePrefix(options.Prefix)))
+	}
+	if options.Match != "" {
+		query += fmt.Sprintf(" AND %v ~ %v", column, arg(globToRegexp(options.Match)))
+	}
+	query += " ORDER BY " + column
+	if options.Limit > 0 {
+		query += " LIMIT " + arg(options.Limit+1)
+	}
+	rows, err := PDB.Connection.QueryContext(ctx, query, args...)
+	if err != nil {
+		logger.Error("Query failed with error", "function", "KeysPage", "struct", "PostgresSingleTableDatabase", "namespace", namespace, "error", err)
+		return nil, "", err
+	}
+	defer rows.Close()
+	keys := []string{}
+	for rows.Next() {
+		var key string
+		err = rows.Scan(&key)
+		if err != nil {
+			logger.Error("Scan row failed with error", "function", "KeysPage", "struct", "PostgresSingleTableDatabase", "namespace", namespace, "error", err)
+			return nil, "", err
+		}
+		if options.Limit > 0 && len(keys) == options.Limit {
+			return keys, encodeCursor(keys[len(keys)-1]), nil
+		}
+		keys = append(keys, key)
+	}
+	return keys, "", rows.Err()
+}
+
+func (PDB *PostgresSingleTableDatabase) CountKeys(ctx context.Context, namespace string) (int, error) {
+	if !PDB.Initialized.Load() {
+		return 0, errNotInitialized
+	}
+	var count int
+	err := PDB.Connection.QueryRowContext(ctx, fmt.Sprintf(`SELECT COUNT(*) FROM "%v" WHERE "namespace" = $1 AND %v`,
+		PDB.Config.DataTableName, PDB.live(2)), namespace, time.Now().UnixMilli()).Scan(&count)
+	if err != nil {
+		logger.Error("Query failed with error", "function", "CountKeys", "struct", "PostgresSingleTableDatabase", "namespace", namespace, "error", err)
+	}
+	return count, err
+}
+
+func (PDB *PostgresSingleTableDatabase) DeleteKey(ctx context.Context, namespace string, key string) error {
+	if !PDB.Initialized.Load() {
+		return errNotInitialized
+	}
+	_, err := PDB.Connection.ExecContext(ctx, fmt.Sprintf(`DELETE FROM "%v" WHERE "namespace" = $1 AND "key" = $2`, PDB.Config.DataTableName), namespace, key)
+	if err != nil {
+		logger.Error("Exec failed with error", "function", "DeleteKey", "struct", "PostgresSingleTableDatabase", "namespace", namespace, "key", key, "error", err)
+	}
+	return err
+}
+
+func (PDB *PostgresSingleTableDatabase) CompareAndDelete(ctx context.Context, namespace string, key string, expected string) error {
+	if !PDB.Initialized.Load() {
+		return errNotInitialized
+	}
+	result, err := PDB.Connection.ExecContext(ctx, fmt.Sprintf(`DELETE FROM "%v" WHERE "namespace" = $1 AND "key" = $2 AND "value" = $3 AND %v`,
+		PDB.Config.DataTableName, PDB.live(4)), namespace, key, expected, time.Now().UnixMilli())
+	if err != nil {
+		logger.Error("Exec failed with error", "function", "CompareAndDelete", "struct", "PostgresSingleTableDatabase", "namespace", namespace, "key", key, "error", err)
+		return err
+	}
+	affected, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if affected == 0 {
+		return &ErrPreconditionFailed{Value: key}
+	}
+	return nil
+}
+
+func (PDB *PostgresSingleTableDatabase) CreateNamespace(ctx context.Context, namespace string) error {
+	if !PDB.Initialized.Load() {
+		return errNotInitialized
+	}
+	_, err := PDB.Connection.ExecContext(ctx, PDB.createNamespaceStatement(), namespace, time.Now().UnixMilli())
+	if err != nil {
+		logger.Error("Error creating namespace", "function", "CreateNamespace", "struct", "PostgresSingleTableDatabase", "namespace", namespace, "error", err)
+	}
+	return err
+}
+
+func (PDB *PostgresSingleTableDatabase) DeleteNamespace(ctx context.Context, namespace string) error {
+	if !PDB.Initialized.Load() {
+		return errNotInitialized
+	}
+	if namespace == PDB.GetSystemNS() {
+		return &ErrNotAllowed{Value: fmt.Sprintf("delete System NS %v", namespace)}
+	}
+	tx, err := PDB.Connection.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	for _, table := range []string{PDB.Config.DataTableName, PDB.Config.NamespaceTableName, PDB.Config.HistoryTableName} {
+		_, err = tx.ExecContext(ctx, fmt.Sprintf(`DELETE FROM "%v" WHERE "namespace" = $1`, table), namespace)
+		if err != nil {
+			logger.Error("Exec failed with error", "function", "DeleteNamespace", "struct", "PostgresSingleTableDatabase", "namespace", namespace, "table", table, "error", err)
+			return err
+		}
+	}
+	return tx.Commit()
+}
@@ -2,27 +2,42 @@ package main
 
 import (
 	"context"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"os"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
 
+	"github.com/SimonStiil/keyvaluedatabase/rest"
 	redis "github.com/redis/go-redis/v9"
 	"github.com/spf13/viper"
 )
 
 type RedisDatabase struct {
-	Initialized bool
-	CTX         context.Context
-	RDC         *redis.Client
+	Initialized atomic.Bool
+	RDC         redis.UniversalClient
 	Config      *ConfigRedis
 	Password    string
 }
 
 type ConfigRedis struct {
-	Address         string `mapstructure:"address"`
-	Prefix          string `mapstructure:"prefix"`
-	SystemNS        string `mapstructure:"systemnamespace"`
-	Seperator       string `mapstructure:"seperator"`
-	EnvVariableName string `mapstructure:"envVariableName"`
+	Address                 string    `mapstructure:"address"`
+	Addresses               []string  `mapstructure:"addresses"`  // Sentinel or cluster node addresses, used instead of Address
+	MasterName              string    `mapstructure:"masterName"` // Sentinel master name, Addresses are the sentinels
+	Cluster                 bool      `mapstructure:"cluster"`
+	DB                      int       `mapstructure:"db"`
+	Username                string    `mapstructure:"username"`
+	Prefix                  string    `mapstructure:"prefix"`
+	SystemNS                string    `mapstructure:"systemnamespace"`
+	Seperator               string    `mapstructure:"seperator"`
+	EnvVariableName         string    `mapstructure:"envVariableName"`
+	SentinelUsername        string    `mapstructure:"sentinelUsername"`
+	SentinelEnvVariableName string    `mapstructure:"sentinelEnvVariableName"`
+	TLS                     ConfigTLS `mapstructure:"tls"`
 }
 
 func RedisDBGetDefaults(configReader *viper.Viper) {
@@ -31,47 +46,364 @@ func RedisDBGetDefaults(configReader *viper.Viper) {
 	configReader.SetDefault("redis.systemnamespace", "kvdb")
 	configReader.SetDefault("redis.seperator", "_")
 	configReader.SetDefault("redis.envVariableName", BaseENVname+"_REDIS_PASSWORD")
+	configReader.SetDefault("redis.db", 1)
+	configReader.SetDefault("redis.cluster", false)
+	configReader.SetDefault("redis.sentinelEnvVariableName", BaseENVname+"_REDIS_SENTINEL_PASSWORD")
+	configReader.SetDefault("redis.tls.enabled", false)
 }
 
 func (DB *RedisDatabase) GetSystemNS() string {
 	return DB.Config.SystemNS
 }
 
-func (DB *RedisDatabase) Init() {
+func (DB *RedisDatabase) Init() error {
 
 	logger.Debug("Initializing Redis Connection", "function", "Init", "struct", "RedisDatabase")
 
 	DB.Password = os.Getenv(DB.Config.EnvVariableName)
-	DB.CTX = context.Background()
-	DB.RDC = redis.NewClient(&redis.Options{
-		Addr:     DB.Config.Address,
-		Password: DB.Password, // no password set
-		DB:       1,           // use default DB
-	})
+	options, err := DB.Config.UniversalOptions(DB.Password, os.Getenv(DB.Config.SentinelEnvVariableName))
+	if err != nil {
+		return &ErrInvalidConfig{Value: "redis", Err: err}
+	}
+	DB.RDC = redis.NewUniversalClient(options)
+	DB.Initialized.Store(true)
+	// The client connects on first use, failing here leaves the registry to be filled by writes
+	ctx := context.Background()
+	err = DB.registerExistingNamespaces(ctx)
+	if err == nil {
+		err = DB.CreateNamespace(ctx, DB.GetSystemNS())
+	}
+	if err != nil {
+		logger.Error("Unable to register namespaces", "function", "Init", "struct", "RedisDatabase", "error", err)
+	}
 	logger.Debug("Initialization complete", "function", "Init", "struct", "RedisDatabase")
-	DB.Initialized = true
+	return nil
+}
+
+// UniversalOptions returns the client options. With MasterName the client connects through Sentinel,
+// with Cluster to a Redis Cluster, otherwise to a single server.
+func (Config *ConfigRedis) UniversalOptions(password string, sentinelPassword string) (*redis.UniversalOptions, error) {
+	tlsConfig, err := Config.TLS.ClientConfig()
+	if err != nil {
+		return nil, err
+	}
+	addresses := Config.Addresses
+	if len(addresses) == 0 {
+		addresses = []string{Config.Address}
+	}
+	if Config.Cluster && Config.MasterName != "" {
+		return nil, errors.New("redis.cluster and redis.masterName can not be used together")
+	}
+	logger.Debug("Redis connection", "function", "UniversalOptions", "struct", "ConfigRedis", "addresses", addresses, "masterName", Config.MasterName, "cluster", Config.Cluster, "db", Config.DB, "username", Config.Username, "tls", Config.TLS.Enabled)
+	return &redis.UniversalOptions{
+		Addrs:            addresses,
+		MasterName:       Config.MasterName,
+		IsClusterMode:    Config.Cluster,
+		DB:               Config.DB, // Not supported by Redis Cluster
+		Username:         Config.Username,
+		Password:         password,
+		SentinelUsername: Config.SentinelUsername,
+		SentinelPassword: sentinelPassword,
+		TLSConfig:        tlsConfig,
+	}, nil
+}
+
+// Databases written before the namespace registry existed only have keys, their namespaces are registered once.
+// A namespace containing the seperator is registered cut at the first seperator, as earlier versions listed it.
+func (DB *RedisDatabase) registerExistingNamespaces(ctx context.Context) error {
+	exists, err := DB.RDC.Exists(ctx, DB.namespacesKey()).Result()
+	if err != nil || exists > 0 {
+		return err
+	}
+	namespaces := map[string]bool{}
+	err = DB.scan(ctx, escapeNamespacePattern(DB.Config.Prefix+DB.Config.Seperator)+"*", 0, func(keys []string) bool {
+		for _, key := range keys {
+			if namespace, ok := DB.namespaceFromKey(key); ok {
+				namespaces[namespace] = true
+			}
+		}
+		return true
+	})
+	if err != nil {
+		return err
+	}
+	for namespace := range namespaces {
+		err = DB.CreateNamespace(ctx, namespace)
+		if err != nil {
+			return err
+		}
+	}
+	logger.Info("Registered existing namespaces", "function", "registerExistingNamespaces", "struct", "RedisDatabase", "namespaces", len(namespaces))
+	return nil
 }
 
+// Keys are stored as <prefix><seperator><namespace><seperator><key>, the layout of earlier versions. The keys of
+// namespace a_b also start with the prefix of namespace a, so the registered namespaces nested in a are left out of it.
 func (DB *RedisDatabase) formatKey(namespace string, key string) string {
 	return fmt.Sprintf("%v%v%v%v%v", DB.Config.Prefix, DB.Config.Seperator, namespace, DB.Config.Seperator, key)
 }
 
-func (DB *RedisDatabase) Set(namespace string, key string, value interface{}) error {
-	if !DB.Initialized {
-		panic("Unable to set. db not initialized()")
+// History lives outside the key prefix so it is never listed by Keys
+func (DB *RedisDatabase) formatHistoryKey(namespace string, key string) string {
+	return fmt.Sprintf("%v%v%v%v", DB.historyPrefix(), namespace, DB.Config.Seperator, key)
+}
+
+func (DB *RedisDatabase) historyPrefix() string {
+	return DB.Config.Prefix + "-history" + DB.Config.Seperator
+}
+
+// The namespace registry is a set of all namespace names
+func (DB *RedisDatabase) namespacesKey() string {
+	return DB.Config.Prefix + "-namespaces"
+}
+
+// reservedNamespace is true when the keys of namespace would overlap the history, with a seperator starting with -
+func (DB *RedisDatabase) reservedNamespace(namespace string) bool {
+	keyPrefix := DB.formatKey(namespace, "")
+	return strings.HasPrefix(keyPrefix, DB.historyPrefix()) || strings.HasPrefix(DB.historyPrefix(), keyPrefix)
+}
+
+func (DB *RedisDatabase) checkNamespace(namespace string) error {
+	if DB.reservedNamespace(namespace) {
+		return &ErrNotAllowed{Value: fmt.Sprintf("namespace %v overlaps the history", namespace)}
+	}
+	return nil
+}
+
+// namespaceFromKey returns the namespace of a key stored with formatKey, cut at the first seperator like earlier versions listed them
+func (DB *RedisDatabase) namespaceFromKey(redisKey string) (string, bool) {
+	if strings.HasPrefix(redisKey, DB.historyPrefix()) {
+		return "", false
+	}
+	namespace, _, found := strings.Cut(strings.TrimPrefix(redisKey, DB.Config.Prefix+DB.Config.Seperator), DB.Config.Seperator)
+	return namespace, found
+}
+
+// nestedPrefixes returns the prefixes inside prefix that belong to other namespaces or the history,
+// format is formatKey or formatHistoryKey
+func (DB *RedisDatabase) nestedPrefixes(prefix string, namespaces []string, format func(namespace string, key string) string) []string {
+	candidates := []string{DB.historyPrefix()}
+	for _, namespace := range namespaces {
+		candidates = append(candidates, format(namespace, ""))
+	}
+	nested := []string{}
+	for _, candidate := range candidates {
+		if len(candidate) > len(prefix) && strings.HasPrefix(candidate, prefix) {
+			nested = append(nested, candidate)
+		}
+	}
+	return nested
+}
+
+// nestedKeyPrefixes returns the key prefixes of the registered namespaces and the history inside keyPrefix
+func (DB *RedisDatabase) nestedKeyPrefixes(ctx context.Context, keyPrefix string) ([]string, error) {
+	namespaces, err := DB.RDC.SMembers(ctx, DB.namespacesKey()).Result()
+	if err != nil {
+		return nil, err
+	}
+	return DB.nestedPrefixes(keyPrefix, namespaces, DB.formatKey), nil
+}
+
+// ownKey is true when redisKey is not in one of the nested prefixes
+func ownKey(redisKey string, nested []string) bool {
+	return !slices.ContainsFunc(nested, func(prefix string) bool {
+		return strings.HasPrefix(redisKey, prefix)
+	})
+}
+
+func (DB *RedisDatabase) Set(ctx context.Context, namespace string, key string, value interface{}) error {
+	return DB.SetWithTTL(ctx, namespace, key, value, 0)
+}
+
+func (DB *RedisDatabase) SetWithTTL(ctx context.Context, namespace string, key string, value interface{}, ttl time.Duration) error {
+	if !DB.Initialized.Load() {
+		return errNotInitialized
+	}
+	err := DB.checkNamespace(namespace)
+	if err != nil {
+		return err
+	}
+	// Not a MULTI as the registry and the key can be in different cluster slots
+	_, err = DB.RDC.Pipelined(ctx, func(pipe redis.Pipeliner) error {
+		pipe.SAdd(ctx, DB.namespacesKey(), namespace)
+		pipe.Set(ctx, DB.formatKey(namespace, key), value, ttl) //0 is no expiry
+		return nil
+	})
+	return err
+}
+
+func (DB *RedisDatabase) CompareAndSet(ctx context.Context, namespace string, key string, expected *string, value string, ttl time.Duration) error {
+	if !DB.Initialized.Load() {
+		return errNotInitialized
+	}
+	err := DB.CreateNamespace(ctx, namespace)
+	if err != nil {
+		return err
+	}
+	redisKey := DB.formatKey(namespace, key)
+	err = DB.RDC.Watch(ctx, func(tx *redis.Tx) error {
+		current, err := tx.Get(ctx, redisKey).Result()
+		if err != nil && err != redis.Nil {
+			return err
+		}
+		exists := err == nil
+		if expected == nil && exists || expected != nil && (!exists || current != *expected) {
+			return &ErrPreconditionFailed{Value: key}
+		}
+		_, err = tx.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+			pipe.Set(ctx, redisKey, value, ttl)
+			return nil
+		})
+		return err
+	}, redisKey)
+	if err == redis.TxFailedErr {
+		return &ErrPreconditionFailed{Value: key}
+	}
+	return err
+}
+
+func (DB *RedisDatabase) CompareAndDelete(ctx context.Context, namespace string, key string, expected string) error {
+	if !DB.Initialized.Load() {
+		return errNotInitialized
+	}
+	redisKey := DB.formatKey(namespace, key)
+	err := DB.RDC.Watch(ctx, func(tx *redis.Tx) error {
+		current, err := tx.Get(ctx, redisKey).Result()
+		if err == redis.Nil || err == nil && current != expected {
+			return &ErrPreconditionFailed{Value: key}
+		} else if err != nil {
+			return err
+		}
+		_, err = tx.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+			pipe.Del(ctx, redisKey)
+			return nil
+		})
+		return err
+	}, redisKey)
+	if err == redis.TxFailedErr {
+		return &ErrPreconditionFailed{Value: key}
+	}
+	return err
+}
+
+// Transaction watches the keys read by fn and applies the writes with MULTI/EXEC,
+// a change to a watched key by another client fails the transaction with ErrConflict.
+func (DB *RedisDatabase) Transaction(ctx context.Context, fn func(tx Transaction) error) error {
+	if !DB.Initialized.Load() {
+		return errNotInitialized
+	}
+	if !DB.Atomic() {
+		return (&directTransaction{DB: DB}).Transaction(ctx, fn)
+	}
+	err := DB.RDC.Watch(ctx, func(tx *redis.Tx) error {
+		transaction := &redisTransaction{DB: DB, Tx: tx, ctx: ctx, pending: map[string]redisWrite{}}
+		err := fn(transaction)
+		if err != nil || len(transaction.writes) == 0 {
+			return err
+		}
+		_, err = tx.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+			for _, write := range transaction.writes {
+				if write.Delete {
+					pipe.Del(ctx, write.Key)
+				} else {
+					pipe.SAdd(ctx, DB.namespacesKey(), write.Namespace)
+					pipe.Set(ctx, write.Key, write.Value, write.TTL)
+				}
+			}
+			return nil
+		})
+		return err
+	})
+	if err == redis.TxFailedErr {
+		return &ErrConflict{Value: "transaction"}
+	}
+	return err
+}
+
+// Atomic is false with Redis Cluster, where the keys of a transaction are in different slots
+func (DB *RedisDatabase) Atomic() bool {
+	_, cluster := DB.RDC.(*redis.ClusterClient)
+	return !cluster
+}
+
+type redisWrite struct {
+	Namespace string
+	Key       string
+	Value     string
+	TTL       time.Duration
+	Delete    bool
+}
+
+// redisTransaction queues writes until the transaction is executed, reads see the queued writes
+type redisTransaction struct {
+	DB      *RedisDatabase
+	Tx      *redis.Tx
+	ctx     context.Context
+	writes  []redisWrite
+	pending map[string]redisWrite
+}
+
+func (Tx *redisTransaction) queue(write redisWrite) {
+	Tx.writes = append(Tx.writes, write)
+	Tx.pending[write.Key] = write
+}
+
+func (Tx *redisTransaction) Get(namespace string, key string) (string, error) {
+	redisKey := Tx.DB.formatKey(namespace, key)
+	if write, ok := Tx.pending[redisKey]; ok {
+		if write.Delete {
+			return "", &ErrNotFound{Value: key}
+		}
+		return write.Value, nil
+	}
+	err := Tx.Tx.Watch(Tx.ctx, redisKey).Err()
+	if err != nil {
+		return "", err
 	}
-	err := DB.RDC.Set(DB.CTX, DB.formatKey(namespace, key), value, 0).Err() //0 is ttl
+	value, err := Tx.Tx.Get(Tx.ctx, redisKey).Result()
+	if err == redis.Nil {
+		return "", &ErrNotFound{Value: key}
+	}
+	return value, err
+}
+
+func (Tx *redisTransaction) SetWithTTL(namespace string, key string, value string, ttl time.Duration) error {
+	err := Tx.DB.checkNamespace(namespace)
 	if err != nil {
 		return err
 	}
+	Tx.queue(redisWrite{Namespace: namespace, Key: Tx.DB.formatKey(namespace, key), Value: value, TTL: ttl})
 	return nil
 }
 
-func (DB *RedisDatabase) Get(namespace string, key string) (string, error) {
-	if !DB.Initialized {
-		panic("Unable to get. db not initialized()")
+func (Tx *redisTransaction) DeleteKey(namespace string, key string) error {
+	Tx.queue(redisWrite{Key: Tx.DB.formatKey(namespace, key), Delete: true})
+	return nil
+}
+
+func (DB *RedisDatabase) TTL(ctx context.Context, namespace string, key string) (time.Duration, error) {
+	if !DB.Initialized.Load() {
+		return 0, errNotInitialized
+	}
+	ttl, err := DB.RDC.PTTL(ctx, DB.formatKey(namespace, key)).Result()
+	if err != nil {
+		return 0, err
+	}
+	// -2 key does not exist, -1 key exists without expiry
+	if ttl == -2 {
+		return 0, &ErrNotFound{Value: key}
+	}
+	if ttl < 0 {
+		return 0, nil
+	}
+	return ttl, nil
+}
+
+func (DB *RedisDatabase) Get(ctx context.Context, namespace string, key string) (string, error) {
+	if !DB.Initialized.Load() {
+		return "", errNotInitialized
 	}
-	val, err := DB.RDC.Get(DB.CTX, DB.formatKey(namespace, key)).Result()
+	val, err := DB.RDC.Get(ctx, DB.formatKey(namespace, key)).Result()
 	if err == redis.Nil {
 		return "", &ErrNotFound{Value: key}
 	} else if err != nil {
@@ -80,52 +412,263 @@ func (DB *RedisDatabase) Get(namespace string, key string) (string, error) {
 	return val, nil
 }
 
-func (DB *RedisDatabase) Keys(namespace string) ([]string, error) {
-	if !DB.Initialized {
-		panic("Unable to get. db not initialized()")
+func (DB *RedisDatabase) Keys(ctx context.Context, namespace string) ([]string, error) {
+	if !DB.Initialized.Load() {
+		return nil, errNotInitialized
 	}
-	var val []string
-	var err error
 	if namespace == "" {
-		val, err = DB.RDC.Keys(DB.CTX, fmt.Sprintf("%v%v*", DB.Config.Prefix, DB.Config.Seperator)).Result()
-	} else {
-		val, err = DB.RDC.Keys(DB.CTX, fmt.Sprintf("%v%v%v%v*", DB.Config.Prefix, DB.Config.Seperator, namespace, DB.Config.Seperator)).Result()
+		namespaces, err := DB.RDC.SMembers(ctx, DB.namespacesKey()).Result()
+		logger.Debug("List namespaces", "function", "Keys", "struct", "RedisDatabase", "values", namespaces, "error", err)
+		slices.Sort(namespaces)
+		return namespaces, err
 	}
+	keyPrefix := DB.formatKey(namespace, "")
+	nested, err := DB.nestedKeyPrefixes(ctx, keyPrefix)
+	if err != nil {
+		return nil, err
+	}
+	keys := []string{}
+	err = DB.scan(ctx, escapeNamespacePattern(keyPrefix)+"*", 0, func(batch []string) bool {
+		for _, key := range batch {
+			if ownKey(key, nested) {
+				keys = append(keys, strings.TrimPrefix(key, keyPrefix))
+			}
+		}
+		return true
+	})
+	logger.Debug("List", "function", "Keys", "struct", "RedisDatabase", "namespace", namespace, "values", keys, "error", err)
+	return keys, err
+}
 
-	logger.Debug("List", "function", "Keys", "struct", "RedisDatabase", "values", val, "error", err)
-	if err == redis.Nil {
-		return val, nil
-	} else if err != nil {
-		return val, err
+// scanNodes returns the clients to SCAN, the masters ordered by address with Redis Cluster
+func (DB *RedisDatabase) scanNodes(ctx context.Context) ([]redis.UniversalClient, error) {
+	cluster, ok := DB.RDC.(*redis.ClusterClient)
+	if !ok {
+		return []redis.UniversalClient{DB.RDC}, nil
 	}
-	//TODO: Remove prefix from keys
-	//if namespace == "" {
-	//TODO: Add filtering to only get namespace names not all full keys
-	//}
-	return val, nil
+	var lock sync.Mutex
+	masters := []*redis.Client{}
+	err := cluster.ForEachMaster(ctx, func(ctx context.Context, master *redis.Client) error {
+		lock.Lock()
+		defer lock.Unlock()
+		masters = append(masters, master)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	slices.SortFunc(masters, func(a *redis.Client, b *redis.Client) int {
+		return strings.Compare(a.Options().Addr, b.Options().Addr)
+	})
+	nodes := make([]redis.UniversalClient, len(masters))
+	for i, master := range masters {
+		nodes[i] = master
+	}
+	return nodes, nil
 }
 
-func (DB *RedisDatabase) CreateNamespace(namespace string) error {
-	if !DB.Initialized {
-		panic("F Unable to get. db not initialized()")
+// scan iterates the keys matching pattern, calling fn for each batch until fn returns false.
+// Cluster masters are scanned one after another.
+func (DB *RedisDatabase) scan(ctx context.Context, pattern string, count int64, fn func(keys []string) bool) error {
+	nodes, err := DB.scanNodes(ctx)
+	if err != nil {
+		logger.Error("Listing cluster nodes failed with error", "function", "scan", "struct", "RedisDatabase", "error", err)
+		return err
+	}
+	for _, node := range nodes {
+		var position uint64
+		for {
+			keys, next, err := node.Scan(ctx, position, pattern, count).Result()
+			if err != nil {
+				logger.Error("Scan failed with error", "function", "scan", "struct", "RedisDatabase", "pattern", pattern, "error", err)
+				return err
+			}
+			if !fn(keys) {
+				return nil
+			}
+			position = next
+			if position == 0 {
+				break
+			}
+		}
 	}
-	// Stub. Concept does not exist missing keys list implementation
 	return nil
 }
 
-func (DB *RedisDatabase) DeleteNamespace(namespace string) error {
-	if !DB.Initialized {
-		panic("F Unable to get. db not initialized()")
+// KeysPage scans the keys of the namespace and pages them in order like the other backends,
+// the cursor is the last key of the previous page.
+func (DB *RedisDatabase) KeysPage(ctx context.Context, namespace string, options ListOptions) ([]string, string, error) {
+	if !DB.Initialized.Load() {
+		return nil, "", errNotInitialized
+	}
+	if namespace == "" {
+		namespaces, err := DB.Keys(ctx, "")
+		if err != nil {
+			return nil, "", err
+		}
+		return pageSorted(namespaces, options)
+	}
+	keyPrefix := DB.formatKey(namespace, "")
+	nested, err := DB.nestedKeyPrefixes(ctx, keyPrefix)
+	if err != nil {
+		return nil, "", err
+	}
+	pattern := escapeNamespacePattern(keyPrefix) + escapeNamespacePattern(options.Prefix) + "*"
+	if options.Match != "" {
+		pattern = escapeNamespacePattern(keyPrefix) + options.Match
+	}
+	keys := []string{}
+	err = DB.scan(ctx, pattern, 0, func(batch []string) bool {
+		for _, key := range batch {
+			if ownKey(key, nested) {
+				keys = append(keys, strings.TrimPrefix(key, keyPrefix))
+			}
+		}
+		return true
+	})
+	if err != nil {
+		return nil, "", err
+	}
+	page, next, err := pageSorted(keys, options)
+	logger.Debug("List page", "function", "KeysPage", "struct", "RedisDatabase", "namespace", namespace, "size", len(page), "next", next)
+	return page, next, err
+}
+
+func (DB *RedisDatabase) CountKeys(ctx context.Context, namespace string) (int, error) {
+	if !DB.Initialized.Load() {
+		return 0, errNotInitialized
+	}
+	keyPrefix := DB.formatKey(namespace, "")
+	nested, err := DB.nestedKeyPrefixes(ctx, keyPrefix)
+	if err != nil {
+		return 0, err
+	}
+	count := 0
+	err = DB.scan(ctx, escapeNamespacePattern(keyPrefix)+"*", 0, func(keys []string) bool {
+		for _, key := range keys {
+			if ownKey(key, nested) {
+				count++
+			}
+		}
+		return true
+	})
+	return count, err
+}
+
+func (DB *RedisDatabase) AddVersion(ctx context.Context, namespace string, key string, version rest.KeyVersionV1, limit int) error {
+	if !DB.Initialized.Load() {
+		return errNotInitialized
+	}
+	historyKey := DB.formatHistoryKey(namespace, key)
+	version.Version = 1
+	latest, err := DB.RDC.LIndex(ctx, historyKey, 0).Result()
+	if err != nil && err != redis.Nil {
+		return err
+	}
+	if err == nil {
+		var previous rest.KeyVersionV1
+		err = json.Unmarshal([]byte(latest), &previous)
+		if err != nil {
+			return err
+		}
+		version.Version = previous.Version + 1
+	}
+	encoded, err := json.Marshal(version)
+	if err != nil {
+		return err
+	}
+	pipe := DB.RDC.TxPipeline()
+	pipe.LPush(ctx, historyKey, encoded)
+	if limit > 0 {
+		pipe.LTrim(ctx, historyKey, 0, int64(limit-1))
+	}
+	_, err = pipe.Exec(ctx)
+	return err
+}
+
+func (DB *RedisDatabase) Versions(ctx context.Context, namespace string, key string) (rest.KeyHistoryV1, error) {
+	if !DB.Initialized.Load() {
+		return rest.KeyHistoryV1{}, errNotInitialized
+	}
+	entries, err := DB.RDC.LRange(ctx, DB.formatHistoryKey(namespace, key), 0, -1).Result()
+	if err != nil && err != redis.Nil {
+		return nil, err
+	}
+	if len(entries) == 0 {
+		return nil, &ErrNotFound{Value: key}
+	}
+	versions := make(rest.KeyHistoryV1, len(entries))
+	for i, entry := range entries {
+		err = json.Unmarshal([]byte(entry), &versions[i])
+		if err != nil {
+			return nil, err
+		}
+	}
+	return versions, nil
+}
+
+func (DB *RedisDatabase) CreateNamespace(ctx context.Context, namespace string) error {
+	if !DB.Initialized.Load() {
+		return errNotInitialized
+	}
+	err := DB.checkNamespace(namespace)
+	if err != nil {
+		return err
+	}
+	return DB.RDC.SAdd(ctx, DB.namespacesKey(), namespace).Err()
+}
+
+// DeleteNamespace removes the namespace from the registry before deleting its keys and history
+func (DB *RedisDatabase) DeleteNamespace(ctx context.Context, namespace string) error {
+	if !DB.Initialized.Load() {
+		return errNotInitialized
+	}
+	if namespace == DB.GetSystemNS() {
+		return &ErrNotAllowed{Value: fmt.Sprintf("delete System NS %v", namespace)}
+	}
+	err := DB.RDC.SRem(ctx, DB.namespacesKey(), namespace).Err()
+	if err != nil {
+		return err
+	}
+	namespaces, err := DB.Keys(ctx, "")
+	if err != nil {
+		return err
+	}
+	deleted := 0
+	for _, format := range []func(string, string) string{DB.formatKey, DB.formatHistoryKey} {
+		prefix := format(namespace, "")
+		nested := DB.nestedPrefixes(prefix, namespaces, format)
+		var deleteErr error
+		err = DB.scan(ctx, escapeNamespacePattern(prefix)+"*", 100, func(keys []string) bool {
+			// Deleted one by one as the keys can be in different cluster slots
+			_, deleteErr = DB.RDC.Pipelined(ctx, func(pipe redis.Pipeliner) error {
+				for _, key := range keys {
+					if ownKey(key, nested) {
+						pipe.Del(ctx, key)
+						deleted++
+					}
+				}
+				return nil
+			})
+			return deleteErr == nil
+		})
+		if err == nil {
+			err = deleteErr
+		}
+		if err != nil {
+			logger.Error("Delete failed with error", "function", "DeleteNamespace", "struct", "RedisDatabase", "namespace", namespace, "error", err)
+			return err
+		}
 	}
-	// Stub. Concept does not exist missing keys list implementation
+	logger.Debug("Deleted namespace", "function", "DeleteNamespace", "struct", "RedisDatabase", "namespace", namespace, "deleted", deleted)
 	return nil
 }
 
-func (DB *RedisDatabase) DeleteKey(namespace string, key string) error {
-	if !DB.Initialized {
-		panic("Unable to get. db not initialized()")
+func (DB *RedisDatabase) DeleteKey(ctx context.Context, namespace string, key string) error {
+	if !DB.Initialized.Load() {
+		return errNotInitialized
 	}
-	err := DB.RDC.Del(DB.CTX, DB.formatKey(namespace, key)).Err()
+	err := DB.RDC.Del(ctx, DB.formatKey(namespace, key)).Err()
 	if err == redis.Nil {
 		return nil
 	} else if err != nil {
@@ -135,16 +678,17 @@ func (DB *RedisDatabase) DeleteKey(namespace string, key string) error {
 }
 
 func (DB *RedisDatabase) IsInitialized() bool {
-	return DB.Initialized
+	return DB.Initialized.Load()
 }
 
 func (DB *RedisDatabase) Close() {
-	if !DB.Initialized {
-		panic("Unable to close. db not initialized()")
+	if !DB.Initialized.Load() {
+		return
 	}
 	err := DB.RDC.Close()
 	if err != nil {
-		panic(err)
+		logger.Error("Unable to close connection", "function", "Close", "struct", "RedisDatabase", "error", err)
+		return
 	}
 	logger.Debug("Closed Connection", "function", "Close", "struct", "RedisDatabase")
 }
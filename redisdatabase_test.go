@@ -1,6 +1,9 @@
 package main
 
 import (
+	"context"
+	"slices"
+	"strings"
 	"testing"
 )
 
@@ -17,19 +20,24 @@ func Test_Redis_DB(t *testing.T) {
 		Config: &dbt.Config.Redis,
 	}
 
-	t.Run("initialize db", func(t *testing.T) {
-		dbt.DB.Init()
-	})
+	if !t.Run("initialize db", func(t *testing.T) {
+		err := dbt.DB.Init()
+		if err != nil {
+			t.Fatalf("Unable to initialize database %v", err)
+		}
+	}) {
+		t.FailNow()
+	}
 
 	testKey := "test"
 	testValue := "value"
 
 	t.Run("Delete Key (if it exists)", func(t *testing.T) {
-		dbt.DB.DeleteKey(dbt.DB.GetSystemNS(), testKey)
+		dbt.DB.DeleteKey(context.Background(), dbt.DB.GetSystemNS(), testKey)
 	})
 
 	t.Run("get value (that don't exist)", func(t *testing.T) {
-		_, err := dbt.DB.Get(dbt.DB.GetSystemNS(), testKey)
+		_, err := dbt.DB.Get(context.Background(), dbt.DB.GetSystemNS(), testKey)
 		if err == nil {
 			t.Errorf("Supposed to get error")
 		}
@@ -39,14 +47,14 @@ func Test_Redis_DB(t *testing.T) {
 	})
 
 	t.Run("set value", func(t *testing.T) {
-		err := dbt.DB.Set(dbt.DB.GetSystemNS(), testKey, testValue)
+		err := dbt.DB.Set(context.Background(), dbt.DB.GetSystemNS(), testKey, testValue)
 		if err != nil {
 			t.Errorf("Failed to set value: %v", err)
 		}
 	})
 
 	t.Run("get value", func(t *testing.T) {
-		val, err := dbt.DB.Get(dbt.DB.GetSystemNS(), testKey)
+		val, err := dbt.DB.Get(context.Background(), dbt.DB.GetSystemNS(), testKey)
 		if err != nil {
 			t.Errorf("Supposed to get key %v got error %+v", testKey, err)
 		}
@@ -57,11 +65,11 @@ func Test_Redis_DB(t *testing.T) {
 
 	t.Run("update existing value", func(t *testing.T) {
 		newValue := "updated_value"
-		err := dbt.DB.Set(dbt.DB.GetSystemNS(), testKey, newValue)
+		err := dbt.DB.Set(context.Background(), dbt.DB.GetSystemNS(), testKey, newValue)
 		if err != nil {
 			t.Errorf("Failed to update value: %v", err)
 		}
-		val, err := dbt.DB.Get(dbt.DB.GetSystemNS(), testKey)
+		val, err := dbt.DB.Get(context.Background(), dbt.DB.GetSystemNS(), testKey)
 		if err != nil {
 			t.Errorf("Failed to get updated value: %v", err)
 		}
@@ -71,12 +79,12 @@ func Test_Redis_DB(t *testing.T) {
 	})
 
 	t.Run("list keys in namespace", func(t *testing.T) {
-		keys, err := dbt.DB.Keys(dbt.DB.GetSystemNS())
+		keys, err := dbt.DB.Keys(context.Background(), dbt.DB.GetSystemNS())
 		if err != nil {
 			t.Errorf("Failed to list keys: %v", err)
 		}
 		found := false
-		expectedKey := "kvdb_kvdb_" + testKey
+		expectedKey := testKey
 		for _, key := range keys {
 			if key == expectedKey {
 				found = true
@@ -89,11 +97,11 @@ func Test_Redis_DB(t *testing.T) {
 	})
 
 	t.Run("delete key", func(t *testing.T) {
-		err := dbt.DB.DeleteKey(dbt.DB.GetSystemNS(), testKey)
+		err := dbt.DB.DeleteKey(context.Background(), dbt.DB.GetSystemNS(), testKey)
 		if err != nil {
 			t.Errorf("Failed to delete key: %v", err)
 		}
-		_, err = dbt.DB.Get(dbt.DB.GetSystemNS(), testKey)
+		_, err = dbt.DB.Get(context.Background(), dbt.DB.GetSystemNS(), testKey)
 		if err == nil {
 			t.Errorf("Key should not exist after deletion")
 		}
@@ -105,21 +113,21 @@ func Test_Redis_DB(t *testing.T) {
 	testNamespace := "test_namespace"
 
 	t.Run("create namespace", func(t *testing.T) {
-		err := dbt.DB.CreateNamespace(testNamespace)
+		err := dbt.DB.CreateNamespace(context.Background(), testNamespace)
 		if err != nil {
 			t.Errorf("Failed to create namespace: %v", err)
 		}
 	})
 
 	t.Run("set value in custom namespace", func(t *testing.T) {
-		err := dbt.DB.Set(testNamespace, "ns_key", "ns_value")
+		err := dbt.DB.Set(context.Background(), testNamespace, "ns_key", "ns_value")
 		if err != nil {
 			t.Errorf("Failed to set value in custom namespace: %v", err)
 		}
 	})
 
 	t.Run("get value from custom namespace", func(t *testing.T) {
-		val, err := dbt.DB.Get(testNamespace, "ns_key")
+		val, err := dbt.DB.Get(context.Background(), testNamespace, "ns_key")
 		if err != nil {
 			t.Errorf("Failed to get value from custom namespace: %v", err)
 		}
@@ -129,32 +137,84 @@ func Test_Redis_DB(t *testing.T) {
 	})
 
 	t.Run("list all namespaces", func(t *testing.T) {
-		namespaces, err := dbt.DB.Keys("")
+		namespaces, err := dbt.DB.Keys(context.Background(), "")
 		if err != nil {
 			t.Errorf("Failed to list namespaces: %v", err)
 		}
-		// Redis returns full keys with prefix, just verify we got results
-		if len(namespaces) == 0 {
-			t.Errorf("Expected to find namespaces in list")
+		if !slices.Contains(namespaces, testNamespace) || !slices.Contains(namespaces, dbt.DB.GetSystemNS()) {
+			t.Errorf("Expected to find %v and %v in namespaces, got %v", testNamespace, dbt.DB.GetSystemNS(), namespaces)
+		}
+	})
+
+	t.Run("namespaces containing the seperator", func(t *testing.T) {
+		dbt.DB.Set(context.Background(), "test", "key", "other")
+		keys, err := dbt.DB.Keys(context.Background(), testNamespace)
+		if err != nil || !slices.Equal(keys, []string{"ns_key"}) {
+			t.Errorf("Expected only ns_key in %v, got %v, %v", testNamespace, keys, err)
+		}
+		keys, _ = dbt.DB.Keys(context.Background(), "test")
+		if !slices.Equal(keys, []string{"key"}) {
+			t.Errorf("Expected only key in namespace test, got %v", keys)
+		}
+		dbt.DB.DeleteNamespace(context.Background(), "test")
+		if _, err := dbt.DB.Get(context.Background(), testNamespace, "ns_key"); err != nil {
+			t.Errorf("Deleting namespace test deleted the keys of %v: %v", testNamespace, err)
+		}
+	})
+
+	t.Run("keys of earlier versions", func(t *testing.T) {
+		rdb := dbt.DB.(*RedisDatabase)
+		rdb.RDC.Set(context.Background(), rdb.formatKey("legacy_a", "key"), "legacy", 0)
+		val, err := dbt.DB.Get(context.Background(), "legacy_a", "key")
+		if err != nil || val != "legacy" {
+			t.Errorf("Expected legacy from legacy_a, got %v, %v", val, err)
+		}
+		rdb.RDC.Rename(context.Background(), rdb.namespacesKey(), rdb.namespacesKey()+"-test")
+		err = rdb.registerExistingNamespaces(context.Background())
+		namespaces, _ := dbt.DB.Keys(context.Background(), "")
+		rdb.RDC.Rename(context.Background(), rdb.namespacesKey()+"-test", rdb.namespacesKey())
+		if err != nil || !slices.Contains(namespaces, "legacy") {
+			t.Errorf("Expected legacy registered, got %v, %v", namespaces, err)
+		}
+		dbt.DB.CreateNamespace(context.Background(), "legacy_a")
+		keys, _ := dbt.DB.Keys(context.Background(), "legacy_a")
+		if !slices.Equal(keys, []string{"key"}) {
+			t.Errorf("Expected key in legacy_a, got %v", keys)
 		}
+		dbt.DB.DeleteNamespace(context.Background(), "legacy_a")
 	})
 
 	t.Run("delete namespace", func(t *testing.T) {
-		err := dbt.DB.DeleteNamespace(testNamespace)
+		err := dbt.DB.DeleteNamespace(context.Background(), testNamespace)
 		if err != nil {
 			t.Errorf("Failed to delete namespace: %v", err)
 		}
-		// Note: Redis DeleteNamespace is a stub, so key may still exist
+		if _, err := dbt.DB.Get(context.Background(), testNamespace, "ns_key"); err == nil {
+			t.Errorf("Key should not exist after namespace deletion")
+		}
+		namespaces, _ := dbt.DB.Keys(context.Background(), "")
+		if slices.Contains(namespaces, testNamespace) {
+			t.Errorf("Namespace %v listed after deletion", testNamespace)
+		}
 	})
 
 	t.Run("prevent deletion of system namespace", func(t *testing.T) {
-		// Redis doesn't implement namespace protection, skip this test
-		t.Skip("Redis DeleteNamespace is stub implementation")
+		err := dbt.DB.DeleteNamespace(context.Background(), dbt.DB.GetSystemNS())
+		if _, ok := err.(*ErrNotAllowed); !ok {
+			t.Errorf("Expected ErrNotAllowed deleting system namespace, got %v", err)
+		}
+	})
+
+	t.Run("transaction", func(t *testing.T) {
+		testTransaction(t, dbt.DB, "transaction")
+	})
+	t.Run("keys page", func(t *testing.T) {
+		testKeysPage(t, dbt.DB, "paged")
 	})
 
 	t.Run("Counter Integration Test (stored db)", func(t *testing.T) {
 		count := Counter{}
-		dbt.DB.DeleteKey(dbt.DB.GetSystemNS(), "counter")
+		dbt.DB.DeleteKey(context.Background(), dbt.DB.GetSystemNS(), "counter")
 		count.Init(dbt.DB)
 		val := count.GetCount()
 		if val != 0 {
@@ -180,3 +240,84 @@ func Test_Redis_DB(t *testing.T) {
 		dbt.DB.Close()
 	})
 }
+
+func Test_Redis_Layout(t *testing.T) {
+	db := &RedisDatabase{Config: &ConfigRedis{Prefix: "kvdb", Seperator: "_"}}
+	for namespace, want := range map[string]string{"test": "kvdb_test_key", "a_b": "kvdb_a_b_key", "50%": "kvdb_50%_key"} {
+		redisKey := db.formatKey(namespace, "key")
+		if redisKey != want {
+			t.Errorf("formatKey(%v) got %v, want %v", namespace, redisKey, want)
+		}
+	}
+	t.Run("namespaces of earlier versions", func(t *testing.T) {
+		for redisKey, want := range map[string]string{"kvdb_test_key": "test", "kvdb_team_a_key": "team"} {
+			if got, ok := db.namespaceFromKey(redisKey); !ok || got != want {
+				t.Errorf("namespaceFromKey(%v) got %v, want %v", redisKey, got, want)
+			}
+		}
+	})
+	t.Run("nested namespaces", func(t *testing.T) {
+		keyPrefix := db.formatKey("a", "")
+		nested := db.nestedPrefixes(keyPrefix, []string{"a", "a_b", "b", "ab"}, db.formatKey)
+		if !slices.Equal(nested, []string{"kvdb_a_b_"}) {
+			t.Errorf("nestedPrefixes(%v) got %v", keyPrefix, nested)
+		}
+		for redisKey, want := range map[string]bool{"kvdb_a_key": true, "kvdb_a_c_key": true, "kvdb_a_b_key": false} {
+			if ownKey(redisKey, nested) != want {
+				t.Errorf("ownKey(%v) got %v, want %v", redisKey, !want, want)
+			}
+		}
+	})
+	t.Run("history outside namespaces", func(t *testing.T) {
+		for _, seperator := range []string{"_", "-", ":"} {
+			db := &RedisDatabase{Config: &ConfigRedis{Prefix: "kvdb", Seperator: seperator}}
+			historyKey := db.formatHistoryKey("test", "key")
+			for _, namespace := range []string{"history", "history" + seperator + "test", "%history", "-history", "test"} {
+				if strings.HasPrefix(historyKey, db.formatKey(namespace, "")) && !db.reservedNamespace(namespace) {
+					t.Errorf("History key %v is a key of namespace %v with seperator %v", historyKey, namespace, seperator)
+				}
+			}
+			if namespace, ok := db.namespaceFromKey(historyKey); ok {
+				t.Errorf("History key %v registered as namespace %v with seperator %v", historyKey, namespace, seperator)
+			}
+			if !ownKey(db.formatKey("test", "key"), db.nestedPrefixes(db.formatKey("test", ""), nil, db.formatKey)) {
+				t.Errorf("Key of namespace test taken as history with seperator %v", seperator)
+			}
+		}
+		db := &RedisDatabase{Config: &ConfigRedis{Prefix: "kvdb", Seperator: "-"}}
+		if _, ok := db.checkNamespace("history").(*ErrNotAllowed); !ok {
+			t.Errorf("Expected ErrNotAllowed for namespace history with seperator -")
+		}
+		if db.checkNamespace("test") != nil {
+			t.Errorf("Expected namespace test to be allowed with seperator -")
+		}
+	})
+}
+
+func Test_Redis_Options(t *testing.T) {
+	setupTestlogging()
+	config := ConfigRedis{Address: "127.0.0.1:6379", DB: 2, Username: "kvdb"}
+	options, err := config.UniversalOptions("password", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !slices.Equal(options.Addrs, []string{config.Address}) || options.DB != 2 || options.Username != "kvdb" || options.Password != "password" || options.TLSConfig != nil {
+		t.Errorf("Unexpected options %+v", options)
+	}
+	config = ConfigRedis{Addresses: []string{"sentinel-1:26379", "sentinel-2:26379"}, MasterName: "kvdb", TLS: ConfigTLS{Enabled: true, ServerName: "redis"}}
+	options, err = config.UniversalOptions("", "sentinel")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(options.Addrs) != 2 || options.MasterName != "kvdb" || options.SentinelPassword != "sentinel" || options.TLSConfig == nil || options.TLSConfig.ServerName != "redis" {
+		t.Errorf("Unexpected sentinel options %+v", options)
+	}
+	config.Cluster = true
+	if _, err := config.UniversalOptions("", ""); err == nil {
+		t.Errorf("Expected error for cluster with masterName")
+	}
+	config = ConfigRedis{TLS: ConfigTLS{Enabled: true, CACertificate: "missing-ca.crt"}}
+	if _, err := config.UniversalOptions("", ""); err == nil {
+		t.Errorf("Expected error for missing CA certificate")
+	}
+}
@@ -1,6 +1,7 @@
 package main
 
 import (
+	"context"
 	"log/slog"
 	"net/http"
 	"strings"
@@ -14,8 +15,15 @@ type RequestParameters struct {
 		Password string
 		Ok       bool
 	}
+	Bearer struct {
+		Token string
+		Ok    bool
+	}
 	Authentication struct {
-		User     *User
+		User *User
+		// Username for credentials not using Basic.Username
+		Username string
+		Token    *APIToken
 		Verified Verified
 	}
 	Attachment *rest.ObjectV1
@@ -23,7 +31,9 @@ type RequestParameters struct {
 	Api        string
 	Namespace  string
 	Key        string
+	Resource   string
 	orgRequest *http.Request
+	ctx        context.Context // orgRequest context limited by the request timeout
 	Body       string
 	RequestIP  string
 	ID         uint32
@@ -36,22 +46,35 @@ type Verified struct {
 	Password bool
 	Host     bool
 	mTLS     bool
+	Token    bool
+	JWT      bool
 }
 
 func (Verified *Verified) Ok() bool {
-	if Verified.mTLS {
+	if Verified.mTLS || Verified.JWT {
 		return true
 	}
-	return Verified.Password && Verified.Host
+	return (Verified.Password || Verified.Token) && Verified.Host
 }
 
 func (RequestParameters *RequestParameters) GetUserName() string {
+	if RequestParameters.Authentication.Username != "" {
+		return RequestParameters.Authentication.Username
+	}
 	if RequestParameters.Basic.Ok || RequestParameters.Authentication.Verified.mTLS {
 		return RequestParameters.Basic.Username
 	}
 	return "anonymous"
 }
 
+// Context of the request for database operations, cancelled when the client disconnects or the request timeout passes
+func (RequestParameters *RequestParameters) Context() context.Context {
+	if RequestParameters.ctx != nil {
+		return RequestParameters.ctx
+	}
+	return RequestParameters.orgRequest.Context()
+}
+
 func GetRequestParameters(r *http.Request, id uint32) *RequestParameters {
 
 	slashSeperated := strings.Split(r.URL.Path[1:], "/")
@@ -65,11 +88,17 @@ func GetRequestParameters(r *http.Request, id uint32) *RequestParameters {
 	if len(slashSeperated) > 2 {
 		req.Key = slashSeperated[2]
 	}
+	if len(slashSeperated) > 3 {
+		req.Resource = slashSeperated[3]
+	}
 	if r.TLS != nil && len(r.TLS.VerifiedChains) > 0 && len(r.TLS.VerifiedChains[0]) > 0 {
 		req.Basic.Username = r.TLS.VerifiedChains[0][0].Subject.CommonName
 		req.Basic.Password = ""
 		req.Basic.Ok = true
 		req.Authentication.Verified.mTLS = true
+	} else if authorization := r.Header.Get("Authorization"); strings.HasPrefix(authorization, "Bearer ") {
+		req.Bearer.Token = strings.TrimSpace(strings.TrimPrefix(authorization, "Bearer "))
+		req.Bearer.Ok = req.Bearer.Token != ""
 	} else {
 		req.Basic.Username, req.Basic.Password, req.Basic.Ok = r.BasicAuth()
 	}
@@ -1,5 +1,7 @@
 package rest
 
+import "time"
+
 type ObjectType string
 
 const (
@@ -10,11 +12,20 @@ const (
 	TypeNamespace ObjectType = "namespace"
 	TypeRoll      ObjectType = "roll"
 	TypeGenerate  ObjectType = "generate"
+	TypeRestore   ObjectType = "restore" // Value holds the version to restore
+
+	// Response header carrying the remaining time to live in seconds
+	HeaderTTL = "X-TTL"
+	// Response header carrying the cursor of the next page of a listing, missing on the last page
+	HeaderNextCursor = "X-Next-Cursor"
+	// Maximum page size of a listing
+	ListMaxLimit = 1000
 )
 
 type ObjectV1 struct {
 	Type  ObjectType `json:"type"`
 	Value string     `json:"value"`
+	TTL   int64      `json:"ttl,omitempty"` // Seconds until the key expires, 0 for no expiry
 }
 type KVPairListV1 []KVPairV2
 
@@ -23,6 +34,15 @@ type KVPairV2 struct {
 	Namespace string `json:"namespace"`
 	Value     string `json:"value"`
 }
+type KeyHistoryV1 []KeyVersionV1
+
+type KeyVersionV1 struct {
+	Version   int       `json:"version"`
+	Value     string    `json:"value"`
+	Timestamp time.Time `json:"timestamp"`
+	User      string    `json:"user"`
+}
+
 type NamespaceListV1 []NamespaceV2
 
 type NamespaceV2 struct {
@@ -34,4 +54,143 @@ type NamespaceV2 struct {
 type HealthV1 struct {
 	Status   string `json:"status"`
 	Requests int    `json:"requests"`
+	Database string `json:"database,omitempty"` // UP or DOWN for databases with a connection
+}
+
+// AuditEventV1 is a single entry in the audit trail, values are never recorded
+type AuditEventV1 struct {
+	Time       time.Time `json:"time"`
+	ID         uint32    `json:"id"`
+	User       string    `json:"user"`
+	IP         string    `json:"ip"`
+	AuthMethod string    `json:"authMethod"`
+	Method     string    `json:"method"`
+	Namespace  string    `json:"namespace,omitempty"`
+	Key        string    `json:"key,omitempty"`
+	Action     string    `json:"action"`
+	Outcome    string    `json:"outcome"`
+	Status     int       `json:"status"`
+}
+
+const (
+	AuditOutcomeSuccess = "success"
+	AuditOutcomeDenied  = "denied"
+	AuditOutcomeFailure = "failure"
+)
+
+// TokenRequestV1 mints a new API token for User
+type TokenRequestV1 struct {
+	User        string         `json:"user"`
+	Description string         `json:"description,omitempty"`
+	TTL         int64          `json:"ttl,omitempty"` // Seconds until the token expires, 0 for no expiry
+	Scopes      []TokenScopeV1 `json:"scopes"`
+}
+
+type TokenScopeV1 struct {
+	Namespaces []string `json:"namespaces"`
+	Keys       []string `json:"keys,omitempty"`
+	Read       bool     `json:"read"`
+	Write      bool     `json:"write"`
+	List       bool     `json:"list"`
+}
+
+type TokenV1 struct {
+	ID          string         `json:"id"`
+	User        string         `json:"user"`
+	Description string         `json:"description,omitempty"`
+	Scopes      []TokenScopeV1 `json:"scopes"`
+	Created     time.Time      `json:"created"`
+	Expires     *time.Time     `json:"expires,omitempty"`
+	Revoked     bool           `json:"revoked"`
+	Token       string         `json:"token,omitempty"` // Only returned when the token is minted
+}
+
+type TokenListV1 []TokenV1
+
+type BatchOp string
+
+const (
+	BatchGet    BatchOp = "get"
+	BatchSet    BatchOp = "set"
+	BatchDelete BatchOp = "delete"
+
+	// Maximum number of operations in a single batch
+	BatchMaxOperations = 1000
+)
+
+type BatchOperationV1 struct {
+	Op          BatchOp `json:"op"`
+	Namespace   string  `json:"namespace"`
+	Key         string  `json:"key"`
+	Value       string  `json:"value,omitempty"`
+	TTL         int64   `json:"ttl,omitempty"`         // Seconds until the key expires, 0 for no expiry
+	IfMatch     string  `json:"ifMatch,omitempty"`     // ETag the current value must match, * requires the key to exist
+	IfNoneMatch string  `json:"ifNoneMatch,omitempty"` // ETag the current value must not match, * requires the key to not exist
+}
+
+type BatchRequestV1 struct {
+	Operations []BatchOperationV1 `json:"operations"`
+}
+
+type BatchResultV1 struct {
+	Op        BatchOp `json:"op"`
+	Namespace string  `json:"namespace"`
+	Key       string  `json:"key"`
+	Status    int     `json:"status"`
+	Value     string  `json:"value,omitempty"`
+	ETag      string  `json:"etag,omitempty"`
+}
+
+type BatchResponseV1 struct {
+	Applied bool            `json:"applied"`
+	Atomic  bool            `json:"atomic"` // False when the database applied the operations one by one
+	Results []BatchResultV1 `json:"results"`
 }
+
+type ArchiveFormat string
+
+type ImportMode string
+
+const (
+	ArchiveJSONLines ArchiveFormat = "jsonl" // Header line followed by one record per line
+	ArchiveTar       ArchiveFormat = "tar"   // archive.yaml with the header and a yaml file per namespace
+
+	ImportMerge     ImportMode = "merge"     // Keys that already exist are kept
+	ImportOverwrite ImportMode = "overwrite" // Keys that already exist are replaced
+	ImportFail      ImportMode = "fail"      // Nothing is imported if a key exists with another value
+
+	// Request header with the passphrase an archive is encrypted with
+	HeaderArchivePassphrase = "X-Archive-Passphrase"
+)
+
+// ArchiveHeaderV1 describes an export, the system namespace is imported to the system namespace of the database
+type ArchiveHeaderV1 struct {
+	Version         int       `json:"version" yaml:"version"`
+	SystemNamespace string    `json:"systemNamespace" yaml:"systemNamespace"`
+	Created         time.Time `json:"created" yaml:"created"`
+}
+
+// ArchiveRecordV1 is a key in an export, a record without Key creates the namespace
+type ArchiveRecordV1 struct {
+	Namespace string       `json:"namespace" yaml:"-"` // The file name in tar archives
+	Key       string       `json:"key,omitempty" yaml:"key"`
+	Value     string       `json:"value,omitempty" yaml:"value"`
+	Expires   *time.Time   `json:"expires,omitempty" yaml:"expires,omitempty"`
+	History   KeyHistoryV1 `json:"history,omitempty" yaml:"history,omitempty"`
+}
+
+type ImportResultV1 struct {
+	Namespaces int      `json:"namespaces"`
+	Imported   int      `json:"imported"`
+	Skipped    int      `json:"skipped"`             // Existing keys kept by merge, expired keys and unchanged keys
+	Conflicts  []string `json:"conflicts,omitempty"` // namespace/key of existing keys with another value, with mode fail
+}
+
+// SnapshotV1 is a backup taken by the server, restore it with POST /system/backups/<name>/restore
+type SnapshotV1 struct {
+	Name    string    `json:"name"`
+	Size    int64     `json:"size"`
+	Created time.Time `json:"created"`
+}
+
+type SnapshotListV1 []SnapshotV1
@@ -0,0 +1,73 @@
+package main
+
+import (
+	"slices"
+	"strings"
+)
+
+// ConfigRoles holds named permission sets, like roles: {reader: [...]}
+type ConfigRoles map[string][]ConfigPermissionsset
+
+// ConfigGroup binds users, mTLS certificate common names and JWT subjects to roles
+type ConfigGroup struct {
+	Name     string   `mapstructure:"name"`
+	Roles    []string `mapstructure:"roles"`
+	Users    []string `mapstructure:"users"`
+	MTLS     []string `mapstructure:"mtls"`
+	Subjects []string `mapstructure:"subjects"`
+}
+
+// GroupBindings maps each member of a group to the roles of all its groups
+type GroupBindings struct {
+	Users    map[string][]string
+	MTLS     map[string][]string
+	Subjects map[string][]string
+}
+
+func NewGroupBindings(groups []ConfigGroup) GroupBindings {
+	bindings := GroupBindings{Users: map[string][]string{}, MTLS: map[string][]string{}, Subjects: map[string][]string{}}
+	bind := func(members []string, binding map[string][]string, roles []string) {
+		for _, member := range members {
+			binding[member] = append(binding[member], roles...)
+		}
+	}
+	for _, group := range groups {
+		logger.Debug("Reading Group", "function", "NewGroupBindings", "group", group.Name, "roles", group.Roles)
+		bind(group.Users, bindings.Users, group.Roles)
+		bind(group.MTLS, bindings.MTLS, group.Roles)
+		bind(group.Subjects, bindings.Subjects, group.Roles)
+	}
+	return bindings
+}
+
+// SetPermissions compiles the permission sets of the user, see NamespacePermissions for how they are applied
+func (User *User) SetPermissions(sets []ConfigPermissionsset) {
+	User.Permissionsset = sets
+	User.Rules = compilePermissionRules(sets)
+}
+
+// WithRoles returns a copy of the user with the permission sets of the named roles added
+func (User User) WithRoles(names []string, roles ConfigRoles) User {
+	if len(names) == 0 {
+		return User
+	}
+	sets := slices.Clone(User.Permissionsset)
+	userRoles := slices.Clone(User.Roles)
+	for _, name := range names {
+		// Role names are case insensitive as the config reader lower cases map keys
+		name = strings.ToLower(name)
+		if slices.Contains(userRoles, name) {
+			continue
+		}
+		roleSets, ok := roles[name]
+		if !ok {
+			logger.Warn("Unknown role", "function", "WithRoles", "struct", "User", "role", name)
+			continue
+		}
+		userRoles = append(userRoles, name)
+		sets = append(sets, roleSets...)
+	}
+	User.Roles = userRoles
+	User.SetPermissions(sets)
+	return User
+}
@@ -0,0 +1,163 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Schedule is a cron like schedule, Next returns the first time after the given time it fires
+type Schedule interface {
+	Next(after time.Time) time.Time
+}
+
+// IntervalSchedule fires every Interval, from @every <duration>
+type IntervalSchedule struct {
+	Interval time.Duration
+}
+
+func (Schedule *IntervalSchedule) Next(after time.Time) time.Time {
+	return after.Add(Schedule.Interval)
+}
+
+// CronSchedule is a standard five field cron expression "minute hour day-of-month month day-of-week".
+// Fields take *, values, ranges a-b, lists a,b and steps */n or a-b/n. Times are in the location of after.
+type CronSchedule struct {
+	Minute     uint64
+	Hour       uint64
+	DayOfMonth uint64
+	Month      uint64
+	DayOfWeek  uint64
+	// Like cron, when both day fields are restricted a day matching either fires
+	anyDayOfMonth bool
+	anyDayOfWeek  bool
+}
+
+var scheduleAliases = map[string]string{
+	"@yearly":  "0 0 1 1 *",
+	"@monthly": "0 0 1 * *",
+	"@weekly":  "0 0 * * 0",
+	"@daily":   "0 0 * * *",
+	"@hourly":  "0 * * * *",
+}
+
+// ParseSchedule parses a five field cron expression, @hourly, @daily, @weekly, @monthly, @yearly or @every <duration>
+func ParseSchedule(expression string) (Schedule, error) {
+	expression = strings.TrimSpace(expression)
+	if interval, found := strings.CutPrefix(expression, "@every "); found {
+		duration, err := time.ParseDuration(strings.TrimSpace(interval))
+		if err != nil || duration < time.Second {
+			return nil, fmt.Errorf("invalid schedule %q, @every needs a duration of at least 1s", expression)
+		}
+		return &IntervalSchedule{Interval: duration}, nil
+	}
+	if alias, ok := scheduleAliases[expression]; ok {
+		expression = alias
+	}
+	fields := strings.Fields(expression)
+	if len(fields) != 5 {
+		return nil, fmt.Errorf("invalid schedule %q, expected 5 fields", expression)
+	}
+	schedule := &CronSchedule{
+		anyDayOfMonth: fields[2] == "*",
+		anyDayOfWeek:  fields[4] == "*",
+	}
+	bounds := []struct {
+		field    *uint64
+		min, max int
+	}{
+		{&schedule.Minute, 0, 59},
+		{&schedule.Hour, 0, 23},
+		{&schedule.DayOfMonth, 1, 31},
+		{&schedule.Month, 1, 12},
+		{&schedule.DayOfWeek, 0, 7},
+	}
+	for i, bound := range bounds {
+		bits, err := parseScheduleField(fields[i], bound.min, bound.max)
+		if err != nil {
+			return nil, fmt.Errorf("invalid schedule %q: %w", expression, err)
+		}
+		*bound.field = bits
+	}
+	// Sunday is both 0 and 7
+	if schedule.DayOfWeek&(1<<7) != 0 {
+		schedule.DayOfWeek |= 1
+	}
+	return schedule, nil
+}
+
+func parseScheduleField(field string, min int, max int) (uint64, error) {
+	var bits uint64
+	for _, part := range strings.Split(field, ",") {
+		valueRange, stepText, hasStep := strings.Cut(part, "/")
+		step := 1
+		if hasStep {
+			var err error
+			step, err = strconv.Atoi(stepText)
+			if err != nil || step < 1 {
+				return 0, fmt.Errorf("invalid step in %q", part)
+			}
+		}
+		first, last := min, max
+		if valueRange != "*" {
+			firstText, lastText, isRange := strings.Cut(valueRange, "-")
+			var err error
+			first, err = strconv.Atoi(firstText)
+			if err != nil {
+				return 0, fmt.Errorf("invalid value in %q", part)
+			}
+			last = first
+			if isRange {
+				last, err = strconv.Atoi(lastText)
+				if err != nil {
+					return 0, fmt.Errorf("invalid value in %q", part)
+				}
+			} else if hasStep {
+				last = max
+			}
+		}
+		if first < min || last > max || first > last {
+			return 0, fmt.Errorf("%q out of range %v-%v", part, min, max)
+		}
+		for value := first; value <= last; value += step {
+			bits |= 1 << value
+		}
+	}
+	return bits, nil
+}
+
+func (Schedule *CronSchedule) dayMatches(t time.Time) bool {
+	dayOfMonth := Schedule.DayOfMonth&(1<<t.Day()) != 0
+	dayOfWeek := Schedule.DayOfWeek&(1<<t.Weekday()) != 0
+	if Schedule.anyDayOfMonth || Schedule.anyDayOfWeek {
+		return dayOfMonth && dayOfWeek
+	}
+	return dayOfMonth || dayOfWeek
+}
+
+func (Schedule *CronSchedule) Next(after time.Time) time.Time {
+	t := after.Truncate(time.Minute).Add(time.Minute)
+	// A schedule that never fires, like the 31st of February, gives up after five years
+	limit := t.AddDate(5, 0, 0)
+	for t.Before(limit) {
+		if Schedule.Month&(1<<t.Month()) == 0 {
+			t = time.Date(t.Year(), t.Month()+1, 1, 0, 0, 0, 0, t.Location())
+			continue
+		}
+		if !Schedule.dayMatches(t) {
+			t = time.Date(t.Year(), t.Month(), t.Day()+1, 0, 0, 0, 0, t.Location())
+			continue
+		}
+		if Schedule.Hour&(1<<t.Hour()) == 0 {
+			t = time.Date(t.Year(), t.Month(), t.Day(), t.Hour()+1, 0, 0, 0, t.Location())
+			continue
+		}
+		if Schedule.Minute&(1<<t.Minute()) == 0 {
+			t = t.Add(time.Minute)
+			continue
+		}
+		return t
+	}
+	return time.Time{}
+}
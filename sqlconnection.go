@@ -0,0 +1,188 @@
+package main
+
+import (
+	"container/list"
+	"context"
+	"database/sql"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/spf13/viper"
+)
+
+// ConfigSQLPool limits the connection pool of the mysql and postgres backends
+type ConfigSQLPool struct {
+	MaxOpenConnections    int           `mapstructure:"maxOpenConnections"` // 0 for no limit
+	MaxIdleConnections    int           `mapstructure:"maxIdleConnections"`
+	ConnectionMaxLifetime time.Duration `mapstructure:"connectionMaxLifetime"` // 0 keeps connections open
+	ConnectionMaxIdleTime time.Duration `mapstructure:"connectionMaxIdleTime"` // 0 keeps idle connections open
+}
+
+func SQLPoolGetDefaults(configReader *viper.Viper, backend string) {
+	configReader.SetDefault(backend+".pool.maxOpenConnections", 10)
+	configReader.SetDefault(backend+".pool.maxIdleConnections", 2)
+	configReader.SetDefault(backend+".pool.connectionMaxLifetime", "30m")
+	configReader.SetDefault(backend+".pool.connectionMaxIdleTime", "5m")
+}
+
+func (Pool *ConfigSQLPool) Apply(connection *sql.DB) {
+	connection.SetMaxOpenConns(Pool.MaxOpenConnections)
+	connection.SetMaxIdleConns(Pool.MaxIdleConnections)
+	connection.SetConnMaxLifetime(Pool.ConnectionMaxLifetime)
+	connection.SetConnMaxIdleTime(Pool.ConnectionMaxIdleTime)
+}
+
+// queryStrings returns the first column of the rows of query
+func queryStrings(connection *sql.DB, query string, args ...any) ([]string, error) {
+	rows, err := connection.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	values := []string{}
+	for rows.Next() {
+		var value string
+		err = rows.Scan(&value)
+		if err != nil {
+			return nil, err
+		}
+		values = append(values, value)
+	}
+	return values, rows.Err()
+}
+
+// waitForDatabase pings connection until it answers or timeout has passed, so the server can start together
+// with its database. Connections lost later are reopened by the pool when used.
+func waitForDatabase(connection *sql.DB, timeout time.Duration) error {
+	deadline := time.Now().Add(timeout)
+	delay := 500 * time.Millisecond
+	for {
+		err := connection.Ping()
+		if err == nil {
+			return nil
+		}
+		if time.Now().Add(delay).After(deadline) {
+			logger.Error("Database unavailable", "function", "waitForDatabase", "error", err)
+			return err
+		}
+		logger.Warn("Database unavailable, retrying", "function", "waitForDatabase", "retry", delay, "error", err)
+		time.Sleep(delay)
+		delay = min(delay*2, 10*time.Second)
+	}
+}
+
+// validateNamespace rejects namespaces that can not be quoted as a table name by the mysql and postgres backends
+func validateNamespace(namespace string) error {
+	if strings.ContainsAny(namespace, "\"`\x00") {
+		return &ErrMalformRequest{Value: fmt.Sprintf("invalid namespace %q", namespace)}
+	}
+	return nil
+}
+
+type statementKey struct {
+	Namespace string
+	Name      string
+}
+
+type cachedStatement struct {
+	key       statementKey
+	statement *sql.Stmt
+	refs      int
+	evicted   bool
+}
+
+// statementCache keeps prepared statements per namespace, beyond Size the least recently used are closed
+// once no longer in use. With a Size of 0 statements are closed when released.
+type statementCache struct {
+	Size       int
+	mutex      sync.Mutex
+	statements map[statementKey]*list.Element
+	order      *list.List
+}
+
+// Prepare returns the statement name of namespace, release must be called when done with it
+func (Cache *statementCache) Prepare(ctx context.Context, connection *sql.DB, namespace string, name string, query string) (*sql.Stmt, func(), error) {
+	key := statementKey{Namespace: namespace, Name: name}
+	Cache.mutex.Lock()
+	if Cache.statements == nil {
+		Cache.statements = map[statementKey]*list.Element{}
+		Cache.order = list.New()
+	}
+	if element, ok := Cache.statements[key]; ok {
+		Cache.order.MoveToFront(element)
+		cached := element.Value.(*cachedStatement)
+		cached.refs++
+		Cache.mutex.Unlock()
+		return cached.statement, func() { Cache.release(cached) }, nil
+	}
+	Cache.mutex.Unlock()
+	statement, err := connection.PrepareContext(ctx, query)
+	if err != nil {
+		return nil, nil, err
+	}
+	cached := &cachedStatement{key: key, statement: statement, refs: 1, evicted: Cache.Size <= 0}
+	if Cache.Size > 0 {
+		Cache.mutex.Lock()
+		if element, ok := Cache.statements[key]; ok {
+			// Prepared by another request at the same time
+			Cache.evict(element)
+		}
+		Cache.statements[key] = Cache.order.PushFront(cached)
+		for Cache.order.Len() > Cache.Size {
+			Cache.evict(Cache.order.Back())
+		}
+		Cache.mutex.Unlock()
+	}
+	return statement, func() { Cache.release(cached) }, nil
+}
+
+func (Cache *statementCache) release(cached *cachedStatement) {
+	Cache.mutex.Lock()
+	defer Cache.mutex.Unlock()
+	cached.refs--
+	if cached.evicted && cached.refs == 0 {
+		cached.statement.Close()
+	}
+}
+
+// evict removes element, its statement is closed when no longer in use. Requires the mutex.
+func (Cache *statementCache) evict(element *list.Element) {
+	cached := element.Value.(*cachedStatement)
+	Cache.order.Remove(element)
+	if Cache.statements[cached.key] == element {
+		delete(Cache.statements, cached.key)
+	}
+	cached.evicted = true
+	if cached.refs == 0 {
+		cached.statement.Close()
+	}
+}
+
+// Invalidate closes the statements of namespace, for namespaces that are deleted
+func (Cache *statementCache) Invalidate(namespace string) {
+	Cache.mutex.Lock()
+	defer Cache.mutex.Unlock()
+	for key, element := range Cache.statements {
+		if key.Namespace == namespace {
+			Cache.evict(element)
+		}
+	}
+}
+
+// Close closes all statements
+func (Cache *statementCache) Close() {
+	Cache.mutex.Lock()
+	defer Cache.mutex.Unlock()
+	for _, element := range Cache.statements {
+		Cache.evict(element)
+	}
+}
+
+// Len returns the number of cached statements
+func (Cache *statementCache) Len() int {
+	Cache.mutex.Lock()
+	defer Cache.mutex.Unlock()
+	return len(Cache.statements)
+}
@@ -0,0 +1,164 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"fmt"
+	"sync/atomic"
+	"testing"
+
+	"github.com/lib/pq"
+)
+
+// countingDriver counts prepared and closed statements
+type countingDriver struct {
+	prepared atomic.Int32
+	closed   atomic.Int32
+}
+
+func (Driver *countingDriver) Open(name string) (driver.Conn, error) {
+	return &countingConn{driver: Driver}, nil
+}
+
+func (Driver *countingDriver) Connect(ctx context.Context) (driver.Conn, error) {
+	return Driver.Open("")
+}
+
+func (Driver *countingDriver) Driver() driver.Driver {
+	return Driver
+}
+
+type countingConn struct {
+	driver *countingDriver
+}
+
+func (Conn *countingConn) Prepare(query string) (driver.Stmt, error) {
+	Conn.driver.prepared.Add(1)
+	return &countingStmt{driver: Conn.driver}, nil
+}
+
+func (Conn *countingConn) Close() error {
+	return nil
+}
+
+func (Conn *countingConn) Begin() (driver.Tx, error) {
+	return nil, errors.New("not supported")
+}
+
+type countingStmt struct {
+	driver *countingDriver
+}
+
+func (Stmt *countingStmt) Close() error {
+	Stmt.driver.closed.Add(1)
+	return nil
+}
+
+func (Stmt *countingStmt) NumInput() int {
+	return -1
+}
+
+func (Stmt *countingStmt) Exec(args []driver.Value) (driver.Result, error) {
+	return driver.RowsAffected(1), nil
+}
+
+func (Stmt *countingStmt) Query(args []driver.Value) (driver.Rows, error) {
+	return nil, errors.New("not supported")
+}
+
+func TestStatementCache(t *testing.T) {
+	counter := &countingDriver{}
+	connection := sql.OpenDB(counter)
+	connection.SetMaxOpenConns(1)
+	defer connection.Close()
+	cache := &statementCache{Size: 2}
+	prepare := func(namespace string, name string) func() {
+		statement, release, err := cache.Prepare(context.Background(), connection, namespace, name, name+" "+namespace)
+		if err != nil {
+			t.Fatalf("Prepare failed: %v", err)
+		}
+		_, err = statement.Exec()
+		if err != nil {
+			t.Errorf("Exec failed: %v", err)
+		}
+		return release
+	}
+	t.Run("reuse", func(t *testing.T) {
+		prepare("a", "get")()
+		prepare("a", "get")()
+		if prepared := counter.prepared.Load(); prepared != 1 {
+			t.Errorf("Expected statement prepared once, got %v", prepared)
+		}
+	})
+	t.Run("evict least recently used", func(t *testing.T) {
+		prepare("a", "set")()
+		prepare("a", "get")()
+		prepare("b", "get")()
+		if cache.Len() != 2 || counter.closed.Load() != 1 {
+			t.Errorf("Expected 2 statements cached and 1 closed, got %v and %v", cache.Len(), counter.closed.Load())
+		}
+		prepared := counter.prepared.Load()
+		prepare("a", "get")()
+		if counter.prepared.Load() != prepared {
+			t.Errorf("Expected the recently used statement to be kept")
+		}
+	})
+	t.Run("statements in use are closed on release", func(t *testing.T) {
+		closed := counter.closed.Load()
+		release := prepare("b", "get")
+		cache.Invalidate("b")
+		if counter.closed.Load() != closed {
+			t.Errorf("Statement in use closed")
+		}
+		release()
+		if counter.closed.Load() != closed+1 {
+			t.Errorf("Expected statement closed on release")
+		}
+	})
+	t.Run("no cache", func(t *testing.T) {
+		uncached := &statementCache{}
+		closed := counter.closed.Load()
+		_, release, err := uncached.Prepare(context.Background(), connection, "a", "get", "get a")
+		if err != nil {
+			t.Fatal(err)
+		}
+		release()
+		if uncached.Len() != 0 || counter.closed.Load() != closed+1 {
+			t.Errorf("Expected statement closed without cache")
+		}
+	})
+	cache.Close()
+	if cache.Len() != 0 || counter.closed.Load() != counter.prepared.Load() {
+		t.Errorf("Expected all statements closed, prepared %v closed %v", counter.prepared.Load(), counter.closed.Load())
+	}
+}
+
+func TestValidateNamespace(t *testing.T) {
+	for _, namespace := range []string{"", "kvdb", "name-space", "name space", "nämespace"} {
+		if err := validateNamespace(namespace); err != nil {
+			t.Errorf("Expected namespace %q to be valid, got %v", namespace, err)
+		}
+	}
+	for _, namespace := range []string{`a"b`, "a`b", "a\x00b", `"; DROP TABLE kvdb; --`} {
+		if _, ok := validateNamespace(namespace).(*ErrMalformRequest); !ok {
+			t.Errorf("Expected ErrMalformRequest for namespace %q", namespace)
+		}
+	}
+}
+
+func TestTableMissing(t *testing.T) {
+	if !isPostgresTableMissing(fmt.Errorf("exec: %w", &pq.Error{Code: "42P01"})) {
+		t.Errorf("Expected undefined table to be missing")
+	}
+	if isPostgresTableMissing(&pq.Error{Code: "42P07"}) || isPostgresTableMissing(nil) {
+		t.Errorf("Expected only undefined table to be missing")
+	}
+	if !isMariaTableMissing(errors.New("Error 1146 (42S02): Table 'kvdb.missing' doesn't exist")) {
+		t.Errorf("Expected table that doesn't exist to be missing")
+	}
+	if isMariaTableMissing(errors.New("Error 1062 (23000): Duplicate entry")) || isMariaTableMissing(nil) {
+		t.Errorf("Expected only table that doesn't exist to be missing")
+	}
+}
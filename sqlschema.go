@@ -0,0 +1,94 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"time"
+)
+
+const (
+	LayoutTable  = "table"  // One table per namespace
+	LayoutSingle = "single" // All namespaces in one schema managed table
+)
+
+// schemaMigration is applied once, in Version order, and recorded in the schema table
+type schemaMigration struct {
+	Version     int
+	Description string
+	Apply       func(tx *sql.Tx) error
+}
+
+// sqlSchema runs the schema migrations of a SQL backend at Init.
+// Lock takes a session lock on the connection so instances starting together migrate one at a time, Unlock releases it.
+// MariaDB commits DDL statements implicitly, so a migration failing halfway is not rolled back there,
+// migrations are written to be safe to run again.
+type sqlSchema struct {
+	Table       string
+	Lock        string
+	Unlock      string
+	Placeholder func(n int) string
+}
+
+func (Schema *sqlSchema) version(tx *sql.Tx) (int, error) {
+	var version int
+	err := tx.QueryRow(fmt.Sprintf("SELECT COALESCE(MAX(version), 0) FROM %v", Schema.Table)).Scan(&version)
+	return version, err
+}
+
+// Migrate applies the migrations newer than the recorded version and returns the resulting version
+func (Schema *sqlSchema) Migrate(connection *sql.DB, migrations []schemaMigration) (int, error) {
+	ctx := context.Background()
+	conn, err := connection.Conn(ctx)
+	if err != nil {
+		return 0, err
+	}
+	defer conn.Close()
+	_, err = conn.ExecContext(ctx, Schema.Lock)
+	if err != nil {
+		logger.Error("Unable to lock schema", "function", "Migrate", "struct", "sqlSchema", "error", err)
+		return 0, err
+	}
+	defer conn.ExecContext(ctx, Schema.Unlock)
+	_, err = conn.ExecContext(ctx, fmt.Sprintf(`CREATE TABLE IF NOT EXISTS %v (
+		version INTEGER NOT NULL PRIMARY KEY,
+		description VARCHAR(255) NOT NULL,
+		applied BIGINT NOT NULL)`, Schema.Table))
+	if err != nil {
+		logger.Error("Unable to create schema table", "function", "Migrate", "struct", "sqlSchema", "error", err)
+		return 0, err
+	}
+	current := 0
+	for _, migration := range migrations {
+		tx, err := conn.BeginTx(ctx, nil)
+		if err != nil {
+			return current, err
+		}
+		current, err = Schema.version(tx)
+		if err != nil || migration.Version <= current {
+			tx.Rollback()
+			if err != nil {
+				return current, err
+			}
+			continue
+		}
+		logger.Info("Applying schema migration", "function", "Migrate", "struct", "sqlSchema", "table", Schema.Table, "version", migration.Version, "description", migration.Description)
+		err = migration.Apply(tx)
+		if err == nil {
+			_, err = tx.Exec(fmt.Sprintf("INSERT INTO %v (version, description, applied) VALUES (%v, %v, %v)",
+				Schema.Table, Schema.Placeholder(1), Schema.Placeholder(2), Schema.Placeholder(3)),
+				migration.Version, migration.Description, time.Now().UnixMilli())
+		}
+		if err != nil {
+			tx.Rollback()
+			logger.Error("Schema migration failed", "function", "Migrate", "struct", "sqlSchema", "table", Schema.Table, "version", migration.Version, "error", err)
+			return current, err
+		}
+		err = tx.Commit()
+		if err != nil {
+			return current, err
+		}
+		current = migration.Version
+	}
+	return current, nil
+}
@@ -0,0 +1,116 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"slices"
+	"testing"
+	"time"
+)
+
+// testSingleTableUpgrade writes with the per namespace layout, starts the single table layout on the same database
+// and verifies the data was copied. connection and version read the schema and row versions of single.
+func testSingleTableUpgrade(t *testing.T, legacy Database, single Database, connection func() *sql.DB, schemaTable string, version func(namespace string, key string) int) {
+	err := legacy.Init()
+	if err != nil {
+		t.Fatalf("Unable to initialize database %v", err)
+	}
+	legacy.CreateNamespace(context.Background(), "upgrade_empty")
+	legacy.Set(context.Background(), "upgrade_ns", "a", "1")
+	legacy.SetWithTTL(context.Background(), "upgrade_ns", "b", "2", time.Hour)
+	legacy.Close()
+
+	t.Run("upgrade copies namespace tables", func(t *testing.T) {
+		single.Init()
+		value, err := single.Get(context.Background(), "upgrade_ns", "a")
+		if err != nil || value != "1" {
+			t.Errorf("Expected copied value 1, got %v %v", value, err)
+		}
+		ttl, err := single.TTL(context.Background(), "upgrade_ns", "b")
+		if err != nil || ttl <= 0 || ttl > time.Hour {
+			t.Errorf("Expected copied ttl within an hour, got %v %v", ttl, err)
+		}
+		namespaces, _ := single.Keys(context.Background(), "")
+		for _, namespace := range []string{"upgrade_ns", "upgrade_empty", single.GetSystemNS()} {
+			if !slices.Contains(namespaces, namespace) {
+				t.Errorf("Expected namespace %v in %v", namespace, namespaces)
+			}
+		}
+	})
+	t.Run("schema version", func(t *testing.T) {
+		var current int
+		err := connection().QueryRow("SELECT MAX(version) FROM " + schemaTable).Scan(&current)
+		if err != nil || current != 2 {
+			t.Errorf("Expected schema version 2, got %v %v", current, err)
+		}
+		single.Close()
+		single.Init()
+		var count int
+		connection().QueryRow("SELECT COUNT(*) FROM " + schemaTable).Scan(&count)
+		if count != 2 {
+			t.Errorf("Expected migrations applied once, got %v", count)
+		}
+	})
+	t.Run("row version", func(t *testing.T) {
+		single.Set(context.Background(), "versioned", "key", "one")
+		single.Set(context.Background(), "versioned", "key", "two")
+		if v := version("versioned", "key"); v != 2 {
+			t.Errorf("Expected row version 2, got %v", v)
+		}
+		single.SetWithTTL(context.Background(), "versioned", "expired", "one", time.Millisecond)
+		time.Sleep(5 * time.Millisecond)
+		single.Set(context.Background(), "versioned", "expired", "two")
+		if v := version("versioned", "expired"); v != 1 {
+			t.Errorf("Expected expired row to restart at version 1, got %v", v)
+		}
+	})
+	t.Run("compare and set", func(t *testing.T) {
+		single.DeleteKey(context.Background(), "versioned", "cas")
+		err := single.CompareAndSet(context.Background(), "versioned", "cas", nil, "first", 0)
+		if err != nil {
+			t.Errorf("CompareAndSet of a new key failed: %v", err)
+		}
+		err = single.CompareAndSet(context.Background(), "versioned", "cas", nil, "again", 0)
+		if _, ok := err.(*ErrPreconditionFailed); !ok {
+			t.Errorf("Expected ErrPreconditionFailed for an existing key, got %v", err)
+		}
+		wrong := "FIRST"
+		err = single.CompareAndSet(context.Background(), "versioned", "cas", &wrong, "second", 0)
+		if _, ok := err.(*ErrPreconditionFailed); !ok {
+			t.Errorf("Expected ErrPreconditionFailed for a different value, got %v", err)
+		}
+		err = single.CompareAndDelete(context.Background(), "versioned", "cas", "first")
+		if err != nil {
+			t.Errorf("CompareAndDelete failed: %v", err)
+		}
+	})
+	t.Run("namespaces are values", func(t *testing.T) {
+		namespace := `odd"name; drop`
+		err := single.Set(context.Background(), namespace, "key", "value")
+		if err != nil {
+			t.Errorf("Set failed: %v", err)
+		}
+		if count, _ := single.CountKeys(context.Background(), namespace); count != 1 {
+			t.Errorf("Expected 1 key, got %v", count)
+		}
+		err = single.DeleteNamespace(context.Background(), namespace)
+		if err != nil {
+			t.Errorf("DeleteNamespace failed: %v", err)
+		}
+		if _, err := single.Get(context.Background(), namespace, "key"); err == nil {
+			t.Errorf("Expected key deleted with the namespace")
+		}
+	})
+	t.Run("transaction", func(t *testing.T) {
+		testTransaction(t, single, "transaction")
+	})
+	t.Run("keys page", func(t *testing.T) {
+		testKeysPage(t, single, "paged")
+	})
+	single.Close()
+	legacy.Init()
+	for _, namespace := range []string{"upgrade_ns", "upgrade_empty"} {
+		legacy.DeleteNamespace(context.Background(), namespace)
+	}
+	legacy.Close()
+}
@@ -2,6 +2,7 @@ package main
 
 import (
 	"context"
+	"errors"
 	"flag"
 	"fmt"
 	"io"
@@ -14,6 +15,7 @@ import (
 	"syscall"
 	"time"
 
+	"github.com/SimonStiil/keyvaluedatabase/rest"
 	"github.com/fsnotify/fsnotify"
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/client_golang/prometheus/promauto"
@@ -25,6 +27,14 @@ var (
 	generate       string
 	test           string
 	configFileName string
+	rotate         bool
+	migrate        string
+	dryRun         bool
+	exportFile     string
+	importFile     string
+	archiveFormat  string
+	importMode     string
+	archiveFilter  ArchiveFilter
 	requests       = promauto.NewCounterVec(prometheus.CounterOpts{
 		Name: "http_endpoint_requests_count",
 		Help: "The amount of requests to an endpoint",
@@ -36,6 +46,24 @@ var (
 		Help: "The amount of requests for a certain key",
 	}, []string{"key", "namespace", "method", "error"},
 	)
+	backupSnapshots = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "backup_snapshots_count",
+		Help: "The amount of snapshots taken by outcome, success or failure",
+	}, []string{"outcome"},
+	)
+	backupDuration = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "backup_snapshot_duration_seconds",
+		Help: "The time the last snapshot took",
+	})
+	_ = promauto.NewGaugeFunc(prometheus.GaugeOpts{
+		Name: "backup_snapshot_age_seconds",
+		Help: "The time since the newest successful snapshot, 0 before the first snapshot",
+	}, func() float64 {
+		if last := lastSnapshot.Load(); last > 0 {
+			return time.Since(time.Unix(last, 0)).Seconds()
+		}
+		return 0
+	})
 	logger      *slog.Logger
 	debugLogger *slog.Logger
 	logFile     *os.File
@@ -47,13 +75,25 @@ type ConfigType struct {
 	Port                     string           `mapstructure:"port"`
 	DatabaseType             string           `mapstructure:"databaseType"`
 	Users                    []ConfigUser     `mapstructure:"users"`
+	Roles                    ConfigRoles      `mapstructure:"roles"`
+	Groups                   []ConfigGroup    `mapstructure:"groups"`
 	MTLS                     MTLSConfig       `mapstructure:"mtls"`
 	TrustedProxies           []string         `mapstructure:"trustedProxies"`
+	PasswordCacheTTL         time.Duration    `mapstructure:"passwordCacheTTL"`
+	RequestTimeout           time.Duration    `mapstructure:"requestTimeout"`
 	PublicReadableNamespaces []string         `mapstructure:"publicReadableNamespaces"`
 	Redis                    ConfigRedis      `mapstructure:"redis"`
 	Mysql                    ConfigMysql      `mapstructure:"mysql"`
 	Postgres                 ConfigPostgres   `mapstructure:"postgres"`
+	Bolt                     ConfigBolt       `mapstructure:"bolt"`
+	Backup                   ConfigBackup     `mapstructure:"backup"`
+	Yaml                     ConfigYaml       `mapstructure:"yaml"`
 	Prometheus               ConfigPrometheus `mapstructure:"prometheus"`
+	Expiry                   ConfigExpiry     `mapstructure:"expiry"`
+	History                  ConfigHistory    `mapstructure:"history"`
+	Encryption               ConfigEncryption `mapstructure:"encryption"`
+	Audit                    ConfigAudit      `mapstructure:"audit"`
+	JWT                      ConfigJWT        `mapstructure:"jwt"`
 }
 type ConfigLogging struct {
 	Level  string `mapstructure:"level"`
@@ -66,11 +106,15 @@ type ConfigUser struct {
 	Password       string                 `mapstructure:"password"`
 	Permissionsset []ConfigPermissionsset `mapstructure:"permissionsset"`
 	Hosts          []string               `mapstructure:"hosts"`
+	Admin          bool                   `mapstructure:"admin"`
+	Roles          []string               `mapstructure:"roles"`
 }
 
 type ConfigPermissionsset struct {
 	Namespaces  []string          `mapstructure:"namespaces"`
+	Keys        []string          `mapstructure:"keys"`
 	Permissions ConfigPermissions `mapstructure:"permissions"`
+	Deny        bool              `mapstructure:"deny"`
 }
 
 type ConfigPermissions struct {
@@ -83,6 +127,14 @@ func (perm *ConfigPermissions) globalAllowed() bool {
 	return !perm.List && !perm.Read && !perm.Write
 }
 
+type ConfigExpiry struct {
+	ReaperInterval time.Duration `mapstructure:"reaperInterval"`
+}
+
+type ConfigHistory struct {
+	Versions int `mapstructure:"versions"`
+}
+
 type ConfigPrometheus struct {
 	Enabled  bool   `mapstructure:"enabled"`
 	Endpoint string `mapstructure:"endpoint"`
@@ -112,12 +164,22 @@ func ConfigRead(configFileName string, configOutput *ConfigType) *viper.Viper {
 	MariaDBGetDefaults(configReader)
 	RedisDBGetDefaults(configReader)
 	PostgresGetDefaults(configReader)
+	BoltDBGetDefaults(configReader)
+	YamlDBGetDefaults(configReader)
+	BackupGetDefaults(configReader)
+	EncryptionGetDefaults(configReader)
+	AuditGetDefaults(configReader)
+	JWTGetDefaults(configReader)
 	configReader.SetDefault("logging.level", "Debug")
 	configReader.SetDefault("logging.format", "text")
 	configReader.SetDefault("port", 8080)
 	configReader.SetDefault("databaseType", "yaml")
+	configReader.SetDefault("passwordCacheTTL", "5m")
+	configReader.SetDefault("requestTimeout", "30s")
 	configReader.SetDefault("prometheus.enabled", true)
 	configReader.SetDefault("prometheus.endpoint", "/system/metrics")
+	configReader.SetDefault("expiry.reaperInterval", "1m")
+	configReader.SetDefault("history.versions", 10)
 	configReader.SetDefault("mtls.enabled", false)
 	configReader.SetDefault("mtls.port", 8443)
 	configReader.SetDefault("mtls.certificate", "server.crt")
@@ -140,7 +202,21 @@ func ConfigRead(configFileName string, configOutput *ConfigType) *viper.Viper {
 func SetupConfigWatcher(logger *slog.Logger, configReader *viper.Viper, App *Application) {
 	configReader.OnConfigChange(func(e fsnotify.Event) {
 		logger.Info(fmt.Sprintf("Config file changed: %v", e.Name))
-		App.Auth.LoadConfig(App.Config)
+		defer func() {
+			if r := recover(); r != nil {
+				logger.Error("Unable to reload users, keeping previous configuration", "function", "SetupConfigWatcher", "error", r)
+			}
+		}()
+		config := ConfigType{}
+		err := configReader.Unmarshal(&config)
+		if err != nil {
+			logger.Error("Unable to read changed config", "function", "SetupConfigWatcher", "error", err)
+			return
+		}
+		App.Auth.LoadConfig(config)
+		App.Config.Users = config.Users
+		App.Config.Roles = config.Roles
+		App.Config.Groups = config.Groups
 	})
 	configReader.WatchConfig()
 }
@@ -205,11 +281,58 @@ func setupTestlogging() {
 	debugLogger = logger
 }
 
+// NewDatabase returns the backend of databaseType configured by config, nil for unknown types and layouts
+func NewDatabase(databaseType string, config *ConfigType) Database {
+	switch databaseType {
+	case "redis":
+		logger.Info("Using Redis DB", "function", "NewDatabase")
+		return &RedisDatabase{Config: &config.Redis}
+	case "mysql":
+		logger.Info("Using Maria DB", "function", "NewDatabase", "layout", config.Mysql.Layout)
+		switch config.Mysql.Layout {
+		case LayoutTable:
+			return &MariaDatabase{Config: &config.Mysql}
+		case LayoutSingle:
+			return &MariaSingleTableDatabase{MariaDatabase: &MariaDatabase{Config: &config.Mysql}}
+		}
+	case "postgres":
+		logger.Info("Using Postgres DB", "function", "NewDatabase", "layout", config.Postgres.Layout)
+		switch config.Postgres.Layout {
+		case LayoutTable:
+			return &PostgresDatabase{Config: &config.Postgres}
+		case LayoutSingle:
+			return &PostgresSingleTableDatabase{PostgresDatabase: &PostgresDatabase{Config: &config.Postgres}}
+		}
+	case "bolt":
+		logger.Info("Using Bolt DB", "function", "NewDatabase", "path", config.Bolt.Path)
+		return &BoltDatabase{Config: &config.Bolt}
+	case "yaml":
+		logger.Info("Using Yaml DB (no Redis or Mysql configuration)", "function", "NewDatabase", "path", config.Yaml.Path)
+		return &YamlDatabase{DatabaseName: config.Yaml.Path, FlushInterval: config.Yaml.FlushInterval}
+	}
+	return nil
+}
+
 // https://medium.com/mercadolibre-tech/go-language-relational-databases-and-orms-682a5fd3bbb6
 func main() {
 	flag.StringVar(&generate, "generate", "", "Generate an encrypted password to use for basic auth")
 	flag.StringVar(&test, "test", "", "Test a base64hash versus a password")
 	flag.StringVar(&configFileName, "config", "config", "Use a different config file name")
+	flag.BoolVar(&rotate, "rotate", false, "Rotate encryption keys and re-encrypt all values, then exit")
+	flag.StringVar(&migrate, "migrate", "", "Copy all namespaces and keys from databaseType to the given database type, then exit")
+	flag.BoolVar(&dryRun, "dry-run", false, "With -migrate, only report what would be copied")
+	flag.StringVar(&exportFile, "export", "", "Export all namespaces and keys to the file, then exit")
+	flag.StringVar(&importFile, "import", "", "Import namespaces and keys from a file written by -export, then exit")
+	flag.StringVar(&archiveFormat, "format", string(rest.ArchiveJSONLines), "Format of -export, jsonl or tar")
+	flag.StringVar(&importMode, "mode", string(rest.ImportMerge), "How -import handles existing keys, merge, overwrite or fail")
+	flag.Func("namespace", "Only -export namespaces matching the pattern, can be repeated", func(pattern string) error {
+		archiveFilter.Namespaces = append(archiveFilter.Namespaces, pattern)
+		return nil
+	})
+	flag.Func("key", "Only -export keys matching the pattern, can be repeated", func(pattern string) error {
+		archiveFilter.Keys = append(archiveFilter.Keys, pattern)
+		return nil
+	})
 	flag.Parse()
 	signal.Notify(rotateSig, syscall.SIGHUP)
 	go logRotateHandler()
@@ -220,41 +343,163 @@ func main() {
 	App.Auth.AuthGenerate(generate, test)
 	//App.Auth.Init(App.Config)
 
-	switch App.Config.DatabaseType {
-	case "redis":
-		logger.Info("Using Redis DB", "function", "main")
-		App.DB = &RedisDatabase{Config: &App.Config.Redis}
-		App.DB.Init()
-	case "mysql":
-		logger.Info("Using Maria DB", "function", "main")
-		App.DB = &MariaDatabase{Config: &App.Config.Mysql}
-		App.DB.Init()
-	case "postgres":
-		logger.Info("Using Postgres DB", "function", "main")
-		App.DB = &PostgresDatabase{Config: &App.Config.Postgres}
-		App.DB.Init()
-	case "yaml":
-		logger.Info("Using Yaml DB (no Redis or Mysql configuration)", "function", "main")
-		App.DB = &YamlDatabase{}
-		App.DB.Init()
+	App.DB = NewDatabase(App.Config.DatabaseType, &App.Config)
+	if App.DB == nil {
+		logger.Error("Unknown databaseType or layout", "function", "main", "databaseType", App.Config.DatabaseType)
+		os.Exit(1)
+	}
+	expirer, hasExpirer := App.DB.(Expirer)
+	if App.Config.Encryption.Enabled {
+		provider, err := NewKeyProvider(App.Config.Encryption)
+		if err != nil {
+			logger.Error("Unable to load encryption key provider", "function", "main", "provider", App.Config.Encryption.Provider, "error", err)
+			os.Exit(1)
+		}
+		logger.Info("Encryption at rest enabled", "function", "main", "provider", App.Config.Encryption.Provider, "master", provider.CurrentKeyID())
+		App.DB = NewEncryptedDatabase(App.DB, provider)
+	}
+	err := App.DB.Init()
+	if err != nil {
+		var invalid *ErrInvalidConfig
+		if errors.As(err, &invalid) || rotate || migrate != "" || exportFile != "" || importFile != "" {
+			logger.Error("Unable to initialize database", "function", "main", "databaseType", App.Config.DatabaseType, "error", err)
+			os.Exit(1)
+		}
+		// Requests answer 503 Service Unavailable and /system/health is DOWN until Reconnect succeeds
+		logger.Error("Database unavailable, serving without it", "function", "main", "databaseType", App.Config.DatabaseType, "error", err)
+	}
+	if rotate {
+		encrypted, ok := App.DB.(*EncryptedDatabase)
+		if !ok {
+			logger.Error("Rotation requires encryption.enabled", "function", "main")
+			os.Exit(1)
+		}
+		count, err := encrypted.Rotate(context.Background())
+		App.DB.Close()
+		if err != nil {
+			logger.Error("Key rotation failed", "function", "main", "reencrypted", count, "error", err)
+			os.Exit(1)
+		}
+		logger.Info("Key rotation done", "function", "main", "reencrypted", count)
+		os.Exit(0)
+	}
+	if migrate != "" {
+		target := NewDatabase(migrate, &App.Config)
+		if target == nil || migrate == App.Config.DatabaseType {
+			logger.Error("Migration requires a database type other than databaseType", "function", "main", "source", App.Config.DatabaseType, "target", migrate)
+			os.Exit(1)
+		}
+		if encrypted, ok := App.DB.(*EncryptedDatabase); ok {
+			target = NewEncryptedDatabase(target, encrypted.Provider)
+		}
+		err = target.Init()
+		if err != nil {
+			logger.Error("Unable to initialize migration target", "function", "main", "target", migrate, "error", err)
+			os.Exit(1)
+		}
+		migration := &Migration{Source: App.DB, Target: target, DryRun: dryRun}
+		result, err := migration.Run(context.Background())
+		target.Close()
+		App.DB.Close()
+		if err != nil {
+			logger.Error("Migration failed", "function", "main", "source", App.Config.DatabaseType, "target", migrate, "namespaces", result.Namespaces, "keys", result.Keys, "error", err)
+			os.Exit(1)
+		}
+		logger.Info("Migration done", "function", "main", "source", App.Config.DatabaseType, "target", migrate, "namespaces", result.Namespaces, "keys", result.Keys, "skipped", result.Skipped, "dryRun", dryRun)
+		os.Exit(0)
+	}
+	if exportFile != "" {
+		file, err := os.OpenFile(exportFile, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+		if err != nil {
+			logger.Error("Unable to create export file", "function", "main", "file", exportFile, "error", err)
+			os.Exit(1)
+		}
+		options := ArchiveOptions{Format: rest.ArchiveFormat(archiveFormat), Filter: archiveFilter, Passphrase: os.Getenv(BaseENVname + "_ARCHIVE_PASSPHRASE")}
+		count, err := Export(context.Background(), App.DB, file, options)
+		if err == nil {
+			err = file.Close()
+		}
+		App.DB.Close()
+		if err != nil {
+			logger.Error("Export failed", "function", "main", "file", exportFile, "exported", count, "error", err)
+			os.Exit(1)
+		}
+		logger.Info("Export done", "function", "main", "file", exportFile, "keys", count, "format", options.Format, "encrypted", options.Passphrase != "")
+		os.Exit(0)
+	}
+	if importFile != "" {
+		file, err := os.Open(importFile)
+		if err != nil {
+			logger.Error("Unable to open import file", "function", "main", "file", importFile, "error", err)
+			os.Exit(1)
+		}
+		result, err := Import(context.Background(), App.DB, file, rest.ImportMode(importMode), os.Getenv(BaseENVname+"_ARCHIVE_PASSPHRASE"))
+		file.Close()
+		App.DB.Close()
+		if err == nil && len(result.Conflicts) > 0 {
+			err = fmt.Errorf("conflicting keys %v", strings.Join(result.Conflicts, ", "))
+		}
+		if err != nil {
+			logger.Error("Import failed", "function", "main", "file", importFile, "imported", result.Imported, "error", err)
+			os.Exit(1)
+		}
+		logger.Info("Import done", "function", "main", "file", importFile, "namespaces", result.Namespaces, "imported", result.Imported, "skipped", result.Skipped)
+		os.Exit(0)
+	}
+	if hasExpirer {
+		reaper := &ExpiryReaper{DB: expirer, Interval: App.Config.Expiry.ReaperInterval}
+		reaper.Start()
+		defer reaper.Stop()
 	}
 	App.Count = &Counter{}
 	App.Count.Init(App.DB)
+	if !App.DB.IsInitialized() {
+		go Reconnect(App.DB, time.Second, func() { App.Count.Init(App.DB) })
+	}
 	App.Auth.Init(App.Config)
+	App.Auth.Tokens = &TokenStore{DB: App.DB}
+	if App.Config.JWT.Enabled {
+		var err error
+		App.Auth.JWT, err = NewJWTVerifier(App.Config.JWT)
+		if err != nil {
+			logger.Error("Unable to setup jwt authentication", "function", "main", "error", err)
+			os.Exit(1)
+		}
+	}
 	SetupConfigWatcher(logger, configReader, App)
 	App.APIEndpoints = []API{&Systemv1{}, &APIv1{}}
+	if App.Config.Audit.Enabled {
+		var err error
+		App.Audit, err = NewAuditor(App.Config.Audit)
+		if err != nil {
+			logger.Error("Unable to start audit log", "function", "main", "error", err)
+			os.Exit(1)
+		}
+		defer App.Audit.Close()
+	}
+	if App.Config.Backup.Enabled {
+		var err error
+		App.Backups, err = NewBackups(App.Config.Backup, App.DB)
+		if err != nil {
+			logger.Error("Unable to setup backups", "function", "main", "error", err)
+			os.Exit(1)
+		}
+		logger.Info("Backups enabled", "function", "main", "schedule", App.Config.Backup.Schedule, "directory", App.Config.Backup.Directory)
+		App.Backups.Start()
+		defer App.Backups.Stop()
+	}
 	defer App.DB.Close()
 	if App.Config.Prometheus.Enabled {
 		logger.Info(fmt.Sprintf("Metrics enabled at %v", App.Config.Prometheus.Endpoint), "function", "main")
 		http.Handle(App.Config.Prometheus.Endpoint, promhttp.Handler())
 	}
 	regularServerMux := http.NewServeMux()
-	regularServerMux.HandleFunc("/", http.HandlerFunc(App.RootControllerV1))
+	regularServerMux.Handle("/", App.Recover(http.HandlerFunc(App.RootControllerV1)))
 
 	logger.Info("users does not contain any entries, password auth disabled", "function", "main")
 	if App.Config.MTLS.Enabled {
 		mtlsServerMux := http.NewServeMux()
-		mtlsServerMux.HandleFunc("/", http.HandlerFunc(App.RootControllerV1))
+		mtlsServerMux.Handle("/", App.Recover(http.HandlerFunc(App.RootControllerV1)))
 		go App.ServeHTTP(regularServerMux)
 		go App.ServeHTTPMTLS(mtlsServerMux)
 		sigInterruptChannel := make(chan os.Signal, 1)
@@ -3,6 +3,8 @@ package main
 import (
 	"encoding/json"
 	"net/http"
+	"strconv"
+	"time"
 
 	"github.com/SimonStiil/keyvaluedatabase/rest"
 )
@@ -30,10 +32,39 @@ func (Api *Systemv1) ApiController(w http.ResponseWriter, request *RequestParame
 			requests.WithLabelValues(request.orgRequest.URL.EscapedPath(), request.Method).Inc()
 		}
 		reply := rest.HealthV1{Status: "UP", Requests: int(App.Count.PeakCount())}
-		debugLogger.Debug("HealthRequest")
+		status := http.StatusOK
+		if !App.DB.IsInitialized() {
+			// Init failed, every database request answers 503 Service Unavailable
+			reply.Status, reply.Database = "DOWN", "DOWN"
+			status = http.StatusServiceUnavailable
+		} else if checker, ok := App.DB.(HealthChecker); ok {
+			reply.Database = "UP"
+			if err := checker.Health(request.Context()); err != nil {
+				request.Logger.Log.Error("Database health check failed", "error", err)
+				reply.Status, reply.Database = "DOWN", "DOWN"
+				status = http.StatusServiceUnavailable
+			}
+		}
+		debugLogger.Debug("HealthRequest", "status", reply.Status)
 		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(status)
 		json.NewEncoder(w).Encode(reply)
 		return
+	case "audit":
+		Api.audit(w, request)
+		return
+	case "tokens":
+		Api.tokens(w, request)
+		return
+	case "export":
+		Api.export(w, request)
+		return
+	case "import":
+		Api.importArchive(w, request)
+		return
+	case "backups":
+		Api.backups(w, request)
+		return
 	}
 	http.NotFoundHandler().ServeHTTP(w, request.orgRequest)
 }
@@ -50,6 +81,261 @@ func (api *Systemv1) Permissions(request *RequestParameters) *ConfigPermissions
 		return &ConfigPermissions{Read: true, Write: true, List: true}
 	}
 }
+func (Api *Systemv1) audit(w http.ResponseWriter, request *RequestParameters) {
+	debugLogger := request.Logger.Ext.With("function", "audit")
+	if request.Authentication.User == nil || !request.Authentication.User.Admin {
+		debugLogger.Debug("Audit query by non admin user")
+		App.WriteStatusMessage(http.StatusForbidden, w, request)
+		return
+	}
+	if request.Method != "GET" {
+		App.WriteStatusMessage(http.StatusMethodNotAllowed, w, request)
+		return
+	}
+	if App.Audit == nil || App.Audit.Querier == nil {
+		debugLogger.Debug("Audit log not enabled or not queryable")
+		App.WriteStatusMessage(http.StatusNotFound, w, request)
+		return
+	}
+	query := request.orgRequest.URL.Query()
+	filter := AuditFilter{
+		User:      query.Get("user"),
+		Namespace: query.Get("namespace"),
+		Key:       query.Get("key"),
+		Action:    query.Get("action"),
+		Outcome:   query.Get("outcome"),
+		Limit:     100,
+	}
+	var err error
+	if limit := query.Get("limit"); limit != "" {
+		filter.Limit, err = strconv.Atoi(limit)
+	}
+	if since := query.Get("since"); since != "" && err == nil {
+		filter.Since, err = time.Parse(time.RFC3339, since)
+	}
+	if until := query.Get("until"); until != "" && err == nil {
+		filter.Until, err = time.Parse(time.RFC3339, until)
+	}
+	if err != nil {
+		debugLogger.Debug("Unable to parse audit query", "error", err)
+		App.WriteStatusMessage(http.StatusBadRequest, w, request)
+		return
+	}
+	events, err := App.Audit.Querier.Query(filter)
+	if err != nil {
+		request.Logger.Log.Error("Unable to query audit log", "error", err)
+		App.WriteStatusMessage(http.StatusInternalServerError, w, request)
+		return
+	}
+	debugLogger.Debug("AuditRequest", "events", len(events))
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(events)
+}
+
+// tokens handles /system/tokens (GET list, POST mint) and /system/tokens/<id> (GET, DELETE revoke)
+func (Api *Systemv1) tokens(w http.ResponseWriter, request *RequestParameters) {
+	debugLogger := request.Logger.Ext.With("function", "tokens")
+	if request.Authentication.User == nil || !request.Authentication.User.Admin {
+		debugLogger.Debug("Token request by non admin user")
+		App.WriteStatusMessage(http.StatusForbidden, w, request)
+		return
+	}
+	if App.Auth.Tokens == nil {
+		App.WriteStatusMessage(http.StatusNotFound, w, request)
+		return
+	}
+	var reply any
+	status := http.StatusOK
+	var err error
+	switch {
+	case request.Method == "GET" && request.Key == "":
+		reply, err = App.Auth.Tokens.List(request.Context(), request.orgRequest.URL.Query().Get("user"))
+	case request.Method == "GET":
+		var token *APIToken
+		token, err = App.Auth.Tokens.Get(request.Context(), request.Key)
+		if err == nil {
+			reply = token.TokenV1
+		}
+	case request.Method == "POST" && request.Key == "":
+		tokenRequest := rest.TokenRequestV1{}
+		err = json.NewDecoder(request.orgRequest.Body).Decode(&tokenRequest)
+		if err != nil {
+			debugLogger.Debug("Unable to decode token request", "error", err)
+			App.WriteStatusMessage(http.StatusBadRequest, w, request)
+			return
+		}
+		if _, ok := App.Auth.Users[tokenRequest.User]; !ok {
+			debugLogger.Debug("Token requested for unknown user", "user", tokenRequest.User)
+			App.WriteStatusMessage(http.StatusBadRequest, w, request)
+			return
+		}
+		reply, err = App.Auth.Tokens.Mint(request.Context(), tokenRequest)
+		status = http.StatusCreated
+	case request.Method == "DELETE" && request.Key != "":
+		reply, err = App.Auth.Tokens.Revoke(request.Context(), request.Key)
+	default:
+		App.WriteStatusMessage(http.StatusMethodNotAllowed, w, request)
+		return
+	}
+	if err != nil {
+		debugLogger.Debug("Token request failed", "error", err)
+		App.WriteErrorMessage(err, w, request)
+		return
+	}
+	debugLogger.Debug("TokensRequest", "status", status)
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(reply)
+}
+
+// export handles GET /system/export, the archive is streamed while the namespaces are read
+func (Api *Systemv1) export(w http.ResponseWriter, request *RequestParameters) {
+	debugLogger := request.Logger.Ext.With("function", "export")
+	if request.Authentication.User == nil || !request.Authentication.User.Admin {
+		debugLogger.Debug("Export by non admin user")
+		App.WriteStatusMessage(http.StatusForbidden, w, request)
+		return
+	}
+	if request.Method != "GET" {
+		App.WriteStatusMessage(http.StatusMethodNotAllowed, w, request)
+		return
+	}
+	options, err := ArchiveOptionsFromQuery(request.orgRequest.URL.Query())
+	if err != nil {
+		debugLogger.Debug("Unable to parse export query", "error", err)
+		App.WriteStatusMessage(http.StatusBadRequest, w, request)
+		return
+	}
+	options.Passphrase = request.orgRequest.Header.Get(rest.HeaderArchivePassphrase)
+	contentType := "application/x-ndjson"
+	if options.Format == rest.ArchiveTar {
+		contentType = "application/x-tar"
+	}
+	fileName := "kvdb-export." + string(options.Format)
+	if options.Passphrase != "" {
+		contentType = "application/octet-stream"
+		fileName += ".enc"
+	}
+	w.Header().Set("Content-Type", contentType)
+	w.Header().Set("Content-Disposition", `attachment; filename="`+fileName+`"`)
+	// Archives take as long as the database is large, they are only cancelled when the client disconnects
+	count, err := Export(request.orgRequest.Context(), App.DB, w, options)
+	if err != nil {
+		// The status has been sent with the first namespace, the archive is incomplete
+		request.Logger.Log.Error("Export failed", "exported", count, "error", err)
+		return
+	}
+	debugLogger.Debug("ExportRequest", "keys", count, "format", options.Format, "encrypted", options.Passphrase != "")
+}
+
+// importArchive handles POST /system/import with an archive from /system/export as body
+func (Api *Systemv1) importArchive(w http.ResponseWriter, request *RequestParameters) {
+	debugLogger := request.Logger.Ext.With("function", "importArchive")
+	if request.Authentication.User == nil || !request.Authentication.User.Admin {
+		debugLogger.Debug("Import by non admin user")
+		App.WriteStatusMessage(http.StatusForbidden, w, request)
+		return
+	}
+	if request.Method != "POST" {
+		App.WriteStatusMessage(http.StatusMethodNotAllowed, w, request)
+		return
+	}
+	mode := rest.ImportMode(request.orgRequest.URL.Query().Get("mode"))
+	if mode == "" {
+		mode = rest.ImportMerge
+	}
+	result, err := Import(request.orgRequest.Context(), App.DB, request.orgRequest.Body, mode, request.orgRequest.Header.Get(rest.HeaderArchivePassphrase))
+	if err != nil {
+		debugLogger.Debug("Unable to import archive", "error", err, "imported", result.Imported)
+		App.WriteErrorMessage(err, w, request)
+		return
+	}
+	status := http.StatusOK
+	if len(result.Conflicts) > 0 {
+		status = http.StatusConflict
+	}
+	debugLogger.Debug("ImportRequest", "status", status, "mode", mode, "imported", result.Imported, "skipped", result.Skipped, "conflicts", len(result.Conflicts))
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(result)
+}
+
+// backups handles /system/backups (GET list, POST take a snapshot) and POST /system/backups/<name>/restore
+func (Api *Systemv1) backups(w http.ResponseWriter, request *RequestParameters) {
+	debugLogger := request.Logger.Ext.With("function", "backups")
+	if request.Authentication.User == nil || !request.Authentication.User.Admin {
+		debugLogger.Debug("Backup request by non admin user")
+		App.WriteStatusMessage(http.StatusForbidden, w, request)
+		return
+	}
+	if App.Backups == nil {
+		debugLogger.Debug("Backups not enabled")
+		App.WriteStatusMessage(http.StatusNotFound, w, request)
+		return
+	}
+	var reply any
+	status := http.StatusOK
+	var err error
+	switch {
+	case request.Method == "GET" && request.Key == "":
+		reply, err = App.Backups.List()
+	case request.Method == "POST" && request.Key == "":
+		reply, err = App.Backups.Snapshot(request.orgRequest.Context())
+		status = http.StatusCreated
+	case request.Method == "POST" && request.Resource == "restore":
+		mode := rest.ImportMode(request.orgRequest.URL.Query().Get("mode"))
+		if mode == "" {
+			mode = rest.ImportOverwrite
+		}
+		var result rest.ImportResultV1
+		result, err = App.Backups.Restore(request.orgRequest.Context(), request.Key, mode)
+		if err == nil && len(result.Conflicts) > 0 {
+			status = http.StatusConflict
+		}
+		reply = result
+	default:
+		App.WriteStatusMessage(http.StatusMethodNotAllowed, w, request)
+		return
+	}
+	if err != nil {
+		debugLogger.Debug("Backup request failed", "error", err)
+		App.WriteErrorMessage(err, w, request)
+		return
+	}
+	debugLogger.Debug("BackupsRequest", "status", status)
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(reply)
+}
+
+func (Api *Systemv1) AuditAction(request *RequestParameters) string {
+	switch request.Namespace {
+	case "audit":
+		return "audit-query"
+	case "export":
+		return "export"
+	case "import":
+		return "import"
+	case "backups":
+		switch {
+		case request.Resource == "restore":
+			return "backup-restore"
+		case request.Method == "POST":
+			return "backup-snapshot"
+		}
+		return "backup-list"
+	case "tokens":
+		switch request.Method {
+		case "POST":
+			return "token-mint"
+		case "DELETE":
+			return "token-revoke"
+		}
+		return "token-list"
+	}
+	return ""
+}
+
 func InitSystemv1(Prometheus http.Handler) *Systemv1 {
 	return &Systemv1{PrometheusHandler: Prometheus}
 }
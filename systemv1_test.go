@@ -1,6 +1,7 @@
 package main
 
 import (
+	"context"
 	"encoding/json"
 	"errors"
 	"net/http"
@@ -50,4 +51,47 @@ func TestSystemV1Api(t *testing.T) {
 			t.Errorf(".Requests got %q, want %q", healthReply.Requests, greetinWanted.Requests)
 		}
 	})
+	t.Run("Health database down", func(t *testing.T) {
+		yaml := App.DB.(*YamlDatabase)
+		defer func() { App.DB = yaml }()
+		checked := &healthCheckedDatabase{YamlDatabase: yaml}
+		App.DB = checked
+		health := func() (int, rest.HealthV1) {
+			request, _ := http.NewRequest(http.MethodGet, "/system/health", nil)
+			response := httptest.NewRecorder()
+			api.ApiController(response, GetRequestParameters(request, 0))
+			var reply rest.HealthV1
+			json.Unmarshal(response.Body.Bytes(), &reply)
+			return response.Code, reply
+		}
+		if code, reply := health(); code != http.StatusOK || reply.Database != "UP" {
+			t.Errorf("Expected 200 and database UP, got %v %+v", code, reply)
+		}
+		checked.err = errors.New("connection refused")
+		if code, reply := health(); code != http.StatusServiceUnavailable || reply.Status != "DOWN" || reply.Database != "DOWN" {
+			t.Errorf("Expected 503 and DOWN, got %v %+v", code, reply)
+		}
+	})
+	t.Run("Health database not initialized", func(t *testing.T) {
+		db := App.DB
+		defer func() { App.DB = db }()
+		App.DB = &YamlDatabase{DatabaseName: "testdb-missing.yaml"}
+		request, _ := http.NewRequest(http.MethodGet, "/system/health", nil)
+		response := httptest.NewRecorder()
+		api.ApiController(response, GetRequestParameters(request, 0))
+		var reply rest.HealthV1
+		json.Unmarshal(response.Body.Bytes(), &reply)
+		if response.Code != http.StatusServiceUnavailable || reply.Status != "DOWN" || reply.Database != "DOWN" {
+			t.Errorf("Expected 503 and DOWN, got %v %+v", response.Code, reply)
+		}
+	})
+}
+
+type healthCheckedDatabase struct {
+	*YamlDatabase
+	err error
+}
+
+func (DB *healthCheckedDatabase) Health(ctx context.Context) error {
+	return DB.err
 }
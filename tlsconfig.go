@@ -0,0 +1,48 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"os"
+)
+
+// ConfigTLS is the TLS configuration for connecting to a database server
+type ConfigTLS struct {
+	Enabled            bool   `mapstructure:"enabled"`
+	CACertificate      string `mapstructure:"caCertificate"`      // CA to verify the server with, system CAs if empty
+	Certificate        string `mapstructure:"certificate"`        // Client certificate, for servers requiring client certificates
+	Key                string `mapstructure:"key"`                // Key of the client certificate
+	ServerName         string `mapstructure:"serverName"`         // Name to verify the server certificate against, the host if empty
+	InsecureSkipVerify bool   `mapstructure:"insecureSkipVerify"` // Do not verify the server certificate
+}
+
+// ClientConfig returns the tls.Config to connect with, nil when TLS is not enabled
+func (Config *ConfigTLS) ClientConfig() (*tls.Config, error) {
+	if !Config.Enabled {
+		return nil, nil
+	}
+	tlsConfig := &tls.Config{
+		MinVersion:         tls.VersionTLS12,
+		ServerName:         Config.ServerName,
+		InsecureSkipVerify: Config.InsecureSkipVerify,
+	}
+	if Config.CACertificate != "" {
+		caCert, err := os.ReadFile(Config.CACertificate)
+		if err != nil {
+			return nil, err
+		}
+		tlsConfig.RootCAs = x509.NewCertPool()
+		if !tlsConfig.RootCAs.AppendCertsFromPEM(caCert) {
+			return nil, errors.New("no certificates found in " + Config.CACertificate)
+		}
+	}
+	if Config.Certificate != "" || Config.Key != "" {
+		certificate, err := tls.LoadX509KeyPair(Config.Certificate, Config.Key)
+		if err != nil {
+			return nil, err
+		}
+		tlsConfig.Certificates = []tls.Certificate{certificate}
+	}
+	return tlsConfig, nil
+}
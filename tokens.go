@@ -0,0 +1,186 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	b64 "encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/SimonStiil/keyvaluedatabase/rest"
+)
+
+const (
+	tokenPrefix    = "kvdb"
+	tokenKeyPrefix = "token/"
+)
+
+// APIToken is stored in the system namespace, only a hash of the secret is kept
+type APIToken struct {
+	rest.TokenV1
+	Hash string `json:"hash"`
+}
+
+func (Token *APIToken) Expired() bool {
+	return Token.Expires != nil && !time.Now().Before(*Token.Expires)
+}
+
+// ScopeUser returns the permissions of the token as a User, tokens never exceed the permissions of their user
+func (Token *APIToken) ScopeUser() *User {
+	sets := []ConfigPermissionsset{}
+	for _, scope := range Token.Scopes {
+		sets = append(sets, ConfigPermissionsset{
+			Namespaces:  scope.Namespaces,
+			Keys:        scope.Keys,
+			Permissions: ConfigPermissions{Read: scope.Read, Write: scope.Write, List: scope.List}})
+	}
+	user := &User{}
+	user.SetPermissions(sets)
+	return user
+}
+
+// TokenStore keeps API tokens as "token/<id>" in the system namespace.
+// Tokens are handed out as kvdb_<id>_<secret>.
+type TokenStore struct {
+	DB Database
+}
+
+func tokenHash(secret string) string {
+	hash := sha256.Sum256([]byte(secret))
+	return b64.StdEncoding.EncodeToString(hash[:])
+}
+
+func parseBearerToken(bearer string) (string, string, error) {
+	parts := strings.SplitN(bearer, "_", 3)
+	if len(parts) != 3 || parts[0] != tokenPrefix || parts[1] == "" || parts[2] == "" {
+		return "", "", &ErrMalformRequest{Value: "bearer token"}
+	}
+	return parts[1], parts[2], nil
+}
+
+func (Store *TokenStore) Mint(ctx context.Context, request rest.TokenRequestV1) (*rest.TokenV1, error) {
+	if request.User == "" || request.TTL < 0 {
+		return nil, &ErrMalformRequest{Value: "token request"}
+	}
+	id := make([]byte, 8)
+	secret := make([]byte, 32)
+	_, err := rand.Read(id)
+	if err != nil {
+		return nil, err
+	}
+	_, err = rand.Read(secret)
+	if err != nil {
+		return nil, err
+	}
+	encodedSecret := b64.RawURLEncoding.EncodeToString(secret)
+	token := &APIToken{
+		TokenV1: rest.TokenV1{
+			ID:          hex.EncodeToString(id),
+			User:        request.User,
+			Description: request.Description,
+			Scopes:      request.Scopes,
+			Created:     time.Now().UTC(),
+		},
+		Hash: tokenHash(encodedSecret),
+	}
+	ttl := time.Duration(request.TTL) * time.Second
+	if ttl > 0 {
+		expires := token.Created.Add(ttl)
+		token.Expires = &expires
+	}
+	err = Store.save(ctx, token, ttl)
+	if err != nil {
+		return nil, err
+	}
+	reply := token.TokenV1
+	reply.Token = fmt.Sprintf("%v_%v_%v", tokenPrefix, token.ID, encodedSecret)
+	return &reply, nil
+}
+
+func (Store *TokenStore) save(ctx context.Context, token *APIToken, ttl time.Duration) error {
+	encoded, err := json.Marshal(token)
+	if err != nil {
+		return err
+	}
+	return Store.DB.SetWithTTL(ctx, Store.DB.GetSystemNS(), tokenKeyPrefix+token.ID, string(encoded), ttl)
+}
+
+func (Store *TokenStore) Get(ctx context.Context, id string) (*APIToken, error) {
+	encoded, err := Store.DB.Get(ctx, Store.DB.GetSystemNS(), tokenKeyPrefix+id)
+	if err != nil {
+		return nil, err
+	}
+	token := &APIToken{}
+	err = json.Unmarshal([]byte(encoded), token)
+	if err != nil {
+		return nil, err
+	}
+	return token, nil
+}
+
+// List returns all tokens, or the tokens of user if not empty
+func (Store *TokenStore) List(ctx context.Context, user string) (rest.TokenListV1, error) {
+	keys, err := Store.DB.Keys(ctx, Store.DB.GetSystemNS())
+	if err != nil {
+		return nil, err
+	}
+	tokens := rest.TokenListV1{}
+	for _, key := range keys {
+		if !strings.HasPrefix(key, tokenKeyPrefix) {
+			continue
+		}
+		token, err := Store.Get(ctx, strings.TrimPrefix(key, tokenKeyPrefix))
+		if err != nil {
+			if _, ok := err.(*ErrNotFound); ok {
+				continue
+			}
+			return nil, err
+		}
+		if user == "" || token.User == user {
+			tokens = append(tokens, token.TokenV1)
+		}
+	}
+	return tokens, nil
+}
+
+// Revoke marks the token revoked, it is kept until it expires so it stays visible in List
+func (Store *TokenStore) Revoke(ctx context.Context, id string) (*rest.TokenV1, error) {
+	token, err := Store.Get(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+	ttl, err := Store.DB.TTL(ctx, Store.DB.GetSystemNS(), tokenKeyPrefix+id)
+	if err != nil {
+		return nil, err
+	}
+	token.Revoked = true
+	err = Store.save(ctx, token, ttl)
+	if err != nil {
+		return nil, err
+	}
+	return &token.TokenV1, nil
+}
+
+// Verify returns the token for a bearer value if the secret matches and it is neither revoked nor expired
+func (Store *TokenStore) Verify(ctx context.Context, bearer string) (*APIToken, error) {
+	id, secret, err := parseBearerToken(bearer)
+	if err != nil {
+		return nil, err
+	}
+	token, err := Store.Get(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+	if subtle.ConstantTimeCompare([]byte(token.Hash), []byte(tokenHash(secret))) != 1 {
+		return nil, &ErrNotAllowed{Value: "token " + id}
+	}
+	if token.Revoked || token.Expired() {
+		return nil, &ErrNotAllowed{Value: "token " + id}
+	}
+	return token, nil
+}
@@ -0,0 +1,156 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/SimonStiil/keyvaluedatabase/rest"
+)
+
+func TestTokens(t *testing.T) {
+	setupTestlogging()
+	App = new(Application)
+	t.Run("Initialize DB for Tests", func(t *testing.T) {
+		fileName := "testdb.yaml"
+		err := os.Remove(fileName)
+		if err != nil && !errors.Is(err, os.ErrNotExist) {
+			t.Fatal(err)
+		}
+		config := ConfigType{}
+		ConfigRead("example-config", &config)
+		App.Auth = Auth{}
+		App.Auth.Init(config)
+		App.DB = &YamlDatabase{DatabaseName: fileName}
+		App.DB.Init()
+		App.Count = &Counter{}
+		App.Count.Init(App.DB)
+		App.Auth.Tokens = &TokenStore{DB: App.DB}
+		App.APIEndpoints = []API{&Systemv1{}, &APIv1{}}
+		user := App.Auth.Users["user"]
+		user.Admin = true
+		App.Auth.Users["user"] = user
+	})
+	send := func(method string, path string, body string, bearer string) *httptest.ResponseRecorder {
+		request, _ := http.NewRequest(method, path, strings.NewReader(body))
+		if bearer == "" {
+			request.SetBasicAuth("user", "password")
+		} else {
+			request.Header.Set("Authorization", "Bearer "+bearer)
+		}
+		request.RemoteAddr = "127.0.0.1:434"
+		response := httptest.NewRecorder()
+		App.RootControllerV1(response, request)
+		return response
+	}
+	var token rest.TokenV1
+	t.Run("Mint", func(t *testing.T) {
+		tokenRequest := `{"user": "user", "description": "ci", "ttl": 3600, "scopes": [{"namespaces": ["scoped"], "read": true}]}`
+		response := send(http.MethodPost, "/system/tokens", tokenRequest, "")
+		if response.Code != http.StatusCreated {
+			t.Fatalf(".Code got %v, want %v", response.Code, http.StatusCreated)
+		}
+		err := json.Unmarshal(response.Body.Bytes(), &token)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !strings.HasPrefix(token.Token, "kvdb_"+token.ID+"_") || token.Expires == nil {
+			t.Errorf("Unexpected token %+v", token)
+		}
+		response = send(http.MethodPost, "/system/tokens", `{"user": "nobody"}`, "")
+		if response.Code != http.StatusBadRequest {
+			t.Errorf(".Code got %v, want %v", response.Code, http.StatusBadRequest)
+		}
+	})
+	t.Run("Use token", func(t *testing.T) {
+		send(http.MethodPost, "/v1/scoped/key", "value", "")
+		send(http.MethodPost, "/v1/other/key", "value", "")
+		if code := send(http.MethodGet, "/v1/scoped/key", "", token.Token).Code; code != http.StatusOK {
+			t.Errorf("Read in scope .Code got %v, want %v", code, http.StatusOK)
+		}
+		if code := send(http.MethodPost, "/v1/scoped/key", "new", token.Token).Code; code != http.StatusUnauthorized {
+			t.Errorf("Write outside scope .Code got %v, want %v", code, http.StatusUnauthorized)
+		}
+		if code := send(http.MethodGet, "/v1/other/key", "", token.Token).Code; code != http.StatusUnauthorized {
+			t.Errorf("Read outside scope .Code got %v, want %v", code, http.StatusUnauthorized)
+		}
+		if code := send(http.MethodGet, "/system/tokens", "", token.Token).Code; code != http.StatusForbidden {
+			t.Errorf("Token admin access .Code got %v, want %v", code, http.StatusForbidden)
+		}
+		if code := send(http.MethodGet, "/v1/scoped/key", "", token.Token+"x").Code; code != http.StatusUnauthorized {
+			t.Errorf("Wrong secret .Code got %v, want %v", code, http.StatusUnauthorized)
+		}
+	})
+	t.Run("List", func(t *testing.T) {
+		response := send(http.MethodGet, "/system/tokens?user=user", "", "")
+		var tokens rest.TokenListV1
+		err := json.Unmarshal(response.Body.Bytes(), &tokens)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(tokens) != 1 || tokens[0].ID != token.ID || tokens[0].Token != "" {
+			t.Errorf("Unexpected token list %+v", tokens)
+		}
+		if strings.Contains(response.Body.String(), "hash") {
+			t.Errorf("Token hash returned in list %v", response.Body.String())
+		}
+	})
+	t.Run("Records not reachable through api", func(t *testing.T) {
+		wildcard := App.Auth.Users["user"]
+		wildcard.Admin = false
+		wildcard.SetPermissions([]ConfigPermissionsset{{Namespaces: []string{"*"}, Permissions: ConfigPermissions{Read: true, Write: true, List: true}}})
+		App.Auth.Users["wildcard"] = wildcard
+		defer delete(App.Auth.Users, "wildcard")
+		sendAs := func(method string, path string, body string) *httptest.ResponseRecorder {
+			request, _ := http.NewRequest(method, path, strings.NewReader(body))
+			request.SetBasicAuth("wildcard", "password")
+			request.RemoteAddr = "127.0.0.1:434"
+			response := httptest.NewRecorder()
+			App.RootControllerV1(response, request)
+			return response
+		}
+		system := App.DB.GetSystemNS()
+		forged := `{"id": "x", "user": "user", "hash": "forged"}`
+		for _, path := range []string{"/v1/" + system + "/token/x", "/v1/" + system + "/token", "/v1/" + system + "/datakeys", "/v1/" + system + "/" + migrateCheckpointKey} {
+			if code := sendAs(http.MethodPut, path, forged).Code; code != http.StatusForbidden {
+				t.Errorf("PUT %v .Code got %v, want %v", path, code, http.StatusForbidden)
+			}
+			if code := sendAs(http.MethodGet, path, "").Code; code != http.StatusForbidden {
+				t.Errorf("GET %v .Code got %v, want %v", path, code, http.StatusForbidden)
+			}
+		}
+		for _, path := range []string{"/v1/" + system, "/v1/" + system + "/*"} {
+			response := sendAs(http.MethodGet, path, "")
+			if response.Code != http.StatusOK || strings.Contains(response.Body.String(), tokenKeyPrefix+token.ID) {
+				t.Errorf("GET %v listed token records got %v %v", path, response.Code, response.Body.String())
+			}
+		}
+		if _, err := App.Auth.Tokens.Verify(context.Background(), "kvdb_x_"+strings.Repeat("a", 43)); err == nil {
+			t.Errorf("Forged token verified")
+		}
+	})
+	t.Run("Revoke", func(t *testing.T) {
+		if code := send(http.MethodDelete, "/system/tokens/"+token.ID, "", "").Code; code != http.StatusOK {
+			t.Errorf(".Code got %v, want %v", code, http.StatusOK)
+		}
+		if code := send(http.MethodGet, "/v1/scoped/key", "", token.Token).Code; code != http.StatusUnauthorized {
+			t.Errorf("Revoked token .Code got %v, want %v", code, http.StatusUnauthorized)
+		}
+		if code := send(http.MethodDelete, "/system/tokens/unknown", "", "").Code; code != http.StatusNotFound {
+			t.Errorf(".Code got %v, want %v", code, http.StatusNotFound)
+		}
+	})
+	t.Run("Expired", func(t *testing.T) {
+		past := time.Now().Add(-time.Minute)
+		expired := APIToken{TokenV1: rest.TokenV1{Expires: &past}}
+		if !expired.Expired() {
+			t.Errorf("Expected token to be expired")
+		}
+	})
+}
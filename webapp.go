@@ -2,6 +2,7 @@ package main
 
 import (
 	"bytes"
+	"context"
 	"crypto/tls"
 	"crypto/x509"
 	"encoding/json"
@@ -13,6 +14,7 @@ import (
 	"os"
 	"reflect"
 	"runtime"
+	"runtime/debug"
 	"strings"
 
 	"github.com/SimonStiil/keyvaluedatabase/rest"
@@ -27,6 +29,8 @@ type Application struct {
 	HTTPServer   *http.Server
 	MTLSServer   *http.Server
 	APIEndpoints []API
+	Audit        *Auditor
+	Backups      *Backups
 }
 
 var decoder = schema.NewDecoder()
@@ -34,11 +38,24 @@ var decoder = schema.NewDecoder()
 func (App *Application) RootControllerV1(w http.ResponseWriter, r *http.Request) {
 	requestcount := App.Count.GetCount()
 	request := GetRequestParameters(r, requestcount)
+	if App.Config.RequestTimeout > 0 {
+		// Database operations of the request fail with context.DeadlineExceeded once the timeout has passed
+		var cancel context.CancelFunc
+		request.ctx, cancel = context.WithTimeout(r.Context(), App.Config.RequestTimeout)
+		defer cancel()
+	}
 	debugLogger := request.Logger.Ext.With("function", "RootControllerV1")
 	debugLogger.Debug("WebAppStart")
 	request.RequestIP, _ = App.Auth.GetIPHeaderFromRequest(request)
 	for _, api := range App.APIEndpoints {
 		if api.APIPrefix() == request.Api {
+			if auditable, ok := api.(Auditable); ok && App.Audit != nil {
+				recorder := &statusRecorder{ResponseWriter: w}
+				w = recorder
+				defer func() {
+					App.Audit.Record(request, auditable.AuditAction(request), recorder.Status())
+				}()
+			}
 			permissions := api.Permissions(request)
 			debugLogger.Debug("Select Api", "prefix", api.APIPrefix(), "requiredPermissions", permissions)
 			if permissions.globalAllowed() {
@@ -168,6 +185,75 @@ func (App *Application) WriteStatusMessage(status int, w http.ResponseWriter, re
 	w.Write([]byte(statusTextFormated))
 }
 
+// WriteErrorMessage writes the status writeErrorStatus maps err to
+func (App *Application) WriteErrorMessage(err error, w http.ResponseWriter, request *RequestParameters) {
+	status := writeErrorStatus(err)
+	if status >= http.StatusInternalServerError {
+		request.Logger.Log.Error("Request failed", "function", "WriteErrorMessage", "status", status, "error", err)
+	}
+	App.WriteStatusMessage(status, w, request)
+}
+
+// writeErrorStatus maps the errors of the database and the APIs to the status written by WriteStatusMessage
+func writeErrorStatus(err error) int {
+	if errors.Is(err, context.DeadlineExceeded) {
+		// The database did not answer within the request timeout
+		return http.StatusGatewayTimeout
+	}
+	var (
+		notFound     *ErrNotFound
+		notAllowed   *ErrNotAllowed
+		malformed    *ErrMalformRequest
+		precondition *ErrPreconditionFailed
+		conflict     *ErrConflict
+		unavailable  *ErrUnavailable
+	)
+	switch {
+	case errors.As(err, &precondition):
+		return http.StatusPreconditionFailed
+	case errors.As(err, &notAllowed):
+		return http.StatusForbidden
+	case errors.As(err, &malformed):
+		return http.StatusBadRequest
+	case errors.As(err, &notFound):
+		return http.StatusNotFound
+	case errors.As(err, &conflict):
+		return http.StatusConflict
+	case errors.As(err, &unavailable):
+		return http.StatusServiceUnavailable
+	}
+	// ErrInvalidConfig and unknown errors are faults of the server
+	return http.StatusInternalServerError
+}
+
+// Recover answers 500 Internal Server Error when a request panics, instead of the connection being closed without an answer
+func (App *Application) Recover(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		recorder := &statusRecorder{ResponseWriter: w}
+		defer func() {
+			rec := recover()
+			if rec == nil {
+				return
+			}
+			if rec == http.ErrAbortHandler {
+				// Used by handlers to abort the response on purpose
+				panic(rec)
+			}
+			logger.Error("Recovered from panic", "function", "Recover", "struct", "Application",
+				"method", r.Method, "path", r.URL.EscapedPath(), "panic", rec, "stack", string(debug.Stack()))
+			if recorder.status != 0 {
+				// Part of the answer was written, the status can not be changed
+				return
+			}
+			status := http.StatusInternalServerError
+			w.Header().Set("Content-Type", "text/html")
+			w.WriteHeader(status)
+			w.Write([]byte(fmt.Sprintf("%v %v", status, http.StatusText(status))))
+		}()
+		next.ServeHTTP(recorder, r)
+	})
+}
+
 func GetFunctionName(i interface{}) string {
 	return runtime.FuncForPC(reflect.ValueOf(i).Pointer()).Name()
 }
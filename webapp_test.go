@@ -1,6 +1,7 @@
 package main
 
 import (
+	"context"
 	"crypto/tls"
 	"crypto/x509"
 	"encoding/pem"
@@ -241,6 +242,61 @@ func TestGETGreeting(t *testing.T) {
 	})
 }
 
+func TestErrorStatus(t *testing.T) {
+	tests := []struct {
+		err    error
+		status int
+	}{
+		{&ErrNotFound{Value: "key"}, http.StatusNotFound},
+		{&ErrNotAllowed{Value: "key"}, http.StatusForbidden},
+		{&ErrMalformRequest{Value: "key"}, http.StatusBadRequest},
+		{&ErrPreconditionFailed{Value: "key"}, http.StatusPreconditionFailed},
+		{&ErrConflict{Value: "key"}, http.StatusConflict},
+		{&ErrUnavailable{Value: "database"}, http.StatusServiceUnavailable},
+		{&ErrInvalidConfig{Value: "database"}, http.StatusInternalServerError},
+		{fmt.Errorf("wrapped: %w", &ErrNotFound{Value: "key"}), http.StatusNotFound},
+		{&ErrUnavailable{Value: "database", Err: context.DeadlineExceeded}, http.StatusGatewayTimeout},
+		{errors.New("unknown"), http.StatusInternalServerError},
+	}
+	for _, test := range tests {
+		t.Run(test.err.Error(), func(t *testing.T) {
+			status := writeErrorStatus(test.err)
+			if status != test.status {
+				t.Errorf("writeErrorStatus got %v, want %v", status, test.status)
+			}
+		})
+	}
+}
+
+func TestRecover(t *testing.T) {
+	setupTestlogging()
+	App = new(Application)
+	t.Run("panic before writing", func(t *testing.T) {
+		handler := App.Recover(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			panic("handler failed")
+		}))
+		response := httptest.NewRecorder()
+		handler.ServeHTTP(response, httptest.NewRequest(http.MethodGet, "/v1/namespace/key", nil))
+		if response.Code != http.StatusInternalServerError {
+			t.Errorf(".Code got %v, want %v", response.Code, http.StatusInternalServerError)
+		}
+		if response.Body.String() != "500 Internal Server Error" {
+			t.Errorf(".Body got %q", response.Body.String())
+		}
+	})
+	t.Run("panic after writing", func(t *testing.T) {
+		handler := App.Recover(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(http.StatusCreated)
+			panic("handler failed")
+		}))
+		response := httptest.NewRecorder()
+		handler.ServeHTTP(response, httptest.NewRequest(http.MethodGet, "/v1/namespace/key", nil))
+		if response.Code != http.StatusCreated {
+			t.Errorf(".Code got %v, want %v", response.Code, http.StatusCreated)
+		}
+	})
+}
+
 type APIStub struct{}
 
 func (Api *APIStub) APIPrefix() string {
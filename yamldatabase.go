@@ -1,180 +1,640 @@
 package main
 
 import (
+	"bytes"
+	"context"
 	"errors"
 	"fmt"
+	"io"
 	"log"
 	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"time"
 
+	"github.com/SimonStiil/keyvaluedatabase/rest"
+	"github.com/spf13/viper"
 	"gopkg.in/yaml.v3"
 )
 
+// YamlDatabase keeps everything in memory and stores it in a single yaml file.
+// All operations are guarded by Mutex and the file is replaced atomically on every write.
 type YamlDatabase struct {
-	Initialized  bool
-	Data         map[string]map[string]string
-	SystemNS     string `mapstructure:"systemnamespace"`
-	DatabaseName string
+	Initialized   atomic.Bool
+	Data          map[string]map[string]string
+	Expiry        map[string]map[string]int64
+	History       map[string]map[string]rest.KeyHistoryV1
+	SystemNS      string `mapstructure:"systemnamespace"`
+	DatabaseName  string
+	FlushInterval time.Duration // Collect changes and write them at most once per interval, 0 writes on every change
+	Mutex         sync.RWMutex
+	dirty         bool
+	flushTimer    *time.Timer
+}
+
+type ConfigYaml struct {
+	Path          string        `mapstructure:"path"`
+	FlushInterval time.Duration `mapstructure:"flushInterval"` // 0 writes the file on every change
+}
+
+func YamlDBGetDefaults(configReader *viper.Viper) {
+	configReader.SetDefault("yaml.path", "db.yaml")
+	configReader.SetDefault("yaml.flushInterval", "0s")
 }
 
 func (DB *YamlDatabase) GetSystemNS() string {
 	return DB.SystemNS
 }
 
-func (DB *YamlDatabase) Init() {
+func (DB *YamlDatabase) Init() (err error) {
+	DB.Mutex.Lock()
+	defer DB.Mutex.Unlock()
 	if DB.DatabaseName == "" {
 		DB.DatabaseName = "db.yaml"
 	}
 	if DB.SystemNS == "" {
 		DB.SystemNS = "kvdb"
 	}
-	defer DB.PrivateInitialize()
+	defer func() {
+		// A file that can not be read is kept, writing would replace it with an empty database
+		if err == nil {
+			DB.PrivateInitialize()
+		}
+	}()
 
 	logger.Debug("Initializing Yaml Database", "function", "Init", "struct", "YamlDatabase")
 	yamlFile, err := os.ReadFile(DB.DatabaseName)
 	if err != nil {
 		// https://stackoverflow.com/questions/12518876/how-to-check-if-a-file-exists-in-go
 		if !errors.Is(err, os.ErrNotExist) {
-			panic(err)
+			return &ErrUnavailable{Value: DB.DatabaseName, Err: err}
 		}
 		DB.Data = map[string]map[string]string{}
+		DB.Expiry = map[string]map[string]int64{}
+		DB.History = map[string]map[string]rest.KeyHistoryV1{}
 	} else {
 		defer func() {
 			if r := recover(); r != nil {
 				log.Printf("Panic: %+v\n", r)
 			}
 		}()
-		err = yaml.Unmarshal(yamlFile, &DB.Data)
-		if err != nil {
-			log.Fatalf("Unmarshal: %v", err)
+		// The first document holds the data, optional following documents hold key expiry and key history
+		dec := yaml.NewDecoder(bytes.NewReader(yamlFile))
+		DB.Data = nil
+		err = dec.Decode(&DB.Data)
+		if err != nil && !errors.Is(err, io.EOF) {
+			return &ErrUnavailable{Value: DB.DatabaseName, Err: err}
+		}
+		DB.Expiry = map[string]map[string]int64{}
+		err = dec.Decode(&DB.Expiry)
+		if err != nil && !errors.Is(err, io.EOF) {
+			return &ErrUnavailable{Value: DB.DatabaseName, Err: err}
+		}
+		if DB.Expiry == nil {
+			DB.Expiry = map[string]map[string]int64{}
+		}
+		DB.History = map[string]map[string]rest.KeyHistoryV1{}
+		err = dec.Decode(&DB.History)
+		if err != nil && !errors.Is(err, io.EOF) {
+			return &ErrUnavailable{Value: DB.DatabaseName, Err: err}
+		}
+		if DB.History == nil {
+			DB.History = map[string]map[string]rest.KeyHistoryV1{}
 		}
-
 	}
 	logger.Debug("Initialization complete", "function", "Init", "struct", "YamlDatabase")
-	DB.Initialized = true
+	DB.Initialized.Store(true)
+	return nil
 }
 
 func (DB *YamlDatabase) PrivateInitialize() {
+	if DB.Expiry == nil {
+		DB.Expiry = map[string]map[string]int64{}
+	}
+	if DB.History == nil {
+		DB.History = map[string]map[string]rest.KeyHistoryV1{}
+	}
 	if DB.Data == nil {
 		DB.Data = map[string]map[string]string{}
-		DB.Initialized = true
+		DB.Initialized.Store(true)
 
 		logger.Debug("recovered", "function", "PrivateInitialize", "struct", "YamlDatabase")
 	}
 }
 
-func (DB *YamlDatabase) Set(namespace string, key string, value interface{}) error {
-	if !DB.Initialized {
-		panic("Unable to set. db not initialized()")
+func (DB *YamlDatabase) Set(ctx context.Context, namespace string, key string, value interface{}) error {
+	return DB.SetWithTTL(ctx, namespace, key, value, 0)
+}
+
+func (DB *YamlDatabase) SetWithTTL(ctx context.Context, namespace string, key string, value interface{}, ttl time.Duration) error {
+	if !DB.Initialized.Load() {
+		return errNotInitialized
 	}
+	DB.Mutex.Lock()
+	defer DB.Mutex.Unlock()
 	// https://aguidehub.com/blog/2022-08-28-golang-convert-interface-to-string/?expand_article=1
+	DB.setWithTTL(namespace, key, fmt.Sprint(value), ttl)
+	return DB.persist()
+}
+
+// setWithTTL changes the value in memory, the caller holds the write lock
+func (DB *YamlDatabase) setWithTTL(namespace string, key string, value string, ttl time.Duration) {
 	if _, ok := DB.Data[namespace]; !ok {
 		DB.Data[namespace] = map[string]string{}
 	}
-	DB.Data[namespace][key] = fmt.Sprint(value)
-	return DB.Write()
+	DB.Data[namespace][key] = value
+	DB.setExpiry(namespace, key, expiryFromTTL(ttl))
 }
 
-func (DB *YamlDatabase) CreateNamespace(namespace string) error {
-	if !DB.Initialized {
-		panic("Unable to get. db not initialized()")
+func (DB *YamlDatabase) CompareAndSet(ctx context.Context, namespace string, key string, expected *string, value string, ttl time.Duration) error {
+	if !DB.Initialized.Load() {
+		return errNotInitialized
 	}
-	if _, ok := DB.Data[namespace]; !ok {
-		DB.Data[namespace] = map[string]string{}
+	DB.Mutex.Lock()
+	defer DB.Mutex.Unlock()
+	current, err := DB.get(namespace, key)
+	exists := err == nil
+	if expected == nil && exists || expected != nil && (!exists || current != *expected) {
+		return &ErrPreconditionFailed{Value: key}
 	}
-	return nil
+	DB.setWithTTL(namespace, key, value, ttl)
+	return DB.persist()
+}
+
+func (DB *YamlDatabase) setExpiry(namespace string, key string, expiry int64) {
+	if expiry == 0 {
+		if _, ok := DB.Expiry[namespace]; ok {
+			delete(DB.Expiry[namespace], key)
+			if len(DB.Expiry[namespace]) == 0 {
+				delete(DB.Expiry, namespace)
+			}
+		}
+		return
+	}
+	if _, ok := DB.Expiry[namespace]; !ok {
+		DB.Expiry[namespace] = map[string]int64{}
+	}
+	DB.Expiry[namespace][key] = expiry
 }
 
-func (DB *YamlDatabase) DeleteNamespace(namespace string) error {
-	if !DB.Initialized {
-		panic("Unable to get. db not initialized()")
+func (DB *YamlDatabase) expired(namespace string, key string) bool {
+	return isExpired(DB.Expiry[namespace][key])
+}
+
+func (DB *YamlDatabase) TTL(ctx context.Context, namespace string, key string) (time.Duration, error) {
+	if !DB.Initialized.Load() {
+		return 0, errNotInitialized
+	}
+	DB.Mutex.RLock()
+	defer DB.Mutex.RUnlock()
+	if _, ok := DB.Data[namespace][key]; !ok || DB.expired(namespace, key) {
+		return 0, &ErrNotFound{Value: key}
+	}
+	return ttlFromExpiry(DB.Expiry[namespace][key]), nil
+}
+
+func (DB *YamlDatabase) DeleteExpired(ctx context.Context) (int, error) {
+	if !DB.Initialized.Load() {
+		return 0, errNotInitialized
+	}
+	DB.Mutex.Lock()
+	defer DB.Mutex.Unlock()
+	count := 0
+	for namespace, keys := range DB.Expiry {
+		for key := range keys {
+			if DB.expired(namespace, key) {
+				delete(DB.Data[namespace], key)
+				DB.setExpiry(namespace, key, 0)
+				count++
+			}
+		}
+	}
+	if count > 0 {
+		return count, DB.persist()
+	}
+	return count, nil
+}
+
+func (DB *YamlDatabase) CreateNamespace(ctx context.Context, namespace string) error {
+	if !DB.Initialized.Load() {
+		return errNotInitialized
+	}
+	DB.Mutex.Lock()
+	defer DB.Mutex.Unlock()
+	if _, ok := DB.Data[namespace]; ok {
+		return nil
+	}
+	DB.Data[namespace] = map[string]string{}
+	return DB.persist()
+}
+
+func (DB *YamlDatabase) DeleteNamespace(ctx context.Context, namespace string) error {
+	if !DB.Initialized.Load() {
+		return errNotInitialized
 	}
 	if namespace == DB.GetSystemNS() {
 		return &ErrNotAllowed{Value: fmt.Sprintf("delete System NS %v", namespace)}
 	}
+	DB.Mutex.Lock()
+	defer DB.Mutex.Unlock()
 	delete(DB.Data, namespace)
-	return nil
+	delete(DB.Expiry, namespace)
+	delete(DB.History, namespace)
+	return DB.persist()
 }
 
-func (DB *YamlDatabase) Get(namespace string, key string) (string, error) {
-	if !DB.Initialized {
-		panic("Unable to get. db not initialized()")
+func (DB *YamlDatabase) Get(ctx context.Context, namespace string, key string) (string, error) {
+	if !DB.Initialized.Load() {
+		return "", errNotInitialized
 	}
+	DB.Mutex.RLock()
+	defer DB.Mutex.RUnlock()
+	return DB.get(namespace, key)
+}
+
+// get reads a value, the caller holds the lock
+func (DB *YamlDatabase) get(namespace string, key string) (string, error) {
 	// https://stackoverflow.com/questions/27545270/how-to-get-a-value-from-map
 	if _, ok := DB.Data[namespace]; !ok {
-		return "", fmt.Errorf("namespace not found %v", namespace)
+		return "", &ErrNotFound{Value: namespace}
 	}
 	value, ok := DB.Data[namespace][key]
-	if ok {
+	if ok && !DB.expired(namespace, key) {
 		return value, nil
 	} else {
 		return "", &ErrNotFound{Value: key}
 	}
 }
 
+// Write stores the database in the file now, also when changes are waiting for the flush interval
 func (DB *YamlDatabase) Write() error {
+	DB.Mutex.Lock()
+	defer DB.Mutex.Unlock()
+	return DB.write()
+}
+
+// persist stores the changes made by the caller holding the write lock.
+// With a FlushInterval the write is postponed so changes made within the interval are written together.
+func (DB *YamlDatabase) persist() error {
+	if DB.FlushInterval <= 0 {
+		return DB.write()
+	}
+	DB.dirty = true
+	if DB.flushTimer == nil {
+		DB.flushTimer = time.AfterFunc(DB.FlushInterval, DB.flush)
+	}
+	return nil
+}
+
+// flush writes the changes collected since the last write, a failed write is retried after FlushInterval
+func (DB *YamlDatabase) flush() {
+	DB.Mutex.Lock()
+	defer DB.Mutex.Unlock()
+	DB.flushTimer = nil
+	if !DB.dirty {
+		return
+	}
+	err := DB.write()
+	if err != nil {
+		logger.Error("Unable to flush database, retrying", "function", "flush", "struct", "YamlDatabase", "retry", DB.FlushInterval, "error", err)
+		DB.flushTimer = time.AfterFunc(DB.FlushInterval, DB.flush)
+	}
+}
+
+// write replaces the file with the content of the database, the caller holds the lock.
+// The content is written and synced to a temporary file that is renamed over the database file,
+// so a crash leaves either the previous or the new file and never a partial one.
+func (DB *YamlDatabase) write() error {
 	//https://gobyexample.com/writing-files
 	// https://stackoverflow.com/questions/65207143/writing-the-contents-of-a-struct-to-yml-file
 	logger.Debug(fmt.Sprintf("Writing: %+v\n", DB.Data), "function", "Write", "struct", "YamlDatabase")
 
-	file, err := os.OpenFile(DB.DatabaseName, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0600)
-
+	directory := filepath.Dir(DB.DatabaseName)
+	file, err := os.CreateTemp(directory, filepath.Base(DB.DatabaseName)+".*.tmp")
 	if err != nil {
-		logger.Error("error opening/creating file", "function", "Write", "struct", "YamlDatabase", "error", err)
+		logger.Error("error creating temporary file", "function", "Write", "struct", "YamlDatabase", "error", err)
 		return err
 	}
-	defer file.Close()
-	enc := yaml.NewEncoder(file)
-	err = enc.Encode(DB.Data)
+	defer os.Remove(file.Name())
+	err = DB.encode(file)
 	if err != nil {
+		file.Close()
 		logger.Error("error encoding", "function", "Write", "struct", "YamlDatabase", "error", err)
 		return err
 	}
+	err = file.Sync()
+	if err != nil {
+		file.Close()
+		logger.Error("error syncing file", "function", "Write", "struct", "YamlDatabase", "error", err)
+		return err
+	}
+	err = file.Close()
+	if err != nil {
+		logger.Error("error closing file", "function", "Write", "struct", "YamlDatabase", "error", err)
+		return err
+	}
+	err = os.Rename(file.Name(), DB.DatabaseName)
+	if err != nil {
+		logger.Error("error replacing file", "function", "Write", "struct", "YamlDatabase", "error", err)
+		return err
+	}
+	DB.dirty = false
+	// Sync the directory so the rename survives a crash, not supported on all platforms
+	if dir, err := os.Open(directory); err == nil {
+		dir.Sync()
+		dir.Close()
+	}
 	return nil
 }
 
-func (DB *YamlDatabase) Keys(namespace string) ([]string, error) {
-	if !DB.Initialized {
-		panic("Unable to get. db not initialized()")
+func (DB *YamlDatabase) encode(writer io.Writer) error {
+	enc := yaml.NewEncoder(writer)
+	err := enc.Encode(DB.Data)
+	if err != nil {
+		return err
+	}
+	if len(DB.Expiry) > 0 || len(DB.History) > 0 {
+		err = enc.Encode(DB.Expiry)
+		if err != nil {
+			return err
+		}
+	}
+	if len(DB.History) > 0 {
+		err = enc.Encode(DB.History)
+		if err != nil {
+			return err
+		}
+	}
+	return enc.Close()
+}
+
+func (DB *YamlDatabase) Keys(ctx context.Context, namespace string) ([]string, error) {
+	if !DB.Initialized.Load() {
+		return nil, errNotInitialized
 	}
+	DB.Mutex.RLock()
+	defer DB.Mutex.RUnlock()
 	var length int
 	if namespace == "" {
 		length = len(DB.Data)
 	} else {
 		length = len(DB.Data[namespace])
 	}
-	keys := make([]string, length)
+	keys := make([]string, 0, length)
 
-	i := 0
 	if namespace == "" {
 		for k := range DB.Data {
-			keys[i] = k
-			i++
+			keys = append(keys, k)
 		}
 	} else {
 		for k := range DB.Data[namespace] {
-			keys[i] = k
-			i++
+			if !DB.expired(namespace, k) {
+				keys = append(keys, k)
+			}
 		}
 	}
 	return keys, nil
 }
 
-func (DB *YamlDatabase) DeleteKey(namespace string, key string) error {
-	if !DB.Initialized {
-		panic("Unable to get. db not initialized()")
+func (DB *YamlDatabase) KeysPage(ctx context.Context, namespace string, options ListOptions) ([]string, string, error) {
+	keys, err := DB.Keys(ctx, namespace)
+	if err != nil {
+		return nil, "", err
+	}
+	return pageSorted(keys, options)
+}
+
+func (DB *YamlDatabase) CountKeys(ctx context.Context, namespace string) (int, error) {
+	keys, err := DB.Keys(ctx, namespace)
+	return len(keys), err
+}
+
+func (DB *YamlDatabase) AddVersion(ctx context.Context, namespace string, key string, version rest.KeyVersionV1, limit int) error {
+	if !DB.Initialized.Load() {
+		return errNotInitialized
+	}
+	DB.Mutex.Lock()
+	defer DB.Mutex.Unlock()
+	if _, ok := DB.History[namespace]; !ok {
+		DB.History[namespace] = map[string]rest.KeyHistoryV1{}
+	}
+	history := DB.History[namespace][key]
+	version.Version = 1
+	if len(history) > 0 {
+		version.Version = history[0].Version + 1
+	}
+	history = append(rest.KeyHistoryV1{version}, history...)
+	if limit > 0 && len(history) > limit {
+		history = history[:limit]
+	}
+	DB.History[namespace][key] = history
+	return DB.persist()
+}
+
+func (DB *YamlDatabase) Versions(ctx context.Context, namespace string, key string) (rest.KeyHistoryV1, error) {
+	if !DB.Initialized.Load() {
+		return rest.KeyHistoryV1{}, errNotInitialized
+	}
+	DB.Mutex.RLock()
+	defer DB.Mutex.RUnlock()
+	history, ok := DB.History[namespace][key]
+	if !ok {
+		return nil, &ErrNotFound{Value: key}
 	}
+	versions := make(rest.KeyHistoryV1, len(history))
+	copy(versions, history)
+	return versions, nil
+}
+
+func (DB *YamlDatabase) DeleteKey(ctx context.Context, namespace string, key string) error {
+	if !DB.Initialized.Load() {
+		return errNotInitialized
+	}
+	DB.Mutex.Lock()
+	defer DB.Mutex.Unlock()
+	DB.deleteKey(namespace, key)
+	return DB.persist()
+}
+
+// deleteKey removes the key from memory, the caller holds the write lock
+func (DB *YamlDatabase) deleteKey(namespace string, key string) {
 	delete(DB.Data[namespace], key)
+	DB.setExpiry(namespace, key, 0)
+}
+
+func (DB *YamlDatabase) CompareAndDelete(ctx context.Context, namespace string, key string, expected string) error {
+	if !DB.Initialized.Load() {
+		return errNotInitialized
+	}
+	DB.Mutex.Lock()
+	defer DB.Mutex.Unlock()
+	current, err := DB.get(namespace, key)
+	if err != nil || current != expected {
+		return &ErrPreconditionFailed{Value: key}
+	}
+	DB.deleteKey(namespace, key)
+	return DB.persist()
+}
+
+func (DB *YamlDatabase) Atomic() bool {
+	return true
+}
+
+// Transaction collects the writes of fn and applies them together under the write lock.
+// Values read by fn are checked again before the writes are applied, if another writer changed
+// one of them the transaction fails with ErrPreconditionFailed. The lock is not held while fn runs
+// so fn may use the database directly.
+func (DB *YamlDatabase) Transaction(ctx context.Context, fn func(tx Transaction) error) error {
+	if !DB.Initialized.Load() {
+		return errNotInitialized
+	}
+	tx := &yamlTransaction{DB: DB, pending: map[yamlKey]*yamlWrite{}, reads: map[yamlKey]yamlRead{}}
+	err := fn(tx)
+	if err != nil {
+		return err
+	}
+	err = ctx.Err()
+	if err != nil {
+		return err
+	}
+	return tx.commit()
+}
+
+type yamlKey struct {
+	Namespace string
+	Key       string
+}
+
+type yamlWrite struct {
+	yamlKey
+	Value   string
+	TTL     time.Duration
+	Deleted bool
+}
+
+// yamlRead is a value as first seen by the transaction
+type yamlRead struct {
+	Value  string
+	Exists bool
+}
+
+type yamlUndo struct {
+	Namespace string
+	Key       string
+	Value     string
+	Exists    bool
+	Expiry    int64
+	Created   bool // Namespace was created by the transaction
+}
+
+type yamlTransaction struct {
+	DB      *YamlDatabase
+	writes  []*yamlWrite
+	pending map[yamlKey]*yamlWrite
+	reads   map[yamlKey]yamlRead
+	undo    []yamlUndo
+}
+
+func (Tx *yamlTransaction) remember(namespace string, key string) {
+	_, found := Tx.DB.Data[namespace]
+	value, exists := Tx.DB.Data[namespace][key]
+	Tx.undo = append(Tx.undo, yamlUndo{Namespace: namespace, Key: key, Value: value, Exists: exists, Expiry: Tx.DB.Expiry[namespace][key], Created: !found})
+}
+
+func (Tx *yamlTransaction) rollback() {
+	for i := len(Tx.undo) - 1; i >= 0; i-- {
+		undo := Tx.undo[i]
+		Tx.DB.setExpiry(undo.Namespace, undo.Key, undo.Expiry)
+		if undo.Created {
+			delete(Tx.DB.Data, undo.Namespace)
+		} else if undo.Exists {
+			Tx.DB.Data[undo.Namespace][undo.Key] = undo.Value
+		} else {
+			delete(Tx.DB.Data[undo.Namespace], undo.Key)
+		}
+	}
+}
+
+// commit verifies the values read and applies the writes, the changes are undone if the file can not be written
+func (Tx *yamlTransaction) commit() error {
+	if len(Tx.writes) == 0 {
+		return nil
+	}
+	Tx.DB.Mutex.Lock()
+	defer Tx.DB.Mutex.Unlock()
+	for key, read := range Tx.reads {
+		value, err := Tx.DB.get(key.Namespace, key.Key)
+		if (err == nil) != read.Exists || value != read.Value {
+			return &ErrPreconditionFailed{Value: "transaction"}
+		}
+	}
+	for _, write := range Tx.writes {
+		Tx.remember(write.Namespace, write.Key)
+		if write.Deleted {
+			Tx.DB.deleteKey(write.Namespace, write.Key)
+		} else {
+			Tx.DB.setWithTTL(write.Namespace, write.Key, write.Value, write.TTL)
+		}
+	}
+	err := Tx.DB.persist()
+	if err != nil {
+		Tx.rollback()
+	}
+	return err
+}
+
+func (Tx *yamlTransaction) Get(namespace string, key string) (string, error) {
+	id := yamlKey{Namespace: namespace, Key: key}
+	if write, ok := Tx.pending[id]; ok {
+		if write.Deleted {
+			return "", &ErrNotFound{Value: key}
+		}
+		return write.Value, nil
+	}
+	Tx.DB.Mutex.RLock()
+	_, found := Tx.DB.Data[namespace]
+	value, err := Tx.DB.get(namespace, key)
+	Tx.DB.Mutex.RUnlock()
+	if _, ok := Tx.reads[id]; !ok {
+		Tx.reads[id] = yamlRead{Value: value, Exists: err == nil}
+	}
+	if !found {
+		return "", &ErrNotFound{Value: namespace}
+	}
+	return value, err
+}
+
+func (Tx *yamlTransaction) set(write *yamlWrite) {
+	Tx.writes = append(Tx.writes, write)
+	Tx.pending[write.yamlKey] = write
+}
+
+func (Tx *yamlTransaction) SetWithTTL(namespace string, key string, value string, ttl time.Duration) error {
+	Tx.set(&yamlWrite{yamlKey: yamlKey{Namespace: namespace, Key: key}, Value: value, TTL: ttl})
+	return nil
+}
+
+func (Tx *yamlTransaction) DeleteKey(namespace string, key string) error {
+	Tx.set(&yamlWrite{yamlKey: yamlKey{Namespace: namespace, Key: key}, Deleted: true})
 	return nil
 }
 
 func (DB *YamlDatabase) IsInitialized() bool {
-	return DB.Initialized
+	return DB.Initialized.Load()
 }
 
+// Close writes changes waiting for the flush interval
 func (DB *YamlDatabase) Close() {
-	if !DB.Initialized {
-		panic("Unable to close. db not initialized()")
+	if !DB.Initialized.Load() {
+		return
+	}
+	DB.Mutex.Lock()
+	defer DB.Mutex.Unlock()
+	if DB.flushTimer != nil {
+		DB.flushTimer.Stop()
+		DB.flushTimer = nil
 	}
-	DB.Write()
+	DB.write()
 	logger.Debug("Closed database connection", "function", "Close", "struct", "YamlDatabase")
 }
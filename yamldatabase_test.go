@@ -1,9 +1,17 @@
 package main
 
 import (
+	"context"
 	"errors"
+	"fmt"
 	"os"
+	"path/filepath"
+	"slices"
+	"sync"
 	"testing"
+	"time"
+
+	"github.com/SimonStiil/keyvaluedatabase/rest"
 )
 
 type DBTest struct {
@@ -27,10 +35,10 @@ func Test_Yaml_DB(t *testing.T) {
 	testValue := "value"
 
 	t.Run("set value", func(t *testing.T) {
-		dbt.DB.Set(dbt.DB.GetSystemNS(), testKey, testValue)
+		dbt.DB.Set(context.Background(), dbt.DB.GetSystemNS(), testKey, testValue)
 	})
 	t.Run("get value (that don't exist yet)", func(t *testing.T) {
-		_, err := dbt.DB.Get(dbt.DB.GetSystemNS(), testKey+"13")
+		_, err := dbt.DB.Get(context.Background(), dbt.DB.GetSystemNS(), testKey+"13")
 		if err == nil {
 			t.Errorf("Supposed to get error")
 		}
@@ -39,8 +47,15 @@ func Test_Yaml_DB(t *testing.T) {
 		}
 	})
 
+	t.Run("get value (namespace that don't exist)", func(t *testing.T) {
+		_, err := dbt.DB.Get(context.Background(), "missing-namespace", testKey)
+		if _, ok := err.(*ErrNotFound); !ok {
+			t.Errorf("Supposed to get ErrNotFound error got %v", err)
+		}
+	})
+
 	t.Run("get value", func(t *testing.T) {
-		val, err := dbt.DB.Get(dbt.DB.GetSystemNS(), testKey)
+		val, err := dbt.DB.Get(context.Background(), dbt.DB.GetSystemNS(), testKey)
 		if err != nil {
 			t.Errorf("Supposed to get key %v got error %+v", testKey, err)
 		}
@@ -48,6 +63,121 @@ func Test_Yaml_DB(t *testing.T) {
 			t.Errorf("Read from database failed expected %v, got %v", testValue, val)
 		}
 	})
+	t.Run("set value with ttl", func(t *testing.T) {
+		err := dbt.DB.SetWithTTL(context.Background(), dbt.DB.GetSystemNS(), testKey+"ttl", testValue, time.Hour)
+		if err != nil {
+			t.Fatalf("Failed to set value: %v", err)
+		}
+		ttl, err := dbt.DB.TTL(context.Background(), dbt.DB.GetSystemNS(), testKey+"ttl")
+		if err != nil {
+			t.Errorf("Failed to get ttl: %v", err)
+		}
+		if ttl <= 0 || ttl > time.Hour {
+			t.Errorf("Expected ttl within an hour, got %v", ttl)
+		}
+		ttl, err = dbt.DB.TTL(context.Background(), dbt.DB.GetSystemNS(), testKey)
+		if err != nil {
+			t.Errorf("Failed to get ttl: %v", err)
+		}
+		if ttl != 0 {
+			t.Errorf("Expected no ttl for %v, got %v", testKey, ttl)
+		}
+	})
+	t.Run("ttl persisted", func(t *testing.T) {
+		dbt.DB.Close()
+		dbt.DB.Init()
+		ttl, err := dbt.DB.TTL(context.Background(), dbt.DB.GetSystemNS(), testKey+"ttl")
+		if err != nil {
+			t.Errorf("Failed to get ttl: %v", err)
+		}
+		if ttl <= 0 {
+			t.Errorf("Expected ttl to survive reload, got %v", ttl)
+		}
+	})
+	t.Run("expired value", func(t *testing.T) {
+		err := dbt.DB.SetWithTTL(context.Background(), dbt.DB.GetSystemNS(), testKey+"expire", testValue, 10*time.Millisecond)
+		if err != nil {
+			t.Fatalf("Failed to set value: %v", err)
+		}
+		time.Sleep(20 * time.Millisecond)
+		_, err = dbt.DB.Get(context.Background(), dbt.DB.GetSystemNS(), testKey+"expire")
+		if _, ok := err.(*ErrNotFound); !ok {
+			t.Errorf("Supposed to get ErrNotFound error got %v", err)
+		}
+		keys, _ := dbt.DB.Keys(context.Background(), dbt.DB.GetSystemNS())
+		for _, key := range keys {
+			if key == testKey+"expire" {
+				t.Errorf("Expired key %v should not be listed", key)
+			}
+		}
+		count, err := dbt.DB.(Expirer).DeleteExpired(context.Background())
+		if err != nil {
+			t.Errorf("Failed to delete expired: %v", err)
+		}
+		if count != 1 {
+			t.Errorf("Expected 1 expired key deleted, got %v", count)
+		}
+	})
+	t.Run("key history", func(t *testing.T) {
+		for _, value := range []string{"one", "two", "three"} {
+			err := dbt.DB.AddVersion(context.Background(), dbt.DB.GetSystemNS(), testKey, rest.KeyVersionV1{Value: value, User: "test", Timestamp: time.Now()}, 2)
+			if err != nil {
+				t.Fatalf("Failed to add version: %v", err)
+			}
+		}
+		dbt.DB.Close()
+		dbt.DB.Init()
+		history, err := dbt.DB.Versions(context.Background(), dbt.DB.GetSystemNS(), testKey)
+		if err != nil {
+			t.Fatalf("Failed to get versions: %v", err)
+		}
+		if len(history) != 2 {
+			t.Fatalf("Expected 2 versions, got %v", len(history))
+		}
+		if history[0].Version != 3 || history[0].Value != "three" || history[1].Version != 2 {
+			t.Errorf("Unexpected history %+v", history)
+		}
+		_, err = dbt.DB.Versions(context.Background(), dbt.DB.GetSystemNS(), testKey+"none")
+		if _, ok := err.(*ErrNotFound); !ok {
+			t.Errorf("Supposed to get ErrNotFound error got %v", err)
+		}
+	})
+	t.Run("keys page", func(t *testing.T) {
+		testKeysPage(t, dbt.DB, "paged")
+	})
+	t.Run("namespace and delete persisted", func(t *testing.T) {
+		err := dbt.DB.CreateNamespace(context.Background(), "created")
+		if err != nil {
+			t.Fatalf("Failed to create namespace: %v", err)
+		}
+		err = dbt.DB.Set(context.Background(), "removed", testKey, testValue)
+		if err != nil {
+			t.Fatalf("Failed to set value: %v", err)
+		}
+		err = dbt.DB.DeleteNamespace(context.Background(), "removed")
+		if err != nil {
+			t.Fatalf("Failed to delete namespace: %v", err)
+		}
+		err = dbt.DB.DeleteKey(context.Background(), dbt.DB.GetSystemNS(), testKey+"ttl")
+		if err != nil {
+			t.Fatalf("Failed to delete key: %v", err)
+		}
+		// A second instance reads the file without the first being closed
+		reopened := &YamlDatabase{DatabaseName: dbt.FileName}
+		reopened.Init()
+		namespaces, _ := reopened.Keys(context.Background(), "")
+		if !slices.Contains(namespaces, "created") || slices.Contains(namespaces, "removed") {
+			t.Errorf("Expected namespace created and not removed, got %v", namespaces)
+		}
+		_, err = reopened.Get(context.Background(), reopened.GetSystemNS(), testKey+"ttl")
+		if _, ok := err.(*ErrNotFound); !ok {
+			t.Errorf("Supposed to get ErrNotFound error got %v", err)
+		}
+		matches, _ := filepath.Glob(dbt.FileName + ".*.tmp")
+		if len(matches) > 0 {
+			t.Errorf("Temporary files left behind %v", matches)
+		}
+	})
 	t.Run("Counter Integration Test (stored db)", func(t *testing.T) {
 		count := Counter{}
 		err := os.Remove(dbt.FileName)
@@ -107,4 +237,166 @@ func Test_Yaml_DB(t *testing.T) {
 			t.Errorf("Counter expected value to be 0, got %v", val)
 		}
 	})
+	t.Run("Counter Integration Test (invalid value)", func(t *testing.T) {
+		count := Counter{}
+		err := dbt.DB.Set(context.Background(), dbt.DB.GetSystemNS(), "counter", "not a number")
+		if err != nil {
+			t.Fatal(err)
+		}
+		count.Init(dbt.DB)
+		val := count.GetCount()
+		if val != 0 {
+			t.Errorf("Counter with invalid stored value expected value to be 0, got %v", val)
+		}
+	})
+}
+
+func Test_Yaml_Unavailable(t *testing.T) {
+	setupTestlogging()
+	fileName := "testdb-unavailable.yaml"
+	defer os.Remove(fileName)
+	t.Run("not initialized", func(t *testing.T) {
+		db := &YamlDatabase{DatabaseName: fileName}
+		_, err := db.Get(context.Background(), "kvdb", "key")
+		if _, ok := err.(*ErrUnavailable); !ok {
+			t.Errorf("Expected ErrUnavailable got %v", err)
+		}
+		err = db.Set(context.Background(), "kvdb", "key", "value")
+		if _, ok := err.(*ErrUnavailable); !ok {
+			t.Errorf("Expected ErrUnavailable got %v", err)
+		}
+		db.Close()
+	})
+	t.Run("unreadable file", func(t *testing.T) {
+		err := os.WriteFile(fileName, []byte("kvdb: [not, a, map"), 0600)
+		if err != nil {
+			t.Fatal(err)
+		}
+		db := &YamlDatabase{DatabaseName: fileName}
+		err = db.Init()
+		if _, ok := err.(*ErrUnavailable); !ok {
+			t.Errorf("Expected ErrUnavailable got %v", err)
+		}
+		if db.IsInitialized() {
+			t.Errorf("Database with an unreadable file should not be initialized")
+		}
+		db.Close()
+		content, _ := os.ReadFile(fileName)
+		if string(content) != "kvdb: [not, a, map" {
+			t.Errorf("Unreadable file was changed to %q", content)
+		}
+	})
+	t.Run("reconnect", func(t *testing.T) {
+		db := &YamlDatabase{DatabaseName: fileName}
+		if db.Init() == nil {
+			t.Fatal("Expected the unreadable file to fail Init")
+		}
+		ready := make(chan struct{})
+		go Reconnect(db, 10*time.Millisecond, func() { close(ready) })
+		time.Sleep(50 * time.Millisecond)
+		err := os.Remove(fileName)
+		if err != nil {
+			t.Fatal(err)
+		}
+		select {
+		case <-ready:
+		case <-time.After(5 * time.Second):
+			t.Fatal("Reconnect did not initialize the database")
+		}
+		if !db.IsInitialized() {
+			t.Errorf("Database should be initialized after Reconnect")
+		}
+		db.Close()
+	})
+}
+
+// Run with -race to detect unguarded access
+func Test_Yaml_Concurrent(t *testing.T) {
+	setupTestlogging()
+	fileName := filepath.Join(t.TempDir(), "concurrent.yaml")
+	db := &YamlDatabase{DatabaseName: fileName}
+	db.Init()
+	workers := 8
+	operations := 20
+	var wait sync.WaitGroup
+	for worker := 0; worker < workers; worker++ {
+		wait.Add(1)
+		go func(worker int) {
+			defer wait.Done()
+			namespace := fmt.Sprintf("worker%v", worker)
+			db.CreateNamespace(context.Background(), namespace)
+			for i := 0; i < operations; i++ {
+				key := fmt.Sprintf("key%v", i)
+				err := db.Set(context.Background(), namespace, key, i)
+				if err != nil {
+					t.Errorf("Failed to set value: %v", err)
+				}
+				db.Get(context.Background(), namespace, key)
+				db.Keys(context.Background(), "")
+				db.KeysPage(context.Background(), namespace, ListOptions{Limit: 5})
+				db.CompareAndSet(context.Background(), db.GetSystemNS(), "shared", nil, namespace, 0)
+				db.CompareAndDelete(context.Background(), db.GetSystemNS(), "shared", namespace)
+				db.AddVersion(context.Background(), namespace, key, rest.KeyVersionV1{Value: key, Timestamp: time.Now()}, 2)
+				db.Transaction(context.Background(), func(tx Transaction) error {
+					value, _ := tx.Get(db.GetSystemNS(), "counter")
+					return tx.SetWithTTL(db.GetSystemNS(), "counter", value+"1", 0)
+				})
+				if i%2 == 0 {
+					db.DeleteKey(context.Background(), namespace, key)
+				}
+			}
+		}(worker)
+	}
+	wait.Wait()
+	db.Close()
+	reopened := &YamlDatabase{DatabaseName: fileName}
+	reopened.Init()
+	for worker := 0; worker < workers; worker++ {
+		count, _ := reopened.CountKeys(context.Background(), fmt.Sprintf("worker%v", worker))
+		if count != operations/2 {
+			t.Errorf("Expected %v keys for worker%v, got %v", operations/2, worker, count)
+		}
+	}
+	counter, _ := reopened.Get(context.Background(), reopened.GetSystemNS(), "counter")
+	if len(counter) == 0 || len(counter) > workers*operations {
+		t.Errorf("Expected between 1 and %v committed transactions, got %v", workers*operations, len(counter))
+	}
+}
+
+func Test_Yaml_Flush(t *testing.T) {
+	setupTestlogging()
+	fileName := filepath.Join(t.TempDir(), "flush.yaml")
+	db := &YamlDatabase{DatabaseName: fileName, FlushInterval: 50 * time.Millisecond}
+	db.Init()
+	stored := func(key string) bool {
+		reopened := &YamlDatabase{DatabaseName: fileName}
+		reopened.Init()
+		_, err := reopened.Get(context.Background(), reopened.GetSystemNS(), key)
+		return err == nil
+	}
+	t.Run("write postponed", func(t *testing.T) {
+		err := db.Set(context.Background(), db.GetSystemNS(), "first", "value")
+		if err != nil {
+			t.Fatalf("Failed to set value: %v", err)
+		}
+		if stored("first") {
+			t.Errorf("Expected write to wait for the flush interval")
+		}
+	})
+	t.Run("written after interval", func(t *testing.T) {
+		time.Sleep(150 * time.Millisecond)
+		if !stored("first") {
+			t.Errorf("Expected write after the flush interval")
+		}
+	})
+	t.Run("written on close", func(t *testing.T) {
+		err := db.Set(context.Background(), db.GetSystemNS(), "second", "value")
+		if err != nil {
+			t.Fatalf("Failed to set value: %v", err)
+		}
+		db.Close()
+		if !stored("second") {
+			t.Errorf("Expected write when closed")
+		}
+	})
 }